@@ -0,0 +1,85 @@
+package atompubsvc
+
+import (
+	"errors"
+	log "github.com/Sirupsen/logrus"
+	"github.com/gorilla/mux"
+	"github.com/xtracdev/goes"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+//EventAppender is implemented by stores that accept events directly, assigning them to feeds
+//as they are added.
+type EventAppender interface {
+	Append(event *goes.Event) error
+}
+
+//NewAppendHandler instantiates a handler that adds events to a store accepting them directly,
+//such as the SQLite or in-memory stores. This is served up for PUT requests at
+//AppendEventHandlerURI, with the payload as the request body and the event type code given
+//by the typecode query parameter. Where there is an access policy, only the writers it lists may
+//append events, and others get a 403 response.
+func NewAppendHandler(appender EventAppender) (func(rw http.ResponseWriter, req *http.Request), error) {
+	if appender == nil {
+		return nil, ErrNilFeedStore
+	}
+
+	return func(rw http.ResponseWriter, req *http.Request) {
+		svc := "append-event"
+		start := time.Now()
+		aggregateID := mux.Vars(req)["aggregateId"]
+
+		version, err := strconv.Atoi(mux.Vars(req)["version"])
+		if err != nil {
+			logTimingStats(svc, start, err)
+			http.Error(rw, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		typeCode := req.URL.Query().Get("typecode")
+		if typeCode == "" {
+			logTimingStats(svc, start, errors.New("no typecode specified"))
+			http.Error(rw, "No typecode query parameter", http.StatusBadRequest)
+			return
+		}
+
+		if !accessPolicy.AllowsWrite(PrincipalFromContext(req.Context()), aggregateID, typeCode) {
+			logTimingStats(svc, start, nil)
+			log.Infof("Append of event %s %d forbidden", aggregateID, version)
+			http.Error(rw, "Forbidden", http.StatusForbidden)
+			return
+		}
+
+		payload, err := ioutil.ReadAll(req.Body)
+		if err != nil {
+			logTimingStats(svc, start, err)
+			http.Error(rw, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		err = appender.Append(&goes.Event{
+			Source:   aggregateID,
+			Version:  version,
+			TypeCode: typeCode,
+			Payload:  payload,
+		})
+		switch err {
+		case nil:
+		case ErrDuplicateEvent:
+			logTimingStats(svc, start, err)
+			http.Error(rw, err.Error(), http.StatusConflict)
+			return
+		default:
+			logTimingStats(svc, start, err)
+			log.Warnf("Error appending event: %s", err.Error())
+			http.Error(rw, "Error storing event", http.StatusInternalServerError)
+			return
+		}
+
+		rw.WriteHeader(http.StatusCreated)
+		logTimingStats(svc, start, nil)
+	}, nil
+}
@@ -11,7 +11,6 @@ import (
 	"fmt"
 	log "github.com/Sirupsen/logrus"
 	"github.com/armon/go-metrics"
-	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/kms"
 	"github.com/gorilla/mux"
@@ -31,57 +30,87 @@ var ErrBadDBConnection = errors.New("Nil db passed to factory method")
 const (
 	PingURI                = "/ping"
 	RecentHandlerURI       = "/notifications/recent"
+	StreamHandlerURI       = "/notifications/stream"
 	ArchiveHandlerURI      = "/notifications/{feedId}"
 	RetrieveEventHanderURI = "/events/{aggregateId}/{version}"
+	AppendEventHandlerURI  = "/events/{aggregateId}/{version}"
 	KeyAliasRoot           = "alias/"
 	KeyAlias               = "KEY_ALIAS"
+	KeyFile                = "KEY_FILE"
+	KeyID                  = "KEY_ID"
 	LinkProto	       = "LINK_PROTO"
 )
 
 //Used to serialize event store content when directly retrieving using aggregate id and version
 type EventStoreContent struct {
-	XMLName     xml.Name  `xml:"http://github.com/xtracdev/goes event"`
-	AggregateId string    `xml:"aggregateId"`
-	Version     int       `xml:"version"`
-	Published   time.Time `xml:"published"`
-	TypeCode    string    `xml:"typecode"`
-	Content     string    `xml:"content"`
+	XMLName     xml.Name  `xml:"http://github.com/xtracdev/goes event" json:"-"`
+	AggregateId string    `xml:"aggregateId" json:"aggregateId"`
+	Version     int       `xml:"version" json:"version"`
+	Published   time.Time `xml:"published" json:"published"`
+	TypeCode    string    `xml:"typecode" json:"typecode"`
+	Content     string    `xml:"content" json:"content"`
+
+	//ContentType is the media type of the payload where Content holds the payload as is rather
+	//than base64 encoded, which is the case for text payloads of a declared media type
+	ContentType string `xml:"contentType,omitempty" json:"contentType,omitempty"`
+
+	//EncryptedKey is the base64 encoded encrypted data key for the content when using entry
+	//encryption, and KeyID identifies the master key it is encrypted with
+	EncryptedKey string `xml:"encryptedKey,omitempty" json:"encryptedKey,omitempty"`
+	KeyID        string `xml:"keyId,omitempty" json:"keyId,omitempty"`
+
+	//Links relate the event to other resources, e.g. the feed holding it via the collection
+	//link relation
+	Links []EventLink `xml:"link,omitempty" json:"links,omitempty"`
 }
 
-//KMS service
-var kmsSvc *kms.KMS
+//EventLink is a link relation of event store content
+type EventLink struct {
+	Rel  string `xml:"rel,attr" json:"rel"`
+	Href string `xml:"href,attr" json:"href"`
+}
+
+//Key provider used to encrypt output, nil if output is not encrypted
+var keyProvider KeyProvider
 
 //Link proto - http or https
 var linkProto string
 
-func CheckKMSConfig() error {
-	keyAlias := KeyAliasRoot + os.Getenv(KeyAlias)
-	if keyAlias == KeyAliasRoot {
-		return nil
-	}
+//SetKeyProvider sets the key provider used to encrypt output, overriding the provider configured
+//from the environment. A nil provider disables encryption.
+func SetKeyProvider(provider KeyProvider) {
+	keyProvider = provider
+}
 
-	params := &kms.GenerateDataKeyInput{
-		KeyId:   aws.String(keyAlias), // Required
-		KeySpec: aws.String("AES_256"),
+//CheckKeyConfig checks a data key can be obtained from the configured key provider
+func CheckKeyConfig() error {
+	if keyProvider == nil {
+		return nil
 	}
 
-	_, err := kmsSvc.GenerateDataKey(params)
+	_, err := keyProvider.GenerateDataKey()
 	return err
 }
 
 func init() {
 	keyAlias := KeyAliasRoot + os.Getenv(KeyAlias)
+	keyFile := os.Getenv(KeyFile)
+
+	if keyAlias != KeyAliasRoot && keyFile != "" {
+		log.Errorf("Only one of %s and %s may be specified. Exiting.", KeyAlias, KeyFile)
+		os.Exit(1)
+	}
 
-	if keyAlias != "" {
+	if keyAlias != KeyAliasRoot {
 		log.Infof("Key alias specified: %s", keyAlias)
 		log.Infof("AWS_REGION: %s", os.Getenv("AWS_REGION"))
 		log.Infof("AWS_PROFILE: %s", os.Getenv("AWS_PROFILE"))
 
 		sess, err := session.NewSession()
 		if err == nil {
-			kmsSvc = kms.New(sess)
+			keyProvider = NewKMSKeyProvider(kms.New(sess), keyAlias)
 
-			err = CheckKMSConfig()
+			err = CheckKeyConfig()
 			if err != nil {
 				log.Errorf("Error instantiating AWS session: %s. Exiting.", err.Error())
 				os.Exit(1)
@@ -93,6 +122,29 @@ func init() {
 
 	}
 
+	if keyFile != "" {
+		log.Infof("Key file specified: %s", keyFile)
+
+		provider, err := NewStaticKeyProviderFromFile(os.Getenv(KeyID), keyFile)
+		if err != nil {
+			log.Errorf("Error reading key file: %s. Exiting.", err.Error())
+			os.Exit(1)
+		}
+
+		keyProvider = provider
+	}
+
+	cachingProvider, err := cacheKeysFromEnv(keyProvider)
+	if err != nil {
+		log.Errorf("Error configuring data key cache: %s. Exiting.", err.Error())
+		os.Exit(1)
+	}
+
+	if cachingProvider != keyProvider {
+		log.Infof("Caching data keys")
+		keyProvider = cachingProvider
+	}
+
 	linkProto = os.Getenv(LinkProto)
 	if linkProto == "" {
 		log.Infof("No %s from the environment - defaulting to https", LinkProto)
@@ -123,21 +175,32 @@ func Encrypt(plaintext []byte, key *[32]byte) ([]byte, error) {
 	return gcm.Seal(nonce, nonce, plaintext, nil), nil
 }
 
-//Add the retrieved events for a given feed to the atom feed structure
-func addItemsToFeed(feed *atom.Feed, events []atomdata.TimestampedEvent, linkhostport, proto string) {
+//Add the retrieved events for a given feed to the atom feed structure. Payloads are published as
+//transformed by any transformers registered for the event type code.
+func addItemsToFeed(feed *atom.Feed, events []atomdata.TimestampedEvent, linkhostport, proto string) error {
 
 	for _, event := range events {
 
-		encodedPayload := base64.StdEncoding.EncodeToString(event.Payload.([]byte))
+		payload, err := publishedPayload(&event)
+		if err != nil {
+			return err
+		}
+
+		//Payloads of declared media types are kept as is for newAtomEntry to publish, others
+		//are published base64 encoded
+		body := string(payload)
+		if payloadType(event.TypeCode) == "" {
+			body = base64.StdEncoding.EncodeToString(payload)
+		}
 
 		content := &atom.Text{
 			Type: event.TypeCode,
-			Body: encodedPayload,
+			Body: body,
 		}
 
 		entry := &atom.Entry{
 			Title:     "event",
-			ID:        fmt.Sprintf("urn:esid:%s:%d", event.Source, event.Version),
+			ID:        entryID(&event),
 			Published: atom.TimeStr(event.Timestamp.Format(time.RFC3339Nano)),
 			Content:   content,
 		}
@@ -153,6 +216,7 @@ func addItemsToFeed(feed *atom.Feed, events []atomdata.TimestampedEvent, linkhos
 
 	}
 
+	return nil
 }
 
 //Configure where telemery data does. Currently this can be send via UDP to a listener, or can be buffered
@@ -195,45 +259,43 @@ func logTimingStats(svc string, start time.Time, err error) {
 	}(svc, duration, err)
 }
 
-//Encrypt output encrypts the output is indicated by the configuration settings, e.g.
-//KEY_ALIAS set to something. Here we obtain the encryption key from KMS, and append the
-//encrypted version of the key to the encoded output.
-func encryptOutput(svc *kms.KMS, out []byte) ([]byte, error) {
-	keyAlias := KeyAliasRoot + os.Getenv(KeyAlias)
-	if keyAlias == KeyAliasRoot {
+//Encrypt output encrypts the output if a key provider is configured, e.g. KEY_ALIAS or KEY_FILE
+//set to something, and document encryption is used. Here we obtain a data key from the key provider,
+//and append the encrypted version of the key to the encoded output, or with the JWE format carry it
+//in the JWE encrypted key or kid header.
+func encryptOutput(provider KeyProvider, out []byte) ([]byte, error) {
+	if provider == nil || encryptionMode != DocumentEncryption {
 		return out, nil
 	}
 
 	//Get the encryption keys
-	params := &kms.GenerateDataKeyInput{
-		KeyId:   aws.String(keyAlias), // Required
-		KeySpec: aws.String("AES_256"),
-	}
-
-	resp, err := svc.GenerateDataKey(params)
+	dataKey, err := provider.GenerateDataKey()
 	if err != nil {
 		return nil, err
 	}
 
-	key := [32]byte{}
-	copy(key[:], resp.Plaintext[0:32])
+	//Purge the key from memory when done
+	defer func() {
+		*dataKey.Plaintext = [32]byte{}
+	}()
+
+	if encryptionFormat == JWEFormat {
+		jwe, err := encryptJWE(out, dataKey)
+		return []byte(jwe), err
+	}
 
 	//Encrypt the output
-	encrypted, err := Encrypt(out, &key)
+	encrypted, err := Encrypt(out, dataKey.Plaintext)
 	if err != nil {
 		return nil, err
 	}
 
-	//Purge the key from memory
-	key = [32]byte{}
-	resp.Plaintext = nil
-
 	//Encode the output
 	encodedOut := base64.StdEncoding.EncodeToString(encrypted)
 
 	//Encode the encryptedKey - this will have to be decrypted using the KMS
-	//CMK before the payload can be decrypted with it
-	encodedKey := base64.StdEncoding.EncodeToString(resp.CiphertextBlob)
+	//CMK or master key before the payload can be decrypted with it
+	encodedKey := base64.StdEncoding.EncodeToString(dataKey.EncryptedKey)
 
 	keyPlusText := fmt.Sprintf("%s::%s", encodedKey, encodedOut)
 
@@ -241,19 +303,50 @@ func encryptOutput(svc *kms.KMS, out []byte) ([]byte, error) {
 }
 
 //NewRecentHandler instantiates the handler for retrieve recent notifications, which are those that have not
-//yet been assigned a feed id. This will be served up at /notifications/recent
+//yet been assigned a feed id. This will be served up at /notifications/recent. Feed data is read from
+//the given FeedStore.
 //The linkhostport argument is used to set the host and port in the link relations URL. This is useful
 //when proxying the feed, in which case the link relation URLs can reflect the proxied URLs, not the
 //direct URL.
-func NewRecentHandler(db *sql.DB, linkhostport string) (func(rw http.ResponseWriter, req *http.Request), error) {
-	if db == nil {
-		return nil, ErrBadDBConnection
+//
+//Clients may long poll the recent feed by specifying the id of the last entry they have seen via
+//the after query parameter, and how long to wait via the wait parameter. The request is held until
+//newer events are published or a feed is archived, or the wait elapses, before the feed is returned.
+//
+//Where an access policy is configured, entries the caller may not see are dropped from the recent
+//and archive feeds. Clients may limit the entries to given event types via the type query
+//parameter, in which case links skip archives with no matching entries.
+//
+//Navigation follows RFC 5005: the recent feed links to the latest archive via prev-archive and
+//last, and to the oldest via first where the store implements FeedIndexStore.
+func NewRecentHandler(store FeedStore, linkhostport string) (func(rw http.ResponseWriter, req *http.Request), error) {
+	if store == nil {
+		return nil, ErrNilFeedStore
 	}
 
 	return func(rw http.ResponseWriter, req *http.Request) {
 		svc := "notifications-recent"
 		start := time.Now()
-		events, err := atomdata.RetrieveRecent(db)
+
+		//Long poll requests are held until there is something newer than the after entry
+		if after := req.URL.Query().Get(LongPollAfterParam); after != "" {
+			wait, err := parseWait(req.URL.Query().Get(LongPollWaitParam))
+			if err != nil {
+				logTimingStats(svc, start, err)
+				http.Error(rw, err.Error(), http.StatusBadRequest)
+				return
+			}
+
+			err = waitForUpdate(req, store, after, wait)
+			if err != nil {
+				logTimingStats(svc, start, err)
+				log.Warnf("Error waiting for recent items: %s", err.Error())
+				http.Error(rw, "Error retrieving feed items", http.StatusInternalServerError)
+				return
+			}
+		}
+
+		events, err := store.RetrieveRecent()
 		if err != nil {
 			logTimingStats(svc, start, err)
 			log.Warnf("Error retrieving recent items: %s", err.Error())
@@ -261,7 +354,10 @@ func NewRecentHandler(db *sql.DB, linkhostport string) (func(rw http.ResponseWri
 			return
 		}
 
-		latestFeed, err := atomdata.RetrieveLastFeed(db)
+		filter := newEventFilter(req)
+		events = filter.apply(events)
+
+		latestFeed, err := lastFeed(store, filter)
 		if err != nil {
 			logTimingStats(svc, start, err)
 			log.Warnf("Error retrieving last feed id: %s", err.Error())
@@ -269,51 +365,107 @@ func NewRecentHandler(db *sql.DB, linkhostport string) (func(rw http.ResponseWri
 			return
 		}
 
+		//The recent page is mutable, so caches must revalidate it each time. The entity tag is
+		//derived from the page content, so pollers of an unchanged page get a cheap 304.
+		contentType := feedContentType(req)
+		etag := recentETag(events, latestFeed+filter.types.query(), contentType)
+		modified := lastModified(events)
+
+		if notModified(req, etag, modified) {
+			writeNotModified(rw, accessPolicy.cacheControl("no-cache"), etag, modified)
+			logTimingStats(svc, start, nil)
+			return
+		}
+
 		feed := atom.Feed{
 			Title:   "Event store feed",
 			ID:      "recent",
 			Updated: atom.TimeStr(time.Now().Format(time.RFC3339)),
 		}
 
+		//Links carry the type filter so consumers stay within the filtered view
+		query := filter.types.query()
+
 		self := atom.Link{
-			Href: fmt.Sprintf("%s://%s/notifications/recent", linkProto, linkhostport),
+			Href: fmt.Sprintf("%s://%s/notifications/recent%s", linkProto, linkhostport, query),
 			Rel:  "self",
 		}
 
-		via := atom.Link{
-			Href: fmt.Sprintf("%s://%s/notifications/recent", linkProto, linkhostport),
-			Rel:  "related",
+		current := atom.Link{
+			Href: fmt.Sprintf("%s://%s/notifications/recent%s", linkProto, linkhostport, query),
+			Rel:  "current",
 		}
 
 		feed.Link = append(feed.Link, self)
-		feed.Link = append(feed.Link, via)
+		feed.Link = append(feed.Link, current)
 
 		if latestFeed != "" {
 			previous := atom.Link{
-				Href: fmt.Sprintf("%s://%s/notifications/%s", linkProto, linkhostport, latestFeed),
+				Href: fmt.Sprintf("%s://%s/notifications/%s%s", linkProto, linkhostport, latestFeed, query),
 				Rel:  "prev-archive",
 			}
 			feed.Link = append(feed.Link, previous)
+
+			first, err := firstFeed(store, filter)
+			if err != nil {
+				logTimingStats(svc, start, err)
+				log.Warnf("Error retrieving first feed id: %s", err.Error())
+				http.Error(rw, "Error retrieving feed id", http.StatusInternalServerError)
+				return
+			}
+
+			if first != "" {
+				feed.Link = append(feed.Link, atom.Link{
+					Href: fmt.Sprintf("%s://%s/notifications/%s%s", linkProto, linkhostport, first, query),
+					Rel:  "first",
+				})
+			}
+
+			feed.Link = append(feed.Link, atom.Link{
+				Href: fmt.Sprintf("%s://%s/notifications/%s%s", linkProto, linkhostport, latestFeed, query),
+				Rel:  "last",
+			})
 		}
 
-		addItemsToFeed(&feed, events, linkhostport, linkProto)
+		err = addItemsToFeed(&feed, events, linkhostport, linkProto)
+		if err != nil {
+			http.Error(rw, err.Error(), http.StatusInternalServerError)
+			logTimingStats(svc, start, err)
+			return
+		}
 
-		out, err := xml.Marshal(&feed)
+		err = encryptEntries(keyProvider, &feed)
 		if err != nil {
 			http.Error(rw, err.Error(), http.StatusInternalServerError)
 			logTimingStats(svc, start, err)
 			return
 		}
 
-		encodedOut, err := encryptOutput(kmsSvc, out)
+		out, _, err := marshalFeed(req, &feed)
 		if err != nil {
 			http.Error(rw, err.Error(), http.StatusInternalServerError)
 			logTimingStats(svc, start, err)
 			return
 		}
 
-		rw.Header().Add("Cache-Control", "no-store")
-		rw.Header().Add("Content-Type", "application/atom+xml")
+		encodedOut, err := encryptOutput(keyProvider, out)
+		if err != nil {
+			http.Error(rw, err.Error(), http.StatusInternalServerError)
+			logTimingStats(svc, start, err)
+			return
+		}
+
+		err = signResponse(responseSigner, rw, encodedOut)
+		if err != nil {
+			http.Error(rw, err.Error(), http.StatusInternalServerError)
+			logTimingStats(svc, start, err)
+			return
+		}
+
+		rw.Header().Add("Cache-Control", accessPolicy.cacheControl("no-cache"))
+		rw.Header().Add("Content-Type", contentType)
+		rw.Header().Add("Vary", "Accept")
+		setValidators(rw, etag, modified)
 		rw.Write(encodedOut)
 		logTimingStats(svc, start, nil)
 	}, nil
@@ -324,9 +476,11 @@ func NewRecentHandler(db *sql.DB, linkhostport string) (func(rw http.ResponseWri
 //The linkhostport argument is used to set the host and port in the link relations URL. This is useful
 //when proxying the feed, in which case the link relation URLs can reflect the proxied URLs, not the
 //direct URL.
-func NewArchiveHandler(db *sql.DB, linkhostport string) (func(rw http.ResponseWriter, req *http.Request), error) {
-	if db == nil {
-		return nil, ErrBadDBConnection
+//Archive pages are marked with the RFC 5005 fh:archive element, and link to the recent feed via
+//current as well as to the adjacent and oldest archives.
+func NewArchiveHandler(store FeedStore, linkhostport string) (func(rw http.ResponseWriter, req *http.Request), error) {
+	if store == nil {
+		return nil, ErrNilFeedStore
 	}
 
 	return func(rw http.ResponseWriter, req *http.Request) {
@@ -341,8 +495,36 @@ func NewArchiveHandler(db *sql.DB, linkhostport string) (func(rw http.ResponseWr
 
 		log.Infof("processing request for feed %s", feedID)
 
+		//Archived feeds are immutable, so a request with a matching entity tag can be answered
+		//without going to the store. Where an access policy or type filter applies to the feed,
+		//the entity tag identifies the caller's view of it. The links of type filtered views
+		//change as matching archives are added, so those are only revalidated once the links
+		//are known.
+		filter := newEventFilter(req)
+		filtered := feedID != "recent" && len(filter.types) > 0
+		cacheControl := accessPolicy.cacheControl("max-age=2592000")
+
+		var etag string
+		if feedID != "recent" {
+			etag = feedID
+			for _, qualifier := range []string{accessPolicy.view(filter.principal), filter.types.key()} {
+				if qualifier != "" {
+					etag += "-" + qualifier
+				}
+			}
+		}
+
+		if feedID != "recent" && !filtered {
+			etag = representationETag(etag, feedContentType(req))
+			if etagMatches(req, etag) {
+				writeNotModified(rw, cacheControl, etag, time.Time{})
+				logTimingStats(svc, start, nil)
+				return
+			}
+		}
+
 		//Retrieve events for the given feed id.
-		latestFeed, err := atomdata.RetrieveArchive(db, feedID)
+		latestFeed, err := store.RetrieveArchive(feedID)
 		if err != nil {
 			logTimingStats(svc, start, err)
 			log.Warnf("Error retrieving last feed id: %s", err.Error())
@@ -359,7 +541,35 @@ func NewArchiveHandler(db *sql.DB, linkhostport string) (func(rw http.ResponseWr
 			return
 		}
 
-		previousFeed, err := atomdata.RetrievePreviousFeed(db, feedID)
+		//Entries the caller may not see or did not ask for are dropped, leaving the page in place
+		//for navigation
+		latestFeed = filter.apply(latestFeed)
+
+		modified := lastModified(latestFeed)
+		if feedID != "recent" && !filtered && notModified(req, etag, modified) {
+			writeNotModified(rw, cacheControl, etag, modified)
+			logTimingStats(svc, start, nil)
+			return
+		}
+
+		previousFeed, err := store.RetrievePreviousFeed(feedID)
+		if err != nil {
+			logTimingStats(svc, start, err)
+			log.Warnf("Error retrieving previous feed id: %s", err.Error())
+			http.Error(rw, "Error retrieving previous feed id", http.StatusInternalServerError)
+			return
+		}
+
+		nextFeed, err := store.RetrieveNextFeed(feedID)
+		if err != nil {
+			logTimingStats(svc, start, err)
+			log.Warnf("Error retrieving next feed id: %s", err.Error())
+			http.Error(rw, "Error retrieving next feed id", http.StatusInternalServerError)
+			return
+		}
+
+		//Type filtered views skip archives with no matching events
+		previous, err := filter.matchingFeed(store, previousFeed.String, true)
 		if err != nil {
 			logTimingStats(svc, start, err)
 			log.Warnf("Error retrieving previous feed id: %s", err.Error())
@@ -367,7 +577,7 @@ func NewArchiveHandler(db *sql.DB, linkhostport string) (func(rw http.ResponseWr
 			return
 		}
 
-		nextFeed, err := atomdata.RetrieveNextFeed(db, feedID)
+		next, err := filter.matchingFeed(store, nextFeed.String, false)
 		if err != nil {
 			logTimingStats(svc, start, err)
 			log.Warnf("Error retrieving next feed id: %s", err.Error())
@@ -375,47 +585,126 @@ func NewArchiveHandler(db *sql.DB, linkhostport string) (func(rw http.ResponseWr
 			return
 		}
 
+		first, err := firstFeed(store, filter)
+		if err != nil {
+			logTimingStats(svc, start, err)
+			log.Warnf("Error retrieving first feed id: %s", err.Error())
+			http.Error(rw, "Error retrieving first feed id", http.StatusInternalServerError)
+			return
+		}
+
+		last, err := lastFeed(store, filter)
+		if err != nil {
+			logTimingStats(svc, start, err)
+			log.Warnf("Error retrieving last feed id: %s", err.Error())
+			http.Error(rw, "Error retrieving last feed id", http.StatusInternalServerError)
+			return
+		}
+
+		//The next and last links of type filtered views lead to the nearest and newest matching
+		//archives, which change as archives are added, so the pages are revalidated rather than
+		//cached, and the entity tag identifies the links. Entries do not change with the links,
+		//so the last modified time is not a validator.
+		if filtered {
+			cacheControl = accessPolicy.cacheControl("no-cache")
+			etag = representationETag(etag+"-"+linksKey(next, last), feedContentType(req))
+			modified = time.Time{}
+			if notModified(req, etag, modified) {
+				writeNotModified(rw, cacheControl, etag, modified)
+				logTimingStats(svc, start, nil)
+				return
+			}
+		}
+
 		feed := atom.Feed{
 			Title: "Event store feed",
 			ID:    feedID,
 		}
 
+		//Links carry the type filter so consumers stay within the filtered view
+		query := filter.types.query()
+
 		self := atom.Link{
-			Href: fmt.Sprintf("%s://%s/notifications/%s", linkProto, linkhostport, feedID),
+			Href: fmt.Sprintf("%s://%s/notifications/%s%s", linkProto, linkhostport, feedID, query),
 			Rel:  "self",
 		}
 
+		current := atom.Link{
+			Href: fmt.Sprintf("%s://%s/notifications/recent%s", linkProto, linkhostport, query),
+			Rel:  "current",
+		}
+
 		feed.Link = append(feed.Link, self)
+		feed.Link = append(feed.Link, current)
+
+		if first != "" {
+			feed.Link = append(feed.Link, atom.Link{
+				Href: fmt.Sprintf("%s://%s/notifications/%s%s", linkProto, linkhostport, first, query),
+				Rel:  "first",
+			})
+		}
+
+		//Archives are cached for a long time while the last archive changes as feeds are added,
+		//so the last link of a cached archive may lead to an earlier archive than the newest.
+		//The current link always leads to the newest via prev-archive.
+		if last != "" {
+			feed.Link = append(feed.Link, atom.Link{
+				Href: fmt.Sprintf("%s://%s/notifications/%s%s", linkProto, linkhostport, last, query),
+				Rel:  "last",
+			})
+		}
 
-		if previousFeed.Valid {
+		if previous != "" {
 			feed.Link = append(feed.Link, atom.Link{
-				Href: fmt.Sprintf("%s://%s/notifications/%s", linkProto, linkhostport, previousFeed.String),
+				Href: fmt.Sprintf("%s://%s/notifications/%s%s", linkProto, linkhostport, previous, query),
 				Rel:  "prev-archive",
 			})
 		}
 
-		var next string
-		if (nextFeed.Valid == true && nextFeed.String == "") || !nextFeed.Valid {
+		if next == "" {
 			next = "recent"
-		} else {
-			next = nextFeed.String
 		}
 
 		feed.Link = append(feed.Link, atom.Link{
-			Href: fmt.Sprintf("%s://%s/notifications/%s", linkProto, linkhostport, next),
+			Href: fmt.Sprintf("%s://%s/notifications/%s%s", linkProto, linkhostport, next, query),
 			Rel:  "next-archive",
 		})
 
-		addItemsToFeed(&feed, latestFeed, linkhostport, linkProto)
+		err = addItemsToFeed(&feed, latestFeed, linkhostport, linkProto)
+		if err != nil {
+			logTimingStats(svc, start, err)
+			http.Error(rw, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		err = encryptEntries(keyProvider, &feed)
+		if err != nil {
+			logTimingStats(svc, start, err)
+			http.Error(rw, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		//Archived feeds are marked as archive documents
+		marshal := marshalArchive
+		if feedID == "recent" {
+			marshal = marshalFeed
+		}
 
-		out, err := xml.Marshal(&feed)
+		out, contentType, err := marshal(req, &feed)
 		if err != nil {
 			logTimingStats(svc, start, err)
 			http.Error(rw, err.Error(), http.StatusInternalServerError)
 			return
 		}
 
-		encodedOut, err := encryptOutput(kmsSvc, out)
+		encodedOut, err := encryptOutput(keyProvider, out)
+		if err != nil {
+			http.Error(rw, err.Error(), http.StatusInternalServerError)
+			logTimingStats(svc, start, err)
+			return
+		}
+
+		err = signResponse(responseSigner, rw, encodedOut)
 		if err != nil {
 			http.Error(rw, err.Error(), http.StatusInternalServerError)
 			logTimingStats(svc, start, err)
@@ -423,17 +712,19 @@ func NewArchiveHandler(db *sql.DB, linkhostport string) (func(rw http.ResponseWr
 		}
 
 		//For all feeds except recent, we can indicate the page can be cached for a long time,
-		//e.g. 30 days. The recent page is mutable so we don't indicate caching for it. We could
-		//potentially attempt to load it from this method via link traversal.
+		//e.g. 30 days, unless its links are type filtered. The recent page is mutable so we don't
+		//indicate caching for it. We could potentially attempt to load it from this method via
+		//link traversal.
 		if feedID != "recent" {
-			log.Infof("setting Cache-Control max-age=2592000 for ETag %s", feedID)
-			rw.Header().Add("Cache-Control", "max-age=2592000") //Contents are immutable, cache for a month
-			rw.Header().Add("ETag", feedID)
+			log.Infof("setting Cache-Control %s for ETag %s", cacheControl, etag)
+			rw.Header().Add("Cache-Control", cacheControl)
+			setValidators(rw, etag, modified)
 		} else {
 			rw.Header().Add("Cache-Control", "no-store")
 		}
 
-		rw.Header().Add("Content-Type", "application/atom+xml")
+		rw.Header().Add("Content-Type", contentType)
+		rw.Header().Add("Vary", "Accept")
 		rw.Write(encodedOut)
 
 		logTimingStats(svc, start, nil)
@@ -443,9 +734,12 @@ func NewArchiveHandler(db *sql.DB, linkhostport string) (func(rw http.ResponseWr
 
 //NewRetrieveHandler instantiates a handler for the retrieval of specific events by aggregate id
 //and version. This will be served at /notifications/{aggregateId}/{version}
-func NewEventRetrieveHandler(db *sql.DB) (func(rw http.ResponseWriter, req *http.Request), error) {
-	if db == nil {
-		return nil, ErrBadDBConnection
+//Events the caller may not see under the access policy get a 403 response.
+//Where the store implements EventFeedStore, the event links to the feed holding it via the
+//collection link relation, with the linkhostport argument used as for the feed handlers.
+func NewEventRetrieveHandler(store FeedStore, linkhostport string) (func(rw http.ResponseWriter, req *http.Request), error) {
+	if store == nil {
+		return nil, ErrNilFeedStore
 	}
 
 	return func(rw http.ResponseWriter, req *http.Request) {
@@ -463,7 +757,17 @@ func NewEventRetrieveHandler(db *sql.DB) (func(rw http.ResponseWriter, req *http
 			return
 		}
 
-		event, err := atomdata.RetrieveEvent(db, aggregateID, version)
+		//Events are immutable, so a request with a matching entity tag can be answered without
+		//going to the store, unless the event must first be checked against the access policy.
+		cacheControl := accessPolicy.cacheControl("max-age=2592000")
+		etag := representationETag(fmt.Sprintf("%s:%d", aggregateID, version), eventContentType(req))
+		if accessPolicy == nil && etagMatches(req, etag) {
+			writeNotModified(rw, cacheControl, etag, time.Time{})
+			logTimingStats(svc, start, nil)
+			return
+		}
+
+		event, err := store.RetrieveEvent(aggregateID, version)
 		if err != nil {
 			logTimingStats(svc, start, err)
 			switch err {
@@ -477,31 +781,93 @@ func NewEventRetrieveHandler(db *sql.DB) (func(rw http.ResponseWriter, req *http
 			return
 		}
 
+		if !accessPolicy.Allows(PrincipalFromContext(req.Context()), aggregateID, event.TypeCode) {
+			logTimingStats(svc, start, nil)
+			log.Infof("Access to event %s %d forbidden", aggregateID, version)
+			http.Error(rw, "Forbidden", http.StatusForbidden)
+			return
+		}
+
+		var links []EventLink
+		if locator, ok := store.(EventFeedStore); ok {
+			feedID, err := locator.RetrieveEventFeed(aggregateID, version)
+			if err != nil {
+				logTimingStats(svc, start, err)
+				log.Warnf("Error locating event: %s", err.Error())
+				http.Error(rw, "Error locating event", http.StatusInternalServerError)
+				return
+			}
+
+			//Events in the recent feed will move to an archive, so the representation linking
+			//to the recent feed has its own entity tag and must be revalidated. Once archived,
+			//events never move.
+			if feedID == "" {
+				feedID = "recent"
+				etag = representationETag(fmt.Sprintf("%s:%d-recent", aggregateID, version), eventContentType(req))
+				cacheControl = accessPolicy.cacheControl("no-cache")
+			}
+
+			links = append(links, EventLink{
+				Rel:  "collection",
+				Href: fmt.Sprintf("%s://%s/notifications/%s", linkProto, linkhostport, feedID),
+			})
+		}
+
+		if notModified(req, etag, event.Timestamp) {
+			writeNotModified(rw, cacheControl, etag, event.Timestamp)
+			logTimingStats(svc, start, nil)
+			return
+		}
+
 		eventContent := EventStoreContent{
 			AggregateId: aggregateID,
 			Version:     version,
 			TypeCode:    event.TypeCode,
 			Published:   event.Timestamp,
-			Content:     base64.StdEncoding.EncodeToString(event.Payload.([]byte)),
+			Links:       links,
+		}
+
+		payload, err := publishedPayload(&event)
+		if err != nil {
+			logTimingStats(svc, start, err)
+			http.Error(rw, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		setEventPayload(&eventContent, payload)
+
+		err = encryptEventContent(keyProvider, &eventContent)
+		if err != nil {
+			logTimingStats(svc, start, err)
+			http.Error(rw, err.Error(), http.StatusInternalServerError)
+			return
 		}
 
-		marshalled, err := xml.Marshal(&eventContent)
+		marshalled, contentType, err := marshalEvent(req, &eventContent)
 		if err != nil {
 			logTimingStats(svc, start, err)
 			http.Error(rw, err.Error(), http.StatusInternalServerError)
 			return
 		}
 
-		encodedOut, err := encryptOutput(kmsSvc, marshalled)
+		encodedOut, err := encryptOutput(keyProvider, marshalled)
+		if err != nil {
+			http.Error(rw, err.Error(), http.StatusInternalServerError)
+			logTimingStats(svc, start, err)
+			return
+		}
+
+		err = signResponse(responseSigner, rw, encodedOut)
 		if err != nil {
 			http.Error(rw, err.Error(), http.StatusInternalServerError)
 			logTimingStats(svc, start, err)
 			return
 		}
 
-		rw.Header().Add("Content-Type", "application/xml")
-		rw.Header().Add("ETag", fmt.Sprintf("%s:%d", aggregateID, version))
-		rw.Header().Add("Cache-Control", "max-age=2592000")
+		rw.Header().Add("Content-Type", contentType)
+		rw.Header().Add("Vary", "Accept")
+		setValidators(rw, etag, event.Timestamp)
+		rw.Header().Add("Cache-Control", cacheControl)
 
 		rw.Write(encodedOut)
 		logTimingStats(svc, start, nil)
@@ -1,6 +1,7 @@
 package atompubsvc
 
 import (
+	"bytes"
 	"database/sql/driver"
 	"encoding/base64"
 	"encoding/xml"
@@ -128,12 +129,20 @@ func TestRetrieve(t *testing.T) {
 				query = query.WillReturnError(test.queryError)
 			}
 
+			//Retrieved events are located to link to their feed
+			if test.expectedEvent != nil {
+				mock.ExpectQuery("select feedid from t_aeae_atom_event where aggregate_id").WithArgs(test.aggregateId, 1).
+					WillReturnRows(sqlmock.NewRows([]string{"feedid"}).AddRow("feed-1"))
+			}
+
 			var eventHandler func(http.ResponseWriter, *http.Request)
 			if test.nilDB == false {
-				eventHandler, err = NewEventRetrieveHandler(db)
+				store, err := NewOracleFeedStore(db)
+				assert.Nil(t, err)
+				eventHandler, err = NewEventRetrieveHandler(store, "testhost:12345")
 				assert.Nil(t, err)
 			} else {
-				eventHandler, err = NewEventRetrieveHandler(nil)
+				eventHandler, err = NewEventRetrieveHandler(nil, "testhost:12345")
 				assert.NotNil(t, err)
 				return
 			}
@@ -163,6 +172,8 @@ func TestRetrieve(t *testing.T) {
 					assert.Equal(t, test.expectedEvent.Version, event.Version)
 					assert.Equal(t, test.expectedEvent.Content, event.Content)
 					assert.True(t, test.expectedEvent.Published.Equal(event.Published))
+					assert.Equal(t, []EventLink{{Rel: "collection", Href: "https://testhost:12345/notifications/feed-1"}},
+						event.Links)
 				}
 
 				//Validate cache headers
@@ -170,7 +181,7 @@ func TestRetrieve(t *testing.T) {
 				assert.Equal(t, "max-age=2592000", cc)
 
 				etag := w.Header().Get("ETag")
-				assert.Equal(t, "1234567:1", etag)
+				assert.Equal(t, `"1234567:1"`, etag)
 
 				//Validate content type
 				assert.Equal(t, "application/xml", w.Header().Get("Content-Type"))
@@ -331,10 +342,19 @@ func TestRecentFeedHandler(t *testing.T) {
 				feedQuery = feedQuery.WillReturnError(test.feedQueryErr)
 			}
 
+			//The first feed is retrieved for the first link once the page is known to link to
+			//an archive
+			if test.expectedPrev != "" {
+				mock.ExpectQuery(`select feedid from t_aefd_feed where id = \(select min\(id\)`).
+					WillReturnRows(sqlmock.NewRows([]string{"feedid"}).AddRow("feed-001"))
+			}
+
 			//Instantiate the handler
 			var eventHandler func(http.ResponseWriter, *http.Request)
 			if test.nilDB == false {
-				eventHandler, err = NewRecentHandler(db, "testhost:12345")
+				store, err := NewOracleFeedStore(db)
+				assert.Nil(t, err)
+				eventHandler, err = NewRecentHandler(store, "testhost:12345")
 				assert.Nil(t, err)
 			} else {
 				eventHandler, err = NewRecentHandler(nil, "testhost:12345")
@@ -374,17 +394,27 @@ func TestRecentFeedHandler(t *testing.T) {
 						assert.Equal(t, test.expectedSelf, *self)
 					}
 
-					related := getLink("related", &feed)
-					if assert.NotNil(t, related) {
-						assert.Equal(t, *self, *related)
+					current := getLink("current", &feed)
+					if assert.NotNil(t, current) {
+						assert.Equal(t, *self, *current)
+					}
+
+					first := getLink("first", &feed)
+					if assert.NotNil(t, first) {
+						assert.Equal(t, "https://testhost:12345/notifications/feed-001", *first)
+					}
+
+					last := getLink("last", &feed)
+					if assert.NotNil(t, last) {
+						assert.Equal(t, test.expectedPrev, *last)
 					}
 				}
 
 				cc := w.Header().Get("Cache-Control")
-				assert.Equal(t, "no-store", cc)
+				assert.Equal(t, "no-cache", cc)
 
 				etag := w.Header().Get("ETag")
-				assert.Equal(t, "", etag)
+				assert.NotEqual(t, "", etag)
 			}
 
 			err = mock.ExpectationsWereMet()
@@ -610,9 +640,18 @@ func TestRetrieveArchiveHandler(t *testing.T) {
 				nextQuery = nextQuery.WillReturnError(test.feedQueryNextErr)
 			}
 
+			if test.expectedNext != "" {
+				mock.ExpectQuery(`select feedid from t_aefd_feed where id = \(select min\(id\)`).
+					WillReturnRows(sqlmock.NewRows([]string{"feedid"}).AddRow("first-xxx"))
+				mock.ExpectQuery(`select feedid from t_aefd_feed where id = \(select max\(id\)`).
+					WillReturnRows(sqlmock.NewRows([]string{"feedid"}).AddRow("last-xxx"))
+			}
+
 			var archiveHandler func(http.ResponseWriter, *http.Request)
 			if test.nilDB == false {
-				archiveHandler, err = NewArchiveHandler(db, "testhost:12345")
+				store, err := NewOracleFeedStore(db)
+				assert.Nil(t, err)
+				archiveHandler, err = NewArchiveHandler(store, "testhost:12345")
 				assert.Nil(t, err)
 			} else {
 				archiveHandler, err = NewArchiveHandler(nil, "testhost:12345")
@@ -664,6 +703,23 @@ func TestRetrieveArchiveHandler(t *testing.T) {
 						assert.Equal(t, test.expectedNext, *next)
 					}
 
+					current := getLink("current", &feed)
+					if assert.NotNil(t, current) {
+						assert.Equal(t, "https://testhost:12345/notifications/recent", *current)
+					}
+
+					first := getLink("first", &feed)
+					if assert.NotNil(t, first) {
+						assert.Equal(t, "https://testhost:12345/notifications/first-xxx", *first)
+					}
+
+					last := getLink("last", &feed)
+					if assert.NotNil(t, last) {
+						assert.Equal(t, "https://testhost:12345/notifications/last-xxx", *last)
+					}
+					assert.Equal(t, feed.ID != "recent", bytes.Contains(eventData,
+						[]byte(`<archive xmlns="`+FeedHistoryNamespace+`">`)))
+
 					if assert.Equal(t, 1, len(feed.Entry)) {
 						assert.Equal(t, "urn:esid:1x2x333:3", feed.Entry[0].ID)
 						assert.Equal(t, "foo", feed.Entry[0].Content.Type)
@@ -676,7 +732,7 @@ func TestRetrieveArchiveHandler(t *testing.T) {
 						assert.Equal(t, "max-age=2592000", cc)
 
 						etag := w.Header().Get("ETag")
-						assert.Equal(t, "foo", etag)
+						assert.Equal(t, `"foo"`, etag)
 					} else {
 						cc := w.Header().Get("Cache-Control")
 						assert.Equal(t, "no-store", cc)
@@ -692,3 +748,9 @@ func TestRetrieveArchiveHandler(t *testing.T) {
 		})
 	}
 }
+
+func TestOracleFeedStoreNilDB(t *testing.T) {
+	store, err := NewOracleFeedStore(nil)
+	assert.Nil(t, store)
+	assert.Equal(t, ErrBadDBConnection, err)
+}
@@ -0,0 +1,183 @@
+package atompubsvc
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	"net/http"
+	"os"
+	"strings"
+)
+
+//Environment variables used to configure authentication. If neither API_KEYS_FILE nor JWKS_FILE
+//is set, requests are not authenticated.
+const (
+	APIKeysFile = "API_KEYS_FILE"
+	JWKSFile    = "JWKS_FILE"
+	JWTIssuer   = "JWT_ISSUER"
+	JWTAudience = "JWT_AUDIENCE"
+)
+
+//APIKeyHeader is the request header carrying an API key
+const APIKeyHeader = "X-API-Key"
+
+//AuthRealm is the realm advertised in WWW-Authenticate challenges
+const AuthRealm = "es-atom-pub"
+
+var ErrNoCredentials = errors.New("No credentials supplied")
+var ErrBadCredentials = errors.New("Invalid credentials")
+var ErrNoAuthenticators = errors.New("No authenticators passed to factory method")
+
+//Principal is the authenticated caller of a request
+type Principal struct {
+	//Subject identifies the caller, e.g. the name associated with an API key, the JWT sub claim or
+	//the client certificate subject
+	Subject string
+
+	//Method is the authentication method used, e.g. api-key, jwt or client-cert
+	Method string
+
+	//Claims holds the JWT claims for callers authenticated with a bearer token
+	Claims map[string]interface{}
+}
+
+type principalKey struct{}
+
+//WithPrincipal returns a copy of the context carrying the principal
+func WithPrincipal(ctx context.Context, principal *Principal) context.Context {
+	return context.WithValue(ctx, principalKey{}, principal)
+}
+
+//PrincipalFromContext returns the principal carried by the context, or nil if the request was
+//not authenticated.
+func PrincipalFromContext(ctx context.Context) *Principal {
+	principal, _ := ctx.Value(principalKey{}).(*Principal)
+	return principal
+}
+
+//Authenticator authenticates requests using a particular type of credential. Authenticate
+//returns ErrNoCredentials if the request does not carry that type of credential. Challenge
+//returns the WWW-Authenticate challenge for the authentication scheme, given the error returned
+//by Authenticate.
+type Authenticator interface {
+	Authenticate(req *http.Request) (*Principal, error)
+	Challenge(err error) string
+}
+
+//APIKeyAuthenticator authenticates requests carrying a static API key in the X-API-Key header
+type APIKeyAuthenticator struct {
+	//Keys are held as hashes, mapped to the subject associated with the key
+	subjects map[[sha256.Size]byte]string
+}
+
+//NewAPIKeyAuthenticator returns an authenticator accepting the given API keys, mapped to the
+//subject associated with each key.
+func NewAPIKeyAuthenticator(keys map[string]string) *APIKeyAuthenticator {
+	subjects := make(map[[sha256.Size]byte]string)
+	for key, subject := range keys {
+		subjects[sha256.Sum256([]byte(key))] = subject
+	}
+
+	return &APIKeyAuthenticator{subjects: subjects}
+}
+
+//NewAPIKeyAuthenticatorFromFile returns an authenticator accepting the API keys read from a
+//file. Each line holds a subject and its key separated by white space. Blank lines and lines
+//starting with # are ignored.
+func NewAPIKeyAuthenticatorFromFile(path string) (*APIKeyAuthenticator, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+
+	defer file.Close()
+
+	keys := make(map[string]string)
+	scanner := bufio.NewScanner(file)
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("Expected subject and key on line %d of %s", lineNo, path)
+		}
+
+		keys[fields[1]] = fields[0]
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return NewAPIKeyAuthenticator(keys), nil
+}
+
+func (aka *APIKeyAuthenticator) Authenticate(req *http.Request) (*Principal, error) {
+	key := req.Header.Get(APIKeyHeader)
+	if key == "" {
+		return nil, ErrNoCredentials
+	}
+
+	//Keys are looked up by hash so the comparison does not leak the key via timing
+	subject, ok := aka.subjects[sha256.Sum256([]byte(key))]
+	if !ok {
+		return nil, ErrBadCredentials
+	}
+
+	return &Principal{Subject: subject, Method: "api-key"}, nil
+}
+
+func (aka *APIKeyAuthenticator) Challenge(err error) string {
+	return fmt.Sprintf(`ApiKey realm="%s", header="%s"`, AuthRealm, APIKeyHeader)
+}
+
+//NewAuthHandler wraps a handler so requests must be authenticated by one of the authenticators
+//before being passed on, with the principal available via PrincipalFromContext. Requests for
+//the open paths, e.g. /ping, are passed on without authentication. Unauthenticated requests
+//get a 401 response with a WWW-Authenticate challenge for each authentication scheme.
+func NewAuthHandler(next http.Handler, openPaths []string, authenticators ...Authenticator) (http.Handler, error) {
+	if len(authenticators) == 0 {
+		return nil, ErrNoAuthenticators
+	}
+
+	open := make(map[string]bool)
+	for _, path := range openPaths {
+		open[path] = true
+	}
+
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if open[req.URL.Path] {
+			next.ServeHTTP(rw, req)
+			return
+		}
+
+		for _, authenticator := range authenticators {
+			principal, err := authenticator.Authenticate(req)
+			if err == ErrNoCredentials {
+				continue
+			}
+
+			if err != nil {
+				log.Infof("Authentication failed for %s: %s", req.URL.Path, err.Error())
+				rw.Header().Add("WWW-Authenticate", authenticator.Challenge(err))
+				http.Error(rw, "Unauthorized", http.StatusUnauthorized)
+				return
+			}
+
+			next.ServeHTTP(rw, req.WithContext(WithPrincipal(req.Context(), principal)))
+			return
+		}
+
+		for _, authenticator := range authenticators {
+			rw.Header().Add("WWW-Authenticate", authenticator.Challenge(ErrNoCredentials))
+		}
+
+		http.Error(rw, "Unauthorized", http.StatusUnauthorized)
+	}), nil
+}
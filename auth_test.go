@@ -0,0 +1,130 @@
+package atompubsvc
+
+import (
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+//principalHandler echoes the subject of the authenticated principal
+func principalHandler(rw http.ResponseWriter, req *http.Request) {
+	principal := PrincipalFromContext(req.Context())
+	if principal == nil {
+		rw.Write([]byte("anonymous"))
+		return
+	}
+
+	rw.Write([]byte(principal.Subject))
+}
+
+func TestAPIKeyAuthenticatorFromFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "auth")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	keysFile := filepath.Join(dir, "keys")
+	assert.Nil(t, ioutil.WriteFile(keysFile, []byte("# subject key\n\nconsumer1 key1\n  consumer2\tkey2  \n"), 0600))
+
+	authenticator, err := NewAPIKeyAuthenticatorFromFile(keysFile)
+	if !assert.Nil(t, err) {
+		return
+	}
+
+	var tests = []struct {
+		key     string
+		subject string
+		err     error
+	}{
+		{"key1", "consumer1", nil},
+		{"key2", "consumer2", nil},
+		{"key3", "", ErrBadCredentials},
+		{"", "", ErrNoCredentials},
+	}
+
+	for _, test := range tests {
+		r, _ := http.NewRequest("GET", "/notifications/recent", nil)
+		if test.key != "" {
+			r.Header.Set(APIKeyHeader, test.key)
+		}
+
+		principal, err := authenticator.Authenticate(r)
+		assert.Equal(t, test.err, err, test.key)
+		if err == nil {
+			assert.Equal(t, test.subject, principal.Subject)
+			assert.Equal(t, "api-key", principal.Method)
+		}
+	}
+
+	badFile := filepath.Join(dir, "bad")
+	assert.Nil(t, ioutil.WriteFile(badFile, []byte("consumer1\n"), 0600))
+	_, err = NewAPIKeyAuthenticatorFromFile(badFile)
+	assert.NotNil(t, err)
+
+	_, err = NewAPIKeyAuthenticatorFromFile(filepath.Join(dir, "missing"))
+	assert.NotNil(t, err)
+}
+
+func TestNewAuthHandlerNoAuthenticators(t *testing.T) {
+	_, err := NewAuthHandler(http.HandlerFunc(principalHandler), nil)
+	assert.Equal(t, ErrNoAuthenticators, err)
+}
+
+func TestAuthHandler(t *testing.T) {
+	signer := newTestTokenSigner(t)
+	jwtAuthenticator, err := NewJWTAuthenticator(signer.jwks, "", "")
+	if !assert.Nil(t, err) {
+		return
+	}
+
+	handler, err := NewAuthHandler(http.HandlerFunc(principalHandler), []string{PingURI},
+		NewAPIKeyAuthenticator(map[string]string{"key1": "consumer1"}), jwtAuthenticator)
+	if !assert.Nil(t, err) {
+		return
+	}
+
+	var tests = []struct {
+		name       string
+		path       string
+		header     string
+		value      string
+		status     int
+		body       string
+		challenges []string
+	}{
+		{"ping open", PingURI, "", "", http.StatusOK, "anonymous", nil},
+		{"no credentials", "/notifications/recent", "", "", http.StatusUnauthorized, "",
+			[]string{`ApiKey realm="es-atom-pub", header="X-API-Key"`, `Bearer realm="es-atom-pub"`}},
+		{"api key", "/notifications/recent", APIKeyHeader, "key1", http.StatusOK, "consumer1", nil},
+		{"bad api key", "/notifications/recent", APIKeyHeader, "key2", http.StatusUnauthorized, "",
+			[]string{`ApiKey realm="es-atom-pub", header="X-API-Key"`}},
+		{"bearer token", "/notifications/1", "Authorization", "Bearer " + signer.token(t, validClaims()), http.StatusOK, "user1", nil},
+		{"bad bearer token", "/notifications/1", "Authorization", "Bearer not.a.token", http.StatusUnauthorized, "",
+			[]string{`Bearer realm="es-atom-pub", error="invalid_token", error_description="Malformed bearer token"`}},
+		{"other scheme", "/notifications/1", "Authorization", "Basic dXNlcjpwYXNz", http.StatusUnauthorized, "", nil},
+	}
+
+	for _, test := range tests {
+		r, _ := http.NewRequest("GET", test.path, nil)
+		if test.header != "" {
+			r.Header.Set(test.header, test.value)
+		}
+
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+
+		assert.Equal(t, test.status, w.Result().StatusCode, test.name)
+		if test.status == http.StatusOK {
+			assert.Equal(t, test.body, w.Body.String(), test.name)
+		} else {
+			assert.NotEmpty(t, w.Result().Header["Www-Authenticate"], test.name)
+		}
+
+		if test.challenges != nil {
+			assert.Equal(t, test.challenges, w.Result().Header["Www-Authenticate"], test.name)
+		}
+	}
+}
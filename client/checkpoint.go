@@ -0,0 +1,76 @@
+package client
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+//CheckpointStore persists the id of the last entry processed by a consumer, so processing
+//can resume from that point. An empty checkpoint means no entries have been processed.
+type CheckpointStore interface {
+	LoadCheckpoint() (string, error)
+	SaveCheckpoint(entryID string) error
+}
+
+//MemoryCheckpointStore keeps the checkpoint in memory, and is mostly useful for testing
+type MemoryCheckpointStore struct {
+	sync.Mutex
+	entryID string
+}
+
+func (mcs *MemoryCheckpointStore) LoadCheckpoint() (string, error) {
+	mcs.Lock()
+	defer mcs.Unlock()
+	return mcs.entryID, nil
+}
+
+func (mcs *MemoryCheckpointStore) SaveCheckpoint(entryID string) error {
+	mcs.Lock()
+	defer mcs.Unlock()
+	mcs.entryID = entryID
+	return nil
+}
+
+//FileCheckpointStore keeps the checkpoint in a file
+type FileCheckpointStore struct {
+	path string
+}
+
+//NewFileCheckpointStore returns a checkpoint store that reads and writes the checkpoint from
+//the given file. A missing file is treated as an empty checkpoint.
+func NewFileCheckpointStore(path string) *FileCheckpointStore {
+	return &FileCheckpointStore{path: path}
+}
+
+func (fcs *FileCheckpointStore) LoadCheckpoint() (string, error) {
+	data, err := ioutil.ReadFile(fcs.path)
+	if os.IsNotExist(err) {
+		return "", nil
+	}
+
+	return strings.TrimSpace(string(data)), err
+}
+
+//SaveCheckpoint writes the checkpoint to a temporary file which is then renamed, so a crash
+//part way through the write does not leave a corrupt checkpoint.
+func (fcs *FileCheckpointStore) SaveCheckpoint(entryID string) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(fcs.path), filepath.Base(fcs.path))
+	if err != nil {
+		return err
+	}
+
+	_, err = tmp.WriteString(entryID)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+
+	if err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+
+	return os.Rename(tmp.Name(), fcs.path)
+}
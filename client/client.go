@@ -0,0 +1,333 @@
+//Package client provides a consumer for the event store atom feed. It walks back from the
+//recent feed via prev-archive links to the last processed entry, then forward via
+//next-archive links to the recent feed, delivering each new entry in order to a handler and
+//checkpointing progress as it goes.
+package client
+
+import (
+	"encoding/base64"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"golang.org/x/tools/blog/atom"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+var ErrCheckpointNotFound = errors.New("Checkpoint entry not found in feed")
+var ErrNilCheckpointStore = errors.New("Nil checkpoint store passed to factory method")
+var ErrNoDecrypter = errors.New("Feed entries are encrypted but no decrypter was provided")
+var ErrBadEncryptedKey = errors.New("Malformed encrypted key link")
+
+//Relation of the entry link carrying the encrypted data key for entry encryption
+const encryptedKeyRel = "encrypted-key"
+
+const encryptedKeyURIPrefix = "data:application/octet-stream;base64,"
+
+//TypeParam is the query parameter selecting the type filtered view of the feed
+const TypeParam = "type"
+
+//EntryHandler processes a feed entry. Returning an error stops processing, with the
+//checkpoint left at the last successfully handled entry.
+type EntryHandler func(entry *atom.Entry) error
+
+//FeedReader follows the feed published at a base URL
+type FeedReader struct {
+	//HTTPClient is used to retrieve feed pages. It defaults to http.DefaultClient.
+	HTTPClient *http.Client
+
+	//Verifier, if set, verifies the signature of each feed page before it is decrypted. Unsigned
+	//pages are rejected.
+	Verifier Verifier
+
+	recentURL   string
+	checkpoints CheckpointStore
+	decrypter   Decrypter
+}
+
+//NewFeedReader returns a reader for the feed served at baseURL, e.g. https://host:port.
+//Progress is recorded in the given checkpoint store. If the publisher encrypts its output,
+//a decrypter must be provided; otherwise it may be nil.
+func NewFeedReader(baseURL string, checkpoints CheckpointStore, decrypter Decrypter) (*FeedReader, error) {
+	if checkpoints == nil {
+		return nil, ErrNilCheckpointStore
+	}
+
+	return &FeedReader{
+		HTTPClient:  http.DefaultClient,
+		recentURL:   strings.TrimSuffix(baseURL, "/") + "/notifications/recent",
+		checkpoints: checkpoints,
+		decrypter:   decrypter,
+	}, nil
+}
+
+//FilterTypes limits the entries read to those with the given event type codes, using the type
+//filtered view of the feed, which skips archives with no matching entries. Calling it with no
+//type codes reads all entries. The checkpoint store should not be shared with readers filtering
+//on other types.
+func (fr *FeedReader) FilterTypes(typeCodes ...string) {
+	fr.recentURL = strings.SplitN(fr.recentURL, "?", 2)[0]
+	if len(typeCodes) > 0 {
+		fr.recentURL += "?" + url.Values{TypeParam: {strings.Join(typeCodes, ",")}}.Encode()
+	}
+}
+
+//getFeed retrieves, verifies and decrypts the feed page at the given URL
+func (fr *FeedReader) getFeed(url string) (*atom.Feed, error) {
+	resp, err := fr.HTTPClient.Get(url)
+	if err != nil {
+		return nil, err
+	}
+
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("Unexpected status %d retrieving %s", resp.StatusCode, url)
+	}
+
+	if fr.Verifier != nil {
+		err = fr.Verifier.Verify(body, resp.Header.Get(SignatureHeader))
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if fr.decrypter != nil {
+		body, err = fr.decrypter.Decrypt(body)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var feed atom.Feed
+	err = xml.Unmarshal(body, &feed)
+	if err != nil {
+		return nil, err
+	}
+
+	err = fr.decryptEntries(&feed)
+	if err != nil {
+		return nil, err
+	}
+
+	err = fr.resolvePayloads(body, &feed)
+	if err != nil {
+		return nil, err
+	}
+
+	return &feed, nil
+}
+
+//decryptEntries decrypts the content of entries served with entry encryption, replacing the
+//content with the base64 encoded plaintext and removing the encrypted key link, so handlers see
+//the same entries regardless of the encryption mode.
+func (fr *FeedReader) decryptEntries(feed *atom.Feed) error {
+	for _, entry := range feed.Entry {
+		var links []atom.Link
+		encryptedKey, keyID := "", ""
+
+		for _, l := range entry.Link {
+			if l.Rel == encryptedKeyRel {
+				encryptedKey, keyID = l.Href, l.Title
+			} else {
+				links = append(links, l)
+			}
+		}
+
+		if entry.Content == nil {
+			continue
+		}
+
+		//Envelope encrypted content has an encrypted key link, JWE content carries its own key
+		var encrypted []byte
+		switch {
+		case encryptedKey != "":
+			if !strings.HasPrefix(encryptedKey, encryptedKeyURIPrefix) {
+				return ErrBadEncryptedKey
+			}
+
+			encrypted = []byte(strings.TrimPrefix(encryptedKey, encryptedKeyURIPrefix) + "::" + entry.Content.Body)
+		case isJWE([]byte(entry.Content.Body)):
+			encrypted = []byte(entry.Content.Body)
+		default:
+			continue
+		}
+
+		if fr.decrypter == nil {
+			return ErrNoDecrypter
+		}
+
+		var plaintext []byte
+		var err error
+		if keyIDDecrypter, ok := fr.decrypter.(KeyIDDecrypter); ok && keyID != "" {
+			plaintext, err = keyIDDecrypter.DecryptWithKeyID(encrypted, keyID)
+		} else {
+			plaintext, err = fr.decrypter.Decrypt(encrypted)
+		}
+		if err != nil {
+			return err
+		}
+
+		entry.Content.Body = base64.StdEncoding.EncodeToString(plaintext)
+		entry.Link = links
+	}
+
+	return nil
+}
+
+//Link returns the href of the feed link with the given relation, or the empty string if the
+//feed has no such link.
+func Link(feed *atom.Feed, rel string) string {
+	for _, l := range feed.Link {
+		if l.Rel == rel {
+			return l.Href
+		}
+	}
+
+	return ""
+}
+
+//Payload decodes the base64 encoded event payload carried in an entry's content
+func Payload(entry *atom.Entry) ([]byte, error) {
+	if entry.Content == nil {
+		return nil, nil
+	}
+
+	return base64.StdEncoding.DecodeString(entry.Content.Body)
+}
+
+//indexOf returns the index of the entry with the given id in the feed, or -1
+func indexOf(feed *atom.Feed, entryID string) int {
+	for i, entry := range feed.Entry {
+		if entry.ID == entryID {
+			return i
+		}
+	}
+
+	return -1
+}
+
+//findCheckpoint walks back from the recent feed via prev-archive links until it finds the
+//page containing the checkpoint entry, returning the page and the index of the entry. An
+//empty checkpoint walks back to the first page, returning an index equal to the number of
+//entries on that page so all are processed.
+func (fr *FeedReader) findCheckpoint(checkpoint string) (*atom.Feed, int, error) {
+	feed, err := fr.getFeed(fr.recentURL)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	for {
+		if checkpoint != "" {
+			if i := indexOf(feed, checkpoint); i >= 0 {
+				return feed, i, nil
+			}
+		}
+
+		prev := Link(feed, "prev-archive")
+		if prev == "" {
+			break
+		}
+
+		feed, err = fr.getFeed(prev)
+		if err != nil {
+			return nil, 0, err
+		}
+	}
+
+	if checkpoint != "" {
+		return nil, 0, ErrCheckpointNotFound
+	}
+
+	return feed, len(feed.Entry), nil
+}
+
+//ProcessNew delivers the entries published since the last checkpoint to the handler, oldest
+//first, saving the checkpoint after each entry is handled. It returns once the entries in the
+//recent feed have been processed.
+func (fr *FeedReader) ProcessNew(handler EntryHandler) error {
+	checkpoint, err := fr.checkpoints.LoadCheckpoint()
+	if err != nil {
+		return err
+	}
+
+	feed, end, err := fr.findCheckpoint(checkpoint)
+	if err != nil {
+		return err
+	}
+
+	for {
+		//Entries are ordered newest first, so process those before the checkpoint in reverse
+		for i := end - 1; i >= 0; i-- {
+			entry := feed.Entry[i]
+			if err := handler(entry); err != nil {
+				return err
+			}
+
+			if err := fr.checkpoints.SaveCheckpoint(entry.ID); err != nil {
+				return err
+			}
+		}
+
+		if feed.ID == "recent" {
+			return nil
+		}
+
+		next := Link(feed, "next-archive")
+		if next == "" {
+			return nil
+		}
+
+		nextFeed, err := fr.getFeed(next)
+		if err != nil {
+			return err
+		}
+
+		//A page cached while it was the last archive has a next-archive link to recent, though
+		//further archives may have been created since. Walk back from recent to the current
+		//page to process any archives in between.
+		if nextFeed.ID == "recent" && Link(nextFeed, "prev-archive") != Link(feed, "self") {
+			between, err := fr.archivesBetween(feed, nextFeed)
+			if err != nil {
+				return err
+			}
+
+			if len(between) > 0 {
+				nextFeed = between[0]
+			}
+		}
+
+		feed = nextFeed
+		end = len(feed.Entry)
+	}
+}
+
+//archivesBetween walks back from the recent feed via prev-archive links to the given archive,
+//returning the archives in between oldest first. If the archive is not reached no archives are
+//returned, so entries are not processed twice.
+func (fr *FeedReader) archivesBetween(archive, recent *atom.Feed) ([]*atom.Feed, error) {
+	var between []*atom.Feed
+
+	for prev := Link(recent, "prev-archive"); prev != Link(archive, "self"); {
+		if prev == "" {
+			return nil, nil
+		}
+
+		page, err := fr.getFeed(prev)
+		if err != nil {
+			return nil, err
+		}
+
+		between = append([]*atom.Feed{page}, between...)
+		prev = Link(page, "prev-archive")
+	}
+
+	return between, nil
+}
@@ -0,0 +1,549 @@
+package client
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"github.com/aws/aws-sdk-go/service/kms"
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+	"github.com/xtracdev/es-atom-pub"
+	"github.com/xtracdev/es-atom-pub/internal/testevents"
+	"golang.org/x/tools/blog/atom"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+//newTestServer serves the feed handlers backed by the given store. A TLS server is used as
+//the handlers generate https links by default.
+func newTestServer(t *testing.T, store atompubsvc.FeedStore) *httptest.Server {
+	r := mux.NewRouter()
+	ts := httptest.NewUnstartedServer(r)
+
+	linkhostport := ts.Listener.Addr().String()
+
+	recentHandler, err := atompubsvc.NewRecentHandler(store, linkhostport)
+	assert.Nil(t, err)
+	archiveHandler, err := atompubsvc.NewArchiveHandler(store, linkhostport)
+	assert.Nil(t, err)
+	payloadHandler, err := atompubsvc.NewPayloadHandler(store)
+	assert.Nil(t, err)
+
+	r.HandleFunc(atompubsvc.RecentHandlerURI, recentHandler)
+	r.HandleFunc(atompubsvc.ArchiveHandlerURI, archiveHandler)
+	r.HandleFunc(atompubsvc.PayloadHandlerURI, payloadHandler)
+
+	ts.StartTLS()
+	return ts
+}
+
+func newTestReader(t *testing.T, ts *httptest.Server, checkpoints CheckpointStore) *FeedReader {
+	reader, err := NewFeedReader(ts.URL, checkpoints, nil)
+	assert.Nil(t, err)
+	reader.HTTPClient = ts.Client()
+	return reader
+}
+
+//collect returns a handler that records the payloads of the entries it is passed
+func collect(t *testing.T, payloads *[]string) EntryHandler {
+	return func(entry *atom.Entry) error {
+		payload, err := Payload(entry)
+		assert.Nil(t, err)
+		*payloads = append(*payloads, string(payload))
+		return nil
+	}
+}
+
+func TestNewFeedReaderNilCheckpointStore(t *testing.T) {
+	_, err := NewFeedReader("https://localhost:5000", nil, nil)
+	assert.Equal(t, ErrNilCheckpointStore, err)
+}
+
+func TestProcessNew(t *testing.T) {
+	store := atompubsvc.NewMemoryFeedStore(2)
+	testevents.Append(t, store, "foo", "a", "b", "c", "d", "e")
+
+	ts := newTestServer(t, store)
+	defer ts.Close()
+
+	checkpoints := &MemoryCheckpointStore{}
+	reader := newTestReader(t, ts, checkpoints)
+
+	var payloads []string
+	err := reader.ProcessNew(collect(t, &payloads))
+	if assert.Nil(t, err) {
+		assert.Equal(t, []string{"ok a", "ok b", "ok c", "ok d", "ok e"}, payloads)
+	}
+
+	checkpoint, _ := checkpoints.LoadCheckpoint()
+	assert.Equal(t, "urn:esid:e:1", checkpoint)
+
+	//Nothing new to process
+	payloads = nil
+	err = reader.ProcessNew(collect(t, &payloads))
+	assert.Nil(t, err)
+	assert.Empty(t, payloads)
+
+	//The checkpointed entry is archived along with the new events
+	testevents.Append(t, store, "foo", "f", "g", "h")
+
+	payloads = nil
+	err = reader.ProcessNew(collect(t, &payloads))
+	if assert.Nil(t, err) {
+		assert.Equal(t, []string{"ok f", "ok g", "ok h"}, payloads)
+	}
+
+	checkpoint, _ = checkpoints.LoadCheckpoint()
+	assert.Equal(t, "urn:esid:h:1", checkpoint)
+}
+
+func TestProcessNewFilterTypes(t *testing.T) {
+	store := atompubsvc.NewMemoryFeedStore(2)
+	testevents.Append(t, store, "foo", "a", "b", "c")
+
+	ts := newTestServer(t, store)
+	defer ts.Close()
+
+	checkpoints := &MemoryCheckpointStore{}
+	reader := newTestReader(t, ts, checkpoints)
+	reader.FilterTypes("bar", "baz")
+
+	testevents.Append(t, store, "bar", "d")
+	testevents.Append(t, store, "foo", "e", "f", "g")
+	testevents.Append(t, store, "baz", "h")
+
+	var payloads []string
+	err := reader.ProcessNew(collect(t, &payloads))
+	if assert.Nil(t, err) {
+		assert.Equal(t, []string{"ok d", "ok h"}, payloads)
+	}
+
+	testevents.Append(t, store, "foo", "i", "j")
+	testevents.Append(t, store, "bar", "k")
+
+	payloads = nil
+	err = reader.ProcessNew(collect(t, &payloads))
+	if assert.Nil(t, err) {
+		assert.Equal(t, []string{"ok k"}, payloads)
+	}
+
+	checkpoint, _ := checkpoints.LoadCheckpoint()
+	assert.Equal(t, "urn:esid:k:1", checkpoint)
+
+	//Clearing the filter reads all entries
+	reader.FilterTypes()
+	assert.Nil(t, checkpoints.SaveCheckpoint(""))
+
+	payloads = nil
+	err = reader.ProcessNew(collect(t, &payloads))
+	if assert.Nil(t, err) {
+		assert.Equal(t, 11, len(payloads))
+	}
+}
+
+func TestProcessNewPayloadTypes(t *testing.T) {
+	atompubsvc.SetPayloadTypes(map[string]string{
+		"xml":  "application/xml",
+		"text": "text/plain",
+		"json": "application/json",
+	})
+	defer atompubsvc.SetPayloadTypes(nil)
+
+	store := atompubsvc.NewMemoryFeedStore(2)
+	expected := []struct{ typeCode, payload string }{
+		{"xml", `<order xmlns="urn:orders" id="1">a &amp; b</order>`},
+		{"text", "a < b"},
+		{"json", `{"amount":10}`},
+		{"xml", "<order>"},
+		{"text", "a \x01 b"},
+		{"foo", "ok a"},
+	}
+
+	for i, event := range expected {
+		testevents.AppendPayload(t, store, fmt.Sprintf("agg%d", i), event.typeCode, event.payload)
+	}
+
+	ts := newTestServer(t, store)
+	defer ts.Close()
+
+	reader := newTestReader(t, ts, &MemoryCheckpointStore{})
+
+	//Handlers see the type code and payload whether the payload is inline, referred to or base64
+	//encoded
+	var i int
+	err := reader.ProcessNew(func(entry *atom.Entry) error {
+		payload, err := Payload(entry)
+		assert.Nil(t, err)
+		if assert.True(t, i < len(expected)) {
+			assert.Equal(t, expected[i].typeCode, entry.Content.Type)
+			assert.Equal(t, expected[i].payload, string(payload))
+		}
+
+		i++
+		return nil
+	})
+
+	assert.Nil(t, err)
+	assert.Equal(t, len(expected), i)
+}
+
+func TestResolvePayloadsEntryWithoutContent(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		assert.Equal(t, "/events/agg2/1/payload", req.URL.Path)
+		rw.Write([]byte(`{"amount":10}`))
+	}))
+	defer ts.Close()
+
+	body := []byte(`<feed xmlns="http://www.w3.org/2005/Atom">
+<entry><id>urn:esid:agg1:1</id></entry>
+<entry><id>urn:esid:agg2:1</id>
+<category scheme="urn:esid:typecode" term="json"></category>
+<content type="application/json" src="` + ts.URL + `/events/agg2/1/payload"></content>
+</entry>
+</feed>`)
+
+	var feed atom.Feed
+	assert.Nil(t, xml.Unmarshal(body, &feed))
+
+	//Entries after one with no content still have their payloads resolved
+	reader := newTestReader(t, ts, &MemoryCheckpointStore{})
+	assert.Nil(t, reader.resolvePayloads(body, &feed))
+	assert.Nil(t, feed.Entry[0].Content)
+	if assert.NotNil(t, feed.Entry[1].Content) {
+		assert.Equal(t, "json", feed.Entry[1].Content.Type)
+		assert.Equal(t, b64([]byte(`{"amount":10}`)), feed.Entry[1].Content.Body)
+	}
+}
+
+func TestProcessNewEmptyFeed(t *testing.T) {
+	ts := newTestServer(t, atompubsvc.NewMemoryFeedStore(2))
+	defer ts.Close()
+
+	reader := newTestReader(t, ts, &MemoryCheckpointStore{})
+
+	var payloads []string
+	err := reader.ProcessNew(collect(t, &payloads))
+	assert.Nil(t, err)
+	assert.Empty(t, payloads)
+}
+
+func TestProcessNewCheckpointNotFound(t *testing.T) {
+	store := atompubsvc.NewMemoryFeedStore(2)
+	testevents.Append(t, store, "foo", "a", "b", "c")
+
+	ts := newTestServer(t, store)
+	defer ts.Close()
+
+	checkpoints := &MemoryCheckpointStore{}
+	checkpoints.SaveCheckpoint("urn:esid:nope:1")
+	reader := newTestReader(t, ts, checkpoints)
+
+	err := reader.ProcessNew(func(entry *atom.Entry) error {
+		t.Fail()
+		return nil
+	})
+	assert.Equal(t, ErrCheckpointNotFound, err)
+}
+
+func TestProcessNewHandlerError(t *testing.T) {
+	store := atompubsvc.NewMemoryFeedStore(2)
+	testevents.Append(t, store, "foo", "a", "b", "c")
+
+	ts := newTestServer(t, store)
+	defer ts.Close()
+
+	checkpoints := &MemoryCheckpointStore{}
+	reader := newTestReader(t, ts, checkpoints)
+
+	handlerErr := errors.New("boom")
+	err := reader.ProcessNew(func(entry *atom.Entry) error {
+		if entry.ID == "urn:esid:b:1" {
+			return handlerErr
+		}
+		return nil
+	})
+	assert.Equal(t, handlerErr, err)
+
+	checkpoint, _ := checkpoints.LoadCheckpoint()
+	assert.Equal(t, "urn:esid:a:1", checkpoint)
+
+	//Processing resumes with the failed entry
+	var payloads []string
+	err = reader.ProcessNew(collect(t, &payloads))
+	if assert.Nil(t, err) {
+		assert.Equal(t, []string{"ok b", "ok c"}, payloads)
+	}
+}
+
+func TestProcessNewErrorStatus(t *testing.T) {
+	ts := httptest.NewServer(http.NotFoundHandler())
+	defer ts.Close()
+
+	reader, err := NewFeedReader(ts.URL, &MemoryCheckpointStore{}, nil)
+	assert.Nil(t, err)
+
+	err = reader.ProcessNew(func(entry *atom.Entry) error { return nil })
+	assert.NotNil(t, err)
+}
+
+func b64(b []byte) string {
+	return base64.StdEncoding.EncodeToString(b)
+}
+
+type fakeKMS struct {
+	key []byte
+}
+
+func (fk *fakeKMS) Decrypt(input *kms.DecryptInput) (*kms.DecryptOutput, error) {
+	if string(input.CiphertextBlob) != "encrypted key" {
+		return nil, errors.New("unknown key")
+	}
+
+	return &kms.DecryptOutput{Plaintext: fk.key}, nil
+}
+
+func TestKMSDecrypter(t *testing.T) {
+	key := [32]byte{}
+	copy(key[:], "0123456789abcdef0123456789abcdef")
+
+	encrypted, err := atompubsvc.Encrypt([]byte("<feed></feed>"), &key)
+	assert.Nil(t, err)
+
+	body := fmt.Sprintf("%s::%s",
+		base64.StdEncoding.EncodeToString([]byte("encrypted key")),
+		base64.StdEncoding.EncodeToString(encrypted))
+
+	decrypter := NewKMSDecrypter(&fakeKMS{key: key[:]})
+
+	decrypted, err := decrypter.Decrypt([]byte(body))
+	if assert.Nil(t, err) {
+		assert.Equal(t, "<feed></feed>", string(decrypted))
+	}
+
+	//Bodies that are not enveloped are passed through
+	decrypted, err = decrypter.Decrypt([]byte("<feed></feed>"))
+	if assert.Nil(t, err) {
+		assert.Equal(t, "<feed></feed>", string(decrypted))
+	}
+
+	_, err = NewKMSDecrypter(&fakeKMS{key: []byte("short")}).Decrypt([]byte(body))
+	assert.Equal(t, ErrMalformedCiphertext, err)
+}
+
+func TestFileCheckpointStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "checkpoint")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	store := NewFileCheckpointStore(filepath.Join(dir, "checkpoint"))
+
+	checkpoint, err := store.LoadCheckpoint()
+	assert.Nil(t, err)
+	assert.Equal(t, "", checkpoint)
+
+	assert.Nil(t, store.SaveCheckpoint("urn:esid:a:1"))
+	assert.Nil(t, store.SaveCheckpoint("urn:esid:b:1"))
+
+	reopened := NewFileCheckpointStore(filepath.Join(dir, "checkpoint"))
+
+	checkpoint, err = reopened.LoadCheckpoint()
+	assert.Nil(t, err)
+	assert.Equal(t, "urn:esid:b:1", checkpoint)
+}
+
+func TestProcessNewStaticKeyEncryption(t *testing.T) {
+	masterKey := [32]byte{}
+	copy(masterKey[:], "0123456789abcdef0123456789abcdef")
+
+	atompubsvc.SetKeyProvider(atompubsvc.NewStaticKeyProvider("", &masterKey))
+	defer atompubsvc.SetKeyProvider(nil)
+
+	store := atompubsvc.NewMemoryFeedStore(2)
+	testevents.Append(t, store, "foo", "a", "b", "c")
+
+	ts := newTestServer(t, store)
+	defer ts.Close()
+
+	reader, err := NewFeedReader(ts.URL, &MemoryCheckpointStore{}, NewStaticKeyDecrypter(&masterKey))
+	assert.Nil(t, err)
+	reader.HTTPClient = ts.Client()
+
+	var payloads []string
+	err = reader.ProcessNew(collect(t, &payloads))
+	if assert.Nil(t, err) {
+		assert.Equal(t, []string{"ok a", "ok b", "ok c"}, payloads)
+	}
+}
+
+func TestProcessNewEntryEncryption(t *testing.T) {
+	masterKey := [32]byte{}
+	copy(masterKey[:], "0123456789abcdef0123456789abcdef")
+
+	atompubsvc.SetKeyProvider(atompubsvc.NewStaticKeyProvider("", &masterKey))
+	atompubsvc.SetEncryptionMode(atompubsvc.EntryEncryption)
+	defer atompubsvc.SetKeyProvider(nil)
+	defer atompubsvc.SetEncryptionMode(atompubsvc.DocumentEncryption)
+
+	store := atompubsvc.NewMemoryFeedStore(2)
+	testevents.Append(t, store, "foo", "a", "b", "c")
+
+	ts := newTestServer(t, store)
+	defer ts.Close()
+
+	//Without a decrypter the feed can be navigated but the content not read
+	err := newTestReader(t, ts, &MemoryCheckpointStore{}).ProcessNew(func(entry *atom.Entry) error {
+		return nil
+	})
+	assert.Equal(t, ErrNoDecrypter, err)
+
+	reader, err := NewFeedReader(ts.URL, &MemoryCheckpointStore{}, NewStaticKeyDecrypter(&masterKey))
+	assert.Nil(t, err)
+	reader.HTTPClient = ts.Client()
+
+	var payloads []string
+	err = reader.ProcessNew(func(entry *atom.Entry) error {
+		for _, l := range entry.Link {
+			assert.NotEqual(t, "encrypted-key", l.Rel)
+		}
+		return collect(t, &payloads)(entry)
+	})
+	if assert.Nil(t, err) {
+		assert.Equal(t, []string{"ok a", "ok b", "ok c"}, payloads)
+	}
+}
+
+func TestProcessNewJWE(t *testing.T) {
+	masterKey := [32]byte{}
+	copy(masterKey[:], "0123456789abcdef0123456789abcdef")
+
+	atompubsvc.SetKeyProvider(atompubsvc.NewStaticKeyProvider("", &masterKey))
+	atompubsvc.SetEncryptionFormat(atompubsvc.JWEFormat)
+	defer atompubsvc.SetKeyProvider(nil)
+	defer atompubsvc.SetEncryptionFormat(atompubsvc.EnvelopeFormat)
+
+	store := atompubsvc.NewMemoryFeedStore(2)
+	testevents.Append(t, store, "foo", "a", "b", "c")
+
+	ts := newTestServer(t, store)
+	defer ts.Close()
+
+	for _, mode := range []string{atompubsvc.DocumentEncryption, atompubsvc.EntryEncryption} {
+		atompubsvc.SetEncryptionMode(mode)
+
+		reader, err := NewFeedReader(ts.URL, &MemoryCheckpointStore{}, NewStaticKeyDecrypter(&masterKey))
+		assert.Nil(t, err)
+		reader.HTTPClient = ts.Client()
+
+		var payloads []string
+		err = reader.ProcessNew(collect(t, &payloads))
+		if assert.Nil(t, err, mode) {
+			assert.Equal(t, []string{"ok a", "ok b", "ok c"}, payloads, mode)
+		}
+	}
+
+	atompubsvc.SetEncryptionMode(atompubsvc.DocumentEncryption)
+}
+
+func TestAESKeyUnwrap(t *testing.T) {
+	//Test vector from RFC 3394 section 4.6, unwrapping 256 bits of key data with a 256 bit key
+	kek, _ := hex.DecodeString("000102030405060708090A0B0C0D0E0F101112131415161718191A1B1C1D1E1F")
+	wrapped, _ := hex.DecodeString("28C9F404C4B810F4CBCCB35CFB87F8263F5786E2D80ED326CBC7F0E71A99F43BFB988B9B7A02DD21")
+
+	key, err := aesKeyUnwrap(kek, wrapped)
+	assert.Nil(t, err)
+	assert.Equal(t, "00112233445566778899aabbccddeeff000102030405060708090a0b0c0d0e0f", hex.EncodeToString(key))
+
+	//Keys wrapped with another key fail the integrity check
+	_, err = aesKeyUnwrap(make([]byte, 32), wrapped)
+	assert.Equal(t, ErrMalformedCiphertext, err)
+
+	_, err = aesKeyUnwrap(kek, wrapped[:16])
+	assert.Equal(t, ErrMalformedCiphertext, err)
+}
+
+func TestDecryptUnsupportedJWE(t *testing.T) {
+	header := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"RSA-OAEP","enc":"A256GCM"}`))
+	jwe := header + ".a2V5.aXY.Y2lwaGVy.dGFn"
+
+	_, err := NewStaticKeyDecrypter(&[32]byte{}).Decrypt([]byte(jwe))
+	assert.Equal(t, ErrUnsupportedJWE, err)
+}
+
+func TestProcessNewVerifiesSignatures(t *testing.T) {
+	privateKey := ed25519.NewKeyFromSeed([]byte("0123456789abcdef0123456789abcdef"))
+	signer, err := atompubsvc.NewEd25519Signer("key-1", privateKey)
+	assert.Nil(t, err)
+
+	atompubsvc.SetSigner(signer)
+	defer atompubsvc.SetSigner(nil)
+
+	store := atompubsvc.NewMemoryFeedStore(2)
+	testevents.Append(t, store, "foo", "a", "b", "c")
+
+	ts := newTestServer(t, store)
+	defer ts.Close()
+
+	verifier := NewSignatureVerifier()
+
+	reader := newTestReader(t, ts, &MemoryCheckpointStore{})
+	reader.Verifier = verifier
+
+	var payloads []string
+	err = reader.ProcessNew(collect(t, &payloads))
+	assert.Equal(t, ErrUnknownSigningKey, err)
+
+	verifier.AddEd25519Key("key-1", privateKey.Public().(ed25519.PublicKey))
+	err = reader.ProcessNew(collect(t, &payloads))
+	if assert.Nil(t, err) {
+		assert.Equal(t, []string{"ok a", "ok b", "ok c"}, payloads)
+	}
+
+	//Unsigned responses are rejected
+	atompubsvc.SetSigner(nil)
+	err = newTestReaderWithVerifier(t, ts, verifier).ProcessNew(collect(t, &payloads))
+	assert.Equal(t, ErrMissingSignature, err)
+}
+
+func newTestReaderWithVerifier(t *testing.T, ts *httptest.Server, verifier Verifier) *FeedReader {
+	reader := newTestReader(t, ts, &MemoryCheckpointStore{})
+	reader.Verifier = verifier
+	return reader
+}
+
+func TestSignatureVerifier(t *testing.T) {
+	body := []byte("body")
+
+	hmacSigner, _ := atompubsvc.NewHMACSigner("shared", []byte("secret"))
+	hmacSignature, _ := hmacSigner.Sign(body)
+
+	verifier := NewSignatureVerifier()
+	verifier.AddHMACKey("shared", []byte("secret"))
+
+	var verifyTests = []struct {
+		testName string
+		header   string
+		body     []byte
+		err      error
+	}{
+		{"valid", atompubsvc.FormatSignature("shared", "hmac-sha256", hmacSignature), body, nil},
+		{"tampered body", atompubsvc.FormatSignature("shared", "hmac-sha256", hmacSignature), []byte("bogus"), ErrBadSignature},
+		{"unknown key", atompubsvc.FormatSignature("other", "hmac-sha256", hmacSignature), body, ErrUnknownSigningKey},
+		{"wrong algorithm", atompubsvc.FormatSignature("shared", "ed25519", hmacSignature), body, ErrUnknownSigningKey},
+		{"missing", "", body, ErrMissingSignature},
+		{"malformed", "nonsense", body, ErrBadSignatureHeader},
+		{"missing signature", `keyId="shared",algorithm="hmac-sha256"`, body, ErrBadSignatureHeader},
+	}
+
+	for _, test := range verifyTests {
+		t.Run(test.testName, func(t *testing.T) {
+			assert.Equal(t, test.err, verifier.Verify(test.body, test.header))
+		})
+	}
+}
@@ -0,0 +1,154 @@
+package client
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/base64"
+	"errors"
+	"github.com/aws/aws-sdk-go/service/kms"
+)
+
+var ErrMalformedCiphertext = errors.New("malformed ciphertext")
+
+//Decrypter decrypts response bodies encrypted by the publisher
+type Decrypter interface {
+	Decrypt(body []byte) ([]byte, error)
+}
+
+//keyDecrypter recovers a data key given the JWE algorithm it was encrypted with: dir for data
+//keys encrypted by the publisher's key provider, as also carried in the envelope format, or
+//A256KW for data keys wrapped with a master key.
+type keyDecrypter func(alg string, encryptedKey []byte) ([]byte, error)
+
+//kmsKeyDecrypter returns a key decrypter decrypting data keys using the KMS
+func kmsKeyDecrypter(svc KMSDecryptAPI) keyDecrypter {
+	return func(alg string, encryptedKey []byte) ([]byte, error) {
+		if alg != jweDirect {
+			return nil, ErrUnsupportedJWE
+		}
+
+		decryptedKey, err := svc.Decrypt(&kms.DecryptInput{
+			CiphertextBlob: encryptedKey,
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		return decryptedKey.Plaintext, nil
+	}
+}
+
+//staticKeyDecrypter returns a key decrypter decrypting or unwrapping data keys with a master key
+func staticKeyDecrypter(masterKey *[32]byte) keyDecrypter {
+	return func(alg string, encryptedKey []byte) ([]byte, error) {
+		if alg == jweKeyWrap {
+			return aesKeyUnwrap(masterKey[:], encryptedKey)
+		}
+
+		return Decrypt(encryptedKey, masterKey)
+	}
+}
+
+//KMSDecryptAPI is the subset of the KMS client used to decrypt data keys
+type KMSDecryptAPI interface {
+	Decrypt(input *kms.DecryptInput) (*kms.DecryptOutput, error)
+}
+
+//KMSDecrypter decrypts response bodies encrypted with a KMS data key, which are of the
+//form base64(encrypted key)::base64(nonce + ciphertext).
+type KMSDecrypter struct {
+	svc KMSDecryptAPI
+}
+
+//NewKMSDecrypter returns a decrypter that decrypts data keys using the given KMS client
+func NewKMSDecrypter(svc KMSDecryptAPI) *KMSDecrypter {
+	return &KMSDecrypter{svc: svc}
+}
+
+//Decrypt decrypts an enveloped or JWE response body. Bodies that are not encrypted, such as
+//those served by a publisher without a KEY_ALIAS, are returned as is.
+func (kd *KMSDecrypter) Decrypt(body []byte) ([]byte, error) {
+	return decryptEnvelope(body, kmsKeyDecrypter(kd.svc))
+}
+
+//StaticKeyDecrypter decrypts response bodies from a publisher configured with a KEY_FILE,
+//whose data keys are encrypted with the master key held in the file.
+type StaticKeyDecrypter struct {
+	masterKey [32]byte
+}
+
+//NewStaticKeyDecrypter returns a decrypter that decrypts data keys with the given master key
+func NewStaticKeyDecrypter(masterKey *[32]byte) *StaticKeyDecrypter {
+	return &StaticKeyDecrypter{masterKey: *masterKey}
+}
+
+//Decrypt decrypts an enveloped or JWE response body. Bodies that are not encrypted are returned
+//as is.
+func (sd *StaticKeyDecrypter) Decrypt(body []byte) ([]byte, error) {
+	return decryptEnvelope(body, staticKeyDecrypter(&sd.masterKey))
+}
+
+//decryptEnvelope decrypts a body of the form base64(encrypted key)::base64(nonce + ciphertext),
+//or in JWE compact serialization, using decryptKey to recover the data key.
+func decryptEnvelope(body []byte, decryptKey keyDecrypter) ([]byte, error) {
+	if isJWE(body) {
+		return decryptJWE(body, decryptKey)
+	}
+
+	parts := bytes.Split(body, []byte("::"))
+	if len(parts) != 2 {
+		return body, nil
+	}
+
+	keyBytes, err := base64.StdEncoding.DecodeString(string(parts[0]))
+	if err != nil {
+		return nil, err
+	}
+
+	msgBytes, err := base64.StdEncoding.DecodeString(string(parts[1]))
+	if err != nil {
+		return nil, err
+	}
+
+	plaintextKey, err := decryptKey(jweDirect, keyBytes)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(plaintextKey) < 32 {
+		return nil, ErrMalformedCiphertext
+	}
+
+	key := [32]byte{}
+	copy(key[:], plaintextKey[0:32])
+	defer func() {
+		key = [32]byte{}
+	}()
+
+	return Decrypt(msgBytes, &key)
+}
+
+//Decrypt from cryptopasta commit bc3a108a5776376aa811eea34b93383837994340
+//used via the CC0 license. See https://github.com/gtank/cryptopasta
+func Decrypt(ciphertext []byte, key *[32]byte) (plaintext []byte, err error) {
+	block, err := aes.NewCipher(key[:])
+	if err != nil {
+		return nil, err
+	}
+
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(ciphertext) < gcm.NonceSize() {
+		return nil, ErrMalformedCiphertext
+	}
+
+	return gcm.Open(nil,
+		ciphertext[:gcm.NonceSize()],
+		ciphertext[gcm.NonceSize():],
+		nil,
+	)
+}
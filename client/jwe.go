@@ -0,0 +1,187 @@
+package client
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"strings"
+)
+
+var ErrUnsupportedJWE = errors.New("Unsupported JWE algorithm or encryption")
+
+//JWE algorithms used by the publisher
+const (
+	jweKeyWrap  = "A256KW"
+	jweDirect   = "dir"
+	jweEncGCM   = "A256GCM"
+	keyWrapIV   = 0xa6a6a6a6a6a6a6a6
+	keyWrapSize = 8
+)
+
+//jweHeader is the protected header of JWE produced by the publisher
+type jweHeader struct {
+	Algorithm  string `json:"alg"`
+	Encryption string `json:"enc"`
+	KeyID      string `json:"kid"`
+}
+
+//masterKeyID returns the id of the master key the content encryption key was encrypted with.
+//With the dir algorithm the kid is the master key id followed by a colon and the base64url
+//encoded encrypted data key.
+func (h *jweHeader) masterKeyID() string {
+	if h.Algorithm == jweDirect {
+		if i := strings.LastIndex(h.KeyID, ":"); i >= 0 {
+			return h.KeyID[:i]
+		}
+	}
+
+	return h.KeyID
+}
+
+//directKey returns the encrypted data key carried in the kid with the dir algorithm
+func (h *jweHeader) directKey() ([]byte, error) {
+	i := strings.LastIndex(h.KeyID, ":")
+	if i < 0 {
+		return nil, ErrMalformedCiphertext
+	}
+
+	return base64.RawURLEncoding.DecodeString(h.KeyID[i+1:])
+}
+
+//parseJWE splits JWE compact serialization into its parts, returning false if the body is not
+//JWE compact serialization.
+func parseJWE(body []byte) (*jweHeader, [][]byte, bool) {
+	parts := bytes.Split(bytes.TrimSpace(body), []byte("."))
+	if len(parts) != 5 {
+		return nil, nil, false
+	}
+
+	headerBytes, err := base64.RawURLEncoding.DecodeString(string(parts[0]))
+	if err != nil {
+		return nil, nil, false
+	}
+
+	var header jweHeader
+	if err := json.Unmarshal(headerBytes, &header); err != nil || header.Encryption == "" {
+		return nil, nil, false
+	}
+
+	return &header, parts, true
+}
+
+//isJWE returns true if the body is JWE compact serialization
+func isJWE(body []byte) bool {
+	_, _, ok := parseJWE(body)
+	return ok
+}
+
+//decryptJWE decrypts JWE compact serialization using A256GCM encryption. With the A256KW
+//algorithm the content encryption key is unwrapped from the JWE encrypted key, and with the dir
+//algorithm it is decrypted from the data key carried in the kid.
+func decryptJWE(body []byte, decryptKey keyDecrypter) ([]byte, error) {
+	header, parts, ok := parseJWE(body)
+	if !ok {
+		return nil, ErrMalformedCiphertext
+	}
+
+	if header.Encryption != jweEncGCM || (header.Algorithm != jweKeyWrap && header.Algorithm != jweDirect) {
+		return nil, ErrUnsupportedJWE
+	}
+
+	var decoded [][]byte
+	for _, part := range parts[1:] {
+		d, err := base64.RawURLEncoding.DecodeString(string(part))
+		if err != nil {
+			return nil, err
+		}
+		decoded = append(decoded, d)
+	}
+
+	encryptedKey, iv, ciphertext, tag := decoded[0], decoded[1], decoded[2], decoded[3]
+
+	if header.Algorithm == jweDirect {
+		var err error
+		encryptedKey, err = header.directKey()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	plaintextKey, err := decryptKey(header.Algorithm, encryptedKey)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(plaintextKey) < 32 {
+		return nil, ErrMalformedCiphertext
+	}
+
+	key := [32]byte{}
+	copy(key[:], plaintextKey[0:32])
+	defer func() {
+		key = [32]byte{}
+	}()
+
+	block, err := aes.NewCipher(key[:])
+	if err != nil {
+		return nil, err
+	}
+
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(iv) != gcm.NonceSize() {
+		return nil, ErrMalformedCiphertext
+	}
+
+	return gcm.Open(nil, iv, append(ciphertext, tag...), parts[0])
+}
+
+//aesKeyUnwrap unwraps a key wrapped with the AES key wrap algorithm of RFC 3394, as used by the
+//JWE A256KW algorithm.
+func aesKeyUnwrap(kek, wrapped []byte) ([]byte, error) {
+	if len(wrapped) < 3*keyWrapSize || len(wrapped)%keyWrapSize != 0 {
+		return nil, ErrMalformedCiphertext
+	}
+
+	block, err := aes.NewCipher(kek)
+	if err != nil {
+		return nil, err
+	}
+
+	n := len(wrapped)/keyWrapSize - 1
+	key := make([]byte, len(wrapped)-keyWrapSize)
+	copy(key, wrapped[keyWrapSize:])
+
+	a := make([]byte, keyWrapSize)
+	copy(a, wrapped[:keyWrapSize])
+	b := make([]byte, 2*keyWrapSize)
+
+	for j := 5; j >= 0; j-- {
+		for i := n; i >= 1; i-- {
+			t := binary.BigEndian.Uint64(a) ^ uint64(n*j+i)
+			binary.BigEndian.PutUint64(b, t)
+			copy(b[keyWrapSize:], key[(i-1)*keyWrapSize:i*keyWrapSize])
+			block.Decrypt(b, b)
+
+			copy(a, b[:keyWrapSize])
+			copy(key[(i-1)*keyWrapSize:], b[keyWrapSize:])
+		}
+	}
+
+	//The integrity check register must be restored to the default initial value
+	iv := make([]byte, keyWrapSize)
+	binary.BigEndian.PutUint64(iv, keyWrapIV)
+	if subtle.ConstantTimeCompare(a, iv) != 1 {
+		return nil, ErrMalformedCiphertext
+	}
+
+	return key, nil
+}
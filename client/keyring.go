@@ -0,0 +1,120 @@
+package client
+
+import (
+	"bytes"
+	"errors"
+	"sort"
+	"sync"
+)
+
+var ErrUnknownKeyID = errors.New("No key with the given key id in the keyring")
+var ErrNoMatchingKey = errors.New("No key in the keyring decrypts the message")
+
+//KeyIDDecrypter is implemented by decrypters that select the key to use based on the id of the
+//master key the data key was encrypted with, as carried in entry metadata.
+type KeyIDDecrypter interface {
+	DecryptWithKeyID(body []byte, keyID string) ([]byte, error)
+}
+
+//Keyring decrypts responses encrypted with any of several master keys, identified by key id.
+//This allows consumers to keep reading cached archive pages encrypted with a previous key
+//after the publisher switches to a new key. Where the key id is known, from the JWE kid header
+//or entry metadata, the matching key is used; otherwise each key is tried in turn.
+type Keyring struct {
+	sync.RWMutex
+	keys map[string]keyDecrypter
+}
+
+//NewKeyring returns an empty keyring
+func NewKeyring() *Keyring {
+	return &Keyring{keys: make(map[string]keyDecrypter)}
+}
+
+//AddKMSKey adds a KMS CMK to the keyring. The key id is the KEY_ALIAS used by the publisher,
+//e.g. alias/my-key. As KMS identifies the CMK from the encrypted data key, the same client may
+//be added under several key ids.
+func (kr *Keyring) AddKMSKey(keyID string, svc KMSDecryptAPI) {
+	kr.addKey(keyID, kmsKeyDecrypter(svc))
+}
+
+//AddStaticKey adds a master key to the keyring. The key id is the KEY_ID used by the publisher,
+//or if none was configured, the id derived from the key.
+func (kr *Keyring) AddStaticKey(keyID string, masterKey *[32]byte) {
+	key := *masterKey
+	kr.addKey(keyID, staticKeyDecrypter(&key))
+}
+
+func (kr *Keyring) addKey(keyID string, decryptKey keyDecrypter) {
+	kr.Lock()
+	defer kr.Unlock()
+	kr.keys[keyID] = decryptKey
+}
+
+//RemoveKey removes a key from the keyring, for example once a retired key is no longer needed
+//to read cached pages.
+func (kr *Keyring) RemoveKey(keyID string) {
+	kr.Lock()
+	defer kr.Unlock()
+	delete(kr.keys, keyID)
+}
+
+//KeyIDs returns the ids of the keys in the keyring, sorted
+func (kr *Keyring) KeyIDs() []string {
+	kr.RLock()
+	defer kr.RUnlock()
+
+	var keyIDs []string
+	for keyID := range kr.keys {
+		keyIDs = append(keyIDs, keyID)
+	}
+
+	sort.Strings(keyIDs)
+	return keyIDs
+}
+
+//Decrypt decrypts an enveloped or JWE response body. Bodies that are not encrypted are
+//returned as is.
+func (kr *Keyring) Decrypt(body []byte) ([]byte, error) {
+	return kr.DecryptWithKeyID(body, "")
+}
+
+//DecryptWithKeyID decrypts a body using the key with the given id. If the id is empty the id
+//in the JWE kid header is used, and failing that each key is tried in turn.
+func (kr *Keyring) DecryptWithKeyID(body []byte, keyID string) ([]byte, error) {
+	header, _, jwe := parseJWE(body)
+	if !jwe && len(bytes.Split(body, []byte("::"))) != 2 {
+		return body, nil
+	}
+
+	if keyID == "" && jwe {
+		keyID = header.masterKeyID()
+	}
+
+	if keyID != "" {
+		kr.RLock()
+		decryptKey, ok := kr.keys[keyID]
+		kr.RUnlock()
+
+		if !ok {
+			return nil, ErrUnknownKeyID
+		}
+
+		return decryptEnvelope(body, decryptKey)
+	}
+
+	for _, id := range kr.KeyIDs() {
+		kr.RLock()
+		decryptKey, ok := kr.keys[id]
+		kr.RUnlock()
+
+		if !ok {
+			continue
+		}
+
+		if plaintext, err := decryptEnvelope(body, decryptKey); err == nil {
+			return plaintext, nil
+		}
+	}
+
+	return nil, ErrNoMatchingKey
+}
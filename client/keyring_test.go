@@ -0,0 +1,206 @@
+package client
+
+import (
+	"bytes"
+	"github.com/stretchr/testify/assert"
+	"github.com/xtracdev/es-atom-pub"
+	"github.com/xtracdev/es-atom-pub/internal/testevents"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+)
+
+//cachingTransport caches archive page responses, as a proxy honouring their 30 day max-age
+//would, so pages encrypted before a key rotation are served after it.
+type cachingTransport struct {
+	sync.Mutex
+	transport http.RoundTripper
+	cache     map[string][]byte
+}
+
+func (ct *cachingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	url := req.URL.String()
+	cacheable := !strings.HasSuffix(url, "/recent")
+
+	ct.Lock()
+	cached, ok := ct.cache[url]
+	ct.Unlock()
+
+	if cacheable && ok {
+		return &http.Response{
+			StatusCode: http.StatusOK,
+			Body:       ioutil.NopCloser(bytes.NewReader(cached)),
+			Header:     make(http.Header),
+			Request:    req,
+		}, nil
+	}
+
+	resp, err := ct.transport.RoundTrip(req)
+	if err != nil || !cacheable || resp.StatusCode != http.StatusOK {
+		return resp, err
+	}
+
+	body, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	ct.Lock()
+	ct.cache[url] = body
+	ct.Unlock()
+
+	resp.Body = ioutil.NopCloser(bytes.NewReader(body))
+	return resp, nil
+}
+
+func TestKeyringRotation(t *testing.T) {
+	oldKey, newKey := [32]byte{}, [32]byte{}
+	copy(oldKey[:], "0123456789abcdef0123456789abcdef")
+	copy(newKey[:], "fedcba9876543210fedcba9876543210")
+
+	var rotationTests = []struct {
+		testName string
+		mode     string
+		format   string
+	}{
+		{"document envelope", atompubsvc.DocumentEncryption, atompubsvc.EnvelopeFormat},
+		{"entry envelope", atompubsvc.EntryEncryption, atompubsvc.EnvelopeFormat},
+		{"document jwe", atompubsvc.DocumentEncryption, atompubsvc.JWEFormat},
+		{"entry jwe", atompubsvc.EntryEncryption, atompubsvc.JWEFormat},
+	}
+
+	defer atompubsvc.SetKeyProvider(nil)
+	defer atompubsvc.SetEncryptionMode(atompubsvc.DocumentEncryption)
+	defer atompubsvc.SetEncryptionFormat(atompubsvc.EnvelopeFormat)
+
+	for _, test := range rotationTests {
+		t.Run(test.testName, func(t *testing.T) {
+			atompubsvc.SetEncryptionMode(test.mode)
+			atompubsvc.SetEncryptionFormat(test.format)
+			atompubsvc.SetKeyProvider(atompubsvc.NewStaticKeyProvider("old", &oldKey))
+
+			store := atompubsvc.NewMemoryFeedStore(2)
+			testevents.Append(t, store, "foo", "a", "b", "c")
+
+			ts := newTestServer(t, store)
+			defer ts.Close()
+
+			transport := &cachingTransport{transport: ts.Client().Transport, cache: make(map[string][]byte)}
+
+			keyring := NewKeyring()
+			keyring.AddStaticKey("old", &oldKey)
+			keyring.AddStaticKey("new", &newKey)
+
+			newReader := func() *FeedReader {
+				reader, err := NewFeedReader(ts.URL, &MemoryCheckpointStore{}, keyring)
+				assert.Nil(t, err)
+				reader.HTTPClient = &http.Client{Transport: transport}
+				return reader
+			}
+
+			//Populate the cache with the archive encrypted with the old key
+			var payloads []string
+			assert.Nil(t, newReader().ProcessNew(collect(t, &payloads)))
+
+			//Rotate, then read from the start via the cached archive
+			atompubsvc.SetKeyProvider(atompubsvc.NewStaticKeyProvider("new", &newKey))
+			testevents.Append(t, store, "foo", "d", "e")
+
+			payloads = nil
+			err := newReader().ProcessNew(collect(t, &payloads))
+			if assert.Nil(t, err) {
+				assert.Equal(t, []string{"ok a", "ok b", "ok c", "ok d", "ok e"}, payloads)
+			}
+
+			//Once the old key is retired the cached archive can no longer be read
+			keyring.RemoveKey("old")
+			err = newReader().ProcessNew(collect(t, &payloads))
+			assert.NotNil(t, err)
+		})
+	}
+}
+
+func TestKeyringDecrypt(t *testing.T) {
+	key1, key2 := [32]byte{}, [32]byte{}
+	copy(key1[:], "0123456789abcdef0123456789abcdef")
+	copy(key2[:], "fedcba9876543210fedcba9876543210")
+
+	keyring := NewKeyring()
+	keyring.AddStaticKey("key-1", &key1)
+	keyring.AddStaticKey("key-2", &key2)
+	assert.Equal(t, []string{"key-1", "key-2"}, keyring.KeyIDs())
+
+	//Plaintext passes through
+	plaintext, err := keyring.Decrypt([]byte("<feed></feed>"))
+	assert.Nil(t, err)
+	assert.Equal(t, "<feed></feed>", string(plaintext))
+
+	encryptedKey, err := atompubsvc.Encrypt(key2[:], &key2)
+	assert.Nil(t, err)
+	ciphertext, err := atompubsvc.Encrypt([]byte("secret"), &key2)
+	assert.Nil(t, err)
+
+	envelope := []byte(b64(encryptedKey) + "::" + b64(ciphertext))
+
+	//The matching key is found by trying each in turn
+	plaintext, err = keyring.Decrypt(envelope)
+	assert.Nil(t, err)
+	assert.Equal(t, "secret", string(plaintext))
+
+	plaintext, err = keyring.DecryptWithKeyID(envelope, "key-2")
+	assert.Nil(t, err)
+	assert.Equal(t, "secret", string(plaintext))
+
+	_, err = keyring.DecryptWithKeyID(envelope, "key-1")
+	assert.NotNil(t, err)
+
+	_, err = keyring.DecryptWithKeyID(envelope, "key-3")
+	assert.Equal(t, ErrUnknownKeyID, err)
+
+	keyring.RemoveKey("key-2")
+	_, err = keyring.Decrypt(envelope)
+	assert.Equal(t, ErrNoMatchingKey, err)
+}
+
+func TestKeyringKMS(t *testing.T) {
+	key := [32]byte{}
+	copy(key[:], "0123456789abcdef0123456789abcdef")
+
+	ciphertext, err := atompubsvc.Encrypt([]byte("secret"), &key)
+	assert.Nil(t, err)
+
+	keyring := NewKeyring()
+	keyring.AddKMSKey("alias/foo", &fakeKMS{key: key[:]})
+
+	plaintext, err := keyring.Decrypt([]byte(b64([]byte("encrypted key")) + "::" + b64(ciphertext)))
+	assert.Nil(t, err)
+	assert.Equal(t, "secret", string(plaintext))
+
+	//With JWE the KMS encrypted data key is carried in the kid, which also identifies the key
+	keyProvider := atompubsvc.NewFakeKeyProvider(key)
+	keyProvider.KeyID, keyProvider.EncryptedKey = "alias/foo", []byte("encrypted key")
+	atompubsvc.SetKeyProvider(keyProvider)
+	atompubsvc.SetEncryptionFormat(atompubsvc.JWEFormat)
+	defer atompubsvc.SetKeyProvider(nil)
+	defer atompubsvc.SetEncryptionFormat(atompubsvc.EnvelopeFormat)
+
+	store := atompubsvc.NewMemoryFeedStore(2)
+	testevents.Append(t, store, "foo", "a", "b", "c")
+
+	ts := newTestServer(t, store)
+	defer ts.Close()
+
+	keyring.AddStaticKey("other", &[32]byte{})
+	reader, err := NewFeedReader(ts.URL, &MemoryCheckpointStore{}, keyring)
+	assert.Nil(t, err)
+	reader.HTTPClient = ts.Client()
+
+	var payloads []string
+	err = reader.ProcessNew(collect(t, &payloads))
+	if assert.Nil(t, err) {
+		assert.Equal(t, []string{"ok a", "ok b", "ok c"}, payloads)
+	}
+}
@@ -0,0 +1,128 @@
+package client
+
+import (
+	"encoding/base64"
+	"encoding/xml"
+	"fmt"
+	"golang.org/x/tools/blog/atom"
+	"io/ioutil"
+	"net/http"
+	"strings"
+)
+
+//Scheme of the atom category carrying the type code of entries whose content type is the
+//media type of the payload
+const typeCodeScheme = "urn:esid:typecode"
+
+//payloadFeed captures the entry content of a feed page as served, as the atom package retains
+//neither inline XML content nor the src attribute, along with the entry categories
+type payloadFeed struct {
+	Entry []struct {
+		Category []struct {
+			Scheme string `xml:"scheme,attr"`
+			Term   string `xml:"term,attr"`
+		} `xml:"category"`
+		Content *struct {
+			Type  string `xml:"type,attr"`
+			Src   string `xml:"src,attr"`
+			Inner string `xml:",innerxml"`
+		} `xml:"content"`
+	} `xml:"entry"`
+}
+
+func isXMLMediaType(mediaType string) bool {
+	mediaType = strings.ToLower(mediaType)
+	return mediaType == "application/xml" || mediaType == "text/xml" ||
+		strings.HasSuffix(mediaType, "+xml") || strings.HasSuffix(mediaType, "/xml")
+}
+
+func isTextMediaType(mediaType string) bool {
+	return strings.HasPrefix(strings.ToLower(mediaType), "text/")
+}
+
+//resolvePayloads replaces the content of entries published with the media type of their payload
+//with the type code and base64 encoded payload, so handlers see the same entries regardless of
+//the payload types configured for the feed. Inline XML and text payloads are taken from the
+//feed page body, base64 encoded payloads are decoded, and payloads referred to via the src
+//attribute are retrieved. Embedded XML has a root element, so XML content with no markup is
+//base64 encoded.
+func (fr *FeedReader) resolvePayloads(body []byte, feed *atom.Feed) error {
+	var served payloadFeed
+	err := xml.Unmarshal(body, &served)
+	if err != nil {
+		return err
+	}
+
+	for i, servedEntry := range served.Entry {
+		if i >= len(feed.Entry) {
+			break
+		}
+
+		if servedEntry.Content == nil {
+			continue
+		}
+
+		typeCode := ""
+		for _, category := range servedEntry.Category {
+			if category.Scheme == typeCodeScheme {
+				typeCode = category.Term
+			}
+		}
+
+		entry := feed.Entry[i]
+		if typeCode == "" || entry.Content == nil {
+			continue
+		}
+
+		var payload []byte
+		switch content := servedEntry.Content; {
+		case content.Src != "":
+			payload, err = fr.getPayload(content.Src)
+		case isXMLMediaType(content.Type) && strings.Contains(content.Inner, "<"):
+			payload = []byte(content.Inner)
+		case isTextMediaType(content.Type):
+			payload = []byte(entry.Content.Body)
+		default:
+			payload, err = base64.StdEncoding.DecodeString(entry.Content.Body)
+		}
+
+		if err != nil {
+			return err
+		}
+
+		entry.Content = &atom.Text{
+			Type: typeCode,
+			Body: base64.StdEncoding.EncodeToString(payload),
+		}
+	}
+
+	return nil
+}
+
+//getPayload retrieves and verifies the payload at the given URL
+func (fr *FeedReader) getPayload(url string) ([]byte, error) {
+	resp, err := fr.HTTPClient.Get(url)
+	if err != nil {
+		return nil, err
+	}
+
+	defer resp.Body.Close()
+
+	payload, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("Unexpected status %d retrieving %s", resp.StatusCode, url)
+	}
+
+	if fr.Verifier != nil {
+		err = fr.Verifier.Verify(payload, resp.Header.Get(SignatureHeader))
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return payload, nil
+}
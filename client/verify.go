@@ -0,0 +1,121 @@
+package client
+
+import (
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"strings"
+	"sync"
+)
+
+//SignatureHeader is the response header carrying the detached signature of the response body
+const SignatureHeader = "X-Signature"
+
+var ErrMissingSignature = errors.New("Response is not signed")
+var ErrBadSignatureHeader = errors.New("Malformed signature header")
+var ErrUnknownSigningKey = errors.New("Unknown signing key id or algorithm")
+var ErrBadSignature = errors.New("Signature verification failed")
+
+//Verifier verifies the signature of a response body given the value of the signature header
+type Verifier interface {
+	Verify(body []byte, signatureHeader string) error
+}
+
+//SignatureVerifier verifies Ed25519 and HMAC-SHA256 signatures using keys registered by key id
+type SignatureVerifier struct {
+	sync.RWMutex
+	ed25519Keys map[string]ed25519.PublicKey
+	hmacKeys    map[string][]byte
+}
+
+//NewSignatureVerifier returns a verifier with no keys registered
+func NewSignatureVerifier() *SignatureVerifier {
+	return &SignatureVerifier{
+		ed25519Keys: make(map[string]ed25519.PublicKey),
+		hmacKeys:    make(map[string][]byte),
+	}
+}
+
+//AddEd25519Key registers the public key for verifying ed25519 signatures with the given key id
+func (sv *SignatureVerifier) AddEd25519Key(keyID string, publicKey ed25519.PublicKey) {
+	sv.Lock()
+	defer sv.Unlock()
+	sv.ed25519Keys[keyID] = publicKey
+}
+
+//AddHMACKey registers the shared secret for verifying hmac-sha256 signatures with the given key id
+func (sv *SignatureVerifier) AddHMACKey(keyID string, secret []byte) {
+	sv.Lock()
+	defer sv.Unlock()
+	sv.hmacKeys[keyID] = secret
+}
+
+//parseSignatureHeader parses the keyId, algorithm and signature parameters of a signature header
+func parseSignatureHeader(header string) (map[string]string, error) {
+	params := make(map[string]string)
+	for _, param := range strings.Split(header, ",") {
+		kv := strings.SplitN(strings.TrimSpace(param), "=", 2)
+		if len(kv) != 2 {
+			return nil, ErrBadSignatureHeader
+		}
+
+		params[kv[0]] = strings.Trim(kv[1], `"`)
+	}
+
+	for _, required := range []string{"keyId", "algorithm", "signature"} {
+		if params[required] == "" {
+			return nil, ErrBadSignatureHeader
+		}
+	}
+
+	return params, nil
+}
+
+//Verify checks the signature in the header is valid for the body
+func (sv *SignatureVerifier) Verify(body []byte, signatureHeader string) error {
+	if signatureHeader == "" {
+		return ErrMissingSignature
+	}
+
+	params, err := parseSignatureHeader(signatureHeader)
+	if err != nil {
+		return err
+	}
+
+	signature, err := base64.StdEncoding.DecodeString(params["signature"])
+	if err != nil {
+		return ErrBadSignatureHeader
+	}
+
+	sv.RLock()
+	defer sv.RUnlock()
+
+	switch params["algorithm"] {
+	case "ed25519":
+		publicKey, ok := sv.ed25519Keys[params["keyId"]]
+		if !ok {
+			return ErrUnknownSigningKey
+		}
+
+		if !ed25519.Verify(publicKey, body, signature) {
+			return ErrBadSignature
+		}
+	case "hmac-sha256":
+		secret, ok := sv.hmacKeys[params["keyId"]]
+		if !ok {
+			return ErrUnknownSigningKey
+		}
+
+		mac := hmac.New(sha256.New, secret)
+		mac.Write(body)
+		if !hmac.Equal(mac.Sum(nil), signature) {
+			return ErrBadSignature
+		}
+	default:
+		return ErrUnknownSigningKey
+	}
+
+	return nil
+}
@@ -4,13 +4,19 @@ import (
 	"database/sql"
 	"expvar"
 	_ "expvar"
+	"flag"
 	"fmt"
 	log "github.com/Sirupsen/logrus"
 	"github.com/gorilla/mux"
+	_ "github.com/lib/pq"
+	_ "github.com/mattn/go-sqlite3"
+	atomdata "github.com/xtracdev/es-atom-data"
 	atompub "github.com/xtracdev/es-atom-pub"
 	"github.com/xtracdev/oraconn"
 	"net/http"
+	"net/url"
 	"os"
+	"strconv"
 	"strings"
 )
 
@@ -30,17 +36,26 @@ func init() {
 		pair := strings.Split(e, "=")
 		if strings.Contains(strings.ToLower(pair[0]), "pass") {
 			log.Info(fmt.Sprintf("%s=XXXXXX", pair[0]))
+		} else if pair[0] == "PG_URL" {
+			log.Info(fmt.Sprintf("%s=%s", pair[0], redactURL(strings.TrimPrefix(e, "PG_URL="))))
 		} else {
 			log.Info(e)
 		}
 	}
 }
 
+var storeType = flag.String("store", "oracle", "Feed store backend: oracle, postgres, sqlite or memory")
+var migrateSchema = flag.Bool("migrate", false, "Create the postgres feed and event tables if they do not exist")
+var ingest = flag.Bool("ingest", false, "Accept events via PUT to /events/{aggregateId}/{version} (sqlite and memory stores only)")
+
 type atomFeedPubConfig struct {
 	linkhost              string
 	listenerHostAndPort   string
 	hcListenerHostAndPort string
 	secure                bool
+	certFile              string
+	keyFile               string
+	clientCAFile          string
 }
 
 //expvar exports on the default service mux, which we are not using here. So the following
@@ -77,11 +92,25 @@ func newAtomFeedPubConfig() *atomFeedPubConfig {
 	log.Info("This container exposes its docker health check on port 4567")
 	config.hcListenerHostAndPort = ":4567"
 
+	config.certFile = os.Getenv(atompub.TLSCertFile)
+	config.keyFile = os.Getenv(atompub.TLSKeyFile)
+	config.clientCAFile = os.Getenv(atompub.TLSClientCAFile)
+	if (config.certFile == "") != (config.keyFile == "") {
+		log.Println("TLS_CERT_FILE and TLS_KEY_FILE must be set together")
+		configErr = true
+	}
+
+	if config.clientCAFile != "" && config.certFile == "" {
+		log.Println("TLS_CLIENT_CA_FILE requires TLS_CERT_FILE and TLS_KEY_FILE")
+		configErr = true
+	}
+
 	atompub.ConfigureStatsD()
 
 	keyAlias := os.Getenv(atompub.KeyAlias)
-	if keyAlias == "" {
-		log.Println("Missing KEY_ALIAS environment variable value - required for secure config")
+	keyFile := os.Getenv(atompub.KeyFile)
+	if keyAlias == "" && keyFile == "" {
+		log.Println("Missing KEY_ALIAS or KEY_FILE environment variable value - required for secure config")
 		log.Println(insecureConfigBanner)
 	}
 
@@ -94,26 +123,30 @@ func newAtomFeedPubConfig() *atomFeedPubConfig {
 	return config
 }
 
-func CheckDBConfig(db *sql.DB) error {
+func CheckDBConfig(db *sql.DB, healthQuery string) error {
 	var one int
-	return db.QueryRow("select 1 from dual").Scan(&one)
+	return db.QueryRow(healthQuery).Scan(&one)
 }
 
-func makeHealthCheck(db *sql.DB) func(w http.ResponseWriter, r *http.Request) {
+//makeHealthCheck returns the health check handler. The database check is skipped where there is
+//no database, i.e. for the memory store.
+func makeHealthCheck(db *sql.DB, healthQuery string) func(w http.ResponseWriter, r *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
 		wroteHeader := false
-		err := CheckDBConfig(db)
-		if err != nil {
-			wroteHeader = true
-			w.WriteHeader(http.StatusInternalServerError)
-			log.Warnf("DB error on health check: %s", err.Error())
+		if db != nil {
+			err := CheckDBConfig(db, healthQuery)
+			if err != nil {
+				wroteHeader = true
+				w.WriteHeader(http.StatusInternalServerError)
+				log.Warnf("DB error on health check: %s", err.Error())
+			}
 		}
 
-		err = atompub.CheckKMSConfig()
+		err := atompub.CheckKeyConfig()
 		if err != nil {
 			wroteHeader = true
 			w.WriteHeader(http.StatusInternalServerError)
-			log.Warnf("Error on KMS config health check: %s", err.Error())
+			log.Warnf("Error on key provider config health check: %s", err.Error())
 		}
 
 		if wroteHeader == false {
@@ -122,50 +155,281 @@ func makeHealthCheck(db *sql.DB) func(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+//connectOracle connects to the Oracle database populated by es-atom-data, using the DB_USER,
+//DB_PASSWORD, DB_HOST, DB_PORT and DB_SVC environment variables.
+func connectOracle() (atompub.FeedStore, *sql.DB, string) {
+	config, err := oraconn.NewEnvConfig()
+	if err != nil {
+		log.Fatalf("Missing environment configuration: %s", err.Error())
+	}
+
+	oraDB, err := oraconn.OpenAndConnect(config.ConnectString(), 100)
+	if err != nil {
+		log.Fatal(err.Error())
+	}
+
+	store, err := atompub.NewOracleFeedStore(oraDB.DB)
+	if err != nil {
+		log.Fatal(err.Error())
+	}
+
+	return store, oraDB.DB, "select 1 from dual"
+}
+
+//connectPostgres connects to the PostgreSQL database given by the PG_URL environment variable,
+//creating the feed schema first if requested.
+func connectPostgres(migrate bool) (atompub.FeedStore, *sql.DB, string) {
+	pgURL := os.Getenv("PG_URL")
+	if pgURL == "" {
+		log.Fatal("Missing PG_URL environment variable value")
+	}
+
+	log.Infof("Connecting to postgres at %s", redactURL(pgURL))
+
+	db, err := sql.Open("postgres", pgURL)
+	if err != nil {
+		log.Fatal(redactError(err, pgURL))
+	}
+
+	if err = db.Ping(); err != nil {
+		log.Fatalf("Unable to connect to postgres: %s", redactError(err, pgURL))
+	}
+
+	if migrate {
+		log.Info("Creating postgres feed schema")
+		if err = atompub.MigratePostgres(db); err != nil {
+			log.Fatalf("Error creating postgres feed schema: %s", err.Error())
+		}
+	}
+
+	store, err := atompub.NewPostgresFeedStore(db)
+	if err != nil {
+		log.Fatal(err.Error())
+	}
+
+	return store, db, "select 1"
+}
+
+//redactURL masks the password of a connection URL so it may be logged. Connection strings that
+//are not URLs, such as key=value lists, are masked entirely.
+func redactURL(rawURL string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil || u.Scheme == "" {
+		return "XXXXXX"
+	}
+
+	if u.User != nil {
+		if _, ok := u.User.Password(); ok {
+			u.User = url.UserPassword(u.User.Username(), "XXXXXX")
+		}
+	}
+
+	query := u.Query()
+	if query.Get("password") != "" {
+		query.Set("password", "XXXXXX")
+		u.RawQuery = query.Encode()
+	}
+
+	return u.String()
+}
+
+//redactError returns the message of an error masking any connection URL it includes
+func redactError(err error, rawURL string) string {
+	redacted := redactURL(rawURL)
+	message := strings.Replace(err.Error(), strconv.Quote(rawURL), strconv.Quote(redacted), -1)
+	return strings.Replace(message, rawURL, redacted, -1)
+}
+
+//connectSQLite opens the SQLite database file given by the SQLITE_FILE environment variable,
+//creating the feed schema if needed. Events are assigned to feeds every FEED_THRESHOLD events.
+func connectSQLite() (atompub.FeedStore, *sql.DB, string) {
+	sqliteFile := os.Getenv("SQLITE_FILE")
+	if sqliteFile == "" {
+		log.Fatal("Missing SQLITE_FILE environment variable value")
+	}
+
+	db, err := sql.Open("sqlite3", sqliteFile+"?_busy_timeout=5000")
+	if err != nil {
+		log.Fatal(err.Error())
+	}
+
+	atomdata.ReadFeedThresholdFromEnv()
+	store, err := atompub.NewSQLiteFeedStore(db, atomdata.FeedThreshold)
+	if err != nil {
+		log.Fatalf("Error creating sqlite feed schema: %s", err.Error())
+	}
+
+	return store, db, "select 1"
+}
+
+//connectMemory returns an in-memory store, so the feed can be run locally with no database.
+//Events are assigned to feeds every FEED_THRESHOLD events, and are lost when the command exits.
+func connectMemory() (atompub.FeedStore, *sql.DB, string) {
+	atomdata.ReadFeedThresholdFromEnv()
+	return atompub.NewMemoryFeedStore(atomdata.FeedThreshold), nil, ""
+}
+
+//authenticate wraps the handler with the authentication middleware if API_KEYS_FILE or JWKS_FILE
+//is set, or client certificates are required. The ping endpoint is left open for load balancer
+//checks.
+func authenticate(handler http.Handler, clientCerts bool) http.Handler {
+	var authenticators []atompub.Authenticator
+
+	if apiKeysFile := os.Getenv(atompub.APIKeysFile); apiKeysFile != "" {
+		authenticator, err := atompub.NewAPIKeyAuthenticatorFromFile(apiKeysFile)
+		if err != nil {
+			log.Fatalf("Error reading API keys: %s", err.Error())
+		}
+
+		log.Info("API key authentication enabled")
+		authenticators = append(authenticators, authenticator)
+	}
+
+	if jwksFile := os.Getenv(atompub.JWKSFile); jwksFile != "" {
+		authenticator, err := atompub.NewJWTAuthenticatorFromFile(jwksFile,
+			os.Getenv(atompub.JWTIssuer), os.Getenv(atompub.JWTAudience))
+		if err != nil {
+			log.Fatalf("Error reading JWKS: %s", err.Error())
+		}
+
+		log.Info("JWT bearer token authentication enabled")
+		authenticators = append(authenticators, authenticator)
+	}
+
+	//Client certificates come last so an API key or bearer token, where given, identifies the caller
+	if clientCerts {
+		authenticators = append(authenticators, atompub.NewClientCertAuthenticator())
+	}
+
+	if len(authenticators) == 0 {
+		log.Warn("Missing API_KEYS_FILE or JWKS_FILE environment variable value - feed endpoints are not authenticated")
+		if os.Getenv(atompub.PolicyFile) != "" {
+			log.Warn("All callers get the default grants of the authorization policy")
+		}
+
+		return handler
+	}
+
+	authHandler, err := atompub.NewAuthHandler(handler, []string{atompub.PingURI}, authenticators...)
+	if err != nil {
+		log.Fatal(err.Error())
+	}
+
+	return authHandler
+}
+
 func main() {
+	flag.Parse()
 
 	//Read atom pub config
 	log.Info("Reading config from the environment")
 	feedConfig := newAtomFeedPubConfig()
 
-	//Read db connection config
-	config, err := oraconn.NewEnvConfig()
-	if err != nil {
-		log.Fatalf("Missing environment configuration: %s", err.Error())
-	}
+	//Connect to the feed store
+	var store atompub.FeedStore
+	var db *sql.DB
+	var healthQuery string
 
-	//Connect to DB
-	oraDB, err := oraconn.OpenAndConnect(config.ConnectString(), 100)
-	db := oraDB.DB
+	log.Infof("Using %s feed store", *storeType)
+	switch *storeType {
+	case "oracle":
+		store, db, healthQuery = connectOracle()
+	case "postgres":
+		store, db, healthQuery = connectPostgres(*migrateSchema)
+	case "sqlite":
+		store, db, healthQuery = connectSQLite()
+	case "memory":
+		store, db, healthQuery = connectMemory()
+	default:
+		log.Fatalf("Unknown feed store %s", *storeType)
+	}
 
 	//Create handlers
 	log.Info("Create and register handlers")
-	recentHandler, err := atompub.NewRecentHandler(db, feedConfig.linkhost)
+	recentHandler, err := atompub.NewRecentHandler(store, feedConfig.linkhost)
+	if err != nil {
+		log.Fatal(err.Error())
+	}
+
+	archiveHandler, err := atompub.NewArchiveHandler(store, feedConfig.linkhost)
 	if err != nil {
 		log.Fatal(err.Error())
 	}
 
-	archiveHandler, err := atompub.NewArchiveHandler(db, feedConfig.linkhost)
+	retrieveHandler, err := atompub.NewEventRetrieveHandler(store, feedConfig.linkhost)
 	if err != nil {
 		log.Fatal(err.Error())
 	}
 
-	retrieveHandler, err := atompub.NewEventRetrieveHandler(db)
+	payloadHandler, err := atompub.NewPayloadHandler(store)
+	if err != nil {
+		log.Fatal(err.Error())
+	}
+
+	streamHandler, err := atompub.NewStreamHandler(store, atompub.DefaultStreamPollInterval)
 	if err != nil {
 		log.Fatal(err.Error())
 	}
 
 	r := mux.NewRouter()
+
+	if *ingest {
+		appender, ok := store.(atompub.EventAppender)
+		if !ok {
+			log.Fatalf("The %s feed store does not support event ingestion", *storeType)
+		}
+
+		appendHandler, err := atompub.NewAppendHandler(appender)
+		if err != nil {
+			log.Fatal(err.Error())
+		}
+
+		log.Warn("Event ingestion enabled")
+		if os.Getenv(atompub.PolicyFile) == "" {
+			log.Warn("Missing POLICY_FILE environment variable value - any caller may append events")
+		}
+		r.HandleFunc(atompub.AppendEventHandlerURI, appendHandler).Methods("PUT")
+	}
+
+	if history, ok := store.(atompub.AggregateHistoryStore); ok {
+		aggregateHandler, err := atompub.NewAggregateHandler(history, feedConfig.linkhost)
+		if err != nil {
+			log.Fatal(err.Error())
+		}
+
+		r.HandleFunc(atompub.AggregateHandlerURI, aggregateHandler).Methods("GET")
+	}
+
+	if index, ok := store.(atompub.FeedIndexStore); ok {
+		indexHandler, err := atompub.NewFeedIndexHandler(index, feedConfig.linkhost)
+		if err != nil {
+			log.Fatal(err.Error())
+		}
+
+		r.HandleFunc(atompub.FeedIndexHandlerURI, indexHandler)
+	}
+
+	if locator, ok := store.(atompub.EventLocationStore); ok {
+		locationHandler, err := atompub.NewEventLocationHandler(locator, feedConfig.linkhost)
+		if err != nil {
+			log.Fatal(err.Error())
+		}
+
+		r.HandleFunc(atompub.EventFeedHandlerURI, locationHandler).Methods("GET")
+	}
+
 	r.HandleFunc(atompub.RecentHandlerURI, recentHandler)
+	r.HandleFunc(atompub.StreamHandlerURI, streamHandler)
 	r.HandleFunc(atompub.ArchiveHandlerURI, archiveHandler)
 	r.HandleFunc(atompub.RetrieveEventHanderURI, retrieveHandler)
+	r.HandleFunc(atompub.PayloadHandlerURI, payloadHandler).Methods("GET")
 	r.HandleFunc(atompub.PingURI, atompub.PingHandler)
 
 	var server *http.Server
 
 	go func() {
 		hcMux := http.NewServeMux()
-		healthCheck := makeHealthCheck(oraDB.DB)
+		healthCheck := makeHealthCheck(db, healthQuery)
 		hcMux.HandleFunc("/health", healthCheck)
 		hcMux.HandleFunc("/debug/vars", expvarHandler)
 		log.Infof("Health check and expvars listening on %s", feedConfig.hcListenerHostAndPort)
@@ -174,11 +438,26 @@ func main() {
 
 	//Config server
 	server = &http.Server{
-		Handler: r,
+		Handler: authenticate(r, feedConfig.clientCAFile != ""),
 		Addr:    feedConfig.listenerHostAndPort,
 	}
 
 	//Listen up...
-	log.Info("Start server")
-	log.Fatal(server.ListenAndServe())
+	if feedConfig.certFile == "" {
+		log.Info("Start server")
+		log.Fatal(server.ListenAndServe())
+	}
+
+	server.TLSConfig, err = atompub.NewTLSConfig(feedConfig.certFile, feedConfig.keyFile, feedConfig.clientCAFile)
+	if err != nil {
+		log.Fatalf("Error configuring TLS: %s", err.Error())
+	}
+
+	if feedConfig.clientCAFile != "" {
+		log.Info("Start server with TLS, requiring client certificates")
+	} else {
+		log.Info("Start server with TLS")
+	}
+
+	log.Fatal(server.ListenAndServeTLS("", ""))
 }
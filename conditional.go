@@ -0,0 +1,112 @@
+package atompubsvc
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	atomdata "github.com/xtracdev/es-atom-data"
+	"net/http"
+	"strings"
+	"time"
+)
+
+//etagMatches returns true if the request If-None-Match header lists the given entity tag.
+//Entity tags are compared weakly, and may be quoted or unquoted. The * wildcard is not matched
+//as it only applies to resources known to exist, so etagMatches may be used before the resource
+//has been retrieved.
+func etagMatches(req *http.Request, etag string) bool {
+	ifNoneMatch := req.Header.Get("If-None-Match")
+	if ifNoneMatch == "" || etag == "" {
+		return false
+	}
+
+	for _, candidate := range strings.Split(ifNoneMatch, ",") {
+		candidate = strings.TrimSpace(candidate)
+		candidate = strings.Trim(strings.TrimPrefix(candidate, "W/"), `"`)
+		if candidate == strings.Trim(etag, `"`) {
+			return true
+		}
+	}
+
+	return false
+}
+
+//notModified evaluates the request preconditions against the entity tag and last modified
+//time of the resource, which must have been retrieved. As per RFC 7232, If-Modified-Since is
+//only considered when there is no If-None-Match header. A zero lastModified time disables
+//If-Modified-Since evaluation.
+func notModified(req *http.Request, etag string, lastModified time.Time) bool {
+	if ifNoneMatch := req.Header.Get("If-None-Match"); ifNoneMatch != "" {
+		return strings.TrimSpace(ifNoneMatch) == "*" || etagMatches(req, etag)
+	}
+
+	ifModifiedSince := req.Header.Get("If-Modified-Since")
+	if ifModifiedSince == "" || lastModified.IsZero() {
+		return false
+	}
+
+	since, err := http.ParseTime(ifModifiedSince)
+	if err != nil {
+		return false
+	}
+
+	//HTTP dates have a resolution of seconds
+	return !lastModified.Truncate(time.Second).After(since)
+}
+
+//quoteETag returns the entity tag as a quoted string, as required by RFC 7232
+func quoteETag(etag string) string {
+	return `"` + strings.Trim(etag, `"`) + `"`
+}
+
+//setValidators adds the ETag and Last-Modified response headers, omitting those not known
+func setValidators(rw http.ResponseWriter, etag string, lastModified time.Time) {
+	if etag != "" {
+		rw.Header().Add("ETag", quoteETag(etag))
+	}
+
+	if !lastModified.IsZero() {
+		rw.Header().Add("Last-Modified", lastModified.UTC().Format(http.TimeFormat))
+	}
+}
+
+//lastModified returns the most recent event timestamp, or the zero time if there are no events
+func lastModified(events []atomdata.TimestampedEvent) time.Time {
+	var latest time.Time
+	for _, event := range events {
+		if event.Timestamp.After(latest) {
+			latest = event.Timestamp
+		}
+	}
+
+	return latest
+}
+
+//recentETag derives an entity tag for the recent feed from its content: the entries it
+//contains, the archive it links to, its representation, and the payload types and
+//transformers applied to its entries. The feed updated timestamp is not included as it
+//changes with every request.
+func recentETag(events []atomdata.TimestampedEvent, latestFeed, contentType string) string {
+	hash := sha256.New()
+	hash.Write([]byte(contentType))
+	hash.Write([]byte{0})
+	hash.Write([]byte(payloadTypesKey()))
+	hash.Write([]byte{0})
+	hash.Write([]byte(transformersKey()))
+	hash.Write([]byte{0})
+	hash.Write([]byte(latestFeed))
+	for _, event := range events {
+		hash.Write([]byte{0})
+		hash.Write([]byte(entryID(&event)))
+	}
+
+	return "recent-" + hex.EncodeToString(hash.Sum(nil))[:32]
+}
+
+//writeNotModified writes a 304 response with the caching headers and validators that would
+//have accompanied the full response.
+func writeNotModified(rw http.ResponseWriter, cacheControl, etag string, lastModified time.Time) {
+	rw.Header().Add("Cache-Control", cacheControl)
+	rw.Header().Add("Vary", "Accept")
+	setValidators(rw, etag, lastModified)
+	rw.WriteHeader(http.StatusNotModified)
+}
@@ -0,0 +1,159 @@
+package atompubsvc
+
+import (
+	"fmt"
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+	"github.com/xtracdev/es-atom-pub/internal/testevents"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestNotModified(t *testing.T) {
+	modified := time.Date(2017, 3, 1, 12, 30, 15, 500, time.UTC)
+
+	var conditionalTests = []struct {
+		testName        string
+		ifNoneMatch     string
+		ifModifiedSince string
+		etag            string
+		expected        bool
+	}{
+		{"no preconditions", "", "", "foo", false},
+		{"matching etag", "foo", "", "foo", true},
+		{"matching quoted etag", `"foo"`, "", "foo", true},
+		{"matching weak etag", `W/"foo"`, "", "foo", true},
+		{"matching etag in list", `"bar", "foo"`, "", "foo", true},
+		{"wildcard", "*", "", "foo", true},
+		{"no matching etag", `"bar"`, "", "foo", false},
+		{"no etag", "foo", "", "", false},
+		{"not modified since", "", "Wed, 01 Mar 2017 12:30:15 GMT", "foo", true},
+		{"not modified since later", "", "Thu, 02 Mar 2017 12:30:15 GMT", "foo", true},
+		{"modified since", "", "Wed, 01 Mar 2017 12:30:14 GMT", "foo", false},
+		{"malformed modified since", "", "yesterday", "foo", false},
+		{"if-none-match takes precedence", `"bar"`, "Thu, 02 Mar 2017 12:30:15 GMT", "foo", false},
+	}
+
+	for _, test := range conditionalTests {
+		t.Run(test.testName, func(t *testing.T) {
+			r, err := http.NewRequest("GET", "/", nil)
+			assert.Nil(t, err)
+			if test.ifNoneMatch != "" {
+				r.Header.Set("If-None-Match", test.ifNoneMatch)
+			}
+			if test.ifModifiedSince != "" {
+				r.Header.Set("If-Modified-Since", test.ifModifiedSince)
+			}
+
+			assert.Equal(t, test.expected, notModified(r, test.etag, modified))
+		})
+	}
+}
+
+func TestConditionalGet(t *testing.T) {
+	os.Unsetenv("KEY_ALIAS")
+
+	store := NewMemoryFeedStore(2)
+	testevents.Append(t, store, "foo", "agg1", "agg2", "agg3")
+
+	recentHandler, err := NewRecentHandler(store, "testhost:12345")
+	assert.Nil(t, err)
+	archiveHandler, err := NewArchiveHandler(store, "testhost:12345")
+	assert.Nil(t, err)
+	eventHandler, err := NewEventRetrieveHandler(store, "testhost:12345")
+	assert.Nil(t, err)
+	payloadHandler, err := NewPayloadHandler(store)
+	assert.Nil(t, err)
+
+	router := mux.NewRouter()
+	router.HandleFunc(RecentHandlerURI, recentHandler)
+	router.HandleFunc(ArchiveHandlerURI, archiveHandler)
+	router.HandleFunc(RetrieveEventHanderURI, eventHandler)
+	router.HandleFunc(PayloadHandlerURI, payloadHandler)
+
+	get := func(uri string, headers map[string]string) *httptest.ResponseRecorder {
+		r, err := http.NewRequest("GET", uri, nil)
+		assert.Nil(t, err)
+		for k, v := range headers {
+			r.Header.Set(k, v)
+		}
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, r)
+		return w
+	}
+
+	//Recent
+	w := get(RecentHandlerURI, nil)
+	assert.Equal(t, http.StatusOK, w.Result().StatusCode)
+	recentETag := w.Header().Get("ETag")
+	recentModified := w.Header().Get("Last-Modified")
+	assert.NotEqual(t, "", recentETag)
+	assert.NotEqual(t, "", recentModified)
+
+	w = get(RecentHandlerURI, map[string]string{"If-None-Match": recentETag})
+	assert.Equal(t, http.StatusNotModified, w.Result().StatusCode)
+	assert.Equal(t, 0, w.Body.Len())
+	assert.Equal(t, recentETag, w.Header().Get("ETag"))
+	assert.Equal(t, "no-cache", w.Header().Get("Cache-Control"))
+
+	w = get(RecentHandlerURI, map[string]string{"If-Modified-Since": recentModified})
+	assert.Equal(t, http.StatusNotModified, w.Result().StatusCode)
+
+	//The JSON representation has a different entity tag
+	w = get(RecentHandlerURI, map[string]string{"If-None-Match": recentETag, "Accept": JSONFeedContentType})
+	assert.Equal(t, http.StatusOK, w.Result().StatusCode)
+
+	testevents.Append(t, store, "foo", "agg4")
+	w = get(RecentHandlerURI, map[string]string{"If-None-Match": recentETag})
+	assert.Equal(t, http.StatusOK, w.Result().StatusCode)
+	assert.NotEqual(t, recentETag, w.Header().Get("ETag"))
+
+	//Archive
+	feedID, err := store.RetrieveLastFeed()
+	assert.Nil(t, err)
+	feedURI := fmt.Sprintf("/notifications/%s", feedID)
+
+	w = get(feedURI, nil)
+	assert.Equal(t, http.StatusOK, w.Result().StatusCode)
+	archiveModified := w.Header().Get("Last-Modified")
+	assert.NotEqual(t, "", archiveModified)
+
+	w = get(feedURI, map[string]string{"If-None-Match": fmt.Sprintf(`"%s"`, feedID)})
+	assert.Equal(t, http.StatusNotModified, w.Result().StatusCode)
+	assert.Equal(t, `"`+feedID+`"`, w.Header().Get("ETag"))
+	assert.Equal(t, "max-age=2592000", w.Header().Get("Cache-Control"))
+
+	w = get(feedURI, map[string]string{"If-Modified-Since": archiveModified})
+	assert.Equal(t, http.StatusNotModified, w.Result().StatusCode)
+
+	w = get(feedURI, map[string]string{"If-None-Match": "other-feed"})
+	assert.Equal(t, http.StatusOK, w.Result().StatusCode)
+
+	//Event
+	w = get("/events/agg1/1", map[string]string{"If-None-Match": "agg1:1"})
+	assert.Equal(t, http.StatusNotModified, w.Result().StatusCode)
+	assert.Equal(t, `"agg1:1"`, w.Header().Get("ETag"))
+
+	w = get("/events/agg1/1", nil)
+	assert.Equal(t, http.StatusOK, w.Result().StatusCode)
+
+	w = get("/events/agg1/1", map[string]string{"If-Modified-Since": w.Header().Get("Last-Modified")})
+	assert.Equal(t, http.StatusNotModified, w.Result().StatusCode)
+
+	w = get("/events/agg1/2", map[string]string{"If-Modified-Since": time.Now().UTC().Format(http.TimeFormat)})
+	assert.Equal(t, http.StatusNotFound, w.Result().StatusCode)
+
+	//The wildcard only matches resources that exist
+	for _, uri := range []string{feedURI, "/events/agg1/1", "/events/agg1/1/payload"} {
+		w = get(uri, map[string]string{"If-None-Match": "*"})
+		assert.Equal(t, http.StatusNotModified, w.Result().StatusCode, uri)
+	}
+
+	for _, uri := range []string{"/notifications/nope", "/events/agg1/2", "/events/agg1/2/payload"} {
+		w = get(uri, map[string]string{"If-None-Match": "*"})
+		assert.Equal(t, http.StatusNotFound, w.Result().StatusCode, uri)
+	}
+}
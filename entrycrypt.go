@@ -0,0 +1,149 @@
+package atompubsvc
+
+import (
+	"encoding/base64"
+	"errors"
+	log "github.com/Sirupsen/logrus"
+	"golang.org/x/tools/blog/atom"
+	"os"
+	"strings"
+)
+
+//Encryption modes, selected via the ENCRYPTION_MODE environment variable. Document encryption,
+//the default, encrypts the whole response. Entry encryption leaves the feed structure, ids and
+//links in plaintext and encrypts only the content of each entry or event.
+const (
+	EncryptionModeEnv  = "ENCRYPTION_MODE"
+	DocumentEncryption = "document"
+	EntryEncryption    = "entry"
+)
+
+//EncryptedKeyRel is the relation of the entry link carrying the encrypted data key needed to
+//decrypt the entry content when using entry encryption. The key is base64 encoded in a data URI.
+const EncryptedKeyRel = "encrypted-key"
+
+const encryptedKeyURIPrefix = "data:application/octet-stream;base64,"
+
+var ErrBadEncryptionMode = errors.New("Encryption mode must be document or entry")
+
+//Encryption mode used when a key provider is configured
+var encryptionMode = DocumentEncryption
+
+//SetEncryptionMode sets the encryption mode, overriding the mode configured from the environment
+func SetEncryptionMode(mode string) error {
+	switch mode {
+	case DocumentEncryption, EntryEncryption:
+		encryptionMode = mode
+		return nil
+	default:
+		return ErrBadEncryptionMode
+	}
+}
+
+func init() {
+	mode := os.Getenv(EncryptionModeEnv)
+	if mode == "" {
+		return
+	}
+
+	if err := SetEncryptionMode(strings.ToLower(mode)); err != nil {
+		log.Errorf("Error configuring encryption mode: %s. Exiting.", err.Error())
+		os.Exit(1)
+	}
+}
+
+//EncryptedKeyLink returns the entry link carrying an encrypted data key. The link title is the
+//id of the master key the data key is encrypted with.
+func EncryptedKeyLink(dataKey *DataKey) atom.Link {
+	return atom.Link{
+		Rel:   EncryptedKeyRel,
+		Href:  encryptedKeyURIPrefix + base64.StdEncoding.EncodeToString(dataKey.EncryptedKey),
+		Title: dataKey.KeyID,
+	}
+}
+
+//encryptContent encrypts base64 encoded content. With the envelope format the base64 encoded
+//ciphertext is returned, and the encrypted key must be carried separately. With the JWE format
+//the JWE compact serialization is returned, which includes the encrypted key.
+func encryptContent(encodedContent string, dataKey *DataKey) (string, error) {
+	content, err := base64.StdEncoding.DecodeString(encodedContent)
+	if err != nil {
+		return "", err
+	}
+
+	if encryptionFormat == JWEFormat {
+		return encryptJWE(content, dataKey)
+	}
+
+	encrypted, err := Encrypt(content, dataKey.Plaintext)
+	if err != nil {
+		return "", err
+	}
+
+	return base64.StdEncoding.EncodeToString(encrypted), nil
+}
+
+//encryptEntries encrypts the content of each feed entry when using entry encryption, adding a
+//link with the encrypted data key to each entry when using the envelope format. A single data
+//key is used for the feed page.
+func encryptEntries(provider KeyProvider, feed *atom.Feed) error {
+	if provider == nil || encryptionMode != EntryEncryption || len(feed.Entry) == 0 {
+		return nil
+	}
+
+	dataKey, err := provider.GenerateDataKey()
+	if err != nil {
+		return err
+	}
+
+	//Purge the key from memory when done
+	defer func() {
+		*dataKey.Plaintext = [32]byte{}
+	}()
+
+	for _, entry := range feed.Entry {
+		if entry.Content == nil {
+			continue
+		}
+
+		entry.Content.Body, err = encryptContent(entry.Content.Body, dataKey)
+		if err != nil {
+			return err
+		}
+
+		if encryptionFormat == EnvelopeFormat {
+			entry.Link = append(entry.Link, EncryptedKeyLink(dataKey))
+		}
+	}
+
+	return nil
+}
+
+//encryptEventContent encrypts the content of an event when using entry encryption, setting
+//its encrypted key when using the envelope format.
+func encryptEventContent(provider KeyProvider, event *EventStoreContent) error {
+	if provider == nil || encryptionMode != EntryEncryption {
+		return nil
+	}
+
+	dataKey, err := provider.GenerateDataKey()
+	if err != nil {
+		return err
+	}
+
+	event.Content, err = encryptContent(event.Content, dataKey)
+
+	//Purge the key from memory
+	*dataKey.Plaintext = [32]byte{}
+
+	if err != nil {
+		return err
+	}
+
+	if encryptionFormat == EnvelopeFormat {
+		event.EncryptedKey = base64.StdEncoding.EncodeToString(dataKey.EncryptedKey)
+		event.KeyID = dataKey.KeyID
+	}
+
+	return nil
+}
@@ -0,0 +1,142 @@
+package atompubsvc
+
+import (
+	"encoding/base64"
+	"encoding/xml"
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+	"github.com/xtracdev/es-atom-pub/internal/testevents"
+	"golang.org/x/tools/blog/atom"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestSetEncryptionMode(t *testing.T) {
+	defer SetEncryptionMode(DocumentEncryption)
+
+	assert.Nil(t, SetEncryptionMode(EntryEncryption))
+	assert.Equal(t, EntryEncryption, encryptionMode)
+
+	assert.Equal(t, ErrBadEncryptionMode, SetEncryptionMode("sideways"))
+	assert.Equal(t, EntryEncryption, encryptionMode)
+}
+
+//decryptEntryContent decrypts the content of an entry encrypted with the fake key provider
+func decryptEntryContent(t *testing.T, entry *atom.Entry) string {
+	var keyLink atom.Link
+	for _, l := range entry.Link {
+		if l.Rel == EncryptedKeyRel {
+			keyLink = l
+		}
+	}
+
+	assert.Equal(t, "data:application/octet-stream;base64,"+base64.StdEncoding.EncodeToString([]byte("fake encrypted key")), keyLink.Href)
+	assert.Equal(t, "fake", keyLink.Title)
+
+	ciphertext, err := base64.StdEncoding.DecodeString(entry.Content.Body)
+	assert.Nil(t, err)
+
+	return string(testDecrypt(t, ciphertext, &testKey))
+}
+
+func TestRecentHandlerEntryEncryption(t *testing.T) {
+	SetKeyProvider(NewFakeKeyProvider(testKey))
+	SetEncryptionMode(EntryEncryption)
+	defer SetKeyProvider(nil)
+	defer SetEncryptionMode(DocumentEncryption)
+
+	store := NewMemoryFeedStore(2)
+	testevents.Append(t, store, "foo", "agg1", "agg2", "agg3")
+
+	handler, err := NewRecentHandler(store, "localhost:12345")
+	assert.Nil(t, err)
+
+	r, _ := http.NewRequest("GET", "/notifications/recent", nil)
+	w := httptest.NewRecorder()
+	handler(w, r)
+
+	assert.Equal(t, http.StatusOK, w.Result().StatusCode)
+
+	//The response is plaintext atom with the links intact
+	var feed atom.Feed
+	err = xml.Unmarshal(w.Body.Bytes(), &feed)
+	if assert.Nil(t, err) {
+		assert.Equal(t, "recent", feed.ID)
+		assert.Contains(t, linkHref(feed.Link, "prev-archive"), "/notifications/")
+		if assert.Equal(t, 1, len(feed.Entry)) {
+			entry := feed.Entry[0]
+			assert.Equal(t, "urn:esid:agg3:1", entry.ID)
+			assert.Equal(t, "foo", entry.Content.Type)
+			assert.Equal(t, "ok agg3", decryptEntryContent(t, entry))
+		}
+	}
+}
+
+func TestArchiveHandlerEntryEncryption(t *testing.T) {
+	SetKeyProvider(NewFakeKeyProvider(testKey))
+	SetEncryptionMode(EntryEncryption)
+	defer SetKeyProvider(nil)
+	defer SetEncryptionMode(DocumentEncryption)
+
+	store := NewMemoryFeedStore(2)
+	testevents.Append(t, store, "foo", "agg1", "agg2")
+
+	feedID, _ := store.RetrieveLastFeed()
+
+	handler, err := NewArchiveHandler(store, "localhost:12345")
+	assert.Nil(t, err)
+
+	router := mux.NewRouter()
+	router.HandleFunc(ArchiveHandlerURI, handler)
+
+	r, _ := http.NewRequest("GET", "/notifications/"+feedID, nil)
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, r)
+
+	assert.Equal(t, http.StatusOK, w.Result().StatusCode)
+
+	var feed atom.Feed
+	err = xml.Unmarshal(w.Body.Bytes(), &feed)
+	if assert.Nil(t, err) && assert.Equal(t, 2, len(feed.Entry)) {
+		assert.Equal(t, "ok agg2", decryptEntryContent(t, feed.Entry[0]))
+		assert.Equal(t, "ok agg1", decryptEntryContent(t, feed.Entry[1]))
+	}
+}
+
+func TestEventHandlerEntryEncryption(t *testing.T) {
+	SetKeyProvider(NewFakeKeyProvider(testKey))
+	SetEncryptionMode(EntryEncryption)
+	defer SetKeyProvider(nil)
+	defer SetEncryptionMode(DocumentEncryption)
+
+	store := NewMemoryFeedStore(2)
+	testevents.Append(t, store, "foo", "agg1")
+
+	handler, err := NewEventRetrieveHandler(store, "testhost:12345")
+	assert.Nil(t, err)
+
+	router := mux.NewRouter()
+	router.HandleFunc(RetrieveEventHanderURI, handler)
+
+	r, _ := http.NewRequest("GET", "/events/agg1/1", nil)
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, r)
+
+	assert.Equal(t, http.StatusOK, w.Result().StatusCode)
+
+	var event EventStoreContent
+	err = xml.Unmarshal(w.Body.Bytes(), &event)
+	if assert.Nil(t, err) {
+		assert.Equal(t, "agg1", event.AggregateId)
+		assert.Equal(t, base64.StdEncoding.EncodeToString([]byte("fake encrypted key")), event.EncryptedKey)
+		assert.Equal(t, "fake", event.KeyID)
+
+		ciphertext, err := base64.StdEncoding.DecodeString(event.Content)
+		assert.Nil(t, err)
+		assert.Equal(t, "ok agg1", string(testDecrypt(t, ciphertext, &testKey)))
+	}
+
+	assert.False(t, strings.Contains(w.Body.String(), "::"))
+}
@@ -0,0 +1,240 @@
+package atompubsvc
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	atomdata "github.com/xtracdev/es-atom-data"
+	"strings"
+	"time"
+)
+
+var ErrNilFeedStore = errors.New("Nil feed store passed to factory method")
+
+//FeedStore abstracts the retrieval of feed and event data used by the handlers. The semantics
+//follow those of the es-atom-data package: recent events are those not yet assigned to a feed,
+//previous and next feed ids are returned as null strings when there is no such feed, and
+//RetrieveEvent returns sql.ErrNoRows when the event does not exist.
+type FeedStore interface {
+	RetrieveRecent() ([]atomdata.TimestampedEvent, error)
+	RetrieveLastFeed() (string, error)
+	RetrieveArchive(feedID string) ([]atomdata.TimestampedEvent, error)
+	RetrievePreviousFeed(feedID string) (sql.NullString, error)
+	RetrieveNextFeed(feedID string) (sql.NullString, error)
+	RetrieveEvent(aggregateID string, version int) (atomdata.TimestampedEvent, error)
+}
+
+//OracleFeedStore is the default FeedStore, backed by the Oracle tables populated by
+//es-atom-data.
+type OracleFeedStore struct {
+	db *sql.DB
+}
+
+//NewOracleFeedStore returns a FeedStore that reads the feed and event data via the atomdata
+//package using the given database connection.
+func NewOracleFeedStore(db *sql.DB) (*OracleFeedStore, error) {
+	if db == nil {
+		return nil, ErrBadDBConnection
+	}
+
+	return &OracleFeedStore{db: db}, nil
+}
+
+func (ofs *OracleFeedStore) RetrieveRecent() ([]atomdata.TimestampedEvent, error) {
+	return atomdata.RetrieveRecent(ofs.db)
+}
+
+func (ofs *OracleFeedStore) RetrieveLastFeed() (string, error) {
+	return atomdata.RetrieveLastFeed(ofs.db)
+}
+
+func (ofs *OracleFeedStore) RetrieveArchive(feedID string) ([]atomdata.TimestampedEvent, error) {
+	return atomdata.RetrieveArchive(ofs.db, feedID)
+}
+
+func (ofs *OracleFeedStore) RetrievePreviousFeed(feedID string) (sql.NullString, error) {
+	return atomdata.RetrievePreviousFeed(ofs.db, feedID)
+}
+
+func (ofs *OracleFeedStore) RetrieveNextFeed(feedID string) (sql.NullString, error) {
+	return atomdata.RetrieveNextFeed(ofs.db, feedID)
+}
+
+func (ofs *OracleFeedStore) RetrieveEvent(aggregateID string, version int) (atomdata.TimestampedEvent, error) {
+	return atomdata.RetrieveEvent(ofs.db, aggregateID, version)
+}
+
+func (ofs *OracleFeedStore) RetrieveAggregateEvents(aggregateID string, afterVersion, toVersion, limit int) ([]atomdata.TimestampedEvent, error) {
+	query, args := aggregateEventsQuery(aggregateID, afterVersion, toVersion, limit,
+		func(n int) string { return fmt.Sprintf(":%d", n) },
+		func(limitArg string) string { return "fetch first " + limitArg + " rows only" })
+	return queryEvents(ofs.db, query, args...)
+}
+
+func (ofs *OracleFeedStore) RetrieveFirstFeed() (string, error) {
+	feedID, err := queryNullString(ofs.db, firstFeedQuery)
+	return feedID.String, err
+}
+
+func (ofs *OracleFeedStore) RetrieveFeedIndex() ([]FeedSummary, error) {
+	return queryFeedIndex(ofs.db)
+}
+
+func (ofs *OracleFeedStore) RetrieveFeedAt(at time.Time) (string, error) {
+	feedID, err := queryNullString(ofs.db,
+		`select feedid from t_aeae_atom_event where event_time >= :1 order by event_time, id fetch first 1 rows only`, at)
+	return feedID.String, err
+}
+
+func (ofs *OracleFeedStore) RetrieveEventFeed(aggregateID string, version int) (string, error) {
+	return queryEventFeed(ofs.db, eventFeedQuery(func(n int) string { return fmt.Sprintf(":%d", n) }), aggregateID, version)
+}
+
+func (ofs *OracleFeedStore) RetrieveEventPosition(aggregateID string, version int) (EventPosition, error) {
+	return queryEventPosition(ofs.db, eventPositionQuery(func(n int) string { return fmt.Sprintf(":%d", n) }),
+		aggregateID, version)
+}
+
+func (ofs *OracleFeedStore) RetrieveTypedFeed(feedID string, typeCodes []string, backwards bool) (string, error) {
+	return ofs.queryTypedFeed(feedID, typeCodes, backwards)
+}
+
+func (ofs *OracleFeedStore) RetrieveFirstTypedFeed(typeCodes []string) (string, error) {
+	return ofs.queryTypedFeed("", typeCodes, false)
+}
+
+func (ofs *OracleFeedStore) queryTypedFeed(feedID string, typeCodes []string, backwards bool) (string, error) {
+	query, args := typedFeedQuery(feedID, typeCodes, backwards,
+		func(n int) string { return fmt.Sprintf(":%d", n) },
+		func(limitArg string) string { return "fetch first " + limitArg + " rows only" })
+	result, err := queryNullString(ofs.db, query, args...)
+	return result.String, err
+}
+
+//firstFeedQuery selects the id of the oldest feed
+const firstFeedQuery = `select feedid from t_aefd_feed where id = (select min(id) from t_aefd_feed)`
+
+//feedIndexQuery selects the id of each feed, oldest first, with its event count and the
+//timestamps of its first and last events. The timestamps are selected from the event rows
+//rather than via min and max so their column types are retained by the SQLite driver.
+const feedIndexQuery = `select f.feedid, s.events, fe.event_time, le.event_time from t_aefd_feed f
+	join (select feedid, count(*) events, min(id) first_id, max(id) last_id from t_aeae_atom_event where feedid is not null group by feedid) s on s.feedid = f.feedid
+	join t_aeae_atom_event fe on fe.id = s.first_id
+	join t_aeae_atom_event le on le.id = s.last_id
+	order by f.id`
+
+//queryFeedIndex summarizes the feeds via feedIndexQuery, which is common to the SQL backed stores
+func queryFeedIndex(db *sql.DB) ([]FeedSummary, error) {
+	rows, err := db.Query(feedIndexQuery)
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	var summaries []FeedSummary
+	for rows.Next() {
+		var summary FeedSummary
+		err = rows.Scan(&summary.FeedID, &summary.Events, &summary.First, &summary.Last)
+		if err != nil {
+			return nil, err
+		}
+
+		summaries = append(summaries, summary)
+	}
+
+	return summaries, rows.Err()
+}
+
+//aggregateEventsQuery returns the query selecting the events of an aggregate with versions after
+//afterVersion, and up to toVersion if it is positive, in version order and limited to limit
+//rows, along with its arguments. The bind function returns the placeholder for the nth argument,
+//and limitClause the row limit clause for the limit placeholder, as these differ between
+//databases.
+func aggregateEventsQuery(aggregateID string, afterVersion, toVersion, limit int, bind func(n int) string,
+	limitClause func(limitArg string) string) (string, []interface{}) {
+	query := `select event_time, aggregate_id, version, typecode, payload from t_aeae_atom_event where aggregate_id = ` +
+		bind(1) + ` and version > ` + bind(2)
+	args := []interface{}{aggregateID, afterVersion}
+
+	if toVersion > 0 {
+		args = append(args, toVersion)
+		query += ` and version <= ` + bind(len(args))
+	}
+
+	args = append(args, limit)
+	query += ` order by version ` + limitClause(bind(len(args)))
+
+	return query, args
+}
+
+//typedFeedQuery returns the query selecting the nearest feed holding an event with one of the
+//type codes, along with its arguments. The search starts with feedID and moves to earlier feeds
+//if backwards is true, or later feeds otherwise; an empty feedID selects the oldest such feed.
+//Each feed is checked via the index on the event type code and feed id, so feeds without
+//matching events are skipped without reading their events. The bind and limitClause functions
+//are as for aggregateEventsQuery.
+func typedFeedQuery(feedID string, typeCodes []string, backwards bool, bind func(n int) string,
+	limitClause func(limitArg string) string) (string, []interface{}) {
+	var args []interface{}
+	binds := make([]string, len(typeCodes))
+	for i, typeCode := range typeCodes {
+		args = append(args, typeCode)
+		binds[i] = bind(len(args))
+	}
+
+	query := `select f.feedid from t_aefd_feed f where exists (select 1 from t_aeae_atom_event e where e.typecode in (` +
+		strings.Join(binds, ", ") + `) and e.feedid = f.feedid)`
+
+	comparison, order := ">=", "f.id"
+	if backwards {
+		comparison, order = "<=", "f.id desc"
+	}
+
+	if feedID != "" {
+		args = append(args, feedID)
+		query += ` and f.id ` + comparison + ` (select id from t_aefd_feed where feedid = ` + bind(len(args)) + `)`
+	}
+
+	query += ` order by ` + order + ` ` + limitClause("1")
+	return query, args
+}
+
+//queryEvents runs a query returning event_time, aggregate_id, version, typecode and payload
+//columns, and scans the results into timestamped events. It is used by the SQL backed stores
+//that do not go through atomdata.
+func queryEvents(db *sql.DB, query string, args ...interface{}) ([]atomdata.TimestampedEvent, error) {
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	var events []atomdata.TimestampedEvent
+	for rows.Next() {
+		var event atomdata.TimestampedEvent
+		var payload []byte
+		err = rows.Scan(&event.Timestamp, &event.Source, &event.Version, &event.TypeCode, &payload)
+		if err != nil {
+			return nil, err
+		}
+
+		event.Payload = payload
+		events = append(events, event)
+	}
+
+	return events, rows.Err()
+}
+
+//queryNullString runs a query returning a single nullable string column. No rows is treated
+//as a null result rather than an error.
+func queryNullString(db *sql.DB, query string, args ...interface{}) (sql.NullString, error) {
+	var result sql.NullString
+	err := db.QueryRow(query, args...).Scan(&result)
+	if err == sql.ErrNoRows {
+		return sql.NullString{}, nil
+	}
+
+	return result, err
+}
@@ -0,0 +1,260 @@
+package atompubsvc
+
+import (
+	"errors"
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	"github.com/gorilla/mux"
+	atomdata "github.com/xtracdev/es-atom-data"
+	"golang.org/x/tools/blog/atom"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+//AggregateHandlerURI is where the history of an aggregate is served
+const AggregateHandlerURI = "/events/{aggregateId}"
+
+//Query parameters of the aggregate history: from and to limit the versions returned, inclusive,
+//limit sets the number of entries per page, and after is the version the page follows, as set
+//in next links.
+const (
+	HistoryFromParam  = "from"
+	HistoryToParam    = "to"
+	HistoryLimitParam = "limit"
+	HistoryAfterParam = "after"
+)
+
+//DefaultHistoryPageSize is the number of entries in a page of aggregate history when no limit
+//is requested
+var DefaultHistoryPageSize = 100
+
+//MaxHistoryPageSize caps the limit requested by a client
+var MaxHistoryPageSize = 1000
+
+var ErrBadHistoryParam = errors.New("from, to, limit and after must be positive integers")
+
+//AggregateHistoryStore is implemented by stores that can retrieve the events of an aggregate.
+//RetrieveAggregateEvents returns the events with versions after afterVersion, and up to
+//toVersion if it is positive, in version order, returning at most limit events.
+type AggregateHistoryStore interface {
+	RetrieveAggregateEvents(aggregateID string, afterVersion, toVersion, limit int) ([]atomdata.TimestampedEvent, error)
+}
+
+//historyQuery holds the parsed query parameters of an aggregate history request
+type historyQuery struct {
+	from  int
+	to    int
+	limit int
+	after int
+}
+
+func parseHistoryQuery(req *http.Request) (*historyQuery, error) {
+	params := req.URL.Query()
+	hq := &historyQuery{limit: DefaultHistoryPageSize}
+
+	for param, value := range map[string]*int{
+		HistoryFromParam:  &hq.from,
+		HistoryToParam:    &hq.to,
+		HistoryLimitParam: &hq.limit,
+		HistoryAfterParam: &hq.after,
+	} {
+		if params.Get(param) == "" {
+			continue
+		}
+
+		n, err := strconv.Atoi(params.Get(param))
+		if err != nil || n < 1 {
+			return nil, ErrBadHistoryParam
+		}
+
+		*value = n
+	}
+
+	if hq.limit > MaxHistoryPageSize {
+		hq.limit = MaxHistoryPageSize
+	}
+
+	return hq, nil
+}
+
+//afterVersion returns the version the page starts after, honouring the from parameter
+func (hq *historyQuery) afterVersion() int {
+	if hq.after < hq.from-1 {
+		return hq.from - 1
+	}
+
+	return hq.after
+}
+
+//link returns the URI of the page following the given version, with after omitted for the first
+//page. The range, limit and type filter of the request are kept.
+func (hq *historyQuery) link(base string, after int, types typeFilter) string {
+	params := url.Values{}
+	if hq.from > 0 {
+		params.Set(HistoryFromParam, strconv.Itoa(hq.from))
+	}
+
+	if hq.to > 0 {
+		params.Set(HistoryToParam, strconv.Itoa(hq.to))
+	}
+
+	params.Set(HistoryLimitParam, strconv.Itoa(hq.limit))
+
+	if after > 0 {
+		params.Set(HistoryAfterParam, strconv.Itoa(after))
+	}
+
+	if len(types) > 0 {
+		params.Set(TypeParam, strings.Join(types, ","))
+	}
+
+	return base + "?" + params.Encode()
+}
+
+//matchingHistory returns up to limit events of the aggregate with versions after afterVersion,
+//and up to toVersion if it is positive, that pass the filter. As the filter is applied after
+//the events are retrieved, events are retrieved in batches until limit matching events are
+//found or there are no more. The boolean result is true if there are events in the range,
+//whether or not they pass the filter.
+func matchingHistory(store AggregateHistoryStore, aggregateID string, afterVersion, toVersion, limit int,
+	filter *eventFilter) ([]atomdata.TimestampedEvent, bool, error) {
+	batchSize := limit
+	if filter.active() && batchSize < DefaultHistoryPageSize {
+		batchSize = DefaultHistoryPageSize
+	}
+
+	var matching []atomdata.TimestampedEvent
+	found := false
+
+	for {
+		events, err := store.RetrieveAggregateEvents(aggregateID, afterVersion, toVersion, batchSize)
+		if err != nil {
+			return nil, false, err
+		}
+
+		found = found || len(events) > 0
+		matching = append(matching, filter.apply(events)...)
+
+		if len(matching) >= limit {
+			return matching[:limit], found, nil
+		}
+
+		if len(events) < batchSize {
+			return matching, found, nil
+		}
+
+		afterVersion = events[len(events)-1].Version
+	}
+}
+
+//NewAggregateHandler instantiates a handler returning the history of an aggregate as a feed
+//whose entries are the aggregate's events in version order, oldest first. This will be served
+//up at /events/{aggregateId}. The history is paginated, with first and next links, and may be
+//limited to a range of versions via the from and to query parameters. As with the recent and
+//archive feeds, events are subject to the access policy and any type query parameter.
+func NewAggregateHandler(store AggregateHistoryStore, linkhostport string) (func(rw http.ResponseWriter, req *http.Request), error) {
+	if store == nil {
+		return nil, ErrNilFeedStore
+	}
+
+	return func(rw http.ResponseWriter, req *http.Request) {
+		svc := "aggregate-history"
+		start := time.Now()
+		aggregateID := mux.Vars(req)["aggregateId"]
+
+		hq, err := parseHistoryQuery(req)
+		if err != nil {
+			logTimingStats(svc, start, err)
+			http.Error(rw, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		log.Infof("Retrieving history of %s after version %d", aggregateID, hq.afterVersion())
+
+		//One more event than the page holds is retrieved to tell whether there is a next page
+		filter := newEventFilter(req)
+		events, found, err := matchingHistory(store, aggregateID, hq.afterVersion(), hq.to, hq.limit+1, filter)
+		if err != nil {
+			logTimingStats(svc, start, err)
+			log.Warnf("Error retrieving aggregate history: %s", err.Error())
+			http.Error(rw, "Error retrieving aggregate history", http.StatusInternalServerError)
+			return
+		}
+
+		//An aggregate with no events in the requested range is not found, though later pages
+		//may be empty
+		if !found && hq.after == 0 {
+			logTimingStats(svc, start, nil)
+			http.Error(rw, "", http.StatusNotFound)
+			return
+		}
+
+		hasNext := len(events) > hq.limit
+		if hasNext {
+			events = events[:hq.limit]
+		}
+
+		base := fmt.Sprintf("%s://%s/events/%s", linkProto, linkhostport, url.PathEscape(aggregateID))
+
+		feed := atom.Feed{
+			Title:   "Aggregate history",
+			ID:      fmt.Sprintf("urn:esid:%s", aggregateID),
+			Updated: atom.TimeStr(time.Now().Format(time.RFC3339)),
+		}
+
+		feed.Link = append(feed.Link, atom.Link{Href: hq.link(base, hq.after, filter.types), Rel: "self"})
+		feed.Link = append(feed.Link, atom.Link{Href: hq.link(base, 0, filter.types), Rel: "first"})
+
+		if hasNext {
+			feed.Link = append(feed.Link, atom.Link{
+				Href: hq.link(base, events[len(events)-1].Version, filter.types),
+				Rel:  "next",
+			})
+		}
+
+		err = addItemsToFeed(&feed, events, linkhostport, linkProto)
+		if err != nil {
+			logTimingStats(svc, start, err)
+			http.Error(rw, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		err = encryptEntries(keyProvider, &feed)
+		if err != nil {
+			logTimingStats(svc, start, err)
+			http.Error(rw, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		out, contentType, err := marshalFeed(req, &feed)
+		if err != nil {
+			logTimingStats(svc, start, err)
+			http.Error(rw, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		encodedOut, err := encryptOutput(keyProvider, out)
+		if err != nil {
+			http.Error(rw, err.Error(), http.StatusInternalServerError)
+			logTimingStats(svc, start, err)
+			return
+		}
+
+		err = signResponse(responseSigner, rw, encodedOut)
+		if err != nil {
+			http.Error(rw, err.Error(), http.StatusInternalServerError)
+			logTimingStats(svc, start, err)
+			return
+		}
+
+		//New versions may be added to the aggregate, so the history is not cached
+		rw.Header().Add("Cache-Control", accessPolicy.cacheControl("no-cache"))
+		rw.Header().Add("Content-Type", contentType)
+		rw.Header().Add("Vary", "Accept")
+		rw.Write(encodedOut)
+		logTimingStats(svc, start, nil)
+	}, nil
+}
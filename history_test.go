@@ -0,0 +1,244 @@
+package atompubsvc
+
+import (
+	"encoding/xml"
+	"fmt"
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+	atomdata "github.com/xtracdev/es-atom-data"
+	"github.com/xtracdev/goes"
+	"golang.org/x/tools/blog/atom"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+//appendVersions appends versions 1 to n of an aggregate, with even versions of type even
+func appendVersions(t *testing.T, store EventAppender, aggregateID string, n int) {
+	for version := 1; version <= n; version++ {
+		typeCode := "odd"
+		if version%2 == 0 {
+			typeCode = "even"
+		}
+
+		err := store.Append(&goes.Event{
+			Source:   aggregateID,
+			Version:  version,
+			TypeCode: typeCode,
+			Payload:  []byte("ok"),
+		})
+		assert.Nil(t, err)
+	}
+}
+
+func TestAggregateEventsQuery(t *testing.T) {
+	oracleBind := func(n int) string { return fmt.Sprintf(":%d", n) }
+	fetchFirst := func(limitArg string) string { return "fetch first " + limitArg + " rows only" }
+
+	query, args := aggregateEventsQuery("agg1", 2, 0, 10, oracleBind, fetchFirst)
+	assert.True(t, strings.HasSuffix(query, "where aggregate_id = :1 and version > :2 order by version fetch first :3 rows only"), query)
+	assert.Equal(t, []interface{}{"agg1", 2, 10}, args)
+
+	query, args = aggregateEventsQuery("agg1", 2, 8, 10, oracleBind, fetchFirst)
+	assert.True(t, strings.HasSuffix(query, "version > :2 and version <= :3 order by version fetch first :4 rows only"), query)
+	assert.Equal(t, []interface{}{"agg1", 2, 8, 10}, args)
+}
+
+func TestAggregateHandler(t *testing.T) {
+	_, err := NewAggregateHandler(nil, "testhost:12345")
+	assert.Equal(t, ErrNilFeedStore, err)
+
+	store := NewMemoryFeedStore(3)
+	appendVersions(t, store, "agg1", 5)
+	appendVersions(t, store, "agg2", 2)
+
+	handler, err := NewAggregateHandler(store, "testhost:12345")
+	assert.Nil(t, err)
+
+	router := mux.NewRouter()
+	router.HandleFunc(AggregateHandlerURI, handler)
+
+	get := func(uri string, status int) *atom.Feed {
+		r, _ := http.NewRequest("GET", strings.TrimPrefix(uri, "https://testhost:12345"), nil)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, r)
+		assert.Equal(t, status, w.Result().StatusCode, uri)
+		if status != http.StatusOK {
+			return nil
+		}
+
+		assert.Equal(t, "no-cache", w.Result().Header.Get("Cache-Control"))
+
+		var feed atom.Feed
+		assert.Nil(t, xml.Unmarshal(w.Body.Bytes(), &feed))
+		return &feed
+	}
+
+	ids := func(feed *atom.Feed) []string {
+		var ids []string
+		for _, entry := range feed.Entry {
+			ids = append(ids, entry.ID)
+		}
+		return ids
+	}
+
+	//The whole history, oldest first
+	feed := get("/events/agg1", http.StatusOK)
+	assert.Equal(t, "urn:esid:agg1", feed.ID)
+	assert.Equal(t, []string{"urn:esid:agg1:1", "urn:esid:agg1:2", "urn:esid:agg1:3", "urn:esid:agg1:4", "urn:esid:agg1:5"}, ids(feed))
+	assert.Equal(t, "https://testhost:12345/events/agg1?limit=100", *getLink("first", feed))
+	assert.Nil(t, getLink("next", feed))
+	assert.Equal(t, "https://testhost:12345/events/agg1/1", linkHref(feed.Entry[0].Link, "self"))
+
+	//Paginated over a version range
+	feed = get("/events/agg1?from=2&to=5&limit=2", http.StatusOK)
+	assert.Equal(t, []string{"urn:esid:agg1:2", "urn:esid:agg1:3"}, ids(feed))
+	first := *getLink("first", feed)
+	assert.Equal(t, "https://testhost:12345/events/agg1?from=2&limit=2&to=5", first)
+
+	feed = get(*getLink("next", feed), http.StatusOK)
+	assert.Equal(t, []string{"urn:esid:agg1:4", "urn:esid:agg1:5"}, ids(feed))
+	assert.Equal(t, "https://testhost:12345/events/agg1?after=3&from=2&limit=2&to=5", *getLink("self", feed))
+	assert.Equal(t, first, *getLink("first", feed))
+	assert.Nil(t, getLink("next", feed))
+
+	//Type filtered pages are filled with matching events, and the filter carries through the links
+	feed = get("/events/agg1?type=odd&limit=2", http.StatusOK)
+	assert.Equal(t, []string{"urn:esid:agg1:1", "urn:esid:agg1:3"}, ids(feed))
+	next := *getLink("next", feed)
+	assert.Contains(t, next, "after=3")
+	assert.Contains(t, next, "type=odd")
+	feed = get(next, http.StatusOK)
+	assert.Equal(t, []string{"urn:esid:agg1:5"}, ids(feed))
+	assert.Nil(t, getLink("next", feed))
+
+	//There is no next page when the remaining events do not match
+	feed = get("/events/agg1?type=even&limit=2", http.StatusOK)
+	assert.Equal(t, []string{"urn:esid:agg1:2", "urn:esid:agg1:4"}, ids(feed))
+	assert.Nil(t, getLink("next", feed))
+
+	//An aggregate with events of other types is found, with an empty history
+	assert.Empty(t, get("/events/agg1?type=other", http.StatusOK).Entry)
+
+	//Unknown aggregates and empty ranges are not found, but later pages may be empty
+	get("/events/agg3", http.StatusNotFound)
+	get("/events/agg2?from=3", http.StatusNotFound)
+	assert.Empty(t, get("/events/agg2?after=2", http.StatusOK).Entry)
+
+	for _, bad := range []string{"from=0", "to=x", "limit=-1", "after=1.5"} {
+		get("/events/agg1?"+bad, http.StatusBadRequest)
+	}
+}
+
+func TestAggregateHandlerPolicy(t *testing.T) {
+	policy, cleanup := writeTestPolicy(t)
+	defer cleanup()
+
+	SetPolicy(policy)
+	defer SetPolicy(nil)
+
+	store := NewMemoryFeedStore(10)
+	appendPolicyTestEvents(t, store)
+
+	handler, err := NewAggregateHandler(store, "testhost:12345")
+	assert.Nil(t, err)
+
+	router := mux.NewRouter()
+	router.HandleFunc(AggregateHandlerURI, handler)
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, principalRequest("/events/order-2", "orders"))
+	assert.Equal(t, http.StatusOK, w.Result().StatusCode)
+	assert.Empty(t, entryIDs(t, w.Body.Bytes()))
+	assert.Equal(t, "private, no-cache", w.Result().Header.Get("Cache-Control"))
+
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, principalRequest("/events/order-2", "billing"))
+	assert.Equal(t, []string{"urn:esid:order-2:1"}, entryIDs(t, w.Body.Bytes()))
+}
+
+//checkAggregateEvents checks the version range and limit semantics of RetrieveAggregateEvents
+func checkAggregateEvents(t *testing.T, store interface {
+	EventAppender
+	AggregateHistoryStore
+}) {
+	appendVersions(t, store, "agg2", 3)
+	appendVersions(t, store, "agg1", 5)
+
+	var tests = []struct {
+		after    int
+		to       int
+		limit    int
+		versions []int
+	}{
+		{0, 0, 10, []int{1, 2, 3, 4, 5}},
+		{2, 0, 10, []int{3, 4, 5}},
+		{0, 3, 10, []int{1, 2, 3}},
+		{1, 4, 2, []int{2, 3}},
+		{5, 0, 10, nil},
+	}
+
+	for _, test := range tests {
+		events, err := store.RetrieveAggregateEvents("agg1", test.after, test.to, test.limit)
+		assert.Nil(t, err)
+
+		var versions []int
+		for _, event := range events {
+			assert.Equal(t, "agg1", event.Source)
+			versions = append(versions, event.Version)
+		}
+
+		assert.Equal(t, test.versions, versions, "%v", test)
+	}
+}
+
+//countingHistoryStore counts the calls made to an aggregate history store
+type countingHistoryStore struct {
+	AggregateHistoryStore
+	calls int
+}
+
+func (chs *countingHistoryStore) RetrieveAggregateEvents(aggregateID string, afterVersion, toVersion, limit int) ([]atomdata.TimestampedEvent, error) {
+	chs.calls++
+	return chs.AggregateHistoryStore.RetrieveAggregateEvents(aggregateID, afterVersion, toVersion, limit)
+}
+
+func TestMatchingHistory(t *testing.T) {
+	memoryStore := NewMemoryFeedStore(10)
+	appendVersions(t, memoryStore, "agg1", 250)
+	store := &countingHistoryStore{AggregateHistoryStore: memoryStore}
+
+	filter := &eventFilter{types: typeFilter{"even"}}
+	events, found, err := matchingHistory(store, "agg1", 0, 0, 3, filter)
+	assert.Nil(t, err)
+	assert.True(t, found)
+	if assert.Equal(t, 3, len(events)) {
+		assert.Equal(t, 6, events[2].Version)
+	}
+
+	//Batches are retrieved until enough matching events are found
+	events, _, err = matchingHistory(store, "agg1", 0, 0, 120, filter)
+	assert.Nil(t, err)
+	if assert.Equal(t, 120, len(events)) {
+		assert.Equal(t, 240, events[119].Version)
+	}
+
+	store.calls = 0
+	events, found, err = matchingHistory(store, "agg1", 0, 0, 10, &eventFilter{types: typeFilter{"other"}})
+	assert.Nil(t, err)
+	assert.True(t, found)
+	assert.Empty(t, events)
+	assert.Equal(t, 3, store.calls)
+
+	//Without a filter a single retrieval fills the page
+	store.calls = 0
+	events, _, err = matchingHistory(store, "agg1", 0, 0, 10, &eventFilter{})
+	assert.Nil(t, err)
+	assert.Equal(t, 10, len(events))
+	assert.Equal(t, 1, store.calls)
+}
+
+func TestMemoryFeedStoreAggregateEvents(t *testing.T) {
+	checkAggregateEvents(t, NewMemoryFeedStore(2))
+}
@@ -0,0 +1,232 @@
+package atompubsvc
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	"net/http"
+	"strings"
+	"time"
+)
+
+//FeedIndexHandlerURI is where the index of archived feeds is served
+const FeedIndexHandlerURI = "/notifications"
+
+//FeedSeekParam is the query parameter of the feed index giving a time to seek to, e.g.
+///notifications?at=2017-01-01T00:00:00Z
+const FeedSeekParam = "at"
+
+var ErrBadSeekTime = errors.New("at must be an RFC 3339 timestamp")
+
+//FeedIndexStore is implemented by stores that can summarize their archived feeds. RetrieveFirstFeed
+//returns the id of the oldest feed, or the empty string if no feeds have been archived, and
+//RetrieveFeedIndex returns a summary of each feed, oldest first. RetrieveFeedAt returns the id of
+//the feed holding the first event at or after the given time, ordered by event time and then by
+//publication order, or the empty string if that event has not been archived or there is no such
+//event. The SQL stores rely on an index on the event time to find it.
+type FeedIndexStore interface {
+	RetrieveFirstFeed() (string, error)
+	RetrieveFeedIndex() ([]FeedSummary, error)
+	RetrieveFeedAt(at time.Time) (string, error)
+}
+
+//FeedSummary describes an archived feed: its id, the number of events it holds, and the
+//timestamps of its first and last events.
+type FeedSummary struct {
+	FeedID string
+	Events int
+	First  time.Time
+	Last   time.Time
+}
+
+//FeedIndex is the representation of the feed index, listing the archived feeds oldest first
+//along with the URI of the recent feed.
+type FeedIndex struct {
+	XMLName xml.Name         `xml:"http://github.com/xtracdev/es-atom-pub feeds" json:"-"`
+	Current string           `xml:"current" json:"current"`
+	Feeds   []FeedIndexEntry `xml:"feed" json:"feeds"`
+}
+
+//FeedIndexEntry is the representation of a feed summary in the index, with the URI of the feed
+type FeedIndexEntry struct {
+	ID     string    `xml:"id" json:"id"`
+	Href   string    `xml:"href" json:"href"`
+	Events int       `xml:"events" json:"events"`
+	First  time.Time `xml:"first" json:"first"`
+	Last   time.Time `xml:"last" json:"last"`
+}
+
+//firstFeed returns the oldest feed holding events passing the filter, or the empty string if
+//there is no such feed or the store cannot tell which feed is the oldest.
+func firstFeed(store FeedStore, filter *eventFilter) (string, error) {
+	var first string
+	var err error
+
+	if typedStore, ok := store.(TypedFeedStore); ok && len(filter.types) > 0 {
+		first, err = typedStore.RetrieveFirstTypedFeed(filter.types)
+	} else if indexStore, ok := store.(FeedIndexStore); ok {
+		first, err = indexStore.RetrieveFirstFeed()
+	} else {
+		return "", nil
+	}
+
+	if err != nil {
+		return "", err
+	}
+
+	return filter.matchingFeed(store, first, false)
+}
+
+//lastFeed returns the newest feed holding events passing the filter, or the empty string if there
+//is no such feed
+func lastFeed(store FeedStore, filter *eventFilter) (string, error) {
+	last, err := store.RetrieveLastFeed()
+	if err != nil {
+		return "", err
+	}
+
+	return filter.matchingFeed(store, last, true)
+}
+
+//NewFeedIndexHandler instantiates a handler returning the index of archived feeds, served up at
+///notifications. Each feed is listed with its URI, event count and the timestamps of its first and
+//last events, so clients can start reading the archives from an arbitrary point rather than
+//walking the prev-archive links from the recent feed. The index is returned as XML or JSON as
+//negotiated via the Accept header. The counts are of all the events in each feed, before any
+//access policy is applied.
+//
+//Requests with an at query parameter are instead redirected to the feed holding the first event
+//at or after that time, or to the recent feed if that event has not been archived or there is no
+//such event, so consumers can replay from a point in time. Any type query parameter is carried
+//over to the feed. Requests with an entry query parameter giving an atom entry id are redirected
+//to the location of the event, served at /events/{aggregateId}/{version}/feed.
+func NewFeedIndexHandler(store FeedIndexStore, linkhostport string) (func(rw http.ResponseWriter, req *http.Request), error) {
+	if store == nil {
+		return nil, ErrNilFeedStore
+	}
+
+	return func(rw http.ResponseWriter, req *http.Request) {
+		svc := "notifications-index"
+		start := time.Now()
+
+		if at := req.URL.Query().Get(FeedSeekParam); at != "" {
+			seek(rw, req, store, linkhostport, at)
+			return
+		}
+
+		if entry := req.URL.Query().Get(EntryParam); entry != "" {
+			locateEntry(rw, req, linkhostport, entry)
+			return
+		}
+
+		summaries, err := store.RetrieveFeedIndex()
+		if err != nil {
+			logTimingStats(svc, start, err)
+			log.Warnf("Error retrieving feed index: %s", err.Error())
+			http.Error(rw, "Error retrieving feed index", http.StatusInternalServerError)
+			return
+		}
+
+		//Archived feeds are immutable, so the index only changes when a feed is added, and
+		//is identified by its last feed
+		contentType := eventContentType(req)
+		etag := "index"
+		var modified time.Time
+		if len(summaries) > 0 {
+			etag += "-" + summaries[len(summaries)-1].FeedID
+			modified = summaries[len(summaries)-1].Last
+		}
+
+		etag = representationETag(etag, contentType)
+		if notModified(req, etag, modified) {
+			writeNotModified(rw, "no-cache", etag, modified)
+			logTimingStats(svc, start, nil)
+			return
+		}
+
+		index := FeedIndex{
+			Current: fmt.Sprintf("%s://%s/notifications/recent", linkProto, linkhostport),
+			Feeds:   []FeedIndexEntry{},
+		}
+
+		for _, summary := range summaries {
+			index.Feeds = append(index.Feeds, FeedIndexEntry{
+				ID:     summary.FeedID,
+				Href:   fmt.Sprintf("%s://%s/notifications/%s", linkProto, linkhostport, summary.FeedID),
+				Events: summary.Events,
+				First:  summary.First,
+				Last:   summary.Last,
+			})
+		}
+
+		var out []byte
+		if contentType == JSONContentType {
+			out, err = json.Marshal(&index)
+		} else {
+			out, err = xml.Marshal(&index)
+		}
+
+		if err != nil {
+			logTimingStats(svc, start, err)
+			http.Error(rw, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		encodedOut, err := encryptOutput(keyProvider, out)
+		if err != nil {
+			logTimingStats(svc, start, err)
+			http.Error(rw, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		err = signResponse(responseSigner, rw, encodedOut)
+		if err != nil {
+			logTimingStats(svc, start, err)
+			http.Error(rw, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		rw.Header().Add("Cache-Control", "no-cache")
+		rw.Header().Add("Content-Type", contentType)
+		rw.Header().Add("Vary", "Accept")
+		setValidators(rw, etag, modified)
+		rw.Write(encodedOut)
+		logTimingStats(svc, start, nil)
+	}, nil
+}
+
+//seek redirects to the feed holding the first event at or after the given time
+func seek(rw http.ResponseWriter, req *http.Request, store FeedIndexStore, linkhostport, at string) {
+	svc := "notifications-seek"
+	start := time.Now()
+
+	//A + in an unescaped offset is decoded as a space
+	seekTime, err := time.Parse(time.RFC3339Nano, strings.Replace(at, " ", "+", -1))
+	if err != nil {
+		logTimingStats(svc, start, ErrBadSeekTime)
+		http.Error(rw, ErrBadSeekTime.Error(), http.StatusBadRequest)
+		return
+	}
+
+	feedID, err := store.RetrieveFeedAt(seekTime)
+	if err != nil {
+		logTimingStats(svc, start, err)
+		log.Warnf("Error retrieving feed at %s: %s", at, err.Error())
+		http.Error(rw, "Error retrieving feed id", http.StatusInternalServerError)
+		return
+	}
+
+	if feedID == "" {
+		feedID = "recent"
+	}
+
+	log.Infof("Feed at %s is %s", at, feedID)
+
+	//Events at the time may yet be archived, so the redirect is not cached
+	location := fmt.Sprintf("%s://%s/notifications/%s%s", linkProto, linkhostport, feedID, parseTypeFilter(req).query())
+	rw.Header().Add("Cache-Control", "no-cache")
+	http.Redirect(rw, req, location, http.StatusFound)
+	logTimingStats(svc, start, nil)
+}
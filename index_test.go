@@ -0,0 +1,207 @@
+package atompubsvc
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"github.com/stretchr/testify/assert"
+	"github.com/xtracdev/es-atom-pub/internal/testevents"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+//checkFeedIndex checks the index of a store archiving every two events
+func checkFeedIndex(t *testing.T, store interface {
+	EventAppender
+	FeedStore
+	FeedIndexStore
+}) {
+	first, err := store.RetrieveFirstFeed()
+	assert.Nil(t, err)
+	assert.Equal(t, "", first)
+
+	summaries, err := store.RetrieveFeedIndex()
+	assert.Nil(t, err)
+	assert.Empty(t, summaries)
+
+	testevents.Append(t, store, "foo", "agg1", "agg2", "agg3", "agg4", "agg5")
+
+	first, err = store.RetrieveFirstFeed()
+	assert.Nil(t, err)
+	last, err := store.RetrieveLastFeed()
+	assert.Nil(t, err)
+	previous, err := store.RetrievePreviousFeed(last)
+	assert.Nil(t, err)
+	assert.Equal(t, previous.String, first)
+
+	summaries, err = store.RetrieveFeedIndex()
+	assert.Nil(t, err)
+	if assert.Equal(t, 2, len(summaries)) {
+		assert.Equal(t, first, summaries[0].FeedID)
+		assert.Equal(t, last, summaries[1].FeedID)
+
+		for i, summary := range summaries {
+			events, err := store.RetrieveArchive(summary.FeedID)
+			assert.Nil(t, err)
+			if assert.Equal(t, 2, len(events), "feed %d", i) {
+				assert.Equal(t, 2, summary.Events)
+				assert.True(t, summary.First.Equal(events[1].Timestamp))
+				assert.True(t, summary.Last.Equal(events[0].Timestamp))
+			}
+		}
+	}
+}
+
+func TestMemoryFeedStoreIndex(t *testing.T) {
+	checkFeedIndex(t, NewMemoryFeedStore(2))
+}
+
+func TestFeedIndexHandler(t *testing.T) {
+	_, err := NewFeedIndexHandler(nil, "testhost:12345")
+	assert.Equal(t, ErrNilFeedStore, err)
+
+	store := NewMemoryFeedStore(2)
+	handler, err := NewFeedIndexHandler(store, "testhost:12345")
+	if !assert.Nil(t, err) {
+		return
+	}
+
+	get := func(accept, ifNoneMatch string) *httptest.ResponseRecorder {
+		r, _ := http.NewRequest("GET", FeedIndexHandlerURI, nil)
+		r.Header.Set("Accept", accept)
+		r.Header.Set("If-None-Match", ifNoneMatch)
+		w := httptest.NewRecorder()
+		handler(w, r)
+		return w
+	}
+
+	//With nothing archived the index is empty
+	w := get("", "")
+	assert.Equal(t, http.StatusOK, w.Result().StatusCode)
+	assert.Equal(t, `"index"`, w.Header().Get("ETag"))
+
+	var index FeedIndex
+	if assert.Nil(t, json.Unmarshal(get(JSONContentType, "").Body.Bytes(), &index)) {
+		assert.Equal(t, "https://testhost:12345/notifications/recent", index.Current)
+		assert.NotNil(t, index.Feeds)
+		assert.Empty(t, index.Feeds)
+	}
+
+	testevents.Append(t, store, "foo", "agg1", "agg2", "agg3", "agg4", "agg5")
+	last, err := store.RetrieveLastFeed()
+	assert.Nil(t, err)
+
+	w = get("", "index")
+	assert.Equal(t, http.StatusOK, w.Result().StatusCode)
+	assert.Equal(t, XMLContentType, w.Header().Get("Content-Type"))
+	assert.Equal(t, "no-cache", w.Header().Get("Cache-Control"))
+	assert.Equal(t, `"index-`+last+`"`, w.Header().Get("ETag"))
+	assert.NotEqual(t, "", w.Header().Get("Last-Modified"))
+
+	index = FeedIndex{}
+	if assert.Nil(t, xml.Unmarshal(w.Body.Bytes(), &index)) && assert.Equal(t, 2, len(index.Feeds)) {
+		assert.Equal(t, last, index.Feeds[1].ID)
+		assert.Equal(t, "https://testhost:12345/notifications/"+last, index.Feeds[1].Href)
+		assert.Equal(t, 2, index.Feeds[0].Events)
+		assert.False(t, index.Feeds[0].First.IsZero())
+		assert.False(t, index.Feeds[1].Last.Before(index.Feeds[0].Last))
+	}
+
+	//The index only changes when a feed is archived
+	w = get("", "index-"+last)
+	assert.Equal(t, http.StatusNotModified, w.Result().StatusCode)
+
+	w = get(JSONContentType, "index-"+last)
+	assert.Equal(t, http.StatusOK, w.Result().StatusCode)
+	assert.Equal(t, JSONContentType, w.Header().Get("Content-Type"))
+	assert.Equal(t, `"index-`+last+`+json"`, w.Header().Get("ETag"))
+}
+
+//checkFeedSeek checks seeking by time in a store archiving every two events
+func checkFeedSeek(t *testing.T, store interface {
+	EventAppender
+	FeedStore
+	FeedIndexStore
+}) {
+	before := time.Now().Add(-time.Hour)
+
+	feedID, err := store.RetrieveFeedAt(before)
+	assert.Nil(t, err)
+	assert.Equal(t, "", feedID)
+
+	//Events are spaced out so each has a distinct timestamp
+	for _, aggID := range []string{"agg1", "agg2", "agg3", "agg4", "agg5"} {
+		testevents.Append(t, store, "foo", aggID)
+		time.Sleep(2 * time.Millisecond)
+	}
+
+	summaries, err := store.RetrieveFeedIndex()
+	assert.Nil(t, err)
+	recent, err := store.RetrieveRecent()
+	assert.Nil(t, err)
+	if !assert.Equal(t, 2, len(summaries)) || !assert.Equal(t, 1, len(recent)) {
+		return
+	}
+
+	var tests = []struct {
+		at       time.Time
+		expected string
+	}{
+		{before, summaries[0].FeedID},
+		{summaries[0].Last, summaries[0].FeedID},
+		{summaries[0].Last.Add(time.Nanosecond), summaries[1].FeedID},
+		{summaries[1].First, summaries[1].FeedID},
+		{summaries[1].Last.Add(time.Nanosecond), ""},
+		{recent[0].Timestamp, ""},
+		{time.Now().Add(time.Hour), ""},
+	}
+
+	for i, test := range tests {
+		feedID, err := store.RetrieveFeedAt(test.at)
+		assert.Nil(t, err)
+		assert.Equal(t, test.expected, feedID, "seek %d", i)
+	}
+}
+
+func TestMemoryFeedStoreSeek(t *testing.T) {
+	checkFeedSeek(t, NewMemoryFeedStore(2))
+}
+
+func TestFeedSeek(t *testing.T) {
+	store := NewMemoryFeedStore(2)
+	handler, err := NewFeedIndexHandler(store, "testhost:12345")
+	if !assert.Nil(t, err) {
+		return
+	}
+
+	testevents.Append(t, store, "foo", "agg1", "agg2", "agg3")
+	first, err := store.RetrieveFirstFeed()
+	assert.Nil(t, err)
+
+	var tests = []struct {
+		query            string
+		expectedStatus   int
+		expectedLocation string
+	}{
+		{"at=2017-01-01T00:00:00Z", http.StatusFound, "https://testhost:12345/notifications/" + first},
+		{"at=2017-01-01T01:00:00+01:00&type=foo", http.StatusFound, "https://testhost:12345/notifications/" + first + "?type=foo"},
+		{"at=2017-01-01T01:00:00.5%2B01:00", http.StatusFound, "https://testhost:12345/notifications/" + first},
+		{"at=" + time.Now().Add(time.Hour).Format(time.RFC3339), http.StatusFound, "https://testhost:12345/notifications/recent"},
+		{"at=yesterday", http.StatusBadRequest, ""},
+	}
+
+	for _, test := range tests {
+		t.Run(test.query, func(t *testing.T) {
+			r, _ := http.NewRequest("GET", FeedIndexHandlerURI+"?"+test.query, nil)
+			w := httptest.NewRecorder()
+			handler(w, r)
+
+			assert.Equal(t, test.expectedStatus, w.Result().StatusCode)
+			assert.Equal(t, test.expectedLocation, w.Header().Get("Location"))
+			if test.expectedStatus == http.StatusFound {
+				assert.Equal(t, "no-cache", w.Header().Get("Cache-Control"))
+			}
+		})
+	}
+}
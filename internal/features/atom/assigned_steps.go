@@ -89,7 +89,12 @@ func init() {
 		assert.Nil(T, err)
 		log.Infof("get feed it %s", feedID)
 
-		archiveHandler, err := atompub.NewArchiveHandler(db, "server:12345")
+		store, err := atompub.NewOracleFeedStore(db)
+		if !assert.Nil(T, err) {
+			return
+		}
+
+		archiveHandler, err := atompub.NewArchiveHandler(store, "server:12345")
 		if !assert.Nil(T, err) {
 			return
 		}
@@ -206,7 +211,12 @@ func init() {
 	When(`^I do a get on the feedX resource id$`, func() {
 		var err error
 
-		archiveHandler, err := atompub.NewArchiveHandler(db, "server:12345")
+		store, err := atompub.NewOracleFeedStore(db)
+		if !assert.Nil(T, err) {
+			return
+		}
+
+		archiveHandler, err := atompub.NewArchiveHandler(store, "server:12345")
 		if !assert.Nil(T, err) {
 			return
 		}
@@ -275,7 +285,12 @@ func init() {
 	When(`^I retrieve the event by its id$`, func() {
 		var err error
 
-		eventHandler, err := atompub.NewEventRetrieveHandler(db)
+		store, err := atompub.NewOracleFeedStore(db)
+		if !assert.Nil(T, err) {
+			return
+		}
+
+		eventHandler, err := atompub.NewEventRetrieveHandler(store, "server:12345")
 		if !assert.Nil(T, err) {
 			return
 		}
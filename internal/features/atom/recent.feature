@@ -7,7 +7,7 @@ Feature: Read recent events
     Then the events not yet assigned to a feed are returned
     And there is no previous link relationship
     And there is no next link relationship
-    And cache headers indicate the resource is not cacheable
+    And cache headers indicate the resource must be revalidated
 
   Scenario:
     Given some more events not yet assigned to a feed
@@ -16,4 +16,4 @@ Feature: Read recent events
     Then then events not yet assigned to a feed are returned
     And the previous link relationship refers to the most recently created feed
     And there is no next link relationship
-    And cache headers indicate the resource is not cacheable
+    And cache headers indicate the resource must be revalidated
@@ -75,7 +75,12 @@ func init() {
 
 	When(`^I retrieve the recent resource$`, func() {
 		//Create a test server
-		recentHandler, err := atompub.NewRecentHandler(db, "server:12345")
+		store, err := atompub.NewOracleFeedStore(db)
+		if !assert.Nil(T, err) {
+			return
+		}
+
+		recentHandler, err := atompub.NewRecentHandler(store, "server:12345")
 		if !assert.Nil(T, err) {
 			return
 		}
@@ -120,8 +125,8 @@ func init() {
 		assert.Nil(T, getLink("next-archive", &feed))
 	})
 
-	And(`^cache headers indicate the resource is not cacheable$`, func() {
-		assert.Equal(T, cacheControl, "no-store")
+	And(`^cache headers indicate the resource must be revalidated$`, func() {
+		assert.Equal(T, cacheControl, "no-cache")
 	})
 
 	Given(`^some more events not yet assigned to a feed$`, func() {
@@ -152,7 +157,12 @@ func init() {
 	})
 
 	When(`^I again retrieve the recent resource$`, func() {
-		recentHandler, err := atompub.NewRecentHandler(db, "server:12345")
+		store, err := atompub.NewOracleFeedStore(db)
+		if !assert.Nil(T, err) {
+			return
+		}
+
+		recentHandler, err := atompub.NewRecentHandler(store, "server:12345")
 		if !assert.Nil(T, err) {
 			return
 		}
@@ -0,0 +1,32 @@
+//Package testevents appends events to feed stores for the tests of the service and client
+package testevents
+
+import (
+	"github.com/stretchr/testify/assert"
+	"github.com/xtracdev/goes"
+	"testing"
+)
+
+//Appender is implemented by the feed stores accepting events directly
+type Appender interface {
+	Append(event *goes.Event) error
+}
+
+//Append appends the first version of each aggregate, with the given type code and the payload
+//"ok " followed by the aggregate id
+func Append(t *testing.T, store Appender, typeCode string, aggregateIDs ...string) {
+	for _, aggID := range aggregateIDs {
+		AppendPayload(t, store, aggID, typeCode, "ok "+aggID)
+	}
+}
+
+//AppendPayload appends the first version of an aggregate with the given type code and payload
+func AppendPayload(t *testing.T, store Appender, aggregateID, typeCode, payload string) {
+	err := store.Append(&goes.Event{
+		Source:   aggregateID,
+		Version:  1,
+		TypeCode: typeCode,
+		Payload:  []byte(payload),
+	})
+	assert.Nil(t, err)
+}
@@ -0,0 +1,257 @@
+package atompubsvc
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"encoding/xml"
+	"golang.org/x/tools/blog/atom"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+//Media types produced by the handlers. The Accept header of the request determines which of
+//the feed or event representations are returned, with XML being the default.
+const (
+	AtomContentType     = "application/atom+xml"
+	XMLContentType      = "application/xml"
+	JSONFeedContentType = "application/feed+json"
+	JSONContentType     = "application/json"
+	JSONFeedVersion     = "https://jsonfeed.org/version/1.1"
+	atomExtensionAbout  = "https://github.com/xtracdev/es-atom-pub#json-feed"
+)
+
+//FeedHistoryNamespace is the namespace of the RFC 5005 feed history elements
+const FeedHistoryNamespace = "http://purl.org/syndication/history/1.0"
+
+//JSONFeed is the JSON Feed 1.1 representation of an atom feed page. The atom feed id and
+//link relations are carried in the _atom extension so consumers can navigate the archives in
+//the same way as with the atom representation.
+type JSONFeed struct {
+	Version string         `json:"version"`
+	Title   string         `json:"title"`
+	FeedURL string         `json:"feed_url,omitempty"`
+	NextURL string         `json:"next_url,omitempty"`
+	Atom    JSONFeedAtom   `json:"_atom"`
+	Items   []JSONFeedItem `json:"items"`
+}
+
+//JSONFeedAtom is the _atom extension object for a feed. Archive is set for archive documents,
+//corresponding to the fh:archive element of the atom representation.
+type JSONFeedAtom struct {
+	About   string         `json:"about"`
+	ID      string         `json:"id"`
+	Updated string         `json:"updated,omitempty"`
+	Archive bool           `json:"archive,omitempty"`
+	Links   []JSONFeedLink `json:"links"`
+}
+
+//JSONFeedLink is an atom link relation
+type JSONFeedLink struct {
+	Rel  string `json:"rel"`
+	Href string `json:"href"`
+}
+
+//JSONFeedItem is the JSON Feed representation of a feed entry. The id is the same as the atom
+//entry id, e.g. urn:esid:aggregateId:version, and content_text holds the base64 encoded event
+//payload, or the payload as is for text payloads of a declared media type.
+type JSONFeedItem struct {
+	ID            string           `json:"id"`
+	URL           string           `json:"url,omitempty"`
+	Title         string           `json:"title,omitempty"`
+	ContentText   string           `json:"content_text"`
+	DatePublished string           `json:"date_published,omitempty"`
+	Atom          JSONFeedItemAtom `json:"_atom"`
+}
+
+//JSONFeedItemAtom is the _atom extension object for an item. The content type is the payload
+//media type where content_text holds the payload as is, and otherwise the type code.
+type JSONFeedItemAtom struct {
+	About       string         `json:"about"`
+	ContentType string         `json:"content_type"`
+	TypeCode    string         `json:"typecode,omitempty"`
+	Links       []JSONFeedLink `json:"links"`
+}
+
+func jsonLinks(links []atom.Link) []JSONFeedLink {
+	jsonLinks := []JSONFeedLink{}
+	for _, l := range links {
+		jsonLinks = append(jsonLinks, JSONFeedLink{Rel: l.Rel, Href: l.Href})
+	}
+
+	return jsonLinks
+}
+
+func linkHref(links []atom.Link, rel string) string {
+	for _, l := range links {
+		if l.Rel == rel {
+			return l.Href
+		}
+	}
+
+	return ""
+}
+
+//NewJSONFeed converts an atom feed to its JSON Feed representation. The JSON Feed next_url
+//refers to older items, and so is the prev-archive link of the atom feed.
+func NewJSONFeed(feed *atom.Feed) *JSONFeed {
+	jsonFeed := &JSONFeed{
+		Version: JSONFeedVersion,
+		Title:   feed.Title,
+		FeedURL: linkHref(feed.Link, "self"),
+		NextURL: linkHref(feed.Link, "prev-archive"),
+		Atom: JSONFeedAtom{
+			About:   atomExtensionAbout,
+			ID:      feed.ID,
+			Updated: string(feed.Updated),
+			Links:   jsonLinks(feed.Link),
+		},
+		Items: []JSONFeedItem{},
+	}
+
+	for _, entry := range feed.Entry {
+		item := JSONFeedItem{
+			ID:            entry.ID,
+			URL:           linkHref(entry.Link, "self"),
+			Title:         entry.Title,
+			DatePublished: string(entry.Published),
+			Atom: JSONFeedItemAtom{
+				About: atomExtensionAbout,
+				Links: jsonLinks(entry.Link),
+			},
+		}
+
+		if entry.Content != nil {
+			item.ContentText = entry.Content.Body
+			item.Atom.ContentType = entry.Content.Type
+			item.Atom.TypeCode = entry.Content.Type
+
+			//Entries hold payloads of declared media types as is, and only text ones may be
+			//carried as is in JSON
+			if payloadType(entry.Content.Type) != "" {
+				payload := []byte(entry.Content.Body)
+				if mediaType, ok := textPayload(entry.Content.Type, payload); ok {
+					item.Atom.ContentType = mediaType
+				} else {
+					item.ContentText = base64.StdEncoding.EncodeToString(payload)
+				}
+			}
+		}
+
+		jsonFeed.Items = append(jsonFeed.Items, item)
+	}
+
+	return jsonFeed
+}
+
+//acceptsJSON returns true if the request Accept header prefers one of the JSON media types
+//to the XML ones. Ties go to XML, so requests without an Accept header, or accepting */*,
+//get the atom representation.
+func acceptsJSON(req *http.Request) bool {
+	var xmlQ, jsonQ float64
+
+	for _, accepted := range strings.Split(req.Header.Get("Accept"), ",") {
+		parts := strings.Split(accepted, ";")
+		mediaRange := strings.ToLower(strings.TrimSpace(parts[0]))
+
+		q := 1.0
+		for _, param := range parts[1:] {
+			param = strings.TrimSpace(param)
+			if strings.HasPrefix(param, "q=") {
+				if parsed, err := strconv.ParseFloat(param[2:], 64); err == nil {
+					q = parsed
+				}
+			}
+		}
+
+		switch mediaRange {
+		case JSONFeedContentType, JSONContentType:
+			if q > jsonQ {
+				jsonQ = q
+			}
+		case AtomContentType, XMLContentType, "text/xml", "*/*", "application/*":
+			if q > xmlQ {
+				xmlQ = q
+			}
+		}
+	}
+
+	return jsonQ > xmlQ
+}
+
+//feedContentType returns the feed media type negotiated via the request Accept header
+func feedContentType(req *http.Request) string {
+	if acceptsJSON(req) {
+		return JSONFeedContentType
+	}
+
+	return AtomContentType
+}
+
+//eventContentType returns the event media type negotiated via the request Accept header
+func eventContentType(req *http.Request) string {
+	if acceptsJSON(req) {
+		return JSONContentType
+	}
+
+	return XMLContentType
+}
+
+//marshalFeed serializes the feed as atom XML or JSON Feed as negotiated via the request
+//Accept header, returning the serialized feed and its content type.
+func marshalFeed(req *http.Request, feed *atom.Feed) ([]byte, string, error) {
+	contentType := feedContentType(req)
+	if contentType == JSONFeedContentType {
+		out, err := json.Marshal(NewJSONFeed(feed))
+		return out, contentType, err
+	}
+
+	out, err := xml.Marshal(newAtomFeed(feed, false))
+	return out, contentType, err
+}
+
+//marshalArchive serializes an archived feed as marshalFeed does, marking the document as an
+//archive document whose entries will not change, as per RFC 5005.
+func marshalArchive(req *http.Request, feed *atom.Feed) ([]byte, string, error) {
+	contentType := feedContentType(req)
+	if contentType == JSONFeedContentType {
+		jsonFeed := NewJSONFeed(feed)
+		jsonFeed.Atom.Archive = true
+		out, err := json.Marshal(jsonFeed)
+		return out, contentType, err
+	}
+
+	out, err := xml.Marshal(newAtomFeed(feed, true))
+	return out, contentType, err
+}
+
+//marshalEvent serializes event store content as XML or JSON as negotiated via the request
+//Accept header, returning the serialized event and its content type.
+func marshalEvent(req *http.Request, event *EventStoreContent) ([]byte, string, error) {
+	contentType := eventContentType(req)
+	if contentType == JSONContentType {
+		out, err := json.Marshal(event)
+		return out, contentType, err
+	}
+
+	out, err := xml.Marshal(event)
+	return out, contentType, err
+}
+
+//representationETag qualifies the entity tag of a resource with its representation, so the
+//XML and JSON representations of a feed page or event have distinct entity tags, and tags
+//issued before the payload types or registered transformers changed no longer match. The XML
+//representation with neither payload types nor transformers uses the unqualified tag.
+func representationETag(etag, contentType string) string {
+	for _, key := range []string{payloadTypesKey(), transformersKey()} {
+		if key != "" {
+			etag += "-" + key
+		}
+	}
+
+	if contentType == JSONFeedContentType || contentType == JSONContentType {
+		return etag + "+json"
+	}
+
+	return etag
+}
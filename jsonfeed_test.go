@@ -0,0 +1,138 @@
+package atompubsvc
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+	"github.com/xtracdev/es-atom-pub/internal/testevents"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+)
+
+func TestAcceptsJSON(t *testing.T) {
+	var acceptTests = []struct {
+		accept   string
+		wantJSON bool
+	}{
+		{"", false},
+		{"*/*", false},
+		{"application/atom+xml", false},
+		{"application/json", true},
+		{"application/feed+json", true},
+		{"application/feed+json, */*;q=0.1", true},
+		{"application/atom+xml, application/json;q=0.9", false},
+		{"application/atom+xml;q=0.5, application/json;q=0.9", true},
+		{"text/html, application/json;q=0.8", true},
+	}
+
+	for _, test := range acceptTests {
+		r, err := http.NewRequest("GET", "/", nil)
+		assert.Nil(t, err)
+		r.Header.Set("Accept", test.accept)
+		assert.Equal(t, test.wantJSON, acceptsJSON(r), test.accept)
+	}
+}
+
+func TestJSONFeedRepresentation(t *testing.T) {
+	os.Unsetenv("KEY_ALIAS")
+
+	store := NewMemoryFeedStore(2)
+	testevents.Append(t, store, "foo", "agg1", "agg2", "agg3", "agg4", "agg5")
+
+	recentHandler, err := NewRecentHandler(store, "testhost:12345")
+	assert.Nil(t, err)
+	archiveHandler, err := NewArchiveHandler(store, "testhost:12345")
+	assert.Nil(t, err)
+	eventHandler, err := NewEventRetrieveHandler(store, "testhost:12345")
+	assert.Nil(t, err)
+
+	router := mux.NewRouter()
+	router.HandleFunc(RecentHandlerURI, recentHandler)
+	router.HandleFunc(ArchiveHandlerURI, archiveHandler)
+	router.HandleFunc(RetrieveEventHanderURI, eventHandler)
+
+	get := func(uri string) *httptest.ResponseRecorder {
+		r, err := http.NewRequest("GET", uri, nil)
+		assert.Nil(t, err)
+		r.Header.Set("Accept", "application/feed+json, application/json")
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, r)
+		return w
+	}
+
+	lastFeed, err := store.RetrieveLastFeed()
+	assert.Nil(t, err)
+	previous, err := store.RetrievePreviousFeed(lastFeed)
+	assert.Nil(t, err)
+
+	w := get(RecentHandlerURI)
+	assert.Equal(t, http.StatusOK, w.Result().StatusCode)
+	assert.Equal(t, JSONFeedContentType, w.Header().Get("Content-Type"))
+	assert.Equal(t, "Accept", w.Header().Get("Vary"))
+
+	var feed JSONFeed
+	err = json.Unmarshal(w.Body.Bytes(), &feed)
+	if assert.Nil(t, err) {
+		assert.Equal(t, JSONFeedVersion, feed.Version)
+		assert.Equal(t, "recent", feed.Atom.ID)
+		assert.Equal(t, "https://testhost:12345/notifications/recent", feed.FeedURL)
+		prevArchive := fmt.Sprintf("https://testhost:12345/notifications/%s", lastFeed)
+		assert.Equal(t, prevArchive, feed.NextURL)
+		assert.Contains(t, feed.Atom.Links, JSONFeedLink{Rel: "prev-archive", Href: prevArchive})
+		assert.Contains(t, feed.Atom.Links, JSONFeedLink{Rel: "current", Href: feed.FeedURL})
+		assert.Contains(t, feed.Atom.Links, JSONFeedLink{Rel: "last", Href: prevArchive})
+		assert.False(t, feed.Atom.Archive)
+		if assert.Equal(t, 1, len(feed.Items)) {
+			assert.Equal(t, "urn:esid:agg5:1", feed.Items[0].ID)
+			assert.Equal(t, "https://testhost:12345/events/agg5/1", feed.Items[0].URL)
+			assert.Equal(t, "foo", feed.Items[0].Atom.ContentType)
+			assert.Equal(t, base64.StdEncoding.EncodeToString([]byte("ok agg5")), feed.Items[0].ContentText)
+		}
+	}
+
+	w = get(fmt.Sprintf("/notifications/%s", lastFeed))
+	assert.Equal(t, http.StatusOK, w.Result().StatusCode)
+	assert.Equal(t, `"`+lastFeed+`+json"`, w.Header().Get("ETag"))
+
+	feed = JSONFeed{}
+	err = json.Unmarshal(w.Body.Bytes(), &feed)
+	if assert.Nil(t, err) {
+		assert.Equal(t, lastFeed, feed.Atom.ID)
+		assert.Contains(t, feed.Atom.Links, JSONFeedLink{
+			Rel:  "prev-archive",
+			Href: fmt.Sprintf("https://testhost:12345/notifications/%s", previous.String),
+		})
+		assert.Contains(t, feed.Atom.Links, JSONFeedLink{
+			Rel:  "next-archive",
+			Href: "https://testhost:12345/notifications/recent",
+		})
+		assert.Contains(t, feed.Atom.Links, JSONFeedLink{
+			Rel:  "current",
+			Href: "https://testhost:12345/notifications/recent",
+		})
+		assert.Contains(t, feed.Atom.Links, JSONFeedLink{
+			Rel:  "last",
+			Href: fmt.Sprintf("https://testhost:12345/notifications/%s", lastFeed),
+		})
+		assert.True(t, feed.Atom.Archive)
+		assert.Equal(t, 2, len(feed.Items))
+	}
+
+	w = get("/events/agg3/1")
+	assert.Equal(t, http.StatusOK, w.Result().StatusCode)
+	assert.Equal(t, JSONContentType, w.Header().Get("Content-Type"))
+	assert.Equal(t, `"agg3:1+json"`, w.Header().Get("ETag"))
+
+	var event EventStoreContent
+	err = json.Unmarshal(w.Body.Bytes(), &event)
+	if assert.Nil(t, err) {
+		assert.Equal(t, "agg3", event.AggregateId)
+		assert.Equal(t, 1, event.Version)
+		assert.Equal(t, "foo", event.TypeCode)
+		assert.Equal(t, base64.StdEncoding.EncodeToString([]byte("ok agg3")), event.Content)
+	}
+}
@@ -0,0 +1,167 @@
+package atompubsvc
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	log "github.com/Sirupsen/logrus"
+	"io"
+	"os"
+	"strings"
+)
+
+//Encryption formats, selected via the ENCRYPTION_FORMAT environment variable. The envelope
+//format, the default, is base64(encrypted key)::base64(nonce + ciphertext). The JWE format is
+//JWE compact serialization.
+const (
+	EncryptionFormatEnv = "ENCRYPTION_FORMAT"
+	EnvelopeFormat      = "envelope"
+	JWEFormat           = "jwe"
+)
+
+//JWE algorithms used. The data key is the content encryption key. Where the master key is held
+//locally the data key is wrapped with it using A256KW and carried in the JWE encrypted key.
+//Otherwise, as for KMS data keys, the data key is used directly and the data key encrypted by
+//the key provider is carried in the kid header: see jweDirectKeyID.
+const (
+	JWEKeyWrapAlgorithm = "A256KW"
+	JWEDirectAlgorithm  = "dir"
+	JWEEncryption       = "A256GCM"
+)
+
+var ErrBadEncryptionFormat = errors.New("Encryption format must be envelope or jwe")
+var ErrBadKeyWrapInput = errors.New("Key to wrap must be a multiple of 8 bytes and at least 16 bytes")
+
+//Encryption format used when a key provider is configured
+var encryptionFormat = EnvelopeFormat
+
+//JWEHeader is the JWE protected header. With A256KW consumers recover the content encryption
+//key by unwrapping the JWE encrypted key with the master key identified by KeyID. With dir the
+//KeyID carries the encrypted data key.
+type JWEHeader struct {
+	Algorithm  string `json:"alg"`
+	Encryption string `json:"enc"`
+	KeyID      string `json:"kid,omitempty"`
+}
+
+//SetEncryptionFormat sets the encryption format, overriding the format configured from the
+//environment
+func SetEncryptionFormat(format string) error {
+	switch format {
+	case EnvelopeFormat, JWEFormat:
+		encryptionFormat = format
+		return nil
+	default:
+		return ErrBadEncryptionFormat
+	}
+}
+
+func init() {
+	format := os.Getenv(EncryptionFormatEnv)
+	if format == "" {
+		return
+	}
+
+	if err := SetEncryptionFormat(strings.ToLower(format)); err != nil {
+		log.Errorf("Error configuring encryption format: %s. Exiting.", err.Error())
+		os.Exit(1)
+	}
+}
+
+//jweDirectKeyID returns the kid used with the dir algorithm, which is the id of the master key
+//followed by a colon and the base64url encoded data key as encrypted by the key provider, e.g.
+//alias/my-key:AQIDAHh... Consumers split the kid at the last colon, and decrypt the data key with
+//the KMS to obtain the content encryption key.
+func jweDirectKeyID(dataKey *DataKey) string {
+	return dataKey.KeyID + ":" + base64.RawURLEncoding.EncodeToString(dataKey.EncryptedKey)
+}
+
+//encryptJWE encrypts the plaintext with the data key, returning the JWE compact serialization
+func encryptJWE(plaintext []byte, dataKey *DataKey) (string, error) {
+	header := JWEHeader{
+		Algorithm:  JWEKeyWrapAlgorithm,
+		Encryption: JWEEncryption,
+		KeyID:      dataKey.KeyID,
+	}
+
+	if dataKey.WrappedKey == nil {
+		header.Algorithm = JWEDirectAlgorithm
+		header.KeyID = jweDirectKeyID(dataKey)
+	}
+
+	encodedHeader, err := json.Marshal(&header)
+	if err != nil {
+		return "", err
+	}
+
+	protected := base64.RawURLEncoding.EncodeToString(encodedHeader)
+
+	block, err := aes.NewCipher(dataKey.Plaintext[:])
+	if err != nil {
+		return "", err
+	}
+
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return "", err
+	}
+
+	iv := make([]byte, gcm.NonceSize())
+	_, err = io.ReadFull(rand.Reader, iv)
+	if err != nil {
+		return "", err
+	}
+
+	//The additional authenticated data is the encoded protected header
+	sealed := gcm.Seal(nil, iv, plaintext, []byte(protected))
+	ciphertext, tag := sealed[:len(sealed)-gcm.Overhead()], sealed[len(sealed)-gcm.Overhead():]
+
+	//The JWE encrypted key is empty when the content encryption key is used directly
+	return strings.Join([]string{
+		protected,
+		base64.RawURLEncoding.EncodeToString(dataKey.WrappedKey),
+		base64.RawURLEncoding.EncodeToString(iv),
+		base64.RawURLEncoding.EncodeToString(ciphertext),
+		base64.RawURLEncoding.EncodeToString(tag),
+	}, "."), nil
+}
+
+//aesKeyWrap wraps the key with the key encryption key using the AES key wrap algorithm of
+//RFC 3394, as used by the JWE A256KW algorithm.
+func aesKeyWrap(kek, key []byte) ([]byte, error) {
+	if len(key) < 16 || len(key)%8 != 0 {
+		return nil, ErrBadKeyWrapInput
+	}
+
+	block, err := aes.NewCipher(kek)
+	if err != nil {
+		return nil, err
+	}
+
+	n := len(key) / 8
+	wrapped := make([]byte, 8+len(key))
+	copy(wrapped[8:], key)
+
+	//The integrity check register starts with the default initial value
+	a := []byte{0xa6, 0xa6, 0xa6, 0xa6, 0xa6, 0xa6, 0xa6, 0xa6}
+	b := make([]byte, 16)
+
+	for j := 0; j < 6; j++ {
+		for i := 1; i <= n; i++ {
+			copy(b, a)
+			copy(b[8:], wrapped[i*8:i*8+8])
+			block.Encrypt(b, b)
+
+			t := binary.BigEndian.Uint64(b[:8]) ^ uint64(n*j+i)
+			binary.BigEndian.PutUint64(a, t)
+			copy(wrapped[i*8:], b[8:])
+		}
+	}
+
+	copy(wrapped, a)
+	return wrapped, nil
+}
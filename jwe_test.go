@@ -0,0 +1,162 @@
+package atompubsvc
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"github.com/stretchr/testify/assert"
+	"github.com/xtracdev/es-atom-pub/internal/testevents"
+	"golang.org/x/tools/blog/atom"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+//testDecryptJWE decrypts JWE compact serialization produced with the given key
+func testDecryptJWE(t *testing.T, jwe string, key *[32]byte) (*JWEHeader, []byte) {
+	parts := strings.Split(jwe, ".")
+	if !assert.Equal(t, 5, len(parts)) {
+		t.FailNow()
+	}
+
+	var decoded [][]byte
+	for _, part := range parts {
+		d, err := base64.RawURLEncoding.DecodeString(part)
+		assert.Nil(t, err)
+		decoded = append(decoded, d)
+	}
+
+	var header JWEHeader
+	assert.Nil(t, json.Unmarshal(decoded[0], &header))
+
+	block, err := aes.NewCipher(key[:])
+	assert.Nil(t, err)
+
+	gcm, err := cipher.NewGCM(block)
+	assert.Nil(t, err)
+
+	plaintext, err := gcm.Open(nil, decoded[2], append(decoded[3], decoded[4]...), []byte(parts[0]))
+	assert.Nil(t, err)
+
+	return &header, plaintext
+}
+
+func TestSetEncryptionFormat(t *testing.T) {
+	defer SetEncryptionFormat(EnvelopeFormat)
+
+	assert.Nil(t, SetEncryptionFormat(JWEFormat))
+	assert.Equal(t, JWEFormat, encryptionFormat)
+
+	assert.Equal(t, ErrBadEncryptionFormat, SetEncryptionFormat("pgp"))
+	assert.Equal(t, JWEFormat, encryptionFormat)
+}
+
+func TestEncryptOutputJWE(t *testing.T) {
+	SetEncryptionFormat(JWEFormat)
+	defer SetEncryptionFormat(EnvelopeFormat)
+
+	out, err := encryptOutput(NewFakeKeyProvider(testKey), []byte("secret"))
+	assert.Nil(t, err)
+
+	header, plaintext := testDecryptJWE(t, string(out), &testKey)
+	assert.Equal(t, "dir", header.Algorithm)
+	assert.Equal(t, "A256GCM", header.Encryption)
+	assert.Equal(t, "fake:"+base64.RawURLEncoding.EncodeToString([]byte("fake encrypted key")), header.KeyID)
+	assert.Equal(t, "", strings.Split(string(out), ".")[1])
+	assert.Equal(t, "secret", string(plaintext))
+}
+
+func TestEncryptOutputJWEKeyWrap(t *testing.T) {
+	SetEncryptionFormat(JWEFormat)
+	defer SetEncryptionFormat(EnvelopeFormat)
+
+	masterKey := [32]byte{}
+	copy(masterKey[:], "0123456789abcdef0123456789abcdef")
+
+	out, err := encryptOutput(NewStaticKeyProvider("key-1", &masterKey), []byte("secret"))
+	assert.Nil(t, err)
+
+	parts := strings.Split(string(out), ".")
+	if !assert.Equal(t, 5, len(parts)) {
+		return
+	}
+
+	var header JWEHeader
+	decodedHeader, _ := base64.RawURLEncoding.DecodeString(parts[0])
+	assert.Nil(t, json.Unmarshal(decodedHeader, &header))
+	assert.Equal(t, JWEHeader{Algorithm: "A256KW", Encryption: "A256GCM", KeyID: "key-1"}, header)
+
+	//The JWE encrypted key is the data key wrapped with the master key, 8 bytes longer than the key
+	wrappedKey, err := base64.RawURLEncoding.DecodeString(parts[1])
+	assert.Nil(t, err)
+	assert.Equal(t, 40, len(wrappedKey))
+}
+
+func TestAESKeyWrap(t *testing.T) {
+	//Test vector from RFC 3394 section 4.6, wrapping 256 bits of key data with a 256 bit key
+	kek, _ := hex.DecodeString("000102030405060708090A0B0C0D0E0F101112131415161718191A1B1C1D1E1F")
+	key, _ := hex.DecodeString("00112233445566778899AABBCCDDEEFF000102030405060708090A0B0C0D0E0F")
+
+	wrapped, err := aesKeyWrap(kek, key)
+	assert.Nil(t, err)
+	assert.Equal(t, "28C9F404C4B810F4CBCCB35CFB87F8263F5786E2D80ED326CBC7F0E71A99F43BFB988B9B7A02DD21",
+		strings.ToUpper(hex.EncodeToString(wrapped)))
+
+	_, err = aesKeyWrap(kek, key[:12])
+	assert.Equal(t, ErrBadKeyWrapInput, err)
+}
+
+func TestEncryptJWETamperedHeader(t *testing.T) {
+	jwe, err := encryptJWE([]byte("secret"), &DataKey{Plaintext: &testKey, EncryptedKey: []byte("key")})
+	assert.Nil(t, err)
+
+	parts := strings.Split(jwe, ".")
+	tamperedHeader := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"dir","enc":"A256GCM","kid":"fake:b3RoZXI"}`))
+
+	decoded := func(s string) []byte {
+		d, _ := base64.RawURLEncoding.DecodeString(s)
+		return d
+	}
+
+	block, _ := aes.NewCipher(testKey[:])
+	gcm, _ := cipher.NewGCM(block)
+
+	//The protected header is authenticated
+	_, err = gcm.Open(nil, decoded(parts[2]), append(decoded(parts[3]), decoded(parts[4])...), []byte(tamperedHeader))
+	assert.NotNil(t, err)
+}
+
+func TestRecentHandlerEntryEncryptionJWE(t *testing.T) {
+	SetKeyProvider(NewFakeKeyProvider(testKey))
+	SetEncryptionMode(EntryEncryption)
+	SetEncryptionFormat(JWEFormat)
+	defer SetKeyProvider(nil)
+	defer SetEncryptionMode(DocumentEncryption)
+	defer SetEncryptionFormat(EnvelopeFormat)
+
+	store := NewMemoryFeedStore(2)
+	testevents.Append(t, store, "foo", "agg1")
+
+	handler, err := NewRecentHandler(store, "localhost:12345")
+	assert.Nil(t, err)
+
+	r, _ := http.NewRequest("GET", "/notifications/recent", nil)
+	w := httptest.NewRecorder()
+	handler(w, r)
+
+	assert.Equal(t, http.StatusOK, w.Result().StatusCode)
+
+	var feed atom.Feed
+	err = xml.Unmarshal(w.Body.Bytes(), &feed)
+	if assert.Nil(t, err) && assert.Equal(t, 1, len(feed.Entry)) {
+		entry := feed.Entry[0]
+		assert.Equal(t, "", linkHref(entry.Link, EncryptedKeyRel))
+
+		_, plaintext := testDecryptJWE(t, entry.Content.Body, &testKey)
+		assert.Equal(t, "ok agg1", string(plaintext))
+	}
+}
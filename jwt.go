@@ -0,0 +1,359 @@
+package atompubsvc
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"strings"
+	"time"
+)
+
+//JWT signature algorithms accepted for bearer tokens
+const (
+	RS256 = "RS256"
+	ES256 = "ES256"
+	EdDSA = "EdDSA"
+)
+
+//ClockSkew is the leeway allowed when checking the exp and nbf claims
+const ClockSkew = time.Minute
+
+var ErrBadJWKS = errors.New("JWKS must contain at least one RSA, EC P-256 or Ed25519 public key")
+var ErrMalformedToken = errors.New("Malformed bearer token")
+var ErrUnsupportedTokenAlgorithm = errors.New("Bearer token algorithm must be RS256, ES256 or EdDSA")
+var ErrUnknownTokenKey = errors.New("No key in JWKS matches bearer token")
+var ErrBadTokenSignature = errors.New("Bearer token signature is not valid")
+var ErrTokenExpired = errors.New("Bearer token has expired")
+var ErrTokenNotYetValid = errors.New("Bearer token is not yet valid")
+var ErrBadTokenIssuer = errors.New("Bearer token issuer is not accepted")
+var ErrBadTokenAudience = errors.New("Bearer token audience is not accepted")
+
+//JWK is a JSON web key, holding the members used for RSA, EC and OKP public keys
+type JWK struct {
+	KeyType   string `json:"kty"`
+	KeyID     string `json:"kid,omitempty"`
+	Algorithm string `json:"alg,omitempty"`
+	Use       string `json:"use,omitempty"`
+	N         string `json:"n,omitempty"`
+	E         string `json:"e,omitempty"`
+	Curve     string `json:"crv,omitempty"`
+	X         string `json:"x,omitempty"`
+	Y         string `json:"y,omitempty"`
+}
+
+//JWKS is a JSON web key set
+type JWKS struct {
+	Keys []JWK `json:"keys"`
+}
+
+type verificationKey struct {
+	keyID     string
+	algorithm string
+	publicKey crypto.PublicKey
+}
+
+//JWTAuthenticator authenticates requests carrying a JWT bearer token signed with one of the keys
+//in a JSON web key set.
+type JWTAuthenticator struct {
+	keys     []verificationKey
+	issuer   string
+	audience string
+	now      func() time.Time
+}
+
+//NewJWTAuthenticator returns an authenticator accepting tokens signed by the public keys in the
+//key set. If issuer or audience are not empty, the iss and aud claims must match them. Keys other
+//than RSA, EC P-256 and Ed25519 signature keys are ignored.
+func NewJWTAuthenticator(jwks *JWKS, issuer, audience string) (*JWTAuthenticator, error) {
+	var keys []verificationKey
+	for _, jwk := range jwks.Keys {
+		if jwk.Use != "" && jwk.Use != "sig" {
+			continue
+		}
+
+		key, err := parseJWK(&jwk)
+		if err != nil {
+			return nil, err
+		}
+
+		if key != nil {
+			keys = append(keys, *key)
+		}
+	}
+
+	if len(keys) == 0 {
+		return nil, ErrBadJWKS
+	}
+
+	return &JWTAuthenticator{
+		keys:     keys,
+		issuer:   issuer,
+		audience: audience,
+		now:      time.Now,
+	}, nil
+}
+
+//NewJWTAuthenticatorFromFile returns an authenticator accepting tokens signed by the public keys
+//in the JWKS file.
+func NewJWTAuthenticatorFromFile(path, issuer, audience string) (*JWTAuthenticator, error) {
+	contents, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var jwks JWKS
+	if err := json.Unmarshal(contents, &jwks); err != nil {
+		return nil, fmt.Errorf("Error parsing JWKS file %s: %s", path, err.Error())
+	}
+
+	return NewJWTAuthenticator(&jwks, issuer, audience)
+}
+
+//parseJWK returns the verification key for a JWK, or nil if the key type is not supported
+func parseJWK(jwk *JWK) (*verificationKey, error) {
+	decode := func(member, value string) ([]byte, error) {
+		decoded, err := base64.RawURLEncoding.DecodeString(value)
+		if err != nil || len(decoded) == 0 {
+			return nil, fmt.Errorf("Bad %s member in JWK %s", member, jwk.KeyID)
+		}
+
+		return decoded, nil
+	}
+
+	key := &verificationKey{keyID: jwk.KeyID}
+
+	switch {
+	case jwk.KeyType == "RSA":
+		n, err := decode("n", jwk.N)
+		if err != nil {
+			return nil, err
+		}
+
+		e, err := decode("e", jwk.E)
+		if err != nil {
+			return nil, err
+		}
+
+		exponent := new(big.Int).SetBytes(e)
+		if !exponent.IsInt64() || exponent.Int64() > 1<<31-1 {
+			return nil, fmt.Errorf("Bad e member in JWK %s", jwk.KeyID)
+		}
+
+		key.algorithm = RS256
+		key.publicKey = &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(exponent.Int64())}
+	case jwk.KeyType == "EC" && jwk.Curve == "P-256":
+		x, err := decode("x", jwk.X)
+		if err != nil {
+			return nil, err
+		}
+
+		y, err := decode("y", jwk.Y)
+		if err != nil {
+			return nil, err
+		}
+
+		publicKey := &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+		if !publicKey.Curve.IsOnCurve(publicKey.X, publicKey.Y) {
+			return nil, fmt.Errorf("Point is not on curve in JWK %s", jwk.KeyID)
+		}
+
+		key.algorithm = ES256
+		key.publicKey = publicKey
+	case jwk.KeyType == "OKP" && jwk.Curve == "Ed25519":
+		x, err := decode("x", jwk.X)
+		if err != nil {
+			return nil, err
+		}
+
+		if len(x) != ed25519.PublicKeySize {
+			return nil, fmt.Errorf("Bad x member in JWK %s", jwk.KeyID)
+		}
+
+		key.algorithm = EdDSA
+		key.publicKey = ed25519.PublicKey(x)
+	default:
+		return nil, nil
+	}
+
+	if jwk.Algorithm != "" && jwk.Algorithm != key.algorithm {
+		return nil, nil
+	}
+
+	return key, nil
+}
+
+type jwtHeader struct {
+	Algorithm string `json:"alg"`
+	KeyID     string `json:"kid"`
+}
+
+func (ja *JWTAuthenticator) Authenticate(req *http.Request) (*Principal, error) {
+	authorization := req.Header.Get("Authorization")
+	if len(authorization) < 7 || !strings.EqualFold(authorization[:7], "Bearer ") {
+		return nil, ErrNoCredentials
+	}
+
+	claims, err := ja.validate(strings.TrimSpace(authorization[7:]))
+	if err != nil {
+		return nil, err
+	}
+
+	subject, _ := claims["sub"].(string)
+	return &Principal{Subject: subject, Method: "jwt", Claims: claims}, nil
+}
+
+func (ja *JWTAuthenticator) Challenge(err error) string {
+	if err == ErrNoCredentials {
+		return fmt.Sprintf(`Bearer realm="%s"`, AuthRealm)
+	}
+
+	return fmt.Sprintf(`Bearer realm="%s", error="invalid_token", error_description="%s"`, AuthRealm, err.Error())
+}
+
+//validate checks the token signature and claims, returning the claims of a valid token
+func (ja *JWTAuthenticator) validate(token string) (map[string]interface{}, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, ErrMalformedToken
+	}
+
+	var header jwtHeader
+	if err := decodeTokenPart(parts[0], &header); err != nil {
+		return nil, err
+	}
+
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, ErrMalformedToken
+	}
+
+	switch header.Algorithm {
+	case RS256, ES256, EdDSA:
+	default:
+		return nil, ErrUnsupportedTokenAlgorithm
+	}
+
+	//The key must be of the type the header algorithm claims, so a token cannot pick how it
+	//is verified
+	signed := []byte(parts[0] + "." + parts[1])
+	matched := false
+	verified := false
+	for _, key := range ja.keys {
+		if key.algorithm != header.Algorithm || (header.KeyID != "" && key.keyID != header.KeyID) {
+			continue
+		}
+
+		matched = true
+		if verifySignature(&key, signed, signature) {
+			verified = true
+			break
+		}
+	}
+
+	if !matched {
+		return nil, ErrUnknownTokenKey
+	}
+
+	if !verified {
+		return nil, ErrBadTokenSignature
+	}
+
+	var claims map[string]interface{}
+	if err := decodeTokenPart(parts[1], &claims); err != nil {
+		return nil, err
+	}
+
+	if err := ja.checkClaims(claims); err != nil {
+		return nil, err
+	}
+
+	return claims, nil
+}
+
+func decodeTokenPart(part string, v interface{}) error {
+	decoded, err := base64.RawURLEncoding.DecodeString(part)
+	if err != nil {
+		return ErrMalformedToken
+	}
+
+	if err := json.Unmarshal(decoded, v); err != nil {
+		return ErrMalformedToken
+	}
+
+	return nil
+}
+
+func verifySignature(key *verificationKey, signed, signature []byte) bool {
+	switch publicKey := key.publicKey.(type) {
+	case *rsa.PublicKey:
+		digest := sha256.Sum256(signed)
+		return rsa.VerifyPKCS1v15(publicKey, crypto.SHA256, digest[:], signature) == nil
+	case *ecdsa.PublicKey:
+		//ES256 signatures are the 32 byte big endian r and s values concatenated
+		if len(signature) != 64 {
+			return false
+		}
+
+		digest := sha256.Sum256(signed)
+		r := new(big.Int).SetBytes(signature[:32])
+		s := new(big.Int).SetBytes(signature[32:])
+		return ecdsa.Verify(publicKey, digest[:], r, s)
+	case ed25519.PublicKey:
+		return ed25519.Verify(publicKey, signed, signature)
+	default:
+		return false
+	}
+}
+
+//checkClaims checks the token is current and, if configured, was issued by the expected issuer
+//for the expected audience. Tokens must carry an exp claim.
+func (ja *JWTAuthenticator) checkClaims(claims map[string]interface{}) error {
+	now := ja.now()
+
+	exp, ok := claims["exp"].(float64)
+	if !ok || now.After(time.Unix(int64(exp), 0).Add(ClockSkew)) {
+		return ErrTokenExpired
+	}
+
+	if nbf, ok := claims["nbf"].(float64); ok && now.Add(ClockSkew).Before(time.Unix(int64(nbf), 0)) {
+		return ErrTokenNotYetValid
+	}
+
+	if ja.issuer != "" {
+		if iss, _ := claims["iss"].(string); iss != ja.issuer {
+			return ErrBadTokenIssuer
+		}
+	}
+
+	if ja.audience != "" && !hasAudience(claims["aud"], ja.audience) {
+		return ErrBadTokenAudience
+	}
+
+	return nil
+}
+
+//hasAudience returns true if the aud claim, a string or array of strings, contains the audience
+func hasAudience(aud interface{}, audience string) bool {
+	switch aud := aud.(type) {
+	case string:
+		return aud == audience
+	case []interface{}:
+		for _, a := range aud {
+			if s, ok := a.(string); ok && s == audience {
+				return true
+			}
+		}
+	}
+
+	return false
+}
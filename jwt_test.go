@@ -0,0 +1,201 @@
+package atompubsvc
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+//testTokenSigner holds a key of each supported type, and the JWKS of their public keys
+type testTokenSigner struct {
+	rsaKey     *rsa.PrivateKey
+	ecKey      *ecdsa.PrivateKey
+	ed25519Key ed25519.PrivateKey
+	jwks       *JWKS
+}
+
+func newTestTokenSigner(t *testing.T) *testTokenSigner {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.Nil(t, err)
+
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.Nil(t, err)
+
+	ed25519Public, ed25519Key, err := ed25519.GenerateKey(rand.Reader)
+	assert.Nil(t, err)
+
+	encode := base64.RawURLEncoding.EncodeToString
+	return &testTokenSigner{
+		rsaKey:     rsaKey,
+		ecKey:      ecKey,
+		ed25519Key: ed25519Key,
+		jwks: &JWKS{Keys: []JWK{
+			{KeyType: "RSA", KeyID: "rsa-1", Use: "sig", N: encode(rsaKey.N.Bytes()), E: encode(big.NewInt(int64(rsaKey.E)).Bytes())},
+			{KeyType: "EC", KeyID: "ec-1", Curve: "P-256", X: encode(ecKey.X.FillBytes(make([]byte, 32))), Y: encode(ecKey.Y.FillBytes(make([]byte, 32)))},
+			{KeyType: "OKP", KeyID: "ed-1", Curve: "Ed25519", X: encode(ed25519Public)},
+			{KeyType: "oct", KeyID: "secret"},
+		}},
+	}
+}
+
+func validClaims() map[string]interface{} {
+	return map[string]interface{}{
+		"sub": "user1",
+		"iss": "https://issuer",
+		"aud": []string{"feeds", "other"},
+		"exp": time.Now().Add(time.Hour).Unix(),
+	}
+}
+
+//sign returns a token with the given header and claims signed with the key for the header alg
+func (ts *testTokenSigner) sign(t *testing.T, header map[string]string, claims map[string]interface{}) string {
+	encodedHeader, err := json.Marshal(header)
+	assert.Nil(t, err)
+
+	encodedClaims, err := json.Marshal(claims)
+	assert.Nil(t, err)
+
+	signed := base64.RawURLEncoding.EncodeToString(encodedHeader) + "." + base64.RawURLEncoding.EncodeToString(encodedClaims)
+	digest := sha256.Sum256([]byte(signed))
+
+	var signature []byte
+	switch header["alg"] {
+	case RS256:
+		signature, err = rsa.SignPKCS1v15(rand.Reader, ts.rsaKey, crypto.SHA256, digest[:])
+		assert.Nil(t, err)
+	case ES256:
+		r, s, err := ecdsa.Sign(rand.Reader, ts.ecKey, digest[:])
+		assert.Nil(t, err)
+		signature = append(r.FillBytes(make([]byte, 32)), s.FillBytes(make([]byte, 32))...)
+	case EdDSA:
+		signature = ed25519.Sign(ts.ed25519Key, []byte(signed))
+	}
+
+	return signed + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+func (ts *testTokenSigner) token(t *testing.T, claims map[string]interface{}) string {
+	return ts.sign(t, map[string]string{"alg": RS256, "kid": "rsa-1"}, claims)
+}
+
+func bearerRequest(token string) *http.Request {
+	r, _ := http.NewRequest("GET", "/notifications/recent", nil)
+	r.Header.Set("Authorization", "Bearer "+token)
+	return r
+}
+
+func TestJWTAuthenticator(t *testing.T) {
+	signer := newTestTokenSigner(t)
+	authenticator, err := NewJWTAuthenticator(signer.jwks, "https://issuer", "feeds")
+	if !assert.Nil(t, err) {
+		return
+	}
+
+	withClaim := func(name string, value interface{}) map[string]interface{} {
+		claims := validClaims()
+		if value == nil {
+			delete(claims, name)
+		} else {
+			claims[name] = value
+		}
+		return claims
+	}
+
+	now := time.Now()
+	tamperedToken := signer.token(t, validClaims())
+	tamperedToken = tamperedToken[:len(tamperedToken)-4] + "AAAA"
+
+	var tests = []struct {
+		name   string
+		header map[string]string
+		claims map[string]interface{}
+		err    error
+	}{
+		{"rs256", map[string]string{"alg": RS256, "kid": "rsa-1"}, validClaims(), nil},
+		{"es256", map[string]string{"alg": ES256, "kid": "ec-1"}, validClaims(), nil},
+		{"eddsa", map[string]string{"alg": EdDSA, "kid": "ed-1"}, validClaims(), nil},
+		{"no kid", map[string]string{"alg": ES256}, validClaims(), nil},
+		{"single audience", map[string]string{"alg": EdDSA}, withClaim("aud", "feeds"), nil},
+		{"within skew", map[string]string{"alg": EdDSA}, withClaim("exp", now.Add(-30*time.Second).Unix()), nil},
+		{"unknown kid", map[string]string{"alg": RS256, "kid": "rsa-2"}, validClaims(), ErrUnknownTokenKey},
+		{"alg kid mismatch", map[string]string{"alg": ES256, "kid": "rsa-1"}, validClaims(), ErrUnknownTokenKey},
+		{"none", map[string]string{"alg": "none"}, validClaims(), ErrUnsupportedTokenAlgorithm},
+		{"hs256", map[string]string{"alg": "HS256", "kid": "secret"}, validClaims(), ErrUnsupportedTokenAlgorithm},
+		{"expired", map[string]string{"alg": RS256}, withClaim("exp", now.Add(-2*time.Minute).Unix()), ErrTokenExpired},
+		{"no exp", map[string]string{"alg": RS256}, withClaim("exp", nil), ErrTokenExpired},
+		{"not yet valid", map[string]string{"alg": RS256}, withClaim("nbf", now.Add(time.Hour).Unix()), ErrTokenNotYetValid},
+		{"issuer", map[string]string{"alg": RS256}, withClaim("iss", "https://other"), ErrBadTokenIssuer},
+		{"audience", map[string]string{"alg": RS256}, withClaim("aud", []string{"other"}), ErrBadTokenAudience},
+		{"no audience", map[string]string{"alg": RS256}, withClaim("aud", nil), ErrBadTokenAudience},
+	}
+
+	for _, test := range tests {
+		principal, err := authenticator.Authenticate(bearerRequest(signer.sign(t, test.header, test.claims)))
+		assert.Equal(t, test.err, err, test.name)
+		if err == nil {
+			assert.Equal(t, "user1", principal.Subject, test.name)
+			assert.Equal(t, "jwt", principal.Method, test.name)
+			assert.Equal(t, "https://issuer", principal.Claims["iss"], test.name)
+		}
+	}
+
+	_, err = authenticator.Authenticate(bearerRequest(tamperedToken))
+	assert.Equal(t, ErrBadTokenSignature, err)
+
+	for _, token := range []string{"", "a.b", "a.b.c", "!.!.!"} {
+		_, err = authenticator.Authenticate(bearerRequest(token))
+		assert.Equal(t, ErrMalformedToken, err, token)
+	}
+
+	r, _ := http.NewRequest("GET", "/notifications/recent", nil)
+	_, err = authenticator.Authenticate(r)
+	assert.Equal(t, ErrNoCredentials, err)
+}
+
+func TestJWTAuthenticatorFromFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "jwt")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	signer := newTestTokenSigner(t)
+	contents, err := json.Marshal(signer.jwks)
+	assert.Nil(t, err)
+
+	jwksFile := filepath.Join(dir, "jwks.json")
+	assert.Nil(t, ioutil.WriteFile(jwksFile, contents, 0600))
+
+	authenticator, err := NewJWTAuthenticatorFromFile(jwksFile, "", "")
+	if assert.Nil(t, err) {
+		principal, err := authenticator.Authenticate(bearerRequest(signer.token(t, validClaims())))
+		assert.Nil(t, err)
+		assert.Equal(t, "user1", principal.Subject)
+	}
+
+	noKeysFile := filepath.Join(dir, "nokeys.json")
+	assert.Nil(t, ioutil.WriteFile(noKeysFile, []byte(`{"keys":[{"kty":"oct","k":"c2VjcmV0"}]}`), 0600))
+	_, err = NewJWTAuthenticatorFromFile(noKeysFile, "", "")
+	assert.Equal(t, ErrBadJWKS, err)
+
+	badFile := filepath.Join(dir, "bad.json")
+	assert.Nil(t, ioutil.WriteFile(badFile, []byte("not json"), 0600))
+	_, err = NewJWTAuthenticatorFromFile(badFile, "", "")
+	assert.NotNil(t, err)
+
+	_, err = NewJWTAuthenticator(&JWKS{Keys: []JWK{{KeyType: "EC", Curve: "P-256", X: "AQ", Y: "AQ"}}}, "", "")
+	assert.True(t, err != nil && strings.Contains(err.Error(), "not on curve"))
+}
@@ -0,0 +1,151 @@
+package atompubsvc
+
+import (
+	"errors"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+//Environment variables used to configure data key caching. If neither is set data keys are not
+//cached, and each response is encrypted with a new data key.
+const (
+	KeyCacheMessages = "KEY_CACHE_MESSAGES"
+	KeyCacheTTL      = "KEY_CACHE_TTL"
+)
+
+//Limits used when only one of the key cache limits is configured
+const (
+	DefaultKeyCacheMessages = 1000
+	DefaultKeyCacheTTL      = 5 * time.Minute
+)
+
+var ErrNilKeyProvider = errors.New("Nil key provider passed to factory method")
+var ErrBadKeyCacheLimits = errors.New("Key cache message and time limits must be positive")
+
+//CachingKeyProvider reuses a data key from an underlying provider for a bounded number of
+//messages and period of time before obtaining a new one. The encrypted key is returned with
+//the plaintext key each time, so consumers decrypt cached and uncached keys alike. Keys are
+//zeroed when evicted from the cache.
+type CachingKeyProvider struct {
+	sync.Mutex
+	provider    KeyProvider
+	maxMessages int
+	maxAge      time.Duration
+	now         func() time.Time
+
+	key      *DataKey
+	uses     int
+	issuedAt time.Time
+}
+
+//NewCachingKeyProvider returns a provider caching data keys from the given provider, using each
+//key for at most maxMessages messages and at most maxAge after it was obtained.
+func NewCachingKeyProvider(provider KeyProvider, maxMessages int, maxAge time.Duration) (*CachingKeyProvider, error) {
+	if provider == nil {
+		return nil, ErrNilKeyProvider
+	}
+
+	if maxMessages < 1 || maxAge <= 0 {
+		return nil, ErrBadKeyCacheLimits
+	}
+
+	return &CachingKeyProvider{
+		provider:    provider,
+		maxMessages: maxMessages,
+		maxAge:      maxAge,
+		now:         time.Now,
+	}, nil
+}
+
+//GenerateDataKey returns the cached data key, obtaining a new one from the underlying provider
+//if the cached key has reached its message or time limit. The caller receives a copy of the
+//plaintext and wrapped keys, which it may zero once used without affecting the cache.
+func (ckp *CachingKeyProvider) GenerateDataKey() (*DataKey, error) {
+	ckp.Lock()
+	defer ckp.Unlock()
+
+	if ckp.key == nil || ckp.uses >= ckp.maxMessages || ckp.now().Sub(ckp.issuedAt) >= ckp.maxAge {
+		ckp.evict()
+
+		key, err := ckp.provider.GenerateDataKey()
+		if err != nil {
+			return nil, err
+		}
+
+		ckp.key = key
+		ckp.uses = 0
+		ckp.issuedAt = ckp.now()
+	}
+
+	ckp.uses++
+
+	plaintext := *ckp.key.Plaintext
+	return &DataKey{
+		KeyID:        ckp.key.KeyID,
+		Plaintext:    &plaintext,
+		EncryptedKey: ckp.key.EncryptedKey,
+		WrappedKey:   append([]byte(nil), ckp.key.WrappedKey...),
+	}, nil
+}
+
+//Purge zeroes and evicts the cached data key, so the next message is encrypted with a new key
+func (ckp *CachingKeyProvider) Purge() {
+	ckp.Lock()
+	defer ckp.Unlock()
+	ckp.evict()
+}
+
+func (ckp *CachingKeyProvider) evict() {
+	if ckp.key == nil {
+		return
+	}
+
+	*ckp.key.Plaintext = [32]byte{}
+	for i := range ckp.key.WrappedKey {
+		ckp.key.WrappedKey[i] = 0
+	}
+
+	ckp.key = nil
+}
+
+//cacheKeysFromEnv wraps the provider in a CachingKeyProvider if KEY_CACHE_MESSAGES or
+//KEY_CACHE_TTL is set. The message limit is a count, and the time limit either a number of
+//seconds or a duration such as 10m.
+func cacheKeysFromEnv(provider KeyProvider) (KeyProvider, error) {
+	messagesVal := os.Getenv(KeyCacheMessages)
+	ttlVal := os.Getenv(KeyCacheTTL)
+
+	if provider == nil || (messagesVal == "" && ttlVal == "") {
+		return provider, nil
+	}
+
+	maxMessages := DefaultKeyCacheMessages
+	if messagesVal != "" {
+		parsed, err := strconv.Atoi(messagesVal)
+		if err != nil {
+			return nil, ErrBadKeyCacheLimits
+		}
+
+		maxMessages = parsed
+	}
+
+	maxAge := DefaultKeyCacheTTL
+	if ttlVal != "" {
+		if seconds, err := strconv.Atoi(ttlVal); err == nil {
+			maxAge = time.Duration(seconds) * time.Second
+		} else if duration, err := time.ParseDuration(ttlVal); err == nil {
+			maxAge = duration
+		} else {
+			return nil, ErrBadKeyCacheLimits
+		}
+	}
+
+	cachingProvider, err := NewCachingKeyProvider(provider, maxMessages, maxAge)
+	if err != nil {
+		return nil, err
+	}
+
+	return cachingProvider, nil
+}
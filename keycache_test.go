@@ -0,0 +1,174 @@
+package atompubsvc
+
+import (
+	"encoding/base64"
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+type failingKeyProvider struct{}
+
+func (fkp failingKeyProvider) GenerateDataKey() (*DataKey, error) {
+	return nil, errors.New("no key for you")
+}
+
+func TestNewCachingKeyProviderErrors(t *testing.T) {
+	_, err := NewCachingKeyProvider(nil, 10, time.Minute)
+	assert.Equal(t, ErrNilKeyProvider, err)
+
+	_, err = NewCachingKeyProvider(NewFakeKeyProvider(testKey), 0, time.Minute)
+	assert.Equal(t, ErrBadKeyCacheLimits, err)
+
+	_, err = NewCachingKeyProvider(NewFakeKeyProvider(testKey), 10, 0)
+	assert.Equal(t, ErrBadKeyCacheLimits, err)
+}
+
+func TestCachingKeyProviderMessageLimit(t *testing.T) {
+	fake := NewFakeKeyProvider(testKey)
+	provider, err := NewCachingKeyProvider(fake, 3, time.Hour)
+	assert.Nil(t, err)
+
+	for i := 0; i < 3; i++ {
+		out, err := encryptOutput(provider, []byte("secret"))
+		assert.Nil(t, err)
+
+		//The cached key survives encryptOutput zeroing the key it was given
+		encryptedKey, ciphertext := splitEnvelope(t, out)
+		assert.Equal(t, "fake encrypted key", string(encryptedKey))
+		assert.Equal(t, "secret", string(testDecrypt(t, ciphertext, &testKey)))
+	}
+
+	assert.Equal(t, 1, fake.Generated)
+
+	cached := provider.key.Plaintext
+	_, err = provider.GenerateDataKey()
+	assert.Nil(t, err)
+	assert.Equal(t, 2, fake.Generated)
+	assert.Equal(t, [32]byte{}, *cached)
+}
+
+func TestCachingKeyProviderTimeLimit(t *testing.T) {
+	now := time.Date(2017, 3, 1, 12, 0, 0, 0, time.UTC)
+
+	fake := NewFakeKeyProvider(testKey)
+	provider, err := NewCachingKeyProvider(fake, 100, time.Minute)
+	assert.Nil(t, err)
+	provider.now = func() time.Time { return now }
+
+	provider.GenerateDataKey()
+	now = now.Add(59 * time.Second)
+	provider.GenerateDataKey()
+	assert.Equal(t, 1, fake.Generated)
+
+	now = now.Add(time.Second)
+	provider.GenerateDataKey()
+	assert.Equal(t, 2, fake.Generated)
+}
+
+func TestCachingKeyProviderPurge(t *testing.T) {
+	fake := NewFakeKeyProvider(testKey)
+	provider, err := NewCachingKeyProvider(fake, 100, time.Hour)
+	assert.Nil(t, err)
+
+	provider.GenerateDataKey()
+	cached := provider.key.Plaintext
+
+	provider.Purge()
+	assert.Nil(t, provider.key)
+	assert.Equal(t, [32]byte{}, *cached)
+
+	provider.GenerateDataKey()
+	assert.Equal(t, 2, fake.Generated)
+}
+
+func TestCachingKeyProviderJWEKeyWrap(t *testing.T) {
+	SetEncryptionFormat(JWEFormat)
+	defer SetEncryptionFormat(EnvelopeFormat)
+
+	masterKey := [32]byte{}
+	copy(masterKey[:], "0123456789abcdef0123456789abcdef")
+
+	provider, err := NewCachingKeyProvider(NewStaticKeyProvider("key-1", &masterKey), 3, time.Hour)
+	assert.Nil(t, err)
+
+	//Cached static keys are still wrapped with the master key rather than sent in the key ID
+	for i := 0; i < 2; i++ {
+		out, err := encryptOutput(provider, []byte("secret"))
+		assert.Nil(t, err)
+
+		parts := strings.Split(string(out), ".")
+		if !assert.Equal(t, 5, len(parts)) {
+			return
+		}
+
+		decodedHeader, _ := base64.RawURLEncoding.DecodeString(parts[0])
+		assert.Contains(t, string(decodedHeader), `"alg":"A256KW"`)
+		assert.Contains(t, string(decodedHeader), `"kid":"key-1"`)
+
+		wrappedKey, err := base64.RawURLEncoding.DecodeString(parts[1])
+		assert.Nil(t, err)
+		assert.Equal(t, 40, len(wrappedKey))
+	}
+
+	cached := provider.key.WrappedKey
+	provider.Purge()
+	assert.Equal(t, make([]byte, 40), cached)
+}
+
+func TestCachingKeyProviderError(t *testing.T) {
+	provider, err := NewCachingKeyProvider(failingKeyProvider{}, 100, time.Hour)
+	assert.Nil(t, err)
+
+	_, err = provider.GenerateDataKey()
+	assert.NotNil(t, err)
+	assert.Nil(t, provider.key)
+}
+
+func TestCacheKeysFromEnv(t *testing.T) {
+	defer os.Unsetenv(KeyCacheMessages)
+	defer os.Unsetenv(KeyCacheTTL)
+
+	fake := NewFakeKeyProvider(testKey)
+
+	var cacheEnvTests = []struct {
+		testName    string
+		messages    string
+		ttl         string
+		cached      bool
+		maxMessages int
+		maxAge      time.Duration
+		err         error
+	}{
+		{"no caching", "", "", false, 0, 0, nil},
+		{"messages only", "50", "", true, 50, DefaultKeyCacheTTL, nil},
+		{"ttl seconds", "", "30", true, DefaultKeyCacheMessages, 30 * time.Second, nil},
+		{"ttl duration", "10", "2m", true, 10, 2 * time.Minute, nil},
+		{"bad messages", "lots", "", false, 0, 0, ErrBadKeyCacheLimits},
+		{"bad ttl", "", "soon", false, 0, 0, ErrBadKeyCacheLimits},
+		{"zero messages", "0", "", false, 0, 0, ErrBadKeyCacheLimits},
+	}
+
+	for _, test := range cacheEnvTests {
+		t.Run(test.testName, func(t *testing.T) {
+			os.Setenv(KeyCacheMessages, test.messages)
+			os.Setenv(KeyCacheTTL, test.ttl)
+
+			provider, err := cacheKeysFromEnv(fake)
+			assert.Equal(t, test.err, err)
+			if err != nil {
+				return
+			}
+
+			cachingProvider, ok := provider.(*CachingKeyProvider)
+			assert.Equal(t, test.cached, ok)
+			if ok {
+				assert.Equal(t, test.maxMessages, cachingProvider.maxMessages)
+				assert.Equal(t, test.maxAge, cachingProvider.maxAge)
+			}
+		})
+	}
+}
@@ -0,0 +1,185 @@
+package atompubsvc
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/kms"
+	"io"
+	"io/ioutil"
+	"sync"
+)
+
+var ErrBadKeyFile = errors.New("Key file must contain a 32 byte key, raw or base64 encoded")
+var ErrBadDataKey = errors.New("Data key generated by the KMS is shorter than 32 bytes")
+
+//DataKey is a data encryption key generated by a KeyProvider. The plaintext key is used to
+//encrypt the output and then discarded; the encrypted key accompanies the output so consumers
+//can recover the plaintext key. The key id identifies the master key used to encrypt the data
+//key, so consumers holding several keys know which to use. Key providers holding the master key
+//locally also wrap the data key with it for JWE, in which case WrappedKey holds the data key
+//wrapped with the A256KW algorithm.
+type DataKey struct {
+	KeyID        string
+	Plaintext    *[32]byte
+	EncryptedKey []byte
+	WrappedKey   []byte
+}
+
+//KeyProvider generates the data keys used to encrypt output
+type KeyProvider interface {
+	GenerateDataKey() (*DataKey, error)
+}
+
+//KMSGenerateDataKeyAPI is the subset of the KMS client used to generate data keys
+type KMSGenerateDataKeyAPI interface {
+	GenerateDataKey(input *kms.GenerateDataKeyInput) (*kms.GenerateDataKeyOutput, error)
+}
+
+//KMSKeyProvider generates data keys under a KMS customer master key. Consumers decrypt the
+//data key using the KMS.
+type KMSKeyProvider struct {
+	svc      KMSGenerateDataKeyAPI
+	keyAlias string
+}
+
+//NewKMSKeyProvider returns a key provider generating data keys under the CMK with the given
+//alias, e.g. alias/my-key
+func NewKMSKeyProvider(svc KMSGenerateDataKeyAPI, keyAlias string) *KMSKeyProvider {
+	return &KMSKeyProvider{svc: svc, keyAlias: keyAlias}
+}
+
+func (kkp *KMSKeyProvider) GenerateDataKey() (*DataKey, error) {
+	params := &kms.GenerateDataKeyInput{
+		KeyId:   aws.String(kkp.keyAlias), // Required
+		KeySpec: aws.String("AES_256"),
+	}
+
+	resp, err := kkp.svc.GenerateDataKey(params)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(resp.Plaintext) < 32 {
+		return nil, ErrBadDataKey
+	}
+
+	key := [32]byte{}
+	copy(key[:], resp.Plaintext[0:32])
+
+	//Purge the key from the response
+	for i := range resp.Plaintext {
+		resp.Plaintext[i] = 0
+	}
+
+	return &DataKey{KeyID: kkp.keyAlias, Plaintext: &key, EncryptedKey: resp.CiphertextBlob}, nil
+}
+
+//StaticKeyProvider generates random data keys, encrypting them with a master key held
+//locally. It allows encryption to be used without access to AWS, for example in development
+//and test environments.
+type StaticKeyProvider struct {
+	keyID     string
+	masterKey [32]byte
+}
+
+//NewStaticKeyProvider returns a key provider that encrypts data keys with the given master key,
+//identified by keyID. If keyID is empty the key id is derived from the key via StaticKeyID.
+func NewStaticKeyProvider(keyID string, masterKey *[32]byte) *StaticKeyProvider {
+	if keyID == "" {
+		keyID = StaticKeyID(masterKey)
+	}
+
+	return &StaticKeyProvider{keyID: keyID, masterKey: *masterKey}
+}
+
+//StaticKeyID returns the default key id for a master key, which is static- followed by the
+//first 8 bytes of its SHA-256 hash in hex. It identifies the key without revealing it.
+func StaticKeyID(masterKey *[32]byte) string {
+	sum := sha256.Sum256(masterKey[:])
+	return "static-" + hex.EncodeToString(sum[:8])
+}
+
+//NewStaticKeyProviderFromFile returns a key provider using the master key read from the
+//given file, identified by keyID. The file contains the 32 byte key, either raw or base64
+//encoded.
+func NewStaticKeyProviderFromFile(keyID, path string) (*StaticKeyProvider, error) {
+	contents, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	masterKey, err := parseKey(contents)
+	if err != nil {
+		return nil, err
+	}
+
+	return NewStaticKeyProvider(keyID, masterKey), nil
+}
+
+func parseKey(contents []byte) (*[32]byte, error) {
+	key := [32]byte{}
+
+	if len(contents) == 32 {
+		copy(key[:], contents)
+		return &key, nil
+	}
+
+	decoded, err := base64.StdEncoding.DecodeString(string(bytes.TrimSpace(contents)))
+	if err != nil || len(decoded) != 32 {
+		return nil, ErrBadKeyFile
+	}
+
+	copy(key[:], decoded)
+	return &key, nil
+}
+
+func (skp *StaticKeyProvider) GenerateDataKey() (*DataKey, error) {
+	key := [32]byte{}
+	_, err := io.ReadFull(rand.Reader, key[:])
+	if err != nil {
+		return nil, err
+	}
+
+	encryptedKey, err := Encrypt(key[:], &skp.masterKey)
+	if err != nil {
+		return nil, err
+	}
+
+	wrappedKey, err := aesKeyWrap(skp.masterKey[:], key[:])
+	if err != nil {
+		return nil, err
+	}
+
+	return &DataKey{KeyID: skp.keyID, Plaintext: &key, EncryptedKey: encryptedKey, WrappedKey: wrappedKey}, nil
+}
+
+//FakeKeyProvider always provides the same data key, with a fixed encrypted key and key id. It is
+//intended for testing only.
+type FakeKeyProvider struct {
+	sync.Mutex
+	KeyID        string
+	Key          [32]byte
+	EncryptedKey []byte
+
+	//Generated counts the data keys provided
+	Generated int
+}
+
+//NewFakeKeyProvider returns a fake key provider using the given key
+func NewFakeKeyProvider(key [32]byte) *FakeKeyProvider {
+	return &FakeKeyProvider{KeyID: "fake", Key: key, EncryptedKey: []byte("fake encrypted key")}
+}
+
+func (fkp *FakeKeyProvider) GenerateDataKey() (*DataKey, error) {
+	fkp.Lock()
+	defer fkp.Unlock()
+
+	fkp.Generated++
+	key := fkp.Key
+	return &DataKey{KeyID: fkp.KeyID, Plaintext: &key, EncryptedKey: fkp.EncryptedKey}, nil
+}
@@ -0,0 +1,186 @@
+package atompubsvc
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/base64"
+	"errors"
+	"github.com/aws/aws-sdk-go/service/kms"
+	"github.com/stretchr/testify/assert"
+	"github.com/xtracdev/es-atom-pub/internal/testevents"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+var testKey = [32]byte{
+	1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16,
+	17, 18, 19, 20, 21, 22, 23, 24, 25, 26, 27, 28, 29, 30, 31, 32,
+}
+
+//testDecrypt reverses Encrypt
+func testDecrypt(t *testing.T, ciphertext []byte, key *[32]byte) []byte {
+	block, err := aes.NewCipher(key[:])
+	assert.Nil(t, err)
+
+	gcm, err := cipher.NewGCM(block)
+	assert.Nil(t, err)
+
+	plaintext, err := gcm.Open(nil, ciphertext[:gcm.NonceSize()], ciphertext[gcm.NonceSize():], nil)
+	assert.Nil(t, err)
+
+	return plaintext
+}
+
+//splitEnvelope splits encrypted output into the encrypted key and ciphertext
+func splitEnvelope(t *testing.T, out []byte) ([]byte, []byte) {
+	parts := strings.Split(string(out), "::")
+	if !assert.Equal(t, 2, len(parts)) {
+		t.FailNow()
+	}
+
+	encryptedKey, err := base64.StdEncoding.DecodeString(parts[0])
+	assert.Nil(t, err)
+
+	ciphertext, err := base64.StdEncoding.DecodeString(parts[1])
+	assert.Nil(t, err)
+
+	return encryptedKey, ciphertext
+}
+
+type fakeKMS struct {
+	plaintext []byte
+	err       error
+	keyID     string
+}
+
+func (fk *fakeKMS) GenerateDataKey(input *kms.GenerateDataKeyInput) (*kms.GenerateDataKeyOutput, error) {
+	if fk.err != nil {
+		return nil, fk.err
+	}
+
+	fk.keyID = *input.KeyId
+	return &kms.GenerateDataKeyOutput{
+		CiphertextBlob: []byte("kms encrypted key"),
+		Plaintext:      append([]byte{}, fk.plaintext...),
+	}, nil
+}
+
+func TestEncryptOutputNoKeyProvider(t *testing.T) {
+	out, err := encryptOutput(nil, []byte("plain"))
+	assert.Nil(t, err)
+	assert.Equal(t, "plain", string(out))
+}
+
+func TestEncryptOutputFakeKeyProvider(t *testing.T) {
+	provider := NewFakeKeyProvider(testKey)
+
+	out, err := encryptOutput(provider, []byte("secret"))
+	assert.Nil(t, err)
+
+	encryptedKey, ciphertext := splitEnvelope(t, out)
+	assert.Equal(t, "fake encrypted key", string(encryptedKey))
+	assert.Equal(t, "secret", string(testDecrypt(t, ciphertext, &testKey)))
+	assert.Equal(t, 1, provider.Generated)
+}
+
+func TestKMSKeyProvider(t *testing.T) {
+	svc := &fakeKMS{plaintext: testKey[:]}
+	provider := NewKMSKeyProvider(svc, "alias/foo")
+
+	out, err := encryptOutput(provider, []byte("secret"))
+	assert.Nil(t, err)
+	assert.Equal(t, "alias/foo", svc.keyID)
+
+	encryptedKey, ciphertext := splitEnvelope(t, out)
+	assert.Equal(t, "kms encrypted key", string(encryptedKey))
+	assert.Equal(t, "secret", string(testDecrypt(t, ciphertext, &testKey)))
+}
+
+func TestKMSKeyProviderErrors(t *testing.T) {
+	_, err := NewKMSKeyProvider(&fakeKMS{plaintext: []byte("short")}, "alias/foo").GenerateDataKey()
+	assert.Equal(t, ErrBadDataKey, err)
+
+	kmsErr := errors.New("kms error")
+	_, err = encryptOutput(NewKMSKeyProvider(&fakeKMS{err: kmsErr}, "alias/foo"), []byte("secret"))
+	assert.Equal(t, kmsErr, err)
+}
+
+func TestStaticKeyProviderFromFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "keyprovider")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	rawFile := filepath.Join(dir, "raw")
+	assert.Nil(t, ioutil.WriteFile(rawFile, testKey[:], 0600))
+
+	encodedFile := filepath.Join(dir, "encoded")
+	assert.Nil(t, ioutil.WriteFile(encodedFile, []byte(base64.StdEncoding.EncodeToString(testKey[:])+"\n"), 0600))
+
+	for _, keyFile := range []string{rawFile, encodedFile} {
+		provider, err := NewStaticKeyProviderFromFile("key-1", keyFile)
+		if !assert.Nil(t, err) {
+			continue
+		}
+
+		dataKey, err := provider.GenerateDataKey()
+		assert.Nil(t, err)
+		assert.Equal(t, "key-1", dataKey.KeyID)
+
+		out, err := encryptOutput(provider, []byte("secret"))
+		assert.Nil(t, err)
+
+		encryptedKey, ciphertext := splitEnvelope(t, out)
+		plaintextKey := [32]byte{}
+		copy(plaintextKey[:], testDecrypt(t, encryptedKey, &testKey))
+		assert.Equal(t, "secret", string(testDecrypt(t, ciphertext, &plaintextKey)))
+	}
+
+	badFile := filepath.Join(dir, "bad")
+	assert.Nil(t, ioutil.WriteFile(badFile, []byte("not a key"), 0600))
+
+	_, err = NewStaticKeyProviderFromFile("key-1", badFile)
+	assert.Equal(t, ErrBadKeyFile, err)
+
+	_, err = NewStaticKeyProviderFromFile("key-1", filepath.Join(dir, "missing"))
+	assert.NotNil(t, err)
+}
+
+func TestRecentHandlerEncrypted(t *testing.T) {
+	provider := NewFakeKeyProvider(testKey)
+	SetKeyProvider(provider)
+	defer SetKeyProvider(nil)
+
+	store := NewMemoryFeedStore(2)
+	testevents.Append(t, store, "foo", "agg1")
+
+	handler, err := NewRecentHandler(store, "localhost:12345")
+	assert.Nil(t, err)
+
+	r, _ := http.NewRequest("GET", "/notifications/recent", nil)
+	w := httptest.NewRecorder()
+	handler(w, r)
+
+	assert.Equal(t, http.StatusOK, w.Result().StatusCode)
+	assert.Nil(t, CheckKeyConfig())
+
+	_, ciphertext := splitEnvelope(t, w.Body.Bytes())
+	assert.Contains(t, string(testDecrypt(t, ciphertext, &testKey)), "urn:esid:agg1:1")
+}
+
+func TestStaticKeyID(t *testing.T) {
+	provider := NewStaticKeyProvider("", &testKey)
+
+	dataKey, err := provider.GenerateDataKey()
+	assert.Nil(t, err)
+	assert.Equal(t, StaticKeyID(&testKey), dataKey.KeyID)
+	assert.True(t, strings.HasPrefix(dataKey.KeyID, "static-"))
+	assert.Equal(t, len("static-")+16, len(dataKey.KeyID))
+
+	otherKey := [32]byte{}
+	assert.NotEqual(t, StaticKeyID(&testKey), StaticKeyID(&otherKey))
+}
@@ -0,0 +1,222 @@
+package atompubsvc
+
+import (
+	"database/sql"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	"github.com/gorilla/mux"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+//EventFeedHandlerURI is where the location of an event in the feeds is served
+const EventFeedHandlerURI = "/events/{aggregateId}/{version}/feed"
+
+//EntryParam is the query parameter of the feed index giving an entry id to locate, e.g.
+///notifications?entry=urn:esid:aggregateId:version
+const EntryParam = "entry"
+
+var ErrBadEntryID = errors.New("Entry id must be of the form urn:esid:aggregateId:version")
+
+//EventPosition gives the feed holding an event, which is empty if the event is in the recent
+//feed, and its position in the feed counting from 1 for the first event published to the feed.
+//The event type code is included so access to the event can be checked.
+type EventPosition struct {
+	FeedID   string
+	Position int
+	TypeCode string
+}
+
+//EventLocationStore is implemented by stores that can locate an event in the feeds.
+//RetrieveEventPosition returns sql.ErrNoRows when the event does not exist.
+type EventLocationStore interface {
+	RetrieveEventPosition(aggregateID string, version int) (EventPosition, error)
+}
+
+//EventFeedStore is implemented by stores that can tell which feed holds an event without
+//counting its position. RetrieveEventFeed returns the feed id, which is empty if the event is in
+//the recent feed, and sql.ErrNoRows when the event does not exist.
+type EventFeedStore interface {
+	RetrieveEventFeed(aggregateID string, version int) (string, error)
+}
+
+//EventLocation is the representation of the location of an event in the feeds
+type EventLocation struct {
+	XMLName     xml.Name `xml:"http://github.com/xtracdev/es-atom-pub location" json:"-"`
+	EntryID     string   `xml:"entryId" json:"entryId"`
+	AggregateId string   `xml:"aggregateId" json:"aggregateId"`
+	Version     int      `xml:"version" json:"version"`
+	FeedID      string   `xml:"feedId" json:"feedId"`
+	Href        string   `xml:"href" json:"href"`
+	Position    int      `xml:"position" json:"position"`
+}
+
+//parseEntryID returns the aggregate id and version identified by an atom entry id. As aggregate
+//ids may contain colons, the version follows the last colon.
+func parseEntryID(id string) (string, int, error) {
+	if !strings.HasPrefix(id, "urn:esid:") {
+		return "", 0, ErrBadEntryID
+	}
+
+	id = strings.TrimPrefix(id, "urn:esid:")
+	sep := strings.LastIndex(id, ":")
+	if sep < 1 {
+		return "", 0, ErrBadEntryID
+	}
+
+	version, err := strconv.Atoi(id[sep+1:])
+	if err != nil {
+		return "", 0, ErrBadEntryID
+	}
+
+	return id[:sep], version, nil
+}
+
+//locateEntry redirects to the location of the event with the given entry id
+func locateEntry(rw http.ResponseWriter, req *http.Request, linkhostport, id string) {
+	svc := "notifications-locate"
+	start := time.Now()
+
+	aggregateID, version, err := parseEntryID(id)
+	if err != nil {
+		logTimingStats(svc, start, err)
+		http.Error(rw, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	location := fmt.Sprintf("%s://%s/events/%s/%d/feed", linkProto, linkhostport, url.PathEscape(aggregateID), version)
+	http.Redirect(rw, req, location, http.StatusFound)
+	logTimingStats(svc, start, nil)
+}
+
+//eventPositionQuery returns the query selecting the feed id and type code of an event given its
+//aggregate id and version, along with its position in the feed. The bind function returns the
+//placeholder for the nth argument.
+func eventPositionQuery(bind func(n int) string) string {
+	return `select e.feedid, e.typecode, (select count(*) from t_aeae_atom_event o where o.id <= e.id and
+		(o.feedid = e.feedid or (o.feedid is null and e.feedid is null))) from t_aeae_atom_event e
+		where e.aggregate_id = ` + bind(1) + ` and e.version = ` + bind(2)
+}
+
+//eventFeedQuery returns the query selecting the feed id of an event given its aggregate id and
+//version, which is a single lookup via the unique aggregate id and version index. The bind
+//function returns the placeholder for the nth argument.
+func eventFeedQuery(bind func(n int) string) string {
+	return `select feedid from t_aeae_atom_event where aggregate_id = ` + bind(1) + ` and version = ` + bind(2)
+}
+
+//queryEventFeed runs a query built by eventFeedQuery
+func queryEventFeed(db *sql.DB, query, aggregateID string, version int) (string, error) {
+	var feedID sql.NullString
+	err := db.QueryRow(query, aggregateID, version).Scan(&feedID)
+	return feedID.String, err
+}
+
+//queryEventPosition runs a query built by eventPositionQuery
+func queryEventPosition(db *sql.DB, query, aggregateID string, version int) (EventPosition, error) {
+	var feedID sql.NullString
+	var position EventPosition
+	err := db.QueryRow(query, aggregateID, version).Scan(&feedID, &position.TypeCode, &position.Position)
+	position.FeedID = feedID.String
+	return position, err
+}
+
+//NewEventLocationHandler instantiates a handler returning the feed holding an event, and the
+//position of the event in the feed. This will be served at /events/{aggregateId}/{version}/feed
+//The location is returned as XML or JSON as negotiated via the Accept header. Events the caller
+//may not see under the access policy get a 403 response.
+func NewEventLocationHandler(store EventLocationStore, linkhostport string) (func(rw http.ResponseWriter, req *http.Request), error) {
+	if store == nil {
+		return nil, ErrNilFeedStore
+	}
+
+	return func(rw http.ResponseWriter, req *http.Request) {
+		svc := "locate-event"
+		start := time.Now()
+		aggregateID := mux.Vars(req)["aggregateId"]
+
+		version, err := strconv.Atoi(mux.Vars(req)["version"])
+		if err != nil {
+			logTimingStats(svc, start, err)
+			http.Error(rw, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		position, err := store.RetrieveEventPosition(aggregateID, version)
+		if err != nil {
+			logTimingStats(svc, start, err)
+			switch err {
+			case sql.ErrNoRows:
+				http.Error(rw, "", http.StatusNotFound)
+			default:
+				log.Warnf("Error locating event: %s", err.Error())
+				http.Error(rw, "Error locating event", http.StatusInternalServerError)
+			}
+
+			return
+		}
+
+		if !accessPolicy.Allows(PrincipalFromContext(req.Context()), aggregateID, position.TypeCode) {
+			logTimingStats(svc, start, nil)
+			log.Infof("Access to event %s %d forbidden", aggregateID, version)
+			http.Error(rw, "Forbidden", http.StatusForbidden)
+			return
+		}
+
+		//Archived events never move, but events in the recent feed will be archived
+		cacheControl := accessPolicy.cacheControl("max-age=2592000")
+		if position.FeedID == "" {
+			position.FeedID = "recent"
+			cacheControl = accessPolicy.cacheControl("no-cache")
+		}
+
+		location := EventLocation{
+			EntryID:     fmt.Sprintf("urn:esid:%s:%d", aggregateID, version),
+			AggregateId: aggregateID,
+			Version:     version,
+			FeedID:      position.FeedID,
+			Href:        fmt.Sprintf("%s://%s/notifications/%s", linkProto, linkhostport, position.FeedID),
+			Position:    position.Position,
+		}
+
+		contentType := eventContentType(req)
+		var out []byte
+		if contentType == JSONContentType {
+			out, err = json.Marshal(&location)
+		} else {
+			out, err = xml.Marshal(&location)
+		}
+
+		if err != nil {
+			logTimingStats(svc, start, err)
+			http.Error(rw, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		encodedOut, err := encryptOutput(keyProvider, out)
+		if err != nil {
+			logTimingStats(svc, start, err)
+			http.Error(rw, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		err = signResponse(responseSigner, rw, encodedOut)
+		if err != nil {
+			logTimingStats(svc, start, err)
+			http.Error(rw, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		rw.Header().Add("Cache-Control", cacheControl)
+		rw.Header().Add("Content-Type", contentType)
+		rw.Header().Add("Vary", "Accept")
+		rw.Write(encodedOut)
+		logTimingStats(svc, start, nil)
+	}, nil
+}
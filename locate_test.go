@@ -0,0 +1,228 @@
+package atompubsvc
+
+import (
+	"database/sql"
+	"encoding/json"
+	"encoding/xml"
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+	"github.com/xtracdev/es-atom-pub/internal/testevents"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestParseEntryID(t *testing.T) {
+	var tests = []struct {
+		id          string
+		aggregateID string
+		version     int
+		err         error
+	}{
+		{"urn:esid:agg1:3", "agg1", 3, nil},
+		{"urn:esid:order:eu:12", "order:eu", 12, nil},
+		{"urn:esid:agg1", "", 0, ErrBadEntryID},
+		{"urn:esid::3", "", 0, ErrBadEntryID},
+		{"urn:esid:agg1:x", "", 0, ErrBadEntryID},
+		{"agg1:3", "", 0, ErrBadEntryID},
+	}
+
+	for _, test := range tests {
+		aggregateID, version, err := parseEntryID(test.id)
+		assert.Equal(t, test.err, err, test.id)
+		assert.Equal(t, test.aggregateID, aggregateID, test.id)
+		assert.Equal(t, test.version, version, test.id)
+	}
+}
+
+//checkEventPositions checks events are located in a store archiving every two events
+func checkEventPositions(t *testing.T, store interface {
+	EventAppender
+	FeedStore
+	EventLocationStore
+	EventFeedStore
+}) {
+	testevents.Append(t, store, "foo", "agg1", "agg2", "agg3", "agg4", "agg5")
+
+	last, err := store.RetrieveLastFeed()
+	assert.Nil(t, err)
+	first, err := store.RetrievePreviousFeed(last)
+	assert.Nil(t, err)
+
+	var tests = []struct {
+		aggregateID string
+		expected    EventPosition
+	}{
+		{"agg1", EventPosition{FeedID: first.String, Position: 1, TypeCode: "foo"}},
+		{"agg2", EventPosition{FeedID: first.String, Position: 2, TypeCode: "foo"}},
+		{"agg4", EventPosition{FeedID: last, Position: 2, TypeCode: "foo"}},
+		{"agg5", EventPosition{FeedID: "", Position: 1, TypeCode: "foo"}},
+	}
+
+	for _, test := range tests {
+		position, err := store.RetrieveEventPosition(test.aggregateID, 1)
+		assert.Nil(t, err)
+		assert.Equal(t, test.expected, position, test.aggregateID)
+
+		feedID, err := store.RetrieveEventFeed(test.aggregateID, 1)
+		assert.Nil(t, err)
+		assert.Equal(t, test.expected.FeedID, feedID, test.aggregateID)
+	}
+
+	_, err = store.RetrieveEventPosition("agg1", 2)
+	assert.Equal(t, sql.ErrNoRows, err)
+
+	_, err = store.RetrieveEventFeed("agg1", 2)
+	assert.Equal(t, sql.ErrNoRows, err)
+}
+
+func TestMemoryFeedStorePositions(t *testing.T) {
+	checkEventPositions(t, NewMemoryFeedStore(2))
+}
+
+func TestEventLocationHandler(t *testing.T) {
+	_, err := NewEventLocationHandler(nil, "testhost:12345")
+	assert.Equal(t, ErrNilFeedStore, err)
+
+	store := NewMemoryFeedStore(2)
+	testevents.Append(t, store, "foo", "agg1", "agg2", "agg3")
+	feedID, err := store.RetrieveLastFeed()
+	assert.Nil(t, err)
+
+	locationHandler, err := NewEventLocationHandler(store, "testhost:12345")
+	assert.Nil(t, err)
+	indexHandler, err := NewFeedIndexHandler(store, "testhost:12345")
+	assert.Nil(t, err)
+
+	router := mux.NewRouter()
+	router.HandleFunc(EventFeedHandlerURI, locationHandler)
+	router.HandleFunc(FeedIndexHandlerURI, indexHandler)
+
+	get := func(uri, accept string) *httptest.ResponseRecorder {
+		r, _ := http.NewRequest("GET", uri, nil)
+		r.Header.Set("Accept", accept)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, r)
+		return w
+	}
+
+	w := get("/events/agg2/1/feed", "")
+	assert.Equal(t, http.StatusOK, w.Result().StatusCode)
+	assert.Equal(t, XMLContentType, w.Header().Get("Content-Type"))
+	assert.Equal(t, "max-age=2592000", w.Header().Get("Cache-Control"))
+
+	var location EventLocation
+	if assert.Nil(t, xml.Unmarshal(w.Body.Bytes(), &location)) {
+		assert.Equal(t, "urn:esid:agg2:1", location.EntryID)
+		assert.Equal(t, "agg2", location.AggregateId)
+		assert.Equal(t, 1, location.Version)
+		assert.Equal(t, feedID, location.FeedID)
+		assert.Equal(t, "https://testhost:12345/notifications/"+feedID, location.Href)
+		assert.Equal(t, 2, location.Position)
+	}
+
+	w = get("/events/agg3/1/feed", JSONContentType)
+	assert.Equal(t, http.StatusOK, w.Result().StatusCode)
+	assert.Equal(t, JSONContentType, w.Header().Get("Content-Type"))
+	assert.Equal(t, "no-cache", w.Header().Get("Cache-Control"))
+
+	location = EventLocation{}
+	if assert.Nil(t, json.Unmarshal(w.Body.Bytes(), &location)) {
+		assert.Equal(t, "recent", location.FeedID)
+		assert.Equal(t, "https://testhost:12345/notifications/recent", location.Href)
+		assert.Equal(t, 1, location.Position)
+	}
+
+	assert.Equal(t, http.StatusNotFound, get("/events/agg3/2/feed", "").Result().StatusCode)
+	assert.Equal(t, http.StatusBadRequest, get("/events/agg3/x/feed", "").Result().StatusCode)
+
+	//Entry ids are located via the index
+	w = get("/notifications?entry=urn:esid:agg2:1", "")
+	assert.Equal(t, http.StatusFound, w.Result().StatusCode)
+	assert.Equal(t, "https://testhost:12345/events/agg2/1/feed", w.Header().Get("Location"))
+
+	w = get("/notifications?entry=agg2", "")
+	assert.Equal(t, http.StatusBadRequest, w.Result().StatusCode)
+}
+
+func TestPolicyEventLocationHandler(t *testing.T) {
+	policy, cleanup := writeTestPolicy(t)
+	defer cleanup()
+
+	SetPolicy(policy)
+	defer SetPolicy(nil)
+
+	store := NewMemoryFeedStore(10)
+	appendPolicyTestEvents(t, store)
+
+	locationHandler, err := NewEventLocationHandler(store, "testhost:12345")
+	assert.Nil(t, err)
+
+	router := mux.NewRouter()
+	router.HandleFunc(EventFeedHandlerURI, locationHandler)
+
+	var tests = []struct {
+		subject string
+		uri     string
+		status  int
+	}{
+		{"orders", "/events/order-1/1/feed", http.StatusOK},
+		{"orders", "/events/order-2/1/feed", http.StatusForbidden},
+		{"", "/events/public-1/1/feed", http.StatusOK},
+	}
+
+	for _, test := range tests {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, principalRequest(test.uri, test.subject))
+		assert.Equal(t, test.status, w.Result().StatusCode, "%v", test)
+
+		if test.status == http.StatusOK {
+			assert.Equal(t, "private, no-cache", w.Result().Header.Get("Cache-Control"))
+		}
+	}
+}
+
+func TestEventRetrieveFeedLink(t *testing.T) {
+	store := NewMemoryFeedStore(2)
+	testevents.Append(t, store, "foo", "agg1")
+
+	retrieveHandler, err := NewEventRetrieveHandler(store, "testhost:12345")
+	assert.Nil(t, err)
+
+	router := mux.NewRouter()
+	router.HandleFunc(RetrieveEventHanderURI, retrieveHandler)
+
+	get := func(ifNoneMatch string) (*EventStoreContent, *httptest.ResponseRecorder) {
+		r, _ := http.NewRequest("GET", "/events/agg1/1", nil)
+		r.Header.Set("If-None-Match", ifNoneMatch)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, r)
+
+		var event EventStoreContent
+		if w.Result().StatusCode == http.StatusOK {
+			assert.Nil(t, xml.Unmarshal(w.Body.Bytes(), &event))
+		}
+
+		return &event, w
+	}
+
+	//While in the recent feed the event links to it, and must be revalidated
+	event, w := get("")
+	assert.Equal(t, []EventLink{{Rel: "collection", Href: "https://testhost:12345/notifications/recent"}}, event.Links)
+	assert.Equal(t, "no-cache", w.Header().Get("Cache-Control"))
+	assert.Equal(t, `"agg1:1-recent"`, w.Header().Get("ETag"))
+
+	_, w = get("agg1:1-recent")
+	assert.Equal(t, http.StatusNotModified, w.Result().StatusCode)
+
+	//Once archived the representation changes, and is immutable
+	testevents.Append(t, store, "foo", "agg2")
+	feedID, err := store.RetrieveLastFeed()
+	assert.Nil(t, err)
+
+	event, w = get("agg1:1-recent")
+	assert.Equal(t, http.StatusOK, w.Result().StatusCode)
+	assert.Equal(t, []EventLink{{Rel: "collection", Href: "https://testhost:12345/notifications/" + feedID}}, event.Links)
+	assert.Equal(t, "max-age=2592000", w.Header().Get("Cache-Control"))
+	assert.Equal(t, `"agg1:1"`, w.Header().Get("ETag"))
+}
@@ -0,0 +1,134 @@
+package atompubsvc
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+//Query parameters used to request a long poll of the recent feed: after is the id of the
+//last entry the client has seen, and wait is how long to hold the request for newer events,
+//either in seconds or as a duration such as 30s.
+const (
+	LongPollAfterParam = "after"
+	LongPollWaitParam  = "wait"
+)
+
+//LongPollInterval is how often a held recent feed request checks the store for new events
+var LongPollInterval = time.Second
+
+//DefaultLongPollWait is used when a long poll request does not specify a wait
+var DefaultLongPollWait = 30 * time.Second
+
+//MaxLongPollWait caps the wait requested by a client
+var MaxLongPollWait = 60 * time.Second
+
+var ErrBadWait = errors.New("wait must be a positive number of seconds or a duration")
+
+//parseWait parses the wait query parameter, capping it at MaxLongPollWait
+func parseWait(wait string) (time.Duration, error) {
+	if wait == "" {
+		return DefaultLongPollWait, nil
+	}
+
+	var d time.Duration
+	if seconds, err := strconv.Atoi(wait); err == nil {
+		d = time.Duration(seconds) * time.Second
+	} else if d, err = time.ParseDuration(wait); err != nil {
+		return 0, ErrBadWait
+	}
+
+	if d <= 0 {
+		return 0, ErrBadWait
+	}
+
+	if d > MaxLongPollWait {
+		d = MaxLongPollWait
+	}
+
+	return d, nil
+}
+
+//newestVisibleEntryID returns the id of the most recently published event passing the filter,
+//looking in the recent events and the last archive. The empty string is returned if there is no
+//such event.
+func newestVisibleEntryID(store FeedStore, filter *eventFilter) (string, error) {
+	if !filter.active() {
+		return newestEntryID(store)
+	}
+
+	events, err := store.RetrieveRecent()
+	if err != nil {
+		return "", err
+	}
+
+	events = filter.apply(events)
+	if len(events) == 0 {
+		lastFeed, err := store.RetrieveLastFeed()
+		if err != nil || lastFeed == "" {
+			return "", err
+		}
+
+		events, err = store.RetrieveArchive(lastFeed)
+		if err != nil {
+			return "", err
+		}
+
+		events = filter.apply(events)
+	}
+
+	if len(events) == 0 {
+		return "", nil
+	}
+
+	return entryID(&events[0]), nil
+}
+
+//waitForUpdate holds a recent feed request until an event newer than the after entry id is
+//published, a feed is archived, the wait elapses, or the client goes away. Requests where the
+//client is not caught up with the newest event return immediately. Only events the caller may
+//see under the access policy and of the requested types are considered; a caller who can see
+//none of the recent and last archived events is treated as caught up.
+func waitForUpdate(req *http.Request, store FeedStore, after string, wait time.Duration) error {
+	filter := newEventFilter(req)
+
+	lastFeed, err := store.RetrieveLastFeed()
+	if err != nil {
+		return err
+	}
+
+	timeout := time.NewTimer(wait)
+	defer timeout.Stop()
+
+	ticker := time.NewTicker(LongPollInterval)
+	defer ticker.Stop()
+
+	for {
+		newest, err := newestVisibleEntryID(store, filter)
+		if err != nil {
+			return err
+		}
+
+		if newest != after && (newest != "" || !filter.active()) {
+			return nil
+		}
+
+		currentFeed, err := store.RetrieveLastFeed()
+		if err != nil {
+			return err
+		}
+
+		if currentFeed != lastFeed {
+			return nil
+		}
+
+		select {
+		case <-req.Context().Done():
+			return nil
+		case <-timeout.C:
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
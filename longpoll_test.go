@@ -0,0 +1,103 @@
+package atompubsvc
+
+import (
+	"encoding/xml"
+	"github.com/stretchr/testify/assert"
+	"github.com/xtracdev/es-atom-pub/internal/testevents"
+	"golang.org/x/tools/blog/atom"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestParseWait(t *testing.T) {
+	var waitTests = []struct {
+		wait     string
+		expected time.Duration
+		err      error
+	}{
+		{"", DefaultLongPollWait, nil},
+		{"10", 10 * time.Second, nil},
+		{"1500ms", 1500 * time.Millisecond, nil},
+		{"3600", MaxLongPollWait, nil},
+		{"0", 0, ErrBadWait},
+		{"-5s", 0, ErrBadWait},
+		{"soon", 0, ErrBadWait},
+	}
+
+	for _, test := range waitTests {
+		d, err := parseWait(test.wait)
+		assert.Equal(t, test.err, err, test.wait)
+		assert.Equal(t, test.expected, d, test.wait)
+	}
+}
+
+func TestRecentHandlerLongPoll(t *testing.T) {
+	os.Unsetenv("KEY_ALIAS")
+	defer func(interval time.Duration) { LongPollInterval = interval }(LongPollInterval)
+	LongPollInterval = 10 * time.Millisecond
+
+	store := NewMemoryFeedStore(3)
+	testevents.Append(t, store, "foo", "agg1")
+
+	recentHandler, err := NewRecentHandler(store, "testhost:12345")
+	assert.Nil(t, err)
+
+	longPoll := func(uri string) (*httptest.ResponseRecorder, time.Duration) {
+		r, err := http.NewRequest("GET", uri, nil)
+		assert.Nil(t, err)
+		w := httptest.NewRecorder()
+		start := time.Now()
+		recentHandler(w, r)
+		return w, time.Now().Sub(start)
+	}
+
+	readFeed := func(w *httptest.ResponseRecorder) atom.Feed {
+		var feed atom.Feed
+		err := xml.Unmarshal(w.Body.Bytes(), &feed)
+		assert.Nil(t, err)
+		return feed
+	}
+
+	//A client that is behind gets the feed straight away
+	w, elapsed := longPoll("/notifications/recent?after=urn:esid:agg0:1&wait=5")
+	assert.Equal(t, http.StatusOK, w.Result().StatusCode)
+	assert.True(t, elapsed < time.Second)
+
+	//A client that is caught up waits for the timeout when nothing is published
+	w, elapsed = longPoll("/notifications/recent?after=urn:esid:agg1:1&wait=100ms")
+	assert.Equal(t, http.StatusOK, w.Result().StatusCode)
+	assert.True(t, elapsed >= 100*time.Millisecond)
+	assert.Equal(t, 1, len(readFeed(w).Entry))
+
+	//A caught up client gets the feed once newer events are published
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		testevents.Append(t, store, "foo", "agg2")
+	}()
+
+	w, elapsed = longPoll("/notifications/recent?after=urn:esid:agg1:1&wait=5s")
+	assert.Equal(t, http.StatusOK, w.Result().StatusCode)
+	assert.True(t, elapsed < 5*time.Second)
+	feed := readFeed(w)
+	if assert.Equal(t, 2, len(feed.Entry)) {
+		assert.Equal(t, "urn:esid:agg2:1", feed.Entry[0].ID)
+	}
+
+	//Archiving the recent events also releases the request
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		testevents.Append(t, store, "foo", "agg3")
+	}()
+
+	w, elapsed = longPoll("/notifications/recent?after=urn:esid:agg2:1&wait=5s")
+	assert.True(t, elapsed < 5*time.Second)
+	feed = readFeed(w)
+	assert.Equal(t, 0, len(feed.Entry))
+	assert.NotNil(t, getLink("prev-archive", &feed))
+
+	w, _ = longPoll("/notifications/recent?after=urn:esid:agg3:1&wait=soon")
+	assert.Equal(t, http.StatusBadRequest, w.Result().StatusCode)
+}
@@ -0,0 +1,363 @@
+package atompubsvc
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	atomdata "github.com/xtracdev/es-atom-data"
+	"github.com/xtracdev/goes"
+	"sort"
+	"sync"
+	"time"
+)
+
+var ErrBadPayload = errors.New("Event payload must be a byte slice")
+var ErrDuplicateEvent = errors.New("Event with the given aggregate id and version already stored")
+
+type memoryEvent struct {
+	atomdata.TimestampedEvent
+	feedID string
+}
+
+type memoryFeed struct {
+	feedID   string
+	previous string
+}
+
+//MemoryFeedStore is a FeedStore that keeps its events and feeds in memory. Events are added
+//via Append, and are assigned to a new feed once the number of recent events reaches the
+//feed threshold, mirroring the es-atom-data processing of the event store. It is intended for
+//local development and testing where an Oracle database is not available.
+type MemoryFeedStore struct {
+	sync.RWMutex
+	threshold int
+	events    []memoryEvent
+	feeds     []memoryFeed
+}
+
+//NewMemoryFeedStore returns an empty MemoryFeedStore that archives recent events into a feed
+//every threshold events. A threshold less than 1 defaults to atomdata.FeedThreshold.
+func NewMemoryFeedStore(threshold int) *MemoryFeedStore {
+	if threshold < 1 {
+		threshold = atomdata.FeedThreshold
+	}
+
+	return &MemoryFeedStore{threshold: threshold}
+}
+
+//Append adds an event to the store, timestamping it with the current time. If the number of
+//events not yet assigned to a feed reaches the threshold, they are assigned to a new feed.
+func (mfs *MemoryFeedStore) Append(event *goes.Event) error {
+	if _, ok := event.Payload.([]byte); !ok {
+		return ErrBadPayload
+	}
+
+	mfs.Lock()
+	defer mfs.Unlock()
+
+	for _, e := range mfs.events {
+		if e.Source == event.Source && e.Version == event.Version {
+			return ErrDuplicateEvent
+		}
+	}
+
+	mfs.events = append(mfs.events, memoryEvent{
+		TimestampedEvent: atomdata.TimestampedEvent{
+			Event:     *event,
+			Timestamp: time.Now(),
+		},
+	})
+
+	var recent []int
+	for i, e := range mfs.events {
+		if e.feedID == "" {
+			recent = append(recent, i)
+		}
+	}
+
+	if len(recent) < mfs.threshold {
+		return nil
+	}
+
+	feedID, err := newFeedID()
+	if err != nil {
+		return err
+	}
+
+	var previous string
+	if len(mfs.feeds) > 0 {
+		previous = mfs.feeds[len(mfs.feeds)-1].feedID
+	}
+
+	mfs.feeds = append(mfs.feeds, memoryFeed{feedID: feedID, previous: previous})
+	for _, i := range recent {
+		mfs.events[i].feedID = feedID
+	}
+
+	return nil
+}
+
+//newFeedID generates a random identifier for a newly archived feed
+func newFeedID() (string, error) {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(id), nil
+}
+
+//eventsForFeed returns the events assigned to the given feed, most recent first. The recent
+//events are those with an empty feed id. The caller must hold the lock.
+func (mfs *MemoryFeedStore) eventsForFeed(feedID string) []atomdata.TimestampedEvent {
+	var events []atomdata.TimestampedEvent
+	for i := len(mfs.events) - 1; i >= 0; i-- {
+		if mfs.events[i].feedID == feedID {
+			events = append(events, mfs.events[i].TimestampedEvent)
+		}
+	}
+
+	return events
+}
+
+func (mfs *MemoryFeedStore) RetrieveRecent() ([]atomdata.TimestampedEvent, error) {
+	mfs.RLock()
+	defer mfs.RUnlock()
+
+	return mfs.eventsForFeed(""), nil
+}
+
+func (mfs *MemoryFeedStore) RetrieveLastFeed() (string, error) {
+	mfs.RLock()
+	defer mfs.RUnlock()
+
+	if len(mfs.feeds) == 0 {
+		return "", nil
+	}
+
+	return mfs.feeds[len(mfs.feeds)-1].feedID, nil
+}
+
+func (mfs *MemoryFeedStore) RetrieveArchive(feedID string) ([]atomdata.TimestampedEvent, error) {
+	mfs.RLock()
+	defer mfs.RUnlock()
+
+	if feedID == "" {
+		return nil, nil
+	}
+
+	return mfs.eventsForFeed(feedID), nil
+}
+
+func (mfs *MemoryFeedStore) RetrievePreviousFeed(feedID string) (sql.NullString, error) {
+	mfs.RLock()
+	defer mfs.RUnlock()
+
+	for _, f := range mfs.feeds {
+		if f.feedID == feedID {
+			return sql.NullString{String: f.previous, Valid: f.previous != ""}, nil
+		}
+	}
+
+	return sql.NullString{}, nil
+}
+
+func (mfs *MemoryFeedStore) RetrieveNextFeed(feedID string) (sql.NullString, error) {
+	mfs.RLock()
+	defer mfs.RUnlock()
+
+	if feedID == "" {
+		return sql.NullString{}, nil
+	}
+
+	for _, f := range mfs.feeds {
+		if f.previous == feedID {
+			return sql.NullString{String: f.feedID, Valid: true}, nil
+		}
+	}
+
+	return sql.NullString{}, nil
+}
+
+func (mfs *MemoryFeedStore) RetrieveEvent(aggregateID string, version int) (atomdata.TimestampedEvent, error) {
+	mfs.RLock()
+	defer mfs.RUnlock()
+
+	for _, e := range mfs.events {
+		if e.Source == aggregateID && e.Version == version {
+			return e.TimestampedEvent, nil
+		}
+	}
+
+	return atomdata.TimestampedEvent{}, sql.ErrNoRows
+}
+
+func (mfs *MemoryFeedStore) RetrieveAggregateEvents(aggregateID string, afterVersion, toVersion, limit int) ([]atomdata.TimestampedEvent, error) {
+	mfs.RLock()
+	defer mfs.RUnlock()
+
+	var events []atomdata.TimestampedEvent
+	for _, e := range mfs.events {
+		if e.Source == aggregateID && e.Version > afterVersion && (toVersion <= 0 || e.Version <= toVersion) {
+			events = append(events, e.TimestampedEvent)
+		}
+	}
+
+	sort.Slice(events, func(i, j int) bool { return events[i].Version < events[j].Version })
+
+	if len(events) > limit {
+		events = events[:limit]
+	}
+
+	return events, nil
+}
+
+func (mfs *MemoryFeedStore) RetrieveFirstFeed() (string, error) {
+	mfs.RLock()
+	defer mfs.RUnlock()
+
+	if len(mfs.feeds) == 0 {
+		return "", nil
+	}
+
+	return mfs.feeds[0].feedID, nil
+}
+
+func (mfs *MemoryFeedStore) RetrieveFeedIndex() ([]FeedSummary, error) {
+	mfs.RLock()
+	defer mfs.RUnlock()
+
+	var summaries []FeedSummary
+	for _, f := range mfs.feeds {
+		summary := FeedSummary{FeedID: f.feedID}
+		for _, e := range mfs.events {
+			if e.feedID != f.feedID {
+				continue
+			}
+
+			if summary.Events == 0 {
+				summary.First = e.Timestamp
+			}
+
+			summary.Events++
+			summary.Last = e.Timestamp
+		}
+
+		summaries = append(summaries, summary)
+	}
+
+	return summaries, nil
+}
+
+func (mfs *MemoryFeedStore) RetrieveFeedAt(at time.Time) (string, error) {
+	mfs.RLock()
+	defer mfs.RUnlock()
+
+	var first *memoryEvent
+	for i, e := range mfs.events {
+		if !e.Timestamp.Before(at) && (first == nil || e.Timestamp.Before(first.Timestamp)) {
+			first = &mfs.events[i]
+		}
+	}
+
+	if first == nil {
+		return "", nil
+	}
+
+	return first.feedID, nil
+}
+
+func (mfs *MemoryFeedStore) RetrieveTypedFeed(feedID string, typeCodes []string, backwards bool) (string, error) {
+	mfs.RLock()
+	defer mfs.RUnlock()
+
+	start := -1
+	for i, f := range mfs.feeds {
+		if f.feedID == feedID {
+			start = i
+		}
+	}
+
+	if start < 0 {
+		return "", nil
+	}
+
+	step := 1
+	if backwards {
+		step = -1
+	}
+
+	for i := start; i >= 0 && i < len(mfs.feeds); i += step {
+		if mfs.holdsTypes(mfs.feeds[i].feedID, typeCodes) {
+			return mfs.feeds[i].feedID, nil
+		}
+	}
+
+	return "", nil
+}
+
+func (mfs *MemoryFeedStore) RetrieveFirstTypedFeed(typeCodes []string) (string, error) {
+	mfs.RLock()
+	defer mfs.RUnlock()
+
+	for _, f := range mfs.feeds {
+		if mfs.holdsTypes(f.feedID, typeCodes) {
+			return f.feedID, nil
+		}
+	}
+
+	return "", nil
+}
+
+//holdsTypes returns true if the feed holds an event with one of the type codes
+func (mfs *MemoryFeedStore) holdsTypes(feedID string, typeCodes []string) bool {
+	for _, e := range mfs.events {
+		if e.feedID != feedID {
+			continue
+		}
+
+		for _, typeCode := range typeCodes {
+			if e.TypeCode == typeCode {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+func (mfs *MemoryFeedStore) RetrieveEventFeed(aggregateID string, version int) (string, error) {
+	mfs.RLock()
+	defer mfs.RUnlock()
+
+	for _, e := range mfs.events {
+		if e.Source == aggregateID && e.Version == version {
+			return e.feedID, nil
+		}
+	}
+
+	return "", sql.ErrNoRows
+}
+
+func (mfs *MemoryFeedStore) RetrieveEventPosition(aggregateID string, version int) (EventPosition, error) {
+	mfs.RLock()
+	defer mfs.RUnlock()
+
+	for i, e := range mfs.events {
+		if e.Source != aggregateID || e.Version != version {
+			continue
+		}
+
+		position := EventPosition{FeedID: e.feedID, TypeCode: e.TypeCode}
+		for _, earlier := range mfs.events[:i+1] {
+			if earlier.feedID == e.feedID {
+				position.Position++
+			}
+		}
+
+		return position, nil
+	}
+
+	return EventPosition{}, sql.ErrNoRows
+}
@@ -0,0 +1,164 @@
+package atompubsvc
+
+import (
+	"database/sql"
+	"encoding/base64"
+	"encoding/xml"
+	"fmt"
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+	"github.com/xtracdev/es-atom-pub/internal/testevents"
+	"github.com/xtracdev/goes"
+	"golang.org/x/tools/blog/atom"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+)
+
+func TestMemoryFeedStoreAppend(t *testing.T) {
+	store := NewMemoryFeedStore(2)
+
+	testevents.Append(t, store, "foo", "agg1")
+
+	recent, err := store.RetrieveRecent()
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(recent))
+
+	lastFeed, err := store.RetrieveLastFeed()
+	assert.Nil(t, err)
+	assert.Equal(t, "", lastFeed)
+
+	//Reaching the threshold assigns the recent events to a feed
+	testevents.Append(t, store, "foo", "agg2")
+
+	recent, err = store.RetrieveRecent()
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(recent))
+
+	lastFeed, err = store.RetrieveLastFeed()
+	assert.Nil(t, err)
+	assert.NotEqual(t, "", lastFeed)
+
+	archive, err := store.RetrieveArchive(lastFeed)
+	assert.Nil(t, err)
+	if assert.Equal(t, 2, len(archive)) {
+		assert.Equal(t, "agg2", archive[0].Source)
+		assert.Equal(t, "agg1", archive[1].Source)
+	}
+
+	err = store.Append(&goes.Event{Source: "agg1", Version: 1, Payload: []byte("dup")})
+	assert.Equal(t, ErrDuplicateEvent, err)
+
+	err = store.Append(&goes.Event{Source: "agg9", Version: 1, Payload: "not bytes"})
+	assert.Equal(t, ErrBadPayload, err)
+}
+
+func TestMemoryFeedStoreLinks(t *testing.T) {
+	store := NewMemoryFeedStore(2)
+	testevents.Append(t, store, "foo", "agg1", "agg2", "agg3", "agg4", "agg5", "agg6", "agg7")
+
+	last, err := store.RetrieveLastFeed()
+	assert.Nil(t, err)
+
+	middle, err := store.RetrievePreviousFeed(last)
+	assert.Nil(t, err)
+	assert.True(t, middle.Valid)
+
+	first, err := store.RetrievePreviousFeed(middle.String)
+	assert.Nil(t, err)
+	assert.True(t, first.Valid)
+
+	noPrevious, err := store.RetrievePreviousFeed(first.String)
+	assert.Nil(t, err)
+	assert.False(t, noPrevious.Valid)
+
+	next, err := store.RetrieveNextFeed(first.String)
+	assert.Nil(t, err)
+	assert.Equal(t, middle, next)
+
+	next, err = store.RetrieveNextFeed(last)
+	assert.Nil(t, err)
+	assert.False(t, next.Valid)
+
+	event, err := store.RetrieveEvent("agg3", 1)
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("ok agg3"), event.Payload)
+
+	_, err = store.RetrieveEvent("agg3", 2)
+	assert.Equal(t, sql.ErrNoRows, err)
+}
+
+func TestHandlersWithMemoryFeedStore(t *testing.T) {
+	os.Unsetenv("KEY_ALIAS")
+
+	store := NewMemoryFeedStore(2)
+	testevents.Append(t, store, "foo", "agg1", "agg2", "agg3", "agg4", "agg5")
+
+	recentHandler, err := NewRecentHandler(store, "testhost:12345")
+	assert.Nil(t, err)
+	archiveHandler, err := NewArchiveHandler(store, "testhost:12345")
+	assert.Nil(t, err)
+	eventHandler, err := NewEventRetrieveHandler(store, "testhost:12345")
+	assert.Nil(t, err)
+
+	router := mux.NewRouter()
+	router.HandleFunc(RecentHandlerURI, recentHandler)
+	router.HandleFunc(ArchiveHandlerURI, archiveHandler)
+	router.HandleFunc(RetrieveEventHanderURI, eventHandler)
+
+	get := func(uri string) *httptest.ResponseRecorder {
+		r, err := http.NewRequest("GET", uri, nil)
+		assert.Nil(t, err)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, r)
+		return w
+	}
+
+	w := get(RecentHandlerURI)
+	assert.Equal(t, http.StatusOK, w.Result().StatusCode)
+
+	var feed atom.Feed
+	err = xml.Unmarshal(w.Body.Bytes(), &feed)
+	if assert.Nil(t, err) && assert.Equal(t, 1, len(feed.Entry)) {
+		assert.Equal(t, "urn:esid:agg5:1", feed.Entry[0].ID)
+	}
+
+	lastFeed, err := store.RetrieveLastFeed()
+	assert.Nil(t, err)
+	prev := getLink("prev-archive", &feed)
+	if assert.NotNil(t, prev) {
+		assert.Equal(t, fmt.Sprintf("https://testhost:12345/notifications/%s", lastFeed), *prev)
+	}
+
+	w = get(fmt.Sprintf("/notifications/%s", lastFeed))
+	assert.Equal(t, http.StatusOK, w.Result().StatusCode)
+
+	feed = atom.Feed{}
+	err = xml.Unmarshal(w.Body.Bytes(), &feed)
+	if assert.Nil(t, err) && assert.Equal(t, 2, len(feed.Entry)) {
+		assert.Equal(t, "urn:esid:agg4:1", feed.Entry[0].ID)
+		assert.Equal(t, "urn:esid:agg3:1", feed.Entry[1].ID)
+		assert.Equal(t, base64.StdEncoding.EncodeToString([]byte("ok agg3")), feed.Entry[1].Content.Body)
+		assert.NotNil(t, getLink("prev-archive", &feed))
+		next := getLink("next-archive", &feed)
+		if assert.NotNil(t, next) {
+			assert.Equal(t, "https://testhost:12345/notifications/recent", *next)
+		}
+	}
+
+	w = get("/notifications/nosuchfeed")
+	assert.Equal(t, http.StatusNotFound, w.Result().StatusCode)
+
+	w = get("/events/agg3/1")
+	assert.Equal(t, http.StatusOK, w.Result().StatusCode)
+	var event EventStoreContent
+	err = xml.Unmarshal(w.Body.Bytes(), &event)
+	if assert.Nil(t, err) {
+		assert.Equal(t, "agg3", event.AggregateId)
+		assert.Equal(t, base64.StdEncoding.EncodeToString([]byte("ok agg3")), event.Content)
+	}
+
+	w = get("/events/agg3/2")
+	assert.Equal(t, http.StatusNotFound, w.Result().StatusCode)
+}
@@ -0,0 +1,420 @@
+package atompubsvc
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	"github.com/gorilla/mux"
+	"golang.org/x/tools/blog/atom"
+	"io"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+//PayloadTypesEnv is the environment variable declaring the media types of event payloads by
+//type code, e.g. PAYLOAD_TYPES=OrderPlaced=application/json,InvoiceRaised=application/xml
+//Payloads of type codes with no declared media type are published base64 encoded.
+const PayloadTypesEnv = "PAYLOAD_TYPES"
+
+//PayloadHandlerURI is where the payload of an event is served as is, with its declared media type
+const PayloadHandlerURI = "/events/{aggregateId}/{version}/payload"
+
+//TypeCodeScheme is the scheme of the atom category carrying the type code of an entry whose
+//content type is the media type of its payload
+const TypeCodeScheme = "urn:esid:typecode"
+
+var ErrBadPayloadTypes = errors.New("Payload types must be of the form typecode=type/subtype,...")
+
+//InlinePayloadLimit is the size in bytes of the largest payload embedded base64 encoded in atom
+//content. The content of larger payloads refers to the payload resource instead.
+var InlinePayloadLimit = 64 * 1024
+
+//Media types of event payloads by type code
+var payloadTypes map[string]string
+
+//SetPayloadTypes sets the media types of event payloads by type code, overriding those
+//configured from the environment. A nil map publishes all payloads base64 encoded.
+func SetPayloadTypes(types map[string]string) {
+	payloadTypes = types
+}
+
+//ParsePayloadTypes parses a comma separated list of typecode=mediatype pairs
+func ParsePayloadTypes(spec string) (map[string]string, error) {
+	types := make(map[string]string)
+	for _, pair := range strings.Split(spec, ",") {
+		parts := strings.SplitN(pair, "=", 2)
+		if len(parts) != 2 || strings.TrimSpace(parts[0]) == "" {
+			return nil, ErrBadPayloadTypes
+		}
+
+		mediaType := strings.ToLower(strings.TrimSpace(parts[1]))
+		slash := strings.Index(mediaType, "/")
+		if slash < 1 || slash == len(mediaType)-1 {
+			return nil, ErrBadPayloadTypes
+		}
+
+		types[strings.TrimSpace(parts[0])] = mediaType
+	}
+
+	return types, nil
+}
+
+func init() {
+	spec := os.Getenv(PayloadTypesEnv)
+	if spec == "" {
+		return
+	}
+
+	types, err := ParsePayloadTypes(spec)
+	if err != nil {
+		log.Errorf("Error configuring payload types: %s. Exiting.", err.Error())
+		os.Exit(1)
+	}
+
+	log.Infof("Payload types specified: %v", types)
+	payloadTypes = types
+}
+
+//payloadTypesKey identifies the payload media types and inline limit in entity tags, as they
+//determine how entries and events are published. It is empty if no payload types are declared.
+func payloadTypesKey() string {
+	if len(payloadTypes) == 0 {
+		return ""
+	}
+
+	var typeCodes []string
+	for typeCode := range payloadTypes {
+		typeCodes = append(typeCodes, typeCode)
+	}
+	sort.Strings(typeCodes)
+
+	hash := sha256.New()
+	fmt.Fprintf(hash, "%d", InlinePayloadLimit)
+	for _, typeCode := range typeCodes {
+		fmt.Fprintf(hash, "\x00%s=%s", typeCode, payloadTypes[typeCode])
+	}
+
+	return "p" + hex.EncodeToString(hash.Sum(nil)[:8])
+}
+
+//payloadType returns the media type declared for payloads of the given type code, or the empty
+//string if there is none. Encrypted entry content is opaque whatever the payload type, so no
+//media type applies when using entry encryption.
+func payloadType(typeCode string) string {
+	if keyProvider != nil && encryptionMode == EntryEncryption {
+		return ""
+	}
+
+	return payloadTypes[typeCode]
+}
+
+//isXMLMediaType returns true for the XML media types, which RFC 4287 allows inline as atom
+//content
+func isXMLMediaType(mediaType string) bool {
+	return mediaType == XMLContentType || mediaType == "text/xml" ||
+		strings.HasSuffix(mediaType, "+xml") || strings.HasSuffix(mediaType, "/xml")
+}
+
+//isTextMediaType returns true for the text media types, which RFC 4287 allows inline as atom
+//content provided it has no child elements
+func isTextMediaType(mediaType string) bool {
+	return strings.HasPrefix(mediaType, "text/")
+}
+
+//isTextualMediaType returns true for media types whose payloads are text, and so can be carried
+//as is in the JSON representations
+func isTextualMediaType(mediaType string) bool {
+	return isXMLMediaType(mediaType) || isTextMediaType(mediaType) || mediaType == JSONContentType ||
+		strings.HasSuffix(mediaType, "+json")
+}
+
+//isXMLText returns true if the payload is UTF-8 text made up of characters allowed in XML
+func isXMLText(payload []byte) bool {
+	for len(payload) > 0 {
+		r, size := utf8.DecodeRune(payload)
+		if r == utf8.RuneError && size == 1 {
+			return false
+		}
+
+		if !(r == 0x09 || r == 0x0A || r == 0x0D || r >= 0x20 && r <= 0xD7FF ||
+			r >= 0xE000 && r <= 0xFFFD || r >= 0x10000 && r <= 0x10FFFF) {
+			return false
+		}
+
+		payload = payload[size:]
+	}
+
+	return true
+}
+
+//inlineXML returns an XML payload in a form that may be embedded in another document, i.e. with
+//any XML declaration removed. Payloads that are not well formed, that have no root element, or
+//that have a document type declaration cannot be embedded.
+func inlineXML(payload []byte) (string, bool) {
+	if !isXMLText(payload) {
+		return "", false
+	}
+
+	decoder := xml.NewDecoder(bytes.NewReader(payload))
+	start, depth, roots := int64(0), 0, 0
+
+	for {
+		token, err := decoder.Token()
+		if err == io.EOF {
+			break
+		}
+
+		if err != nil {
+			return "", false
+		}
+
+		switch t := token.(type) {
+		case xml.ProcInst:
+			if t.Target == "xml" {
+				start = decoder.InputOffset()
+			}
+		case xml.Directive:
+			return "", false
+		case xml.StartElement:
+			if depth == 0 {
+				roots++
+			}
+			depth++
+		case xml.EndElement:
+			depth--
+		}
+	}
+
+	if roots == 0 || depth != 0 {
+		return "", false
+	}
+
+	return string(bytes.TrimSpace(payload[start:])), true
+}
+
+//textPayload returns the media type of a payload of the given type code where the payload is
+//text that may be carried as is, rather than base64 encoded, in the JSON representations.
+func textPayload(typeCode string, payload []byte) (string, bool) {
+	mediaType := payloadType(typeCode)
+	if !isTextualMediaType(mediaType) || !utf8.Valid(payload) {
+		return "", false
+	}
+
+	return mediaType, true
+}
+
+//atomFeed serializes an atom feed with entries whose content reflects the payload media types.
+//Archive documents are marked with the RFC 5005 fh:archive element.
+type atomFeed struct {
+	*atom.Feed
+	Archive *struct{}    `xml:"http://purl.org/syndication/history/1.0 archive"`
+	Entry   []*atomEntry `xml:"entry"`
+}
+
+//atomEntry serializes an atom entry, adding the type code category for entries whose content type
+//is the payload media type
+type atomEntry struct {
+	*atom.Entry
+	Category *atomCategory `xml:"category"`
+	Content  *atomContent  `xml:"content"`
+}
+
+type atomCategory struct {
+	Scheme string `xml:"scheme,attr"`
+	Term   string `xml:"term,attr"`
+}
+
+//atomContent is atom entry content, which may be text, inline XML, or refer to the content via
+//the src attribute
+type atomContent struct {
+	Type string `xml:"type,attr,omitempty"`
+	Src  string `xml:"src,attr,omitempty"`
+	Body string `xml:",chardata"`
+	XML  string `xml:",innerxml"`
+}
+
+//newAtomFeed wraps a feed for serialization
+func newAtomFeed(feed *atom.Feed, archive bool) *atomFeed {
+	wrapped := &atomFeed{Feed: feed}
+	if archive {
+		wrapped.Archive = &struct{}{}
+	}
+
+	for _, entry := range feed.Entry {
+		wrapped.Entry = append(wrapped.Entry, newAtomEntry(entry))
+	}
+
+	return wrapped
+}
+
+//newAtomEntry wraps an entry for serialization. Entries hold the type code as the content type.
+//For type codes with no declared payload media type the content is the base64 encoded payload,
+//and is published as is. Otherwise the content is the payload itself, the content type is the
+//media type, and the type code is given by a category. As per RFC 4287, XML payloads are
+//embedded as XML and text payloads as text. Atom content of other types is base64 encoded, so
+//payloads larger than InlinePayloadLimit instead refer to the payload resource, unless output is
+//encrypted, as do text payloads that cannot be embedded.
+func newAtomEntry(entry *atom.Entry) *atomEntry {
+	wrapped := &atomEntry{Entry: entry}
+	if entry.Content == nil {
+		return wrapped
+	}
+
+	content := &atomContent{Type: entry.Content.Type, Body: entry.Content.Body}
+	wrapped.Content = content
+
+	mediaType := payloadType(entry.Content.Type)
+	if mediaType == "" {
+		return wrapped
+	}
+
+	payload := []byte(entry.Content.Body)
+	wrapped.Category = &atomCategory{Scheme: TypeCodeScheme, Term: entry.Content.Type}
+	content.Type = mediaType
+
+	switch {
+	case isXMLMediaType(mediaType):
+		if inline, ok := inlineXML(payload); ok {
+			content.Body, content.XML = "", inline
+			return wrapped
+		}
+	case isTextMediaType(mediaType):
+		if isXMLText(payload) {
+			return wrapped
+		}
+
+		if keyProvider == nil {
+			content.Body, content.Src = "", linkHref(entry.Link, "self")+"/payload"
+			return wrapped
+		}
+	}
+
+	if len(payload) > InlinePayloadLimit && keyProvider == nil {
+		content.Body, content.Src = "", linkHref(entry.Link, "self")+"/payload"
+		return wrapped
+	}
+
+	content.Body = base64.StdEncoding.EncodeToString(payload)
+	return wrapped
+}
+
+//setEventPayload sets the content of event store content from an event payload. Payloads are
+//base64 encoded unless they are text of a declared media type, in which case they are carried
+//as is, with the media type given as the content type.
+func setEventPayload(content *EventStoreContent, payload []byte) {
+	if mediaType, ok := textPayload(content.TypeCode, payload); ok {
+		content.Content = string(payload)
+		content.ContentType = mediaType
+		return
+	}
+
+	content.Content = base64.StdEncoding.EncodeToString(payload)
+}
+
+//NewPayloadHandler instantiates a handler serving event payloads as is, with the media type
+//declared for the event type code, or application/octet-stream if there is none. This will be
+//served at /events/{aggregateId}/{version}/payload, and is the src of atom content that cannot
+//be embedded in the feeds. As payloads are served in plaintext, they are not served when output
+//is encrypted. Events the caller may not see under the access policy get a 403 response.
+func NewPayloadHandler(store FeedStore) (func(rw http.ResponseWriter, req *http.Request), error) {
+	if store == nil {
+		return nil, ErrNilFeedStore
+	}
+
+	return func(rw http.ResponseWriter, req *http.Request) {
+		svc := "retrieve-payload"
+		start := time.Now()
+		aggregateID := mux.Vars(req)["aggregateId"]
+
+		version, err := strconv.Atoi(mux.Vars(req)["version"])
+		if err != nil {
+			logTimingStats(svc, start, err)
+			http.Error(rw, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		if keyProvider != nil {
+			logTimingStats(svc, start, nil)
+			http.Error(rw, "", http.StatusNotFound)
+			return
+		}
+
+		//Payloads are immutable, so as for events a matching entity tag can be answered without
+		//going to the store unless there is an access policy
+		cacheControl := accessPolicy.cacheControl("max-age=2592000")
+		etag := fmt.Sprintf("%s:%d-payload", aggregateID, version)
+		for _, key := range []string{payloadTypesKey(), transformersKey()} {
+			if key != "" {
+				etag += "-" + key
+			}
+		}
+		if accessPolicy == nil && etagMatches(req, etag) {
+			writeNotModified(rw, cacheControl, etag, time.Time{})
+			logTimingStats(svc, start, nil)
+			return
+		}
+
+		event, err := store.RetrieveEvent(aggregateID, version)
+		if err != nil {
+			logTimingStats(svc, start, err)
+			switch err {
+			case sql.ErrNoRows:
+				http.Error(rw, "", http.StatusNotFound)
+			default:
+				log.Warnf("Error retrieving event: %s", err.Error())
+				http.Error(rw, "Error retrieving event", http.StatusInternalServerError)
+			}
+
+			return
+		}
+
+		if !accessPolicy.Allows(PrincipalFromContext(req.Context()), aggregateID, event.TypeCode) {
+			logTimingStats(svc, start, nil)
+			log.Infof("Access to event %s %d forbidden", aggregateID, version)
+			http.Error(rw, "Forbidden", http.StatusForbidden)
+			return
+		}
+
+		if notModified(req, etag, event.Timestamp) {
+			writeNotModified(rw, cacheControl, etag, event.Timestamp)
+			logTimingStats(svc, start, nil)
+			return
+		}
+
+		contentType := payloadType(event.TypeCode)
+		if contentType == "" {
+			contentType = "application/octet-stream"
+		}
+
+		payload, err := publishedPayload(&event)
+		if err != nil {
+			logTimingStats(svc, start, err)
+			http.Error(rw, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		err = signResponse(responseSigner, rw, payload)
+		if err != nil {
+			logTimingStats(svc, start, err)
+			http.Error(rw, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		rw.Header().Add("Content-Type", contentType)
+		setValidators(rw, etag, event.Timestamp)
+		rw.Header().Add("Cache-Control", cacheControl)
+		rw.Write(payload)
+		logTimingStats(svc, start, nil)
+	}, nil
+}
@@ -0,0 +1,379 @@
+package atompubsvc
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"encoding/xml"
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+	"github.com/xtracdev/es-atom-pub/internal/testevents"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+var testPayloadTypes = map[string]string{
+	"OrderPlaced":   "application/xml",
+	"NoteAdded":     "text/plain",
+	"InvoiceRaised": "application/json",
+}
+
+//appendPayloadTestEvents appends events with payloads of each of the test payload types, an
+//XML payload that is not well formed, and a payload with no declared type
+func appendPayloadTestEvents(t *testing.T, store EventAppender) {
+	testevents.AppendPayload(t, store, "order-1", "OrderPlaced", `<?xml version="1.0"?><order id="1">a &amp; b</order>`)
+	testevents.AppendPayload(t, store, "note-1", "NoteAdded", "see <order> 1")
+	testevents.AppendPayload(t, store, "invoice-1", "InvoiceRaised", `{"amount":10}`)
+	testevents.AppendPayload(t, store, "order-2", "OrderPlaced", "<order>")
+	testevents.AppendPayload(t, store, "other-1", "foo", "ok other-1")
+}
+
+//servedFeed captures entry content as served
+type servedFeed struct {
+	Entry []struct {
+		ID       string `xml:"id"`
+		Category *struct {
+			Scheme string `xml:"scheme,attr"`
+			Term   string `xml:"term,attr"`
+		} `xml:"category"`
+		Content struct {
+			Type  string `xml:"type,attr"`
+			Src   string `xml:"src,attr"`
+			Inner string `xml:",innerxml"`
+		} `xml:"content"`
+	} `xml:"entry"`
+}
+
+func getRecent(t *testing.T, store FeedStore, accept string) *httptest.ResponseRecorder {
+	handler, err := NewRecentHandler(store, "testhost:12345")
+	assert.Nil(t, err)
+
+	r, _ := http.NewRequest("GET", "/notifications/recent", nil)
+	r.Header.Set("Accept", accept)
+	w := httptest.NewRecorder()
+	handler(w, r)
+	assert.Equal(t, http.StatusOK, w.Result().StatusCode)
+	return w
+}
+
+func TestParsePayloadTypes(t *testing.T) {
+	var tests = []struct {
+		spec     string
+		expected map[string]string
+		err      error
+	}{
+		{"OrderPlaced=application/xml", map[string]string{"OrderPlaced": "application/xml"}, nil},
+		{"A=Application/JSON, B = text/plain", map[string]string{"A": "application/json", "B": "text/plain"}, nil},
+		{"A=application/json,B", nil, ErrBadPayloadTypes},
+		{"=application/json", nil, ErrBadPayloadTypes},
+		{"A=json", nil, ErrBadPayloadTypes},
+		{"A=application/", nil, ErrBadPayloadTypes},
+	}
+
+	for _, test := range tests {
+		types, err := ParsePayloadTypes(test.spec)
+		assert.Equal(t, test.err, err, test.spec)
+		assert.Equal(t, test.expected, types, test.spec)
+	}
+}
+
+func TestInlineXML(t *testing.T) {
+	var tests = []struct {
+		payload  string
+		expected string
+		ok       bool
+	}{
+		{`<a>b</a>`, `<a>b</a>`, true},
+		{"<?xml version=\"1.0\" encoding=\"UTF-8\"?>\n<a x=\"1\"><b/></a>\n", `<a x="1"><b/></a>`, true},
+		{`<!-- note --><a/>`, `<!-- note --><a/>`, true},
+		{`<a>`, "", false},
+		{`<a></b>`, "", false},
+		{`just text`, "", false},
+		{`<!DOCTYPE a [<!ENTITY e "x">]><a>&e;</a>`, "", false},
+		{"<a>\x01</a>", "", false},
+		{"<a>\xff</a>", "", false},
+	}
+
+	for _, test := range tests {
+		inline, ok := inlineXML([]byte(test.payload))
+		assert.Equal(t, test.ok, ok, test.payload)
+		assert.Equal(t, test.expected, inline, test.payload)
+	}
+}
+
+func TestFeedPayloads(t *testing.T) {
+	SetPayloadTypes(testPayloadTypes)
+	defer SetPayloadTypes(nil)
+
+	store := NewMemoryFeedStore(10)
+	appendPayloadTestEvents(t, store)
+
+	var feed servedFeed
+	if !assert.Nil(t, xml.Unmarshal(getRecent(t, store, "").Body.Bytes(), &feed)) || !assert.Equal(t, 5, len(feed.Entry)) {
+		return
+	}
+
+	var tests = []struct {
+		contentType string
+		src         string
+		inner       string
+	}{
+		{"foo", "", "b2sgb3RoZXItMQ=="},
+		{"application/xml", "", "PG9yZGVyPg=="},
+		{"application/json", "", "eyJhbW91bnQiOjEwfQ=="},
+		{"text/plain", "", "see &lt;order&gt; 1"},
+		{"application/xml", "", `<order id="1">a &amp; b</order>`},
+	}
+
+	for i, test := range tests {
+		entry := feed.Entry[i]
+		assert.Equal(t, test.contentType, entry.Content.Type, entry.ID)
+		assert.Equal(t, test.src, entry.Content.Src, entry.ID)
+		assert.Equal(t, test.inner, entry.Content.Inner, entry.ID)
+
+		//Entries published with the payload media type carry the type code as a category
+		if test.contentType == "foo" {
+			assert.Nil(t, entry.Category, entry.ID)
+		} else if assert.NotNil(t, entry.Category, entry.ID) {
+			assert.Equal(t, TypeCodeScheme, entry.Category.Scheme)
+			assert.Equal(t, testPayloadTypes[entry.Category.Term], test.contentType)
+		}
+	}
+
+	//JSON Feed items carry textual payloads as is
+	var jsonFeed JSONFeed
+	if assert.Nil(t, json.Unmarshal(getRecent(t, store, JSONFeedContentType).Body.Bytes(), &jsonFeed)) &&
+		assert.Equal(t, 5, len(jsonFeed.Items)) {
+		assert.Equal(t, "b2sgb3RoZXItMQ==", jsonFeed.Items[0].ContentText)
+		assert.Equal(t, "foo", jsonFeed.Items[0].Atom.ContentType)
+		assert.Equal(t, "foo", jsonFeed.Items[0].Atom.TypeCode)
+		assert.Equal(t, `{"amount":10}`, jsonFeed.Items[2].ContentText)
+		assert.Equal(t, "application/json", jsonFeed.Items[2].Atom.ContentType)
+		assert.Equal(t, "InvoiceRaised", jsonFeed.Items[2].Atom.TypeCode)
+		assert.Equal(t, "<order>", jsonFeed.Items[1].ContentText)
+	}
+
+	//Payloads too large to embed refer to the payload resource instead
+	defer func(limit int) { InlinePayloadLimit = limit }(InlinePayloadLimit)
+	InlinePayloadLimit = 8
+
+	feed = servedFeed{}
+	if assert.Nil(t, xml.Unmarshal(getRecent(t, store, "").Body.Bytes(), &feed)) && assert.Equal(t, 5, len(feed.Entry)) {
+		assert.Equal(t, "https://testhost:12345/events/invoice-1/1/payload", feed.Entry[2].Content.Src)
+		assert.Equal(t, "", feed.Entry[2].Content.Inner)
+		assert.Equal(t, "", feed.Entry[1].Content.Src)
+		assert.Equal(t, "PG9yZGVyPg==", feed.Entry[1].Content.Inner)
+	}
+}
+
+func TestFeedPayloadsEncrypted(t *testing.T) {
+	SetPayloadTypes(testPayloadTypes)
+	defer SetPayloadTypes(nil)
+
+	SetKeyProvider(NewFakeKeyProvider(testKey))
+	defer SetKeyProvider(nil)
+
+	store := NewMemoryFeedStore(10)
+	appendPayloadTestEvents(t, store)
+
+	//With document encryption payloads are not referred to, as they would be served in plaintext
+	var feed servedFeed
+	_, ciphertext := splitEnvelope(t, getRecent(t, store, "").Body.Bytes())
+	body := testDecrypt(t, ciphertext, &testKey)
+	if assert.Nil(t, xml.Unmarshal(body, &feed)) && assert.Equal(t, 5, len(feed.Entry)) {
+		assert.Equal(t, "application/json", feed.Entry[2].Content.Type)
+		assert.Equal(t, "", feed.Entry[2].Content.Src)
+		assert.Equal(t, base64.StdEncoding.EncodeToString([]byte(`{"amount":10}`)), feed.Entry[2].Content.Inner)
+		assert.Equal(t, `<order id="1">a &amp; b</order>`, feed.Entry[4].Content.Inner)
+	}
+
+	//With entry encryption the content is opaque, so published as without payload types
+	SetEncryptionMode(EntryEncryption)
+	defer SetEncryptionMode(DocumentEncryption)
+
+	feed = servedFeed{}
+	if assert.Nil(t, xml.Unmarshal(getRecent(t, store, "").Body.Bytes(), &feed)) && assert.Equal(t, 5, len(feed.Entry)) {
+		for _, entry := range feed.Entry {
+			assert.Nil(t, entry.Category, entry.ID)
+			assert.Equal(t, "", entry.Content.Src, entry.ID)
+		}
+
+		assert.Equal(t, "InvoiceRaised", feed.Entry[2].Content.Type)
+	}
+}
+
+func TestEventPayloadContent(t *testing.T) {
+	SetPayloadTypes(testPayloadTypes)
+	defer SetPayloadTypes(nil)
+
+	store := NewMemoryFeedStore(10)
+	appendPayloadTestEvents(t, store)
+
+	retrieveHandler, err := NewEventRetrieveHandler(store, "testhost:12345")
+	assert.Nil(t, err)
+
+	router := mux.NewRouter()
+	router.HandleFunc(RetrieveEventHanderURI, retrieveHandler)
+
+	var tests = []struct {
+		uri         string
+		accept      string
+		content     string
+		contentType string
+	}{
+		{"/events/order-1/1", "", `<?xml version="1.0"?><order id="1">a &amp; b</order>`, "application/xml"},
+		{"/events/invoice-1/1", JSONContentType, `{"amount":10}`, "application/json"},
+		{"/events/invoice-1/1", "", `{"amount":10}`, "application/json"},
+		{"/events/other-1/1", "", "b2sgb3RoZXItMQ==", ""},
+	}
+
+	for _, test := range tests {
+		r, _ := http.NewRequest("GET", test.uri, nil)
+		r.Header.Set("Accept", test.accept)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, r)
+		assert.Equal(t, http.StatusOK, w.Result().StatusCode)
+
+		var event EventStoreContent
+		if test.accept == JSONContentType {
+			assert.Nil(t, json.Unmarshal(w.Body.Bytes(), &event))
+		} else {
+			assert.Nil(t, xml.Unmarshal(w.Body.Bytes(), &event))
+		}
+
+		assert.Equal(t, test.content, event.Content, test.uri)
+		assert.Equal(t, test.contentType, event.ContentType, test.uri)
+	}
+}
+
+func TestPayloadHandler(t *testing.T) {
+	_, err := NewPayloadHandler(nil)
+	assert.Equal(t, ErrNilFeedStore, err)
+
+	SetPayloadTypes(testPayloadTypes)
+	defer SetPayloadTypes(nil)
+
+	store := NewMemoryFeedStore(10)
+	appendPayloadTestEvents(t, store)
+
+	payloadHandler, err := NewPayloadHandler(store)
+	assert.Nil(t, err)
+
+	router := mux.NewRouter()
+	router.HandleFunc(PayloadHandlerURI, payloadHandler)
+
+	get := func(uri, ifNoneMatch string) *httptest.ResponseRecorder {
+		r, _ := http.NewRequest("GET", uri, nil)
+		r.Header.Set("If-None-Match", ifNoneMatch)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, r)
+		return w
+	}
+
+	w := get("/events/invoice-1/1/payload", "")
+	assert.Equal(t, http.StatusOK, w.Result().StatusCode)
+	assert.Equal(t, "application/json", w.Header().Get("Content-Type"))
+	assert.Equal(t, "max-age=2592000", w.Header().Get("Cache-Control"))
+	etag := "invoice-1:1-payload-" + payloadTypesKey()
+	assert.Equal(t, `"`+etag+`"`, w.Header().Get("ETag"))
+	assert.Equal(t, `{"amount":10}`, w.Body.String())
+
+	w = get("/events/other-1/1/payload", "")
+	assert.Equal(t, "application/octet-stream", w.Header().Get("Content-Type"))
+	assert.Equal(t, "ok other-1", w.Body.String())
+
+	assert.Equal(t, http.StatusNotModified, get("/events/invoice-1/1/payload", etag).Result().StatusCode)
+	assert.Equal(t, http.StatusNotFound, get("/events/invoice-1/2/payload", "").Result().StatusCode)
+	assert.Equal(t, http.StatusBadRequest, get("/events/invoice-1/x/payload", "").Result().StatusCode)
+
+	//Payloads are not served in plaintext when output is encrypted
+	SetKeyProvider(NewFakeKeyProvider(testKey))
+	defer SetKeyProvider(nil)
+
+	assert.Equal(t, http.StatusNotFound, get("/events/invoice-1/1/payload", "").Result().StatusCode)
+}
+
+func TestPolicyPayloadHandler(t *testing.T) {
+	policy, cleanup := writeTestPolicy(t)
+	defer cleanup()
+
+	SetPolicy(policy)
+	defer SetPolicy(nil)
+
+	store := NewMemoryFeedStore(10)
+	appendPolicyTestEvents(t, store)
+
+	payloadHandler, err := NewPayloadHandler(store)
+	assert.Nil(t, err)
+
+	router := mux.NewRouter()
+	router.HandleFunc(PayloadHandlerURI, payloadHandler)
+
+	var tests = []struct {
+		subject string
+		uri     string
+		status  int
+	}{
+		{"orders", "/events/order-1/1/payload", http.StatusOK},
+		{"orders", "/events/order-2/1/payload", http.StatusForbidden},
+		{"", "/events/public-1/1/payload", http.StatusOK},
+	}
+
+	for _, test := range tests {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, principalRequest(test.uri, test.subject))
+		assert.Equal(t, test.status, w.Result().StatusCode, "%v", test)
+
+		if test.status == http.StatusOK {
+			assert.Equal(t, "private, max-age=2592000", w.Result().Header.Get("Cache-Control"))
+		}
+	}
+}
+
+func TestPayloadTypesETags(t *testing.T) {
+	defer SetPayloadTypes(nil)
+
+	store := NewMemoryFeedStore(10)
+	appendPayloadTestEvents(t, store)
+
+	archiveHandler, err := NewArchiveHandler(store, "testhost:12345")
+	assert.Nil(t, err)
+	retrieveHandler, err := NewEventRetrieveHandler(store, "testhost:12345")
+	assert.Nil(t, err)
+
+	router := mux.NewRouter()
+	router.HandleFunc(ArchiveHandlerURI, archiveHandler)
+	router.HandleFunc(RetrieveEventHanderURI, retrieveHandler)
+
+	get := func(uri, ifNoneMatch string) *httptest.ResponseRecorder {
+		r, _ := http.NewRequest("GET", uri, nil)
+		r.Header.Set("If-None-Match", ifNoneMatch)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, r)
+		return w
+	}
+
+	recent := getRecent(t, store, "").Header().Get("ETag")
+	untyped := get("/events/invoice-1/1", "").Header().Get("ETag")
+	assert.Equal(t, `"invoice-1:1-recent"`, untyped)
+
+	//Entity tags issued before the payload types change no longer match, as the published
+	//content differs
+	SetPayloadTypes(testPayloadTypes)
+	typed := get("/events/invoice-1/1", untyped)
+	assert.Equal(t, http.StatusOK, typed.Result().StatusCode)
+	assert.NotEqual(t, untyped, typed.Header().Get("ETag"))
+	assert.NotEqual(t, recent, getRecent(t, store, "").Header().Get("ETag"))
+	assert.Equal(t, http.StatusNotModified, get("/events/invoice-1/1", typed.Header().Get("ETag")).Result().StatusCode)
+
+	SetPayloadTypes(map[string]string{"InvoiceRaised": "text/plain"})
+	assert.Equal(t, http.StatusOK, get("/events/invoice-1/1", typed.Header().Get("ETag")).Result().StatusCode)
+
+	defer func(limit int) { InlinePayloadLimit = limit }(InlinePayloadLimit)
+	retyped := get("/events/invoice-1/1", "").Header().Get("ETag")
+	InlinePayloadLimit = 8
+	assert.Equal(t, http.StatusOK, get("/events/invoice-1/1", retyped).Result().StatusCode)
+
+	SetPayloadTypes(nil)
+	assert.Equal(t, untyped, get("/events/invoice-1/1", "").Header().Get("ETag"))
+}
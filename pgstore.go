@@ -0,0 +1,161 @@
+package atompubsvc
+
+import (
+	"database/sql"
+	"fmt"
+	atomdata "github.com/xtracdev/es-atom-data"
+	"time"
+)
+
+//PostgresSchema contains the statements used to create the feed and event tables in
+//PostgreSQL. The tables mirror the t_aefd_feed and t_aeae_atom_event tables es-atom-data
+//maintains in Oracle: events have a null feed id until they are archived into a feed, and each
+//feed records the id of the feed that preceded it.
+var PostgresSchema = []string{
+	`create table if not exists t_aefd_feed (
+		id bigserial primary key,
+		event_time timestamptz not null default now(),
+		feedid varchar(100) not null unique,
+		previous varchar(100)
+	)`,
+	`create table if not exists t_aeae_atom_event (
+		id bigserial primary key,
+		feedid varchar(100) references t_aefd_feed(feedid),
+		event_time timestamptz not null default now(),
+		aggregate_id varchar(60) not null,
+		version integer not null,
+		typecode varchar(60) not null,
+		payload bytea,
+		unique (aggregate_id, version)
+	)`,
+	`create index if not exists aeae_feedid_ix on t_aeae_atom_event(feedid)`,
+	`create index if not exists aeae_typecode_ix on t_aeae_atom_event(typecode, feedid)`,
+	`create index if not exists aeae_event_time_ix on t_aeae_atom_event(event_time, id)`,
+	`create index if not exists aefd_previous_ix on t_aefd_feed(previous)`,
+}
+
+//MigratePostgres creates the feed and event tables if they do not already exist.
+func MigratePostgres(db *sql.DB) error {
+	if db == nil {
+		return ErrBadDBConnection
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+
+	for _, stmt := range PostgresSchema {
+		if _, err := tx.Exec(stmt); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+//PostgresFeedStore is a FeedStore backed by PostgreSQL tables created via MigratePostgres.
+type PostgresFeedStore struct {
+	db *sql.DB
+}
+
+//NewPostgresFeedStore returns a FeedStore that reads feed and event data from PostgreSQL
+//using the given database connection.
+func NewPostgresFeedStore(db *sql.DB) (*PostgresFeedStore, error) {
+	if db == nil {
+		return nil, ErrBadDBConnection
+	}
+
+	return &PostgresFeedStore{db: db}, nil
+}
+
+func (pfs *PostgresFeedStore) RetrieveRecent() ([]atomdata.TimestampedEvent, error) {
+	return queryEvents(pfs.db,
+		`select event_time, aggregate_id, version, typecode, payload from t_aeae_atom_event where feedid is null order by id desc`)
+}
+
+func (pfs *PostgresFeedStore) RetrieveLastFeed() (string, error) {
+	feedID, err := queryNullString(pfs.db,
+		`select feedid from t_aefd_feed where id = (select max(id) from t_aefd_feed)`)
+	return feedID.String, err
+}
+
+func (pfs *PostgresFeedStore) RetrieveArchive(feedID string) ([]atomdata.TimestampedEvent, error) {
+	return queryEvents(pfs.db,
+		`select event_time, aggregate_id, version, typecode, payload from t_aeae_atom_event where feedid = $1 order by id desc`,
+		feedID)
+}
+
+func (pfs *PostgresFeedStore) RetrievePreviousFeed(feedID string) (sql.NullString, error) {
+	return queryNullString(pfs.db, `select previous from t_aefd_feed where feedid = $1`, feedID)
+}
+
+func (pfs *PostgresFeedStore) RetrieveNextFeed(feedID string) (sql.NullString, error) {
+	return queryNullString(pfs.db, `select feedid from t_aefd_feed where previous = $1`, feedID)
+}
+
+func (pfs *PostgresFeedStore) RetrieveEvent(aggregateID string, version int) (atomdata.TimestampedEvent, error) {
+	var event atomdata.TimestampedEvent
+	var payload []byte
+
+	row := pfs.db.QueryRow(
+		`select event_time, typecode, payload from t_aeae_atom_event where aggregate_id = $1 and version = $2`,
+		aggregateID, version)
+	if err := row.Scan(&event.Timestamp, &event.TypeCode, &payload); err != nil {
+		return atomdata.TimestampedEvent{}, err
+	}
+
+	event.Source = aggregateID
+	event.Version = version
+	event.Payload = payload
+
+	return event, nil
+}
+
+func (pfs *PostgresFeedStore) RetrieveAggregateEvents(aggregateID string, afterVersion, toVersion, limit int) ([]atomdata.TimestampedEvent, error) {
+	query, args := aggregateEventsQuery(aggregateID, afterVersion, toVersion, limit,
+		func(n int) string { return fmt.Sprintf("$%d", n) },
+		func(limitArg string) string { return "limit " + limitArg })
+	return queryEvents(pfs.db, query, args...)
+}
+
+func (pfs *PostgresFeedStore) RetrieveFirstFeed() (string, error) {
+	feedID, err := queryNullString(pfs.db, firstFeedQuery)
+	return feedID.String, err
+}
+
+func (pfs *PostgresFeedStore) RetrieveFeedIndex() ([]FeedSummary, error) {
+	return queryFeedIndex(pfs.db)
+}
+
+func (pfs *PostgresFeedStore) RetrieveFeedAt(at time.Time) (string, error) {
+	feedID, err := queryNullString(pfs.db,
+		`select feedid from t_aeae_atom_event where event_time >= $1 order by event_time, id limit 1`, at)
+	return feedID.String, err
+}
+
+func (pfs *PostgresFeedStore) RetrieveTypedFeed(feedID string, typeCodes []string, backwards bool) (string, error) {
+	return pfs.queryTypedFeed(feedID, typeCodes, backwards)
+}
+
+func (pfs *PostgresFeedStore) RetrieveFirstTypedFeed(typeCodes []string) (string, error) {
+	return pfs.queryTypedFeed("", typeCodes, false)
+}
+
+func (pfs *PostgresFeedStore) queryTypedFeed(feedID string, typeCodes []string, backwards bool) (string, error) {
+	query, args := typedFeedQuery(feedID, typeCodes, backwards,
+		func(n int) string { return fmt.Sprintf("$%d", n) },
+		func(limitArg string) string { return "limit " + limitArg })
+	result, err := queryNullString(pfs.db, query, args...)
+	return result.String, err
+}
+
+func (pfs *PostgresFeedStore) RetrieveEventFeed(aggregateID string, version int) (string, error) {
+	return queryEventFeed(pfs.db, eventFeedQuery(func(n int) string { return fmt.Sprintf("$%d", n) }), aggregateID, version)
+}
+
+func (pfs *PostgresFeedStore) RetrieveEventPosition(aggregateID string, version int) (EventPosition, error) {
+	return queryEventPosition(pfs.db, eventPositionQuery(func(n int) string { return fmt.Sprintf("$%d", n) }),
+		aggregateID, version)
+}
@@ -0,0 +1,143 @@
+package atompubsvc
+
+import (
+	"database/sql"
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/DATA-DOG/go-sqlmock.v1"
+	"testing"
+	"time"
+)
+
+var eventCols = []string{"event_time", "aggregate_id", "version", "typecode", "payload"}
+
+func TestPostgresFeedStoreNilDB(t *testing.T) {
+	store, err := NewPostgresFeedStore(nil)
+	assert.Nil(t, store)
+	assert.Equal(t, ErrBadDBConnection, err)
+
+	assert.Equal(t, ErrBadDBConnection, MigratePostgres(nil))
+}
+
+func TestMigratePostgres(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	mock.ExpectBegin()
+	mock.ExpectExec("create table if not exists t_aefd_feed").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec("create table if not exists t_aeae_atom_event").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec("create index if not exists aeae_feedid_ix").WillReturnError(errors.New("boom"))
+	mock.ExpectRollback()
+
+	err = MigratePostgres(db)
+	assert.NotNil(t, err)
+	assert.Nil(t, mock.ExpectationsWereMet())
+}
+
+func TestPostgresFeedStoreRetrieval(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	store, err := NewPostgresFeedStore(db)
+	assert.Nil(t, err)
+
+	ts := time.Now()
+
+	mock.ExpectQuery("select event_time, aggregate_id, version, typecode, payload from t_aeae_atom_event where feedid is null").
+		WillReturnRows(sqlmock.NewRows(eventCols).AddRow(ts, "agg1", 1, "foo", []byte("ok")))
+	recent, err := store.RetrieveRecent()
+	if assert.Nil(t, err) && assert.Equal(t, 1, len(recent)) {
+		assert.Equal(t, "agg1", recent[0].Source)
+		assert.Equal(t, []byte("ok"), recent[0].Payload)
+	}
+
+	mock.ExpectQuery("select feedid from t_aefd_feed where id =").
+		WillReturnRows(sqlmock.NewRows([]string{"feedid"}))
+	lastFeed, err := store.RetrieveLastFeed()
+	assert.Nil(t, err)
+	assert.Equal(t, "", lastFeed)
+
+	mock.ExpectQuery(`where feedid = \$1`).WithArgs("feed-1").
+		WillReturnRows(sqlmock.NewRows(eventCols).AddRow(ts, "agg2", 1, "foo", []byte("ok")))
+	archive, err := store.RetrieveArchive("feed-1")
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(archive))
+
+	mock.ExpectQuery(`select previous from t_aefd_feed where feedid = \$1`).WithArgs("feed-1").
+		WillReturnRows(sqlmock.NewRows([]string{"previous"}).AddRow(nil))
+	previous, err := store.RetrievePreviousFeed("feed-1")
+	assert.Nil(t, err)
+	assert.False(t, previous.Valid)
+
+	mock.ExpectQuery(`select feedid from t_aefd_feed where previous = \$1`).WithArgs("feed-1").
+		WillReturnRows(sqlmock.NewRows([]string{"feedid"}).AddRow("feed-2"))
+	next, err := store.RetrieveNextFeed("feed-1")
+	assert.Nil(t, err)
+	assert.Equal(t, sql.NullString{String: "feed-2", Valid: true}, next)
+
+	mock.ExpectQuery(`where aggregate_id = \$1 and version = \$2`).WithArgs("agg2", 1).
+		WillReturnRows(sqlmock.NewRows([]string{"event_time", "typecode", "payload"}))
+	_, err = store.RetrieveEvent("agg2", 1)
+	assert.Equal(t, sql.ErrNoRows, err)
+
+	mock.ExpectQuery(`where aggregate_id = \$1 and version > \$2 and version <= \$3 order by version limit \$4`).
+		WithArgs("agg2", 1, 5, 10).
+		WillReturnRows(sqlmock.NewRows(eventCols).AddRow(ts, "agg2", 2, "foo", []byte("ok")))
+	history, err := store.RetrieveAggregateEvents("agg2", 1, 5, 10)
+	if assert.Nil(t, err) && assert.Equal(t, 1, len(history)) {
+		assert.Equal(t, 2, history[0].Version)
+	}
+
+	mock.ExpectQuery(`select feedid from t_aefd_feed where id = \(select min\(id\)`).
+		WillReturnRows(sqlmock.NewRows([]string{"feedid"}).AddRow("feed-1"))
+	firstFeed, err := store.RetrieveFirstFeed()
+	assert.Nil(t, err)
+	assert.Equal(t, "feed-1", firstFeed)
+
+	mock.ExpectQuery(`select f.feedid, s.events, fe.event_time, le.event_time from t_aefd_feed f`).
+		WillReturnRows(sqlmock.NewRows([]string{"feedid", "events", "event_time", "event_time"}).
+			AddRow("feed-1", 2, ts, ts).AddRow("feed-2", 1, ts, ts))
+	index, err := store.RetrieveFeedIndex()
+	if assert.Nil(t, err) && assert.Equal(t, 2, len(index)) {
+		assert.Equal(t, FeedSummary{FeedID: "feed-2", Events: 1, First: ts, Last: ts}, index[1])
+	}
+
+	mock.ExpectQuery(`select feedid from t_aeae_atom_event where event_time >= \$1 order by event_time, id limit 1`).WithArgs(ts).
+		WillReturnRows(sqlmock.NewRows([]string{"feedid"}).AddRow(nil))
+	seekFeed, err := store.RetrieveFeedAt(ts)
+	assert.Nil(t, err)
+	assert.Equal(t, "", seekFeed)
+
+	mock.ExpectQuery(`select e.feedid, e.typecode, .* where e.aggregate_id = \$1 and e.version = \$2`).WithArgs("agg2", 1).
+		WillReturnRows(sqlmock.NewRows([]string{"feedid", "typecode", "position"}).AddRow("feed-1", "foo", 4))
+	position, err := store.RetrieveEventPosition("agg2", 1)
+	assert.Nil(t, err)
+	assert.Equal(t, EventPosition{FeedID: "feed-1", Position: 4, TypeCode: "foo"}, position)
+
+	mock.ExpectQuery(`select feedid from t_aeae_atom_event where aggregate_id = \$1 and version = \$2`).WithArgs("agg2", 1).
+		WillReturnRows(sqlmock.NewRows([]string{"feedid"}).AddRow(nil))
+	eventFeed, err := store.RetrieveEventFeed("agg2", 1)
+	assert.Nil(t, err)
+	assert.Equal(t, "", eventFeed)
+
+	mock.ExpectQuery(`where e.typecode in \(\$1, \$2\) and e.feedid = f.feedid\) and f.id <= \(select id from t_aefd_feed where feedid = \$3\) order by f.id desc limit 1`).
+		WithArgs("bar", "foo", "feed-2").
+		WillReturnRows(sqlmock.NewRows([]string{"feedid"}).AddRow("feed-1"))
+	typedFeed, err := store.RetrieveTypedFeed("feed-2", []string{"bar", "foo"}, true)
+	assert.Nil(t, err)
+	assert.Equal(t, "feed-1", typedFeed)
+
+	mock.ExpectQuery(`where e.typecode in \(\$1\) and e.feedid = f.feedid\) order by f.id limit 1`).WithArgs("bar").
+		WillReturnRows(sqlmock.NewRows([]string{"feedid"}))
+	typedFeed, err = store.RetrieveFirstTypedFeed([]string{"bar"})
+	assert.Nil(t, err)
+	assert.Equal(t, "", typedFeed)
+
+	assert.Nil(t, mock.ExpectationsWereMet())
+}
@@ -0,0 +1,189 @@
+package atompubsvc
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	"io/ioutil"
+	"os"
+	"strings"
+)
+
+//PolicyFile is the environment variable giving the path of the authorization policy file. If it
+//is not set, all callers see all events.
+const PolicyFile = "POLICY_FILE"
+
+//Grant allows access to events with one of the type codes and an aggregate id starting with one
+//of the prefixes. An empty list places no restriction, so an empty grant allows all events.
+type Grant struct {
+	TypeCodes         []string `json:"typecodes,omitempty"`
+	AggregatePrefixes []string `json:"aggregatePrefixes,omitempty"`
+}
+
+func (g *Grant) allows(aggregateID, typeCode string) bool {
+	return g.allowsTypeCode(typeCode) && g.allowsAggregate(aggregateID)
+}
+
+func (g *Grant) allowsTypeCode(typeCode string) bool {
+	if len(g.TypeCodes) == 0 {
+		return true
+	}
+
+	for _, allowed := range g.TypeCodes {
+		if allowed == typeCode {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (g *Grant) allowsAggregate(aggregateID string) bool {
+	if len(g.AggregatePrefixes) == 0 {
+		return true
+	}
+
+	for _, prefix := range g.AggregatePrefixes {
+		if strings.HasPrefix(aggregateID, prefix) {
+			return true
+		}
+	}
+
+	return false
+}
+
+//Policy maps principal subjects to the grants of events they may see. Principals not listed,
+//and unauthenticated callers, get the default grants. A principal with no grants sees no events.
+//Writers maps the subjects of the principals that may append events to the grants of the events
+//they may append; there are no default writers. For example:
+//
+//	{
+//		"principals": {
+//			"billing": [{"typecodes": ["InvoiceRaised", "InvoicePaid"]}],
+//			"CN=audit,O=Example": [{}]
+//		},
+//		"default": [{"aggregatePrefixes": ["public-"]}],
+//		"writers": {
+//			"billing": [{"typecodes": ["InvoiceRaised", "InvoicePaid"]}]
+//		}
+//	}
+type Policy struct {
+	Principals map[string][]Grant `json:"principals"`
+	Default    []Grant            `json:"default"`
+	Writers    map[string][]Grant `json:"writers,omitempty"`
+}
+
+//NewPolicyFromFile reads a JSON policy file
+func NewPolicyFromFile(path string) (*Policy, error) {
+	contents, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	policy := new(Policy)
+	if err := json.Unmarshal(contents, policy); err != nil {
+		return nil, fmt.Errorf("Error parsing policy file %s: %s", path, err.Error())
+	}
+
+	return policy, nil
+}
+
+//Policy applied to requests, nil if all callers see all events
+var accessPolicy *Policy
+
+//SetPolicy sets the authorization policy, overriding the policy configured from the environment.
+//A nil policy allows all callers to see all events.
+func SetPolicy(policy *Policy) {
+	accessPolicy = policy
+}
+
+func init() {
+	policyFile := os.Getenv(PolicyFile)
+	if policyFile == "" {
+		return
+	}
+
+	policy, err := NewPolicyFromFile(policyFile)
+	if err != nil {
+		log.Errorf("Error reading policy file: %s. Exiting.", err.Error())
+		os.Exit(1)
+	}
+
+	log.Infof("Authorization policy read from %s", policyFile)
+	accessPolicy = policy
+}
+
+//grants returns the grants of the principal, which may be nil for unauthenticated callers
+func (p *Policy) grants(principal *Principal) []Grant {
+	if principal != nil {
+		if grants, ok := p.Principals[principal.Subject]; ok {
+			return grants
+		}
+	}
+
+	return p.Default
+}
+
+//Allows returns true if the principal may see the event with the given aggregate id and type
+//code. A nil policy allows everything.
+func (p *Policy) Allows(principal *Principal, aggregateID, typeCode string) bool {
+	if p == nil {
+		return true
+	}
+
+	grants := p.grants(principal)
+	for i := range grants {
+		if grants[i].allows(aggregateID, typeCode) {
+			return true
+		}
+	}
+
+	return false
+}
+
+//AllowsWrite returns true if the principal may append the event with the given aggregate id and
+//type code. Only principals listed as writers may append events, so unauthenticated callers never
+//may. A nil policy allows everything.
+func (p *Policy) AllowsWrite(principal *Principal, aggregateID, typeCode string) bool {
+	if p == nil {
+		return true
+	}
+
+	if principal == nil {
+		return false
+	}
+
+	grants := p.Writers[principal.Subject]
+	for i := range grants {
+		if grants[i].allows(aggregateID, typeCode) {
+			return true
+		}
+	}
+
+	return false
+}
+
+//view identifies the set of events the principal may see, so entity tags of filtered pages
+//differ between principals with different grants, and change when their grants change. The
+//view is empty for a nil policy.
+func (p *Policy) view(principal *Principal) string {
+	if p == nil {
+		return ""
+	}
+
+	grants, _ := json.Marshal(p.grants(principal))
+	hash := sha256.Sum256(grants)
+	return hex.EncodeToString(hash[:8])
+}
+
+//cacheControl returns the Cache-Control directives for a response. Responses filtered by a
+//policy depend on the caller, so must not be stored by shared caches.
+func (p *Policy) cacheControl(directives string) string {
+	if p == nil {
+		return directives
+	}
+
+	return "private, " + directives
+}
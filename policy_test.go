@@ -0,0 +1,373 @@
+package atompubsvc
+
+import (
+	"encoding/xml"
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+	"github.com/xtracdev/es-atom-pub/internal/testevents"
+	"golang.org/x/tools/blog/atom"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testPolicy = `{
+	"principals": {
+		"billing": [{"typecodes": ["InvoiceRaised"]}, {"aggregatePrefixes": ["bill-"]}],
+		"orders": [{"typecodes": ["OrderPlaced"], "aggregatePrefixes": ["order-"]}],
+		"audit": [{}],
+		"nobody": []
+	},
+	"default": [{"aggregatePrefixes": ["public-"]}],
+	"writers": {
+		"orders": [{"typecodes": ["OrderPlaced"], "aggregatePrefixes": ["order-"]}]
+	}
+}`
+
+func writeTestPolicy(t *testing.T) (*Policy, func()) {
+	dir, err := ioutil.TempDir("", "policy")
+	assert.Nil(t, err)
+
+	policyFile := filepath.Join(dir, "policy.json")
+	assert.Nil(t, ioutil.WriteFile(policyFile, []byte(testPolicy), 0600))
+
+	policy, err := NewPolicyFromFile(policyFile)
+	if !assert.Nil(t, err) {
+		t.FailNow()
+	}
+
+	return policy, func() { os.RemoveAll(dir) }
+}
+
+//appendPolicyTestEvents appends events of several type codes and aggregates
+func appendPolicyTestEvents(t *testing.T, store EventAppender) {
+	testevents.Append(t, store, "OrderPlaced", "order-1")
+	testevents.Append(t, store, "InvoiceRaised", "bill-1", "order-2")
+	testevents.Append(t, store, "OrderPlaced", "public-1")
+}
+
+func principalRequest(uri, subject string) *http.Request {
+	r, _ := http.NewRequest("GET", uri, nil)
+	if subject == "" {
+		return r
+	}
+
+	return r.WithContext(WithPrincipal(r.Context(), &Principal{Subject: subject}))
+}
+
+func entryIDs(t *testing.T, body []byte) []string {
+	var feed atom.Feed
+	assert.Nil(t, xml.Unmarshal(body, &feed))
+
+	var ids []string
+	for _, entry := range feed.Entry {
+		ids = append(ids, entry.ID)
+	}
+
+	return ids
+}
+
+func TestPolicyAllows(t *testing.T) {
+	policy, cleanup := writeTestPolicy(t)
+	defer cleanup()
+
+	var tests = []struct {
+		subject     string
+		aggregateID string
+		typeCode    string
+		allowed     bool
+	}{
+		{"billing", "order-2", "InvoiceRaised", true},
+		{"billing", "bill-9", "Anything", true},
+		{"billing", "order-1", "OrderPlaced", false},
+		{"orders", "order-1", "OrderPlaced", true},
+		{"orders", "order-2", "InvoiceRaised", false},
+		{"orders", "public-1", "OrderPlaced", false},
+		{"audit", "anything", "Anything", true},
+		{"nobody", "public-1", "OrderPlaced", false},
+		{"stranger", "public-1", "OrderPlaced", true},
+		{"stranger", "order-1", "OrderPlaced", false},
+		{"", "public-1", "OrderPlaced", true},
+	}
+
+	for _, test := range tests {
+		var principal *Principal
+		if test.subject != "" {
+			principal = &Principal{Subject: test.subject}
+		}
+
+		assert.Equal(t, test.allowed, policy.Allows(principal, test.aggregateID, test.typeCode), "%v", test)
+	}
+
+	//Only writers may append events, within their grants
+	var writeTests = []struct {
+		subject     string
+		aggregateID string
+		typeCode    string
+		allowed     bool
+	}{
+		{"orders", "order-1", "OrderPlaced", true},
+		{"orders", "order-1", "InvoiceRaised", false},
+		{"audit", "order-1", "OrderPlaced", false},
+		{"stranger", "public-1", "OrderPlaced", false},
+		{"", "public-1", "OrderPlaced", false},
+	}
+
+	for _, test := range writeTests {
+		var principal *Principal
+		if test.subject != "" {
+			principal = &Principal{Subject: test.subject}
+		}
+
+		assert.Equal(t, test.allowed, policy.AllowsWrite(principal, test.aggregateID, test.typeCode), "%v", test)
+	}
+
+	var nilPolicy *Policy
+	assert.True(t, nilPolicy.Allows(nil, "order-1", "OrderPlaced"))
+	assert.True(t, nilPolicy.AllowsWrite(nil, "order-1", "OrderPlaced"))
+	assert.Equal(t, "", nilPolicy.view(nil))
+	assert.Equal(t, "max-age=60", nilPolicy.cacheControl("max-age=60"))
+	assert.Equal(t, "private, max-age=60", policy.cacheControl("max-age=60"))
+
+	assert.NotEqual(t, policy.view(&Principal{Subject: "billing"}), policy.view(&Principal{Subject: "orders"}))
+	assert.Equal(t, policy.view(nil), policy.view(&Principal{Subject: "stranger"}))
+}
+
+func TestNewPolicyFromFileErrors(t *testing.T) {
+	dir, err := ioutil.TempDir("", "policy")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	badFile := filepath.Join(dir, "bad.json")
+	assert.Nil(t, ioutil.WriteFile(badFile, []byte(`{"principals": []}`), 0600))
+	_, err = NewPolicyFromFile(badFile)
+	assert.NotNil(t, err)
+
+	_, err = NewPolicyFromFile(filepath.Join(dir, "missing"))
+	assert.NotNil(t, err)
+}
+
+func TestPolicyFeedHandlers(t *testing.T) {
+	policy, cleanup := writeTestPolicy(t)
+	defer cleanup()
+
+	SetPolicy(policy)
+	defer SetPolicy(nil)
+
+	//The same events are held as recent events in one store and archived in the other
+	recentStore := NewMemoryFeedStore(10)
+	appendPolicyTestEvents(t, recentStore)
+
+	store := NewMemoryFeedStore(4)
+	appendPolicyTestEvents(t, store)
+
+	recentHandler, err := NewRecentHandler(recentStore, "testhost:12345")
+	assert.Nil(t, err)
+
+	archiveHandler, err := NewArchiveHandler(store, "testhost:12345")
+	assert.Nil(t, err)
+
+	router := mux.NewRouter()
+	router.HandleFunc(ArchiveHandlerURI, archiveHandler)
+
+	lastFeed, err := store.RetrieveLastFeed()
+	assert.Nil(t, err)
+
+	var tests = []struct {
+		subject string
+		entries []string
+	}{
+		{"billing", []string{"urn:esid:order-2:1", "urn:esid:bill-1:1"}},
+		{"orders", []string{"urn:esid:order-1:1"}},
+		{"audit", []string{"urn:esid:public-1:1", "urn:esid:order-2:1", "urn:esid:bill-1:1", "urn:esid:order-1:1"}},
+		{"nobody", nil},
+		{"", []string{"urn:esid:public-1:1"}},
+	}
+
+	etags := make(map[string]string)
+	for _, test := range tests {
+		w := httptest.NewRecorder()
+		recentHandler(w, principalRequest("/notifications/recent", test.subject))
+		assert.Equal(t, http.StatusOK, w.Result().StatusCode)
+		assert.Equal(t, test.entries, entryIDs(t, w.Body.Bytes()), test.subject)
+		assert.Equal(t, "private, no-cache", w.Result().Header.Get("Cache-Control"))
+
+		w = httptest.NewRecorder()
+		router.ServeHTTP(w, principalRequest("/notifications/"+lastFeed, test.subject))
+		assert.Equal(t, http.StatusOK, w.Result().StatusCode)
+		assert.Equal(t, test.entries, entryIDs(t, w.Body.Bytes()), test.subject)
+		assert.Equal(t, "private, max-age=2592000", w.Result().Header.Get("Cache-Control"))
+
+		etag := w.Result().Header.Get("ETag")
+		_, seen := etags[etag]
+		assert.False(t, seen, "entity tag %s reused for %s", etag, test.subject)
+		etags[etag] = test.subject
+
+		//Conditional requests with the caller's entity tag get a 304
+		r := principalRequest("/notifications/"+lastFeed, test.subject)
+		r.Header.Set("If-None-Match", etag)
+		w = httptest.NewRecorder()
+		router.ServeHTTP(w, r)
+		assert.Equal(t, http.StatusNotModified, w.Result().StatusCode)
+	}
+}
+
+func TestPolicyEventRetrieveHandler(t *testing.T) {
+	policy, cleanup := writeTestPolicy(t)
+	defer cleanup()
+
+	SetPolicy(policy)
+	defer SetPolicy(nil)
+
+	store := NewMemoryFeedStore(10)
+	appendPolicyTestEvents(t, store)
+
+	retrieveHandler, err := NewEventRetrieveHandler(store, "testhost:12345")
+	assert.Nil(t, err)
+
+	router := mux.NewRouter()
+	router.HandleFunc(RetrieveEventHanderURI, retrieveHandler)
+
+	var tests = []struct {
+		subject string
+		uri     string
+		status  int
+	}{
+		{"orders", "/events/order-1/1", http.StatusOK},
+		{"orders", "/events/order-2/1", http.StatusForbidden},
+		{"billing", "/events/order-2/1", http.StatusOK},
+		{"", "/events/order-1/1", http.StatusForbidden},
+		{"", "/events/public-1/1", http.StatusOK},
+		{"orders", "/events/order-9/1", http.StatusNotFound},
+	}
+
+	for _, test := range tests {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, principalRequest(test.uri, test.subject))
+		assert.Equal(t, test.status, w.Result().StatusCode, "%v", test)
+
+		//The events are yet to be archived, so must be revalidated
+		if test.status == http.StatusOK {
+			assert.Equal(t, "private, no-cache", w.Result().Header.Get("Cache-Control"))
+		}
+	}
+
+	//A matching entity tag does not bypass the policy
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, principalRequest("/events/order-1/1", "orders"))
+	etag := w.Result().Header.Get("ETag")
+
+	r := principalRequest("/events/order-1/1", "billing")
+	r.Header.Set("If-None-Match", etag)
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, r)
+	assert.Equal(t, http.StatusForbidden, w.Result().StatusCode)
+}
+
+func TestPolicyLongPoll(t *testing.T) {
+	policy, cleanup := writeTestPolicy(t)
+	defer cleanup()
+
+	SetPolicy(policy)
+	defer SetPolicy(nil)
+
+	defer func(interval time.Duration) { LongPollInterval = interval }(LongPollInterval)
+	LongPollInterval = 10 * time.Millisecond
+
+	store := NewMemoryFeedStore(10)
+	appendPolicyTestEvents(t, store)
+
+	recentHandler, err := NewRecentHandler(store, "testhost:12345")
+	assert.Nil(t, err)
+
+	longPoll := func(uri, subject string) time.Duration {
+		w := httptest.NewRecorder()
+		start := time.Now()
+		recentHandler(w, principalRequest(uri, subject))
+		assert.Equal(t, http.StatusOK, w.Result().StatusCode)
+		return time.Now().Sub(start)
+	}
+
+	//A caller caught up with the events they can see waits, though newer events are published
+	assert.True(t, longPoll("/notifications/recent?after=urn:esid:order-1:1&wait=100ms", "orders") >= 100*time.Millisecond)
+
+	//A caller who can see none of the events is treated as caught up
+	assert.True(t, longPoll("/notifications/recent?after=urn:esid:other:1&wait=100ms", "nobody") >= 100*time.Millisecond)
+
+	//A caller who is behind gets the feed straight away
+	assert.True(t, longPoll("/notifications/recent?after=urn:esid:bill-1:1&wait=5s", "billing") < time.Second)
+}
+
+func TestPolicyStreamHandler(t *testing.T) {
+	policy, cleanup := writeTestPolicy(t)
+	defer cleanup()
+
+	SetPolicy(policy)
+	defer SetPolicy(nil)
+
+	store := NewMemoryFeedStore(10)
+	streamHandler, err := NewStreamHandler(store, 10*time.Millisecond)
+	assert.Nil(t, err)
+
+	//Unauthenticated callers get the default grants
+	ts := httptest.NewServer(http.HandlerFunc(streamHandler))
+	defer ts.Close()
+
+	resp, err := http.Get(ts.URL)
+	if !assert.Nil(t, err) {
+		return
+	}
+	defer resp.Body.Close()
+
+	messages := readStream(resp)
+	appendPolicyTestEvents(t, store)
+	testevents.Append(t, store, "foo", "public-2")
+
+	assert.Equal(t, "urn:esid:public-1:1", nextMessage(t, messages).id)
+	assert.Equal(t, "urn:esid:public-2:1", nextMessage(t, messages).id)
+}
+
+func TestPolicyAppendHandler(t *testing.T) {
+	policy, cleanup := writeTestPolicy(t)
+	defer cleanup()
+
+	SetPolicy(policy)
+	defer SetPolicy(nil)
+
+	store := NewMemoryFeedStore(10)
+	appendHandler, err := NewAppendHandler(store)
+	assert.Nil(t, err)
+
+	router := mux.NewRouter()
+	router.HandleFunc(AppendEventHandlerURI, appendHandler).Methods("PUT")
+
+	var tests = []struct {
+		subject string
+		uri     string
+		status  int
+	}{
+		{"orders", "/events/order-1/1?typecode=OrderPlaced", http.StatusCreated},
+		{"orders", "/events/order-2/1?typecode=InvoiceRaised", http.StatusForbidden},
+		{"audit", "/events/order-3/1?typecode=OrderPlaced", http.StatusForbidden},
+		{"", "/events/public-1/1?typecode=OrderPlaced", http.StatusForbidden},
+	}
+
+	for _, test := range tests {
+		r := principalRequest(test.uri, test.subject)
+		r.Method = "PUT"
+		r.Body = ioutil.NopCloser(strings.NewReader("ok"))
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, r)
+		assert.Equal(t, test.status, w.Result().StatusCode, "%v", test)
+	}
+
+	//Only the permitted event was appended
+	events, err := store.RetrieveRecent()
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(events))
+}
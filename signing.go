@@ -0,0 +1,192 @@
+package atompubsvc
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+)
+
+//Environment variables used to configure response signing. Responses are signed if
+//SIGNING_KEY_FILE is set.
+const (
+	SigningKeyFile   = "SIGNING_KEY_FILE"
+	SigningAlgorithm = "SIGNING_ALG"
+	SigningKeyID     = "SIGNING_KEY_ID"
+)
+
+//Signature algorithms
+const (
+	Ed25519Algorithm    = "ed25519"
+	HMACSHA256Algorithm = "hmac-sha256"
+)
+
+//SignatureHeader is the response header carrying the detached signature of the response body,
+//e.g. X-Signature: keyId="key-1",algorithm="ed25519",signature="base64 signature"
+const SignatureHeader = "X-Signature"
+
+var ErrBadSigningKey = errors.New("Signing key must be a 32 byte Ed25519 seed or 64 byte Ed25519 private key, raw or base64 encoded")
+var ErrBadSigningAlgorithm = errors.New("Signing algorithm must be ed25519 or hmac-sha256")
+var ErrEmptySigningKey = errors.New("HMAC signing key must not be empty")
+
+//Signer produces detached signatures of response bodies
+type Signer interface {
+	KeyID() string
+	Algorithm() string
+	Sign(body []byte) ([]byte, error)
+}
+
+//Ed25519Signer signs response bodies with an Ed25519 private key. Consumers verify signatures
+//with the corresponding public key.
+type Ed25519Signer struct {
+	keyID      string
+	privateKey ed25519.PrivateKey
+}
+
+//NewEd25519Signer returns a signer using the given private key, identified by keyID
+func NewEd25519Signer(keyID string, privateKey ed25519.PrivateKey) (*Ed25519Signer, error) {
+	if len(privateKey) != ed25519.PrivateKeySize {
+		return nil, ErrBadSigningKey
+	}
+
+	return &Ed25519Signer{keyID: keyID, privateKey: privateKey}, nil
+}
+
+func (es *Ed25519Signer) KeyID() string {
+	return es.keyID
+}
+
+func (es *Ed25519Signer) Algorithm() string {
+	return Ed25519Algorithm
+}
+
+func (es *Ed25519Signer) Sign(body []byte) ([]byte, error) {
+	return ed25519.Sign(es.privateKey, body), nil
+}
+
+//HMACSigner signs response bodies with HMAC-SHA256 using a secret shared with consumers
+type HMACSigner struct {
+	keyID  string
+	secret []byte
+}
+
+//NewHMACSigner returns a signer using the given shared secret, identified by keyID
+func NewHMACSigner(keyID string, secret []byte) (*HMACSigner, error) {
+	if len(secret) == 0 {
+		return nil, ErrEmptySigningKey
+	}
+
+	return &HMACSigner{keyID: keyID, secret: secret}, nil
+}
+
+func (hs *HMACSigner) KeyID() string {
+	return hs.keyID
+}
+
+func (hs *HMACSigner) Algorithm() string {
+	return HMACSHA256Algorithm
+}
+
+func (hs *HMACSigner) Sign(body []byte) ([]byte, error) {
+	mac := hmac.New(sha256.New, hs.secret)
+	mac.Write(body)
+	return mac.Sum(nil), nil
+}
+
+//Signer used to sign responses, nil if responses are not signed
+var responseSigner Signer
+
+//SetSigner sets the signer used to sign responses, overriding the signer configured from the
+//environment. A nil signer disables signing.
+func SetSigner(signer Signer) {
+	responseSigner = signer
+}
+
+//NewSignerFromFile returns a signer for the given algorithm using the key read from a file.
+//Ed25519 keys are a 32 byte seed or 64 byte private key, raw or base64 encoded. HMAC keys are
+//the shared secret, with surrounding white space ignored.
+func NewSignerFromFile(algorithm, keyID, path string) (Signer, error) {
+	contents, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	switch algorithm {
+	case Ed25519Algorithm:
+		key := contents
+		if len(key) != ed25519.SeedSize && len(key) != ed25519.PrivateKeySize {
+			key, err = base64.StdEncoding.DecodeString(string(bytes.TrimSpace(contents)))
+			if err != nil {
+				return nil, ErrBadSigningKey
+			}
+		}
+
+		switch len(key) {
+		case ed25519.SeedSize:
+			return NewEd25519Signer(keyID, ed25519.NewKeyFromSeed(key))
+		case ed25519.PrivateKeySize:
+			return NewEd25519Signer(keyID, ed25519.PrivateKey(key))
+		default:
+			return nil, ErrBadSigningKey
+		}
+	case HMACSHA256Algorithm:
+		return NewHMACSigner(keyID, bytes.TrimSpace(contents))
+	default:
+		return nil, ErrBadSigningAlgorithm
+	}
+}
+
+func init() {
+	keyFile := os.Getenv(SigningKeyFile)
+	if keyFile == "" {
+		return
+	}
+
+	algorithm := strings.ToLower(os.Getenv(SigningAlgorithm))
+	if algorithm == "" {
+		algorithm = Ed25519Algorithm
+	}
+
+	keyID := os.Getenv(SigningKeyID)
+	if keyID == "" {
+		keyID = "default"
+	}
+
+	signer, err := NewSignerFromFile(algorithm, keyID, keyFile)
+	if err != nil {
+		log.Errorf("Error configuring response signing: %s. Exiting.", err.Error())
+		os.Exit(1)
+	}
+
+	log.Infof("Signing responses with %s key %s", algorithm, keyID)
+	responseSigner = signer
+}
+
+//FormatSignature formats the value of the signature header
+func FormatSignature(keyID, algorithm string, signature []byte) string {
+	return fmt.Sprintf(`keyId="%s",algorithm="%s",signature="%s"`,
+		keyID, algorithm, base64.StdEncoding.EncodeToString(signature))
+}
+
+//signResponse adds the signature header for the response body if a signer is configured
+func signResponse(signer Signer, rw http.ResponseWriter, body []byte) error {
+	if signer == nil {
+		return nil
+	}
+
+	signature, err := signer.Sign(body)
+	if err != nil {
+		return err
+	}
+
+	rw.Header().Set(SignatureHeader, FormatSignature(signer.KeyID(), signer.Algorithm(), signature))
+	return nil
+}
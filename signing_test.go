@@ -0,0 +1,149 @@
+package atompubsvc
+
+import (
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+	"github.com/xtracdev/es-atom-pub/internal/testevents"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+var testSeed = []byte("0123456789abcdef0123456789abcdef")
+
+func TestEd25519Signer(t *testing.T) {
+	privateKey := ed25519.NewKeyFromSeed(testSeed)
+
+	signer, err := NewEd25519Signer("key-1", privateKey)
+	assert.Nil(t, err)
+	assert.Equal(t, "key-1", signer.KeyID())
+	assert.Equal(t, Ed25519Algorithm, signer.Algorithm())
+
+	signature, err := signer.Sign([]byte("body"))
+	assert.Nil(t, err)
+	assert.True(t, ed25519.Verify(privateKey.Public().(ed25519.PublicKey), []byte("body"), signature))
+
+	_, err = NewEd25519Signer("key-1", ed25519.PrivateKey("short"))
+	assert.Equal(t, ErrBadSigningKey, err)
+}
+
+func TestHMACSigner(t *testing.T) {
+	signer, err := NewHMACSigner("key-1", []byte("secret"))
+	assert.Nil(t, err)
+	assert.Equal(t, HMACSHA256Algorithm, signer.Algorithm())
+
+	signature, err := signer.Sign([]byte("body"))
+	assert.Nil(t, err)
+
+	mac := hmac.New(sha256.New, []byte("secret"))
+	mac.Write([]byte("body"))
+	assert.Equal(t, mac.Sum(nil), signature)
+
+	_, err = NewHMACSigner("key-1", nil)
+	assert.Equal(t, ErrEmptySigningKey, err)
+}
+
+func TestNewSignerFromFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "signing")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	write := func(name string, contents []byte) string {
+		path := filepath.Join(dir, name)
+		assert.Nil(t, ioutil.WriteFile(path, contents, 0600))
+		return path
+	}
+
+	seedFile := write("seed", testSeed)
+	privateKeyFile := write("private", []byte(base64.StdEncoding.EncodeToString(ed25519.NewKeyFromSeed(testSeed))+"\n"))
+	secretFile := write("secret", []byte("shared secret"))
+	badFile := write("bad", []byte("too short"))
+
+	var signerTests = []struct {
+		testName  string
+		algorithm string
+		path      string
+		err       error
+	}{
+		{"ed25519 seed", Ed25519Algorithm, seedFile, nil},
+		{"ed25519 private key", Ed25519Algorithm, privateKeyFile, nil},
+		{"hmac", HMACSHA256Algorithm, secretFile, nil},
+		{"bad ed25519 key", Ed25519Algorithm, badFile, ErrBadSigningKey},
+		{"bad algorithm", "rot13", secretFile, ErrBadSigningAlgorithm},
+	}
+
+	for _, test := range signerTests {
+		t.Run(test.testName, func(t *testing.T) {
+			signer, err := NewSignerFromFile(test.algorithm, "key-1", test.path)
+			assert.Equal(t, test.err, err)
+			if err == nil {
+				assert.Equal(t, test.algorithm, signer.Algorithm())
+				assert.Equal(t, "key-1", signer.KeyID())
+			}
+		})
+	}
+
+	seedSigner, _ := NewSignerFromFile(Ed25519Algorithm, "key-1", seedFile)
+	privateKeySigner, _ := NewSignerFromFile(Ed25519Algorithm, "key-1", privateKeyFile)
+	s1, _ := seedSigner.Sign([]byte("body"))
+	s2, _ := privateKeySigner.Sign([]byte("body"))
+	assert.Equal(t, s1, s2)
+
+	_, err = NewSignerFromFile(Ed25519Algorithm, "key-1", filepath.Join(dir, "missing"))
+	assert.NotNil(t, err)
+}
+
+func TestSignedResponses(t *testing.T) {
+	privateKey := ed25519.NewKeyFromSeed(testSeed)
+	publicKey := privateKey.Public().(ed25519.PublicKey)
+
+	signer, _ := NewEd25519Signer("key-1", privateKey)
+	SetSigner(signer)
+	defer SetSigner(nil)
+
+	store := NewMemoryFeedStore(2)
+	testevents.Append(t, store, "foo", "agg1", "agg2", "agg3")
+	feedID, _ := store.RetrieveLastFeed()
+
+	recentHandler, _ := NewRecentHandler(store, "localhost:12345")
+	archiveHandler, _ := NewArchiveHandler(store, "localhost:12345")
+	eventHandler, _ := NewEventRetrieveHandler(store, "testhost:12345")
+
+	router := mux.NewRouter()
+	router.HandleFunc(RecentHandlerURI, recentHandler)
+	router.HandleFunc(ArchiveHandlerURI, archiveHandler)
+	router.HandleFunc(RetrieveEventHanderURI, eventHandler)
+
+	for _, uri := range []string{"/notifications/recent", "/notifications/" + feedID, "/events/agg1/1"} {
+		t.Run(uri, func(t *testing.T) {
+			r, _ := http.NewRequest("GET", uri, nil)
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, r)
+
+			assert.Equal(t, http.StatusOK, w.Result().StatusCode)
+
+			signature, _ := signer.Sign(w.Body.Bytes())
+			assert.Equal(t, FormatSignature("key-1", Ed25519Algorithm, signature), w.Header().Get(SignatureHeader))
+			assert.True(t, ed25519.Verify(publicKey, w.Body.Bytes(), signature))
+		})
+	}
+}
+
+func TestUnsignedResponses(t *testing.T) {
+	store := NewMemoryFeedStore(2)
+	recentHandler, _ := NewRecentHandler(store, "localhost:12345")
+
+	r, _ := http.NewRequest("GET", "/notifications/recent", nil)
+	w := httptest.NewRecorder()
+	recentHandler(w, r)
+
+	assert.Equal(t, http.StatusOK, w.Result().StatusCode)
+	assert.Equal(t, "", w.Header().Get(SignatureHeader))
+}
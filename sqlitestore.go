@@ -0,0 +1,223 @@
+package atompubsvc
+
+import (
+	"database/sql"
+	atomdata "github.com/xtracdev/es-atom-data"
+	"github.com/xtracdev/goes"
+	"time"
+)
+
+//SQLiteSchema contains the statements used to bootstrap the feed and event tables in a
+//SQLite database. The tables mirror those es-atom-data maintains in Oracle.
+var SQLiteSchema = []string{
+	`create table if not exists t_aefd_feed (
+		id integer primary key autoincrement,
+		event_time timestamp not null default current_timestamp,
+		feedid text not null unique,
+		previous text
+	)`,
+	`create table if not exists t_aeae_atom_event (
+		id integer primary key autoincrement,
+		feedid text references t_aefd_feed(feedid),
+		event_time timestamp not null,
+		aggregate_id text not null,
+		version integer not null,
+		typecode text not null,
+		payload blob,
+		unique (aggregate_id, version)
+	)`,
+	`create index if not exists aeae_feedid_ix on t_aeae_atom_event(feedid)`,
+	`create index if not exists aeae_typecode_ix on t_aeae_atom_event(typecode, feedid)`,
+	`create index if not exists aeae_event_time_ix on t_aeae_atom_event(event_time, id)`,
+	`create index if not exists aefd_previous_ix on t_aefd_feed(previous)`,
+}
+
+//SQLiteFeedStore is a FeedStore backed by a single SQLite database. Unlike the Oracle and
+//PostgreSQL stores, which serve data populated by a separate process, it creates its own
+//schema and accepts events via Append.
+type SQLiteFeedStore struct {
+	db        *sql.DB
+	threshold int
+}
+
+//NewSQLiteFeedStore bootstraps the feed schema in the given SQLite database if needed, and
+//returns a store that archives recent events into a feed every threshold events. A threshold
+//less than 1 defaults to atomdata.FeedThreshold. The caller is responsible for opening the
+//database with a registered SQLite driver.
+func NewSQLiteFeedStore(db *sql.DB, threshold int) (*SQLiteFeedStore, error) {
+	if db == nil {
+		return nil, ErrBadDBConnection
+	}
+
+	if threshold < 1 {
+		threshold = atomdata.FeedThreshold
+	}
+
+	for _, stmt := range SQLiteSchema {
+		if _, err := db.Exec(stmt); err != nil {
+			return nil, err
+		}
+	}
+
+	return &SQLiteFeedStore{db: db, threshold: threshold}, nil
+}
+
+//Append stores an event, timestamped with the current time. If the number of events not yet
+//assigned to a feed reaches the threshold, they are assigned to a new feed linked to the
+//previous one.
+func (sfs *SQLiteFeedStore) Append(event *goes.Event) error {
+	payload, ok := event.Payload.([]byte)
+	if !ok {
+		return ErrBadPayload
+	}
+
+	tx, err := sfs.db.Begin()
+	if err != nil {
+		return err
+	}
+
+	err = sfs.appendInTx(tx, event, payload)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (sfs *SQLiteFeedStore) appendInTx(tx *sql.Tx, event *goes.Event, payload []byte) error {
+	var count int
+	err := tx.QueryRow(`select count(*) from t_aeae_atom_event where aggregate_id = ? and version = ?`,
+		event.Source, event.Version).Scan(&count)
+	if err != nil {
+		return err
+	}
+
+	if count > 0 {
+		return ErrDuplicateEvent
+	}
+
+	_, err = tx.Exec(`insert into t_aeae_atom_event (event_time, aggregate_id, version, typecode, payload) values (?, ?, ?, ?, ?)`,
+		time.Now().UTC(), event.Source, event.Version, event.TypeCode, payload)
+	if err != nil {
+		return err
+	}
+
+	err = tx.QueryRow(`select count(*) from t_aeae_atom_event where feedid is null`).Scan(&count)
+	if err != nil {
+		return err
+	}
+
+	if count < sfs.threshold {
+		return nil
+	}
+
+	var previous sql.NullString
+	err = tx.QueryRow(`select feedid from t_aefd_feed where id = (select max(id) from t_aefd_feed)`).Scan(&previous)
+	if err != nil && err != sql.ErrNoRows {
+		return err
+	}
+
+	feedID, err := newFeedID()
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(`insert into t_aefd_feed (feedid, previous) values (?, ?)`, feedID, previous)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(`update t_aeae_atom_event set feedid = ? where feedid is null`, feedID)
+	return err
+}
+
+func (sfs *SQLiteFeedStore) RetrieveRecent() ([]atomdata.TimestampedEvent, error) {
+	return queryEvents(sfs.db,
+		`select event_time, aggregate_id, version, typecode, payload from t_aeae_atom_event where feedid is null order by id desc`)
+}
+
+func (sfs *SQLiteFeedStore) RetrieveLastFeed() (string, error) {
+	feedID, err := queryNullString(sfs.db,
+		`select feedid from t_aefd_feed where id = (select max(id) from t_aefd_feed)`)
+	return feedID.String, err
+}
+
+func (sfs *SQLiteFeedStore) RetrieveArchive(feedID string) ([]atomdata.TimestampedEvent, error) {
+	return queryEvents(sfs.db,
+		`select event_time, aggregate_id, version, typecode, payload from t_aeae_atom_event where feedid = ? order by id desc`,
+		feedID)
+}
+
+func (sfs *SQLiteFeedStore) RetrievePreviousFeed(feedID string) (sql.NullString, error) {
+	return queryNullString(sfs.db, `select previous from t_aefd_feed where feedid = ?`, feedID)
+}
+
+func (sfs *SQLiteFeedStore) RetrieveNextFeed(feedID string) (sql.NullString, error) {
+	return queryNullString(sfs.db, `select feedid from t_aefd_feed where previous = ?`, feedID)
+}
+
+func (sfs *SQLiteFeedStore) RetrieveEvent(aggregateID string, version int) (atomdata.TimestampedEvent, error) {
+	var event atomdata.TimestampedEvent
+	var payload []byte
+
+	row := sfs.db.QueryRow(
+		`select event_time, typecode, payload from t_aeae_atom_event where aggregate_id = ? and version = ?`,
+		aggregateID, version)
+	if err := row.Scan(&event.Timestamp, &event.TypeCode, &payload); err != nil {
+		return atomdata.TimestampedEvent{}, err
+	}
+
+	event.Source = aggregateID
+	event.Version = version
+	event.Payload = payload
+
+	return event, nil
+}
+
+func (sfs *SQLiteFeedStore) RetrieveAggregateEvents(aggregateID string, afterVersion, toVersion, limit int) ([]atomdata.TimestampedEvent, error) {
+	query, args := aggregateEventsQuery(aggregateID, afterVersion, toVersion, limit,
+		func(n int) string { return "?" },
+		func(limitArg string) string { return "limit " + limitArg })
+	return queryEvents(sfs.db, query, args...)
+}
+
+func (sfs *SQLiteFeedStore) RetrieveFirstFeed() (string, error) {
+	feedID, err := queryNullString(sfs.db, firstFeedQuery)
+	return feedID.String, err
+}
+
+func (sfs *SQLiteFeedStore) RetrieveFeedIndex() ([]FeedSummary, error) {
+	return queryFeedIndex(sfs.db)
+}
+
+//RetrieveFeedAt compares event times as stored, in UTC
+func (sfs *SQLiteFeedStore) RetrieveFeedAt(at time.Time) (string, error) {
+	feedID, err := queryNullString(sfs.db,
+		`select feedid from t_aeae_atom_event where event_time >= ? order by event_time, id limit 1`, at.UTC())
+	return feedID.String, err
+}
+
+func (sfs *SQLiteFeedStore) RetrieveTypedFeed(feedID string, typeCodes []string, backwards bool) (string, error) {
+	return sfs.queryTypedFeed(feedID, typeCodes, backwards)
+}
+
+func (sfs *SQLiteFeedStore) RetrieveFirstTypedFeed(typeCodes []string) (string, error) {
+	return sfs.queryTypedFeed("", typeCodes, false)
+}
+
+func (sfs *SQLiteFeedStore) queryTypedFeed(feedID string, typeCodes []string, backwards bool) (string, error) {
+	query, args := typedFeedQuery(feedID, typeCodes, backwards,
+		func(n int) string { return "?" },
+		func(limitArg string) string { return "limit " + limitArg })
+	result, err := queryNullString(sfs.db, query, args...)
+	return result.String, err
+}
+
+func (sfs *SQLiteFeedStore) RetrieveEventFeed(aggregateID string, version int) (string, error) {
+	return queryEventFeed(sfs.db, eventFeedQuery(func(n int) string { return "?" }), aggregateID, version)
+}
+
+func (sfs *SQLiteFeedStore) RetrieveEventPosition(aggregateID string, version int) (EventPosition, error) {
+	return queryEventPosition(sfs.db, eventPositionQuery(func(n int) string { return "?" }), aggregateID, version)
+}
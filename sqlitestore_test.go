@@ -0,0 +1,214 @@
+package atompubsvc
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/xml"
+	"fmt"
+	"github.com/gorilla/mux"
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/stretchr/testify/assert"
+	"github.com/xtracdev/es-atom-pub/internal/testevents"
+	"github.com/xtracdev/goes"
+	"golang.org/x/tools/blog/atom"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func openTestSQLiteStore(t *testing.T, threshold int) (*SQLiteFeedStore, func()) {
+	dir, err := ioutil.TempDir("", "atompub")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	db, err := sql.Open("sqlite3", filepath.Join(dir, "feed.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	store, err := NewSQLiteFeedStore(db, threshold)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return store, func() {
+		db.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+func TestSQLiteFeedStoreNilDB(t *testing.T) {
+	store, err := NewSQLiteFeedStore(nil, 2)
+	assert.Nil(t, store)
+	assert.Equal(t, ErrBadDBConnection, err)
+}
+
+func TestSQLiteFeedStore(t *testing.T) {
+	store, cleanup := openTestSQLiteStore(t, 2)
+	defer cleanup()
+
+	//Bootstrapping an existing schema is a no-op
+	_, err := NewSQLiteFeedStore(store.db, 2)
+	assert.Nil(t, err)
+
+	recent, err := store.RetrieveRecent()
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(recent))
+
+	lastFeed, err := store.RetrieveLastFeed()
+	assert.Nil(t, err)
+	assert.Equal(t, "", lastFeed)
+
+	testevents.Append(t, store, "foo", "agg1", "agg2", "agg3", "agg4", "agg5")
+
+	recent, err = store.RetrieveRecent()
+	if assert.Nil(t, err) && assert.Equal(t, 1, len(recent)) {
+		assert.Equal(t, "agg5", recent[0].Source)
+		assert.Equal(t, []byte("ok agg5"), recent[0].Payload)
+		assert.False(t, recent[0].Timestamp.IsZero())
+	}
+
+	lastFeed, err = store.RetrieveLastFeed()
+	assert.Nil(t, err)
+
+	archive, err := store.RetrieveArchive(lastFeed)
+	if assert.Nil(t, err) && assert.Equal(t, 2, len(archive)) {
+		assert.Equal(t, "agg4", archive[0].Source)
+		assert.Equal(t, "agg3", archive[1].Source)
+	}
+
+	previous, err := store.RetrievePreviousFeed(lastFeed)
+	assert.Nil(t, err)
+	assert.True(t, previous.Valid)
+
+	first, err := store.RetrievePreviousFeed(previous.String)
+	assert.Nil(t, err)
+	assert.False(t, first.Valid)
+
+	next, err := store.RetrieveNextFeed(previous.String)
+	assert.Nil(t, err)
+	assert.Equal(t, lastFeed, next.String)
+
+	next, err = store.RetrieveNextFeed(lastFeed)
+	assert.Nil(t, err)
+	assert.False(t, next.Valid)
+
+	event, err := store.RetrieveEvent("agg2", 1)
+	assert.Nil(t, err)
+	assert.Equal(t, "foo", event.TypeCode)
+	assert.Equal(t, []byte("ok agg2"), event.Payload)
+
+	_, err = store.RetrieveEvent("agg2", 2)
+	assert.Equal(t, sql.ErrNoRows, err)
+
+	err = store.Append(&goes.Event{Source: "agg2", Version: 1, TypeCode: "foo", Payload: []byte("dup")})
+	assert.Equal(t, ErrDuplicateEvent, err)
+}
+
+func TestAppendHandler(t *testing.T) {
+	os.Unsetenv("KEY_ALIAS")
+
+	_, err := NewAppendHandler(nil)
+	assert.Equal(t, ErrNilFeedStore, err)
+
+	store, cleanup := openTestSQLiteStore(t, 2)
+	defer cleanup()
+
+	appendHandler, err := NewAppendHandler(store)
+	assert.Nil(t, err)
+	archiveHandler, err := NewArchiveHandler(store, "testhost:12345")
+	assert.Nil(t, err)
+
+	router := mux.NewRouter()
+	router.HandleFunc(AppendEventHandlerURI, appendHandler).Methods("PUT")
+	router.HandleFunc(ArchiveHandlerURI, archiveHandler)
+
+	put := func(uri string, body string) int {
+		r, err := http.NewRequest("PUT", uri, bytes.NewBufferString(body))
+		assert.Nil(t, err)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, r)
+		return w.Result().StatusCode
+	}
+
+	assert.Equal(t, http.StatusCreated, put("/events/agg1/1?typecode=foo", "one"))
+	assert.Equal(t, http.StatusCreated, put("/events/agg1/2?typecode=bar", "two"))
+	assert.Equal(t, http.StatusConflict, put("/events/agg1/2?typecode=bar", "two"))
+	assert.Equal(t, http.StatusBadRequest, put("/events/agg1/x?typecode=bar", "two"))
+	assert.Equal(t, http.StatusBadRequest, put("/events/agg1/3", "three"))
+
+	feedID, err := store.RetrieveLastFeed()
+	assert.Nil(t, err)
+
+	r, err := http.NewRequest("GET", fmt.Sprintf("/notifications/%s", feedID), nil)
+	assert.Nil(t, err)
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, r)
+	assert.Equal(t, http.StatusOK, w.Result().StatusCode)
+
+	var feed atom.Feed
+	err = xml.Unmarshal(w.Body.Bytes(), &feed)
+	if assert.Nil(t, err) && assert.Equal(t, 2, len(feed.Entry)) {
+		assert.Equal(t, "urn:esid:agg1:2", feed.Entry[0].ID)
+		assert.Equal(t, "bar", feed.Entry[0].Content.Type)
+	}
+}
+
+func TestSQLiteFeedStoreAggregateEvents(t *testing.T) {
+	store, cleanup := openTestSQLiteStore(t, 2)
+	defer cleanup()
+
+	checkAggregateEvents(t, store)
+}
+
+func TestSQLiteFeedStoreIndex(t *testing.T) {
+	store, cleanup := openTestSQLiteStore(t, 2)
+	defer cleanup()
+
+	checkFeedIndex(t, store)
+}
+
+func TestSQLiteFeedStoreSeek(t *testing.T) {
+	store, cleanup := openTestSQLiteStore(t, 2)
+	defer cleanup()
+
+	checkFeedSeek(t, store)
+}
+
+func TestSQLiteFeedStoreTypedFeeds(t *testing.T) {
+	store, cleanup := openTestSQLiteStore(t, 2)
+	defer cleanup()
+
+	checkTypedFeeds(t, store)
+}
+
+func TestSQLiteFeedStoreSeekOrder(t *testing.T) {
+	store, cleanup := openTestSQLiteStore(t, 2)
+	defer cleanup()
+
+	testevents.Append(t, store, "foo", "agg1", "agg2", "agg3", "agg4")
+
+	last, err := store.RetrieveLastFeed()
+	assert.Nil(t, err)
+
+	//Events are found by event time, whatever order they were stored in
+	earlier := time.Now().Add(-time.Hour).UTC()
+	_, err = store.db.Exec(`update t_aeae_atom_event set event_time = ? where aggregate_id = 'agg3'`, earlier)
+	assert.Nil(t, err)
+
+	feedID, err := store.RetrieveFeedAt(earlier)
+	assert.Nil(t, err)
+	assert.Equal(t, last, feedID)
+}
+
+func TestSQLiteFeedStorePositions(t *testing.T) {
+	store, cleanup := openTestSQLiteStore(t, 2)
+	defer cleanup()
+
+	checkEventPositions(t, store)
+}
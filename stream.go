@@ -0,0 +1,401 @@
+package atompubsvc
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	atomdata "github.com/xtracdev/es-atom-data"
+	"net/http"
+	"sync"
+	"time"
+)
+
+//DefaultStreamPollInterval is how often the stream handler checks the store for new events
+const DefaultStreamPollInterval = 5 * time.Second
+
+var ErrStreamingUnsupported = errors.New("Response writer does not support streaming")
+
+//entryID returns the atom entry id for an event, e.g. urn:esid:aggregateId:version
+func entryID(event *atomdata.TimestampedEvent) string {
+	return fmt.Sprintf("urn:esid:%s:%d", event.Source, event.Version)
+}
+
+//newestEntryID returns the id of the most recently published event, or the empty string if
+//the store holds no events.
+func newestEntryID(store FeedStore) (string, error) {
+	events, err := store.RetrieveRecent()
+	if err != nil {
+		return "", err
+	}
+
+	if len(events) == 0 {
+		lastFeed, err := store.RetrieveLastFeed()
+		if err != nil || lastFeed == "" {
+			return "", err
+		}
+
+		events, err = store.RetrieveArchive(lastFeed)
+		if err != nil {
+			return "", err
+		}
+	}
+
+	if len(events) == 0 {
+		return "", nil
+	}
+
+	return entryID(&events[0]), nil
+}
+
+//eventsAfter walks back from the recent events through the archived feeds until it finds the
+//event with the given entry id, and returns the events published after it, oldest first. An
+//empty entry id returns all events. The returned boolean indicates whether the entry id was
+//found; if it was not, all events are returned.
+func eventsAfter(store FeedStore, id string) ([]atomdata.TimestampedEvent, bool, error) {
+	events, err := store.RetrieveRecent()
+	if err != nil {
+		return nil, false, err
+	}
+
+	//The last feed is read after the recent events so events archived between the two reads
+	//are seen twice rather than not at all. Duplicates are skipped via the seen set.
+	feedID, err := store.RetrieveLastFeed()
+	if err != nil {
+		return nil, false, err
+	}
+
+	var newer []atomdata.TimestampedEvent
+	seen := make(map[string]bool)
+	found := false
+
+	for {
+		for _, event := range events {
+			eventID := entryID(&event)
+			if id != "" && eventID == id {
+				found = true
+				break
+			}
+
+			if !seen[eventID] {
+				seen[eventID] = true
+				newer = append(newer, event)
+			}
+		}
+
+		if found || feedID == "" {
+			break
+		}
+
+		events, err = store.RetrieveArchive(feedID)
+		if err != nil {
+			return nil, false, err
+		}
+
+		previous, err := store.RetrievePreviousFeed(feedID)
+		if err != nil {
+			return nil, false, err
+		}
+
+		feedID = previous.String
+	}
+
+	//Collected newest first, return oldest first
+	for i, j := 0, len(newer)-1; i < j; i, j = i+1, j-1 {
+		newer[i], newer[j] = newer[j], newer[i]
+	}
+
+	return newer, found, nil
+}
+
+//writeStreamEvent writes an event as a server-sent event message. The message id is the atom
+//entry id, and the data is the JSON representation of the event store content, encrypted if
+//so configured.
+func writeStreamEvent(rw http.ResponseWriter, event *atomdata.TimestampedEvent) error {
+	content := EventStoreContent{
+		AggregateId: event.Source,
+		Version:     event.Version,
+		TypeCode:    event.TypeCode,
+		Published:   event.Timestamp,
+	}
+
+	payload, err := publishedPayload(event)
+	if err != nil {
+		return err
+	}
+
+	setEventPayload(&content, payload)
+
+	err = encryptEventContent(keyProvider, &content)
+	if err != nil {
+		return err
+	}
+
+	data, err := json.Marshal(&content)
+	if err != nil {
+		return err
+	}
+
+	encodedData, err := encryptOutput(keyProvider, data)
+	if err != nil {
+		return err
+	}
+
+	_, err = fmt.Fprintf(rw, "id: %s\ndata: %s\n\n", entryID(event), encodedData)
+	return err
+}
+
+//streamSubscriberBuffer is the number of batches of events buffered for a stream subscriber.
+//Subscribers that fall further behind are disconnected, and may resume via Last-Event-ID.
+const streamSubscriberBuffer = 16
+
+//streamPoller polls the store for new events on behalf of all the clients of a stream handler,
+//so the store is polled once per interval however many clients are connected. Each poll sends
+//the events published since the previous poll, oldest first, to every subscriber; the batch is
+//empty if there are none, serving as the prompt for a keep-alive. The poller runs while there
+//are subscribers.
+type streamPoller struct {
+	sync.Mutex
+	store        FeedStore
+	pollInterval time.Duration
+	subscribers  map[chan []atomdata.TimestampedEvent]bool
+	lastID       string
+	running      bool
+}
+
+func newStreamPoller(store FeedStore, pollInterval time.Duration) *streamPoller {
+	return &streamPoller{
+		store:        store,
+		pollInterval: pollInterval,
+		subscribers:  make(map[chan []atomdata.TimestampedEvent]bool),
+	}
+}
+
+//subscribe returns a channel receiving the events found by each poll, along with the id of the
+//newest event found before subscribing, which is the empty string if the store holds no events.
+//Subsequent batches hold the events published after that event.
+func (sp *streamPoller) subscribe() (chan []atomdata.TimestampedEvent, string, error) {
+	sp.Lock()
+	defer sp.Unlock()
+
+	if !sp.running {
+		lastID, err := newestEntryID(sp.store)
+		if err != nil {
+			return nil, "", err
+		}
+
+		sp.lastID = lastID
+		sp.running = true
+		go sp.poll()
+	}
+
+	events := make(chan []atomdata.TimestampedEvent, streamSubscriberBuffer)
+	sp.subscribers[events] = true
+	return events, sp.lastID, nil
+}
+
+//unsubscribe removes a subscriber, closing its channel
+func (sp *streamPoller) unsubscribe(events chan []atomdata.TimestampedEvent) {
+	sp.Lock()
+	defer sp.Unlock()
+
+	if sp.subscribers[events] {
+		delete(sp.subscribers, events)
+		close(events)
+	}
+}
+
+func (sp *streamPoller) poll() {
+	ticker := time.NewTicker(sp.pollInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		sp.Lock()
+		if len(sp.subscribers) == 0 {
+			sp.running = false
+			sp.Unlock()
+			return
+		}
+
+		lastID := sp.lastID
+		sp.Unlock()
+
+		events, _, err := eventsAfter(sp.store, lastID)
+		if err != nil {
+			log.Warnf("Error retrieving events for stream: %s", err.Error())
+			events = nil
+		}
+
+		sp.Lock()
+		if len(events) > 0 {
+			sp.lastID = entryID(&events[len(events)-1])
+		}
+
+		for subscriber := range sp.subscribers {
+			select {
+			case subscriber <- events:
+			default:
+				//Keep-alives may be skipped, but a subscriber missing events must reconnect
+				if len(events) > 0 {
+					delete(sp.subscribers, subscriber)
+					close(subscriber)
+				}
+			}
+		}
+		sp.Unlock()
+	}
+}
+
+//afterEntry returns the events following the one with the given entry id, or all the events if
+//it is not present
+func afterEntry(events []atomdata.TimestampedEvent, id string) []atomdata.TimestampedEvent {
+	for i := range events {
+		if entryID(&events[i]) == id {
+			return events[i+1:]
+		}
+	}
+
+	return events
+}
+
+//throughEntry returns the events up to and including the one with the given entry id, or all
+//the events if it is not present
+func throughEntry(events []atomdata.TimestampedEvent, id string) []atomdata.TimestampedEvent {
+	for i := range events {
+		if entryID(&events[i]) == id {
+			return events[:i+1]
+		}
+	}
+
+	return events
+}
+
+//NewStreamHandler instantiates a handler that pushes newly published events to the client as
+//server-sent events. This will be served up at /notifications/stream. The store is checked for
+//new events every pollInterval by a single poller shared by the clients of the handler. Clients
+//reconnecting with a Last-Event-ID header are first sent the events published after that event,
+//found by walking back through the recent and archived feeds. Only events the caller may see
+//under the access policy, and of the types given by any type query parameters, are sent.
+func NewStreamHandler(store FeedStore, pollInterval time.Duration) (func(rw http.ResponseWriter, req *http.Request), error) {
+	if store == nil {
+		return nil, ErrNilFeedStore
+	}
+
+	if pollInterval <= 0 {
+		pollInterval = DefaultStreamPollInterval
+	}
+
+	poller := newStreamPoller(store, pollInterval)
+
+	return func(rw http.ResponseWriter, req *http.Request) {
+		svc := "notifications-stream"
+		start := time.Now()
+
+		flusher, ok := rw.(http.Flusher)
+		if !ok {
+			logTimingStats(svc, start, ErrStreamingUnsupported)
+			http.Error(rw, ErrStreamingUnsupported.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		filter := newEventFilter(req)
+
+		//Subscribe before reading any backlog so no events are missed in between
+		live, pollerID, err := poller.subscribe()
+		if err != nil {
+			logTimingStats(svc, start, err)
+			log.Warnf("Error retrieving events for stream: %s", err.Error())
+			http.Error(rw, "Error retrieving events", http.StatusInternalServerError)
+			return
+		}
+
+		defer poller.unsubscribe(live)
+
+		//Reconnecting clients are sent the events after their last event up to the point the
+		//poller has reached, after which the poller delivers them
+		lastID := req.Header.Get("Last-Event-ID")
+		var backlog []atomdata.TimestampedEvent
+
+		if lastID != "" {
+			var found bool
+			backlog, found, err = eventsAfter(store, lastID)
+			if err == nil && !found {
+				logTimingStats(svc, start, errors.New("unknown last event id"))
+				http.Error(rw, fmt.Sprintf("Unknown Last-Event-ID %s", lastID), http.StatusBadRequest)
+				return
+			}
+
+			if err != nil {
+				logTimingStats(svc, start, err)
+				log.Warnf("Error retrieving events for stream: %s", err.Error())
+				http.Error(rw, "Error retrieving events", http.StatusInternalServerError)
+				return
+			}
+
+			if pollerID != "" {
+				backlog = throughEntry(backlog, pollerID)
+			}
+		}
+
+		rw.Header().Add("Content-Type", "text/event-stream")
+		rw.Header().Add("Cache-Control", "no-store")
+		rw.WriteHeader(http.StatusOK)
+		flusher.Flush()
+		logTimingStats(svc, start, nil)
+
+		//Events in the backlog already sent are skipped should the poller also deliver them
+		sentID := ""
+		send := func(events []atomdata.TimestampedEvent) bool {
+			if sentID != "" {
+				events = afterEntry(events, sentID)
+			}
+
+			sent := 0
+			for _, event := range events {
+				sentID = entryID(&event)
+
+				//Events the caller may not see or did not ask for are skipped
+				if !filter.allows(&event) {
+					continue
+				}
+
+				if err := writeStreamEvent(rw, &event); err != nil {
+					log.Warnf("Error writing stream event: %s", err.Error())
+					return false
+				}
+
+				sent++
+			}
+
+			//Comment lines keep the connection alive and detect disconnected clients
+			if sent == 0 {
+				if _, err := fmt.Fprint(rw, ": keep-alive\n\n"); err != nil {
+					return false
+				}
+			}
+
+			flusher.Flush()
+			return true
+		}
+
+		if len(backlog) > 0 && !send(backlog) {
+			return
+		}
+
+		for {
+			select {
+			case <-req.Context().Done():
+				return
+			case events, ok := <-live:
+				if !ok {
+					log.Infof("Stream client fell behind, disconnecting")
+					return
+				}
+
+				if !send(events) {
+					return
+				}
+			}
+		}
+	}, nil
+}
@@ -0,0 +1,251 @@
+package atompubsvc
+
+import (
+	"bufio"
+	"database/sql"
+	"encoding/json"
+	"github.com/stretchr/testify/assert"
+	atomdata "github.com/xtracdev/es-atom-data"
+	"github.com/xtracdev/es-atom-pub/internal/testevents"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+type streamMessage struct {
+	id   string
+	data string
+}
+
+//readStream reads server-sent event messages from the response body, ignoring comments
+func readStream(resp *http.Response) <-chan streamMessage {
+	messages := make(chan streamMessage)
+	go func() {
+		defer close(messages)
+		var msg streamMessage
+		scanner := bufio.NewScanner(resp.Body)
+		for scanner.Scan() {
+			line := scanner.Text()
+			switch {
+			case strings.HasPrefix(line, "id: "):
+				msg.id = line[4:]
+			case strings.HasPrefix(line, "data: "):
+				msg.data = line[6:]
+			case line == "" && msg.id != "":
+				messages <- msg
+				msg = streamMessage{}
+			}
+		}
+	}()
+
+	return messages
+}
+
+func nextMessage(t *testing.T, messages <-chan streamMessage) streamMessage {
+	select {
+	case msg := <-messages:
+		return msg
+	case <-time.After(2 * time.Second):
+		t.Fatal("Timed out waiting for stream message")
+	}
+
+	return streamMessage{}
+}
+
+func TestEventsAfter(t *testing.T) {
+	store := NewMemoryFeedStore(2)
+	testevents.Append(t, store, "foo", "agg1", "agg2", "agg3", "agg4", "agg5")
+
+	events, found, err := eventsAfter(store, "urn:esid:agg2:1")
+	assert.Nil(t, err)
+	assert.True(t, found)
+	if assert.Equal(t, 3, len(events)) {
+		assert.Equal(t, "agg3", events[0].Source)
+		assert.Equal(t, "agg5", events[2].Source)
+	}
+
+	events, found, err = eventsAfter(store, "urn:esid:agg5:1")
+	assert.Nil(t, err)
+	assert.True(t, found)
+	assert.Equal(t, 0, len(events))
+
+	events, found, err = eventsAfter(store, "")
+	assert.Nil(t, err)
+	assert.False(t, found)
+	assert.Equal(t, 5, len(events))
+
+	_, found, err = eventsAfter(store, "urn:esid:nope:1")
+	assert.Nil(t, err)
+	assert.False(t, found)
+
+	newest, err := newestEntryID(store)
+	assert.Nil(t, err)
+	assert.Equal(t, "urn:esid:agg5:1", newest)
+
+	newest, err = newestEntryID(NewMemoryFeedStore(2))
+	assert.Nil(t, err)
+	assert.Equal(t, "", newest)
+}
+
+func TestStreamHandler(t *testing.T) {
+	os.Unsetenv("KEY_ALIAS")
+
+	_, err := NewStreamHandler(nil, time.Second)
+	assert.Equal(t, ErrNilFeedStore, err)
+
+	store := NewMemoryFeedStore(2)
+	testevents.Append(t, store, "foo", "agg1", "agg2", "agg3")
+
+	streamHandler, err := NewStreamHandler(store, 10*time.Millisecond)
+	assert.Nil(t, err)
+
+	ts := httptest.NewServer(http.HandlerFunc(streamHandler))
+	defer ts.Close()
+
+	//A new client only receives events published after it connects
+	resp, err := http.Get(ts.URL)
+	if !assert.Nil(t, err) {
+		return
+	}
+	defer resp.Body.Close()
+
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "text/event-stream", resp.Header.Get("Content-Type"))
+
+	messages := readStream(resp)
+	testevents.Append(t, store, "foo", "agg4", "agg5")
+
+	msg := nextMessage(t, messages)
+	assert.Equal(t, "urn:esid:agg4:1", msg.id)
+
+	var event EventStoreContent
+	err = json.Unmarshal([]byte(msg.data), &event)
+	if assert.Nil(t, err) {
+		assert.Equal(t, "agg4", event.AggregateId)
+		assert.Equal(t, "foo", event.TypeCode)
+	}
+
+	msg = nextMessage(t, messages)
+	assert.Equal(t, "urn:esid:agg5:1", msg.id)
+
+	//A reconnecting client resumes after the last event id, across archived feeds
+	req, err := http.NewRequest("GET", ts.URL, nil)
+	assert.Nil(t, err)
+	req.Header.Set("Last-Event-ID", "urn:esid:agg2:1")
+
+	resumed, err := http.DefaultClient.Do(req)
+	if !assert.Nil(t, err) {
+		return
+	}
+	defer resumed.Body.Close()
+
+	resumedMessages := readStream(resumed)
+	for _, expected := range []string{"urn:esid:agg3:1", "urn:esid:agg4:1", "urn:esid:agg5:1"} {
+		msg = nextMessage(t, resumedMessages)
+		assert.Equal(t, expected, msg.id)
+	}
+
+	testevents.Append(t, store, "foo", "agg6")
+	assert.Equal(t, "urn:esid:agg6:1", nextMessage(t, resumedMessages).id)
+	assert.Equal(t, "urn:esid:agg6:1", nextMessage(t, messages).id)
+
+	//An unknown last event id cannot be resumed from
+	req.Header.Set("Last-Event-ID", "urn:esid:nope:1")
+	unknown, err := http.DefaultClient.Do(req)
+	if assert.Nil(t, err) {
+		assert.Equal(t, http.StatusBadRequest, unknown.StatusCode)
+		unknown.Body.Close()
+	}
+}
+
+//countingStore counts the calls made to a feed store
+type countingStore struct {
+	FeedStore
+	sync.Mutex
+	calls map[string]int
+}
+
+func newCountingStore(store FeedStore) *countingStore {
+	return &countingStore{FeedStore: store, calls: make(map[string]int)}
+}
+
+func (cs *countingStore) count(method string) {
+	cs.Lock()
+	defer cs.Unlock()
+	cs.calls[method]++
+}
+
+func (cs *countingStore) Calls(method string) int {
+	cs.Lock()
+	defer cs.Unlock()
+	return cs.calls[method]
+}
+
+func (cs *countingStore) RetrieveRecent() ([]atomdata.TimestampedEvent, error) {
+	cs.count("RetrieveRecent")
+	return cs.FeedStore.RetrieveRecent()
+}
+
+func (cs *countingStore) RetrieveLastFeed() (string, error) {
+	cs.count("RetrieveLastFeed")
+	return cs.FeedStore.RetrieveLastFeed()
+}
+
+func (cs *countingStore) RetrieveArchive(feedID string) ([]atomdata.TimestampedEvent, error) {
+	cs.count("RetrieveArchive")
+	return cs.FeedStore.RetrieveArchive(feedID)
+}
+
+func (cs *countingStore) RetrievePreviousFeed(feedID string) (sql.NullString, error) {
+	cs.count("RetrievePreviousFeed")
+	return cs.FeedStore.RetrievePreviousFeed(feedID)
+}
+
+func (cs *countingStore) RetrieveNextFeed(feedID string) (sql.NullString, error) {
+	cs.count("RetrieveNextFeed")
+	return cs.FeedStore.RetrieveNextFeed(feedID)
+}
+
+func TestStreamHandlerSharesPolling(t *testing.T) {
+	memoryStore := NewMemoryFeedStore(2)
+	testevents.Append(t, memoryStore, "foo", "agg1")
+	store := newCountingStore(memoryStore)
+
+	pollInterval := 20 * time.Millisecond
+	streamHandler, err := NewStreamHandler(store, pollInterval)
+	assert.Nil(t, err)
+
+	ts := httptest.NewServer(http.HandlerFunc(streamHandler))
+	defer ts.Close()
+
+	var clients []<-chan streamMessage
+	for i := 0; i < 5; i++ {
+		resp, err := http.Get(ts.URL)
+		if !assert.Nil(t, err) {
+			return
+		}
+		defer resp.Body.Close()
+
+		clients = append(clients, readStream(resp))
+	}
+
+	started := time.Now()
+	polls := store.Calls("RetrieveRecent")
+	testevents.Append(t, memoryStore, "foo", "agg2")
+
+	for _, messages := range clients {
+		assert.Equal(t, "urn:esid:agg2:1", nextMessage(t, messages).id)
+	}
+
+	time.Sleep(5 * pollInterval)
+
+	//The clients share one poller, so the store is polled once per interval rather than once
+	//per interval per client
+	intervals := int(time.Now().Sub(started)/pollInterval) + 1
+	assert.True(t, store.Calls("RetrieveRecent")-polls <= intervals, "%d polls in %d intervals",
+		store.Calls("RetrieveRecent")-polls, intervals)
+}
@@ -0,0 +1,99 @@
+package atompubsvc
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+)
+
+//Environment variables used to configure TLS. The server listens with TLS if TLS_CERT_FILE and
+//TLS_KEY_FILE are set, and requires client certificates issued by a CA in TLS_CLIENT_CA_FILE if
+//that is set too.
+const (
+	TLSCertFile     = "TLS_CERT_FILE"
+	TLSKeyFile      = "TLS_KEY_FILE"
+	TLSClientCAFile = "TLS_CLIENT_CA_FILE"
+)
+
+var ErrBadCABundle = errors.New("CA bundle contains no PEM encoded certificates")
+
+//NewTLSConfig returns the server TLS configuration using the certificate and key files. If
+//clientCAFile is not empty, clients must present a certificate issued by one of the CAs in the
+//PEM encoded bundle.
+func NewTLSConfig(certFile, keyFile, clientCAFile string) (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+
+	config := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+
+	if clientCAFile == "" {
+		return config, nil
+	}
+
+	bundle, err := ioutil.ReadFile(clientCAFile)
+	if err != nil {
+		return nil, err
+	}
+
+	clientCAs := x509.NewCertPool()
+	if !clientCAs.AppendCertsFromPEM(bundle) {
+		return nil, fmt.Errorf("%s: %s", clientCAFile, ErrBadCABundle.Error())
+	}
+
+	config.ClientCAs = clientCAs
+	config.ClientAuth = tls.RequireAndVerifyClientCert
+
+	return config, nil
+}
+
+//ClientCertificate returns the verified client certificate of the request, or nil if the
+//client did not present one.
+func ClientCertificate(req *http.Request) *x509.Certificate {
+	if req.TLS == nil || len(req.TLS.VerifiedChains) == 0 || len(req.TLS.VerifiedChains[0]) == 0 {
+		return nil
+	}
+
+	return req.TLS.VerifiedChains[0][0]
+}
+
+//ClientSubject returns the subject distinguished name of the verified client certificate of
+//the request, e.g. CN=consumer1,O=Example, or the empty string if there is none.
+func ClientSubject(req *http.Request) string {
+	cert := ClientCertificate(req)
+	if cert == nil {
+		return ""
+	}
+
+	return cert.Subject.String()
+}
+
+//ClientCertAuthenticator authenticates requests by their verified client certificate, with the
+//certificate subject as the principal subject. Certificates are verified by the TLS listener, so
+//requests either carry a verified certificate or no credentials.
+type ClientCertAuthenticator struct{}
+
+//NewClientCertAuthenticator returns an authenticator for requests with verified client certificates
+func NewClientCertAuthenticator() *ClientCertAuthenticator {
+	return &ClientCertAuthenticator{}
+}
+
+func (cca *ClientCertAuthenticator) Authenticate(req *http.Request) (*Principal, error) {
+	subject := ClientSubject(req)
+	if subject == "" {
+		return nil, ErrNoCredentials
+	}
+
+	return &Principal{Subject: subject, Method: "client-cert"}, nil
+}
+
+func (cca *ClientCertAuthenticator) Challenge(err error) string {
+	return fmt.Sprintf(`Certificate realm="%s"`, AuthRealm)
+}
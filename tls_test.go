@@ -0,0 +1,180 @@
+package atompubsvc
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+//testCert is a certificate and key, optionally signed by a CA
+type testCert struct {
+	cert *x509.Certificate
+	der  []byte
+	key  *ecdsa.PrivateKey
+}
+
+func newTestCert(t *testing.T, template *x509.Certificate, issuer *testCert) *testCert {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.Nil(t, err)
+
+	template.SerialNumber = big.NewInt(time.Now().UnixNano())
+	template.NotBefore = time.Now().Add(-time.Hour)
+	template.NotAfter = time.Now().Add(time.Hour)
+
+	parent, signer := template, key
+	if issuer != nil {
+		parent, signer = issuer.cert, issuer.key
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, signer)
+	assert.Nil(t, err)
+
+	cert, err := x509.ParseCertificate(der)
+	assert.Nil(t, err)
+
+	return &testCert{cert: cert, der: der, key: key}
+}
+
+//writePEM writes the certificate and key PEM files to dir, returning their paths
+func (tc *testCert) writePEM(t *testing.T, dir, name string) (string, string) {
+	certFile := filepath.Join(dir, name+".crt")
+	assert.Nil(t, ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: tc.der}), 0600))
+
+	keyDER, err := x509.MarshalECPrivateKey(tc.key)
+	assert.Nil(t, err)
+
+	keyFile := filepath.Join(dir, name+".key")
+	assert.Nil(t, ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600))
+
+	return certFile, keyFile
+}
+
+func (tc *testCert) tlsCertificate() tls.Certificate {
+	return tls.Certificate{Certificate: [][]byte{tc.der}, PrivateKey: tc.key}
+}
+
+func TestMutualTLS(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tls")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	ca := newTestCert(t, &x509.Certificate{
+		Subject:               pkix.Name{CommonName: "test ca"},
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}, nil)
+	serverCert := newTestCert(t, &x509.Certificate{
+		Subject:     pkix.Name{CommonName: "localhost"},
+		IPAddresses: []net.IP{net.ParseIP("127.0.0.1")},
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}, ca)
+	clientCert := newTestCert(t, &x509.Certificate{
+		Subject:     pkix.Name{CommonName: "consumer1", Organization: []string{"Example"}},
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}, ca)
+	otherCA := newTestCert(t, &x509.Certificate{
+		Subject:               pkix.Name{CommonName: "other ca"},
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}, nil)
+	untrustedCert := newTestCert(t, &x509.Certificate{
+		Subject:     pkix.Name{CommonName: "intruder"},
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}, otherCA)
+
+	certFile, keyFile := serverCert.writePEM(t, dir, "server")
+	caFile, _ := ca.writePEM(t, dir, "ca")
+
+	tlsConfig, err := NewTLSConfig(certFile, keyFile, caFile)
+	if !assert.Nil(t, err) {
+		return
+	}
+	assert.Equal(t, tls.RequireAndVerifyClientCert, tlsConfig.ClientAuth)
+
+	handler, err := NewAuthHandler(http.HandlerFunc(principalHandler), nil, NewClientCertAuthenticator())
+	assert.Nil(t, err)
+
+	server := httptest.NewUnstartedServer(handler)
+	server.TLS = tlsConfig
+	server.StartTLS()
+	defer server.Close()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+
+	get := func(certs ...tls.Certificate) (string, error) {
+		client := &http.Client{Transport: &http.Transport{
+			TLSClientConfig: &tls.Config{RootCAs: roots, Certificates: certs},
+		}}
+
+		resp, err := client.Get(server.URL + "/notifications/recent")
+		if err != nil {
+			return "", err
+		}
+
+		defer resp.Body.Close()
+		body, err := ioutil.ReadAll(resp.Body)
+		return string(body), err
+	}
+
+	body, err := get(clientCert.tlsCertificate())
+	assert.Nil(t, err)
+	assert.Equal(t, "CN=consumer1,O=Example", body)
+
+	_, err = get()
+	assert.NotNil(t, err)
+
+	_, err = get(untrustedCert.tlsCertificate())
+	assert.NotNil(t, err)
+}
+
+func TestNewTLSConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tls")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	cert := newTestCert(t, &x509.Certificate{Subject: pkix.Name{CommonName: "localhost"}}, nil)
+	certFile, keyFile := cert.writePEM(t, dir, "server")
+
+	tlsConfig, err := NewTLSConfig(certFile, keyFile, "")
+	if assert.Nil(t, err) {
+		assert.Equal(t, tls.NoClientCert, tlsConfig.ClientAuth)
+		assert.Nil(t, tlsConfig.ClientCAs)
+	}
+
+	badCAFile := filepath.Join(dir, "bad-ca.pem")
+	assert.Nil(t, ioutil.WriteFile(badCAFile, []byte("not pem"), 0600))
+	_, err = NewTLSConfig(certFile, keyFile, badCAFile)
+	assert.NotNil(t, err)
+
+	_, err = NewTLSConfig(certFile, keyFile, filepath.Join(dir, "missing"))
+	assert.NotNil(t, err)
+
+	_, err = NewTLSConfig(keyFile, certFile, "")
+	assert.NotNil(t, err)
+}
+
+func TestClientSubjectNoTLS(t *testing.T) {
+	r, _ := http.NewRequest("GET", "/notifications/recent", nil)
+	assert.Nil(t, ClientCertificate(r))
+	assert.Equal(t, "", ClientSubject(r))
+
+	_, err := NewClientCertAuthenticator().Authenticate(r)
+	assert.Equal(t, ErrNoCredentials, err)
+}
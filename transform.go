@@ -0,0 +1,130 @@
+package atompubsvc
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	atomdata "github.com/xtracdev/es-atom-data"
+	"sync"
+)
+
+var ErrNilTransformer = errors.New("Nil transformer passed to registration method")
+
+//Transformer returns the payload to publish for an event, allowing the published form of events
+//to differ from that held in the store, e.g. to upcast old versions of an event to the current
+//schema, strip internal fields or rename properties. The event payload is a copy the transformer
+//may modify.
+type Transformer func(event atomdata.TimestampedEvent) ([]byte, error)
+
+//Transformers registered by type code, applied in registration order. The generation counts
+//the changes to the registered transformers, and with the version identifies the transformer set
+//in entity tags.
+var transformers = struct {
+	sync.RWMutex
+	byTypeCode map[string][]Transformer
+	generation int
+	version    string
+}{byTypeCode: make(map[string][]Transformer)}
+
+//RegisterTransformer registers a transformer for events of the given type code. Where several
+//transformers are registered for a type code, each is passed the event with the payload returned
+//by the one registered before it, so transformations may be chained. Transformers apply to all
+//representations of events, so consumers see a stable public contract as the events held in the
+//store evolve.
+func RegisterTransformer(typeCode string, transformer Transformer) error {
+	if transformer == nil {
+		return ErrNilTransformer
+	}
+
+	transformers.Lock()
+	defer transformers.Unlock()
+
+	transformers.byTypeCode[typeCode] = append(transformers.byTypeCode[typeCode], transformer)
+	transformers.generation++
+	return nil
+}
+
+//ResetTransformers removes all registered transformers, so events are published as stored
+func ResetTransformers() {
+	transformers.Lock()
+	defer transformers.Unlock()
+
+	transformers.byTypeCode = make(map[string][]Transformer)
+	transformers.generation++
+}
+
+//SetTransformersVersion names the set of registered transformers, e.g. with the release defining
+//them. Entity tags identify the transformer set, so cached events and feeds are revalidated in
+//full when transformers change, but transformers are functions and so cannot be compared across
+//deployments. Changing the version when changing what the transformers do ensures entity tags
+//issued by a previous deployment no longer match.
+func SetTransformersVersion(version string) {
+	transformers.Lock()
+	defer transformers.Unlock()
+
+	transformers.version = version
+	transformers.generation++
+}
+
+//transformersKey identifies the transformer set in entity tags, and is empty if no transformers
+//are registered and no version is set, as events are then published as stored
+func transformersKey() string {
+	transformers.RLock()
+	defer transformers.RUnlock()
+
+	if len(transformers.byTypeCode) == 0 && transformers.version == "" {
+		return ""
+	}
+
+	hash := sha256.Sum256([]byte(fmt.Sprintf("%s\x00%d", transformers.version, transformers.generation)))
+	return "x" + hex.EncodeToString(hash[:8])
+}
+
+//TransformJSON returns a transformer for JSON object payloads. The payload is decoded and passed
+//to the transform function, which may add, remove or rename fields, and is then re-encoded. Numbers
+//are decoded as json.Number so they are re-encoded as they were.
+func TransformJSON(transform func(fields map[string]interface{}) error) Transformer {
+	return func(event atomdata.TimestampedEvent) ([]byte, error) {
+		decoder := json.NewDecoder(bytes.NewReader(event.Payload.([]byte)))
+		decoder.UseNumber()
+
+		var fields map[string]interface{}
+		err := decoder.Decode(&fields)
+		if err != nil {
+			return nil, err
+		}
+
+		err = transform(fields)
+		if err != nil {
+			return nil, err
+		}
+
+		return json.Marshal(fields)
+	}
+}
+
+//publishedPayload returns the payload of an event as published, i.e. after applying the
+//transformers registered for its type code
+func publishedPayload(event *atomdata.TimestampedEvent) ([]byte, error) {
+	transformers.RLock()
+	registered := transformers.byTypeCode[event.TypeCode]
+	transformers.RUnlock()
+
+	payload := event.Payload.([]byte)
+	for _, transformer := range registered {
+		transformed := *event
+		transformed.Payload = append([]byte{}, payload...)
+
+		var err error
+		payload, err = transformer(transformed)
+		if err != nil {
+			return nil, fmt.Errorf("Error transforming %s event %s %d: %s", event.TypeCode, event.Source,
+				event.Version, err.Error())
+		}
+	}
+
+	return payload, nil
+}
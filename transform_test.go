@@ -0,0 +1,239 @@
+package atompubsvc
+
+import (
+	"encoding/base64"
+	"encoding/xml"
+	"errors"
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+	atomdata "github.com/xtracdev/es-atom-data"
+	"github.com/xtracdev/es-atom-pub/internal/testevents"
+	"github.com/xtracdev/goes"
+	"golang.org/x/tools/blog/atom"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestRegisterTransformer(t *testing.T) {
+	defer ResetTransformers()
+
+	assert.Equal(t, ErrNilTransformer, RegisterTransformer("foo", nil))
+
+	//Transformers are chained in registration order, and are passed a copy of the payload
+	assert.Nil(t, RegisterTransformer("foo", func(event atomdata.TimestampedEvent) ([]byte, error) {
+		payload := event.Payload.([]byte)
+		payload[0] = 'O'
+		return payload, nil
+	}))
+	assert.Nil(t, RegisterTransformer("foo", func(event atomdata.TimestampedEvent) ([]byte, error) {
+		return []byte(string(event.Payload.([]byte)) + " v2"), nil
+	}))
+
+	event := atomdata.TimestampedEvent{Event: goes.Event{Source: "agg1", Version: 1, TypeCode: "foo", Payload: []byte("ok")}}
+	payload, err := publishedPayload(&event)
+	assert.Nil(t, err)
+	assert.Equal(t, "Ok v2", string(payload))
+	assert.Equal(t, "ok", string(event.Payload.([]byte)))
+
+	//Events of other types are published as stored
+	event.TypeCode = "bar"
+	payload, err = publishedPayload(&event)
+	assert.Nil(t, err)
+	assert.Equal(t, "ok", string(payload))
+
+	ResetTransformers()
+	event.TypeCode = "foo"
+	payload, err = publishedPayload(&event)
+	assert.Nil(t, err)
+	assert.Equal(t, "ok", string(payload))
+
+	RegisterTransformer("foo", func(event atomdata.TimestampedEvent) ([]byte, error) {
+		return nil, errors.New("unknown schema")
+	})
+	_, err = publishedPayload(&event)
+	if assert.NotNil(t, err) {
+		assert.Equal(t, "Error transforming foo event agg1 1: unknown schema", err.Error())
+	}
+}
+
+func TestTransformJSON(t *testing.T) {
+	upcast := TransformJSON(func(fields map[string]interface{}) error {
+		if _, ok := fields["amount"]; !ok {
+			return errors.New("no amount")
+		}
+
+		fields["total"] = fields["amount"]
+		delete(fields, "amount")
+		delete(fields, "internal")
+		return nil
+	})
+
+	var tests = []struct {
+		payload  string
+		expected string
+		err      bool
+	}{
+		{`{"amount":10.50,"internal":"x","id":"1"}`, `{"id":"1","total":10.50}`, false},
+		{`{"id":"1"}`, "", true},
+		{`[1,2]`, "", true},
+		{`not json`, "", true},
+	}
+
+	for _, test := range tests {
+		payload, err := upcast(atomdata.TimestampedEvent{Event: goes.Event{Payload: []byte(test.payload)}})
+		assert.Equal(t, test.err, err != nil, test.payload)
+		assert.Equal(t, test.expected, string(payload), test.payload)
+	}
+}
+
+func TestTransformedEvents(t *testing.T) {
+	defer ResetTransformers()
+	RegisterTransformer("foo", func(event atomdata.TimestampedEvent) ([]byte, error) {
+		return []byte(strings.ToUpper(string(event.Payload.([]byte)))), nil
+	})
+
+	store := NewMemoryFeedStore(2)
+	testevents.Append(t, store, "foo", "agg1", "agg2", "agg3")
+
+	recentHandler, err := NewRecentHandler(store, "testhost:12345")
+	assert.Nil(t, err)
+	archiveHandler, err := NewArchiveHandler(store, "testhost:12345")
+	assert.Nil(t, err)
+	retrieveHandler, err := NewEventRetrieveHandler(store, "testhost:12345")
+	assert.Nil(t, err)
+	payloadHandler, err := NewPayloadHandler(store)
+	assert.Nil(t, err)
+
+	router := mux.NewRouter()
+	router.HandleFunc(RecentHandlerURI, recentHandler)
+	router.HandleFunc(ArchiveHandlerURI, archiveHandler)
+	router.HandleFunc(RetrieveEventHanderURI, retrieveHandler)
+	router.HandleFunc(PayloadHandlerURI, payloadHandler)
+
+	get := func(uri string) *httptest.ResponseRecorder {
+		r, _ := http.NewRequest("GET", uri, nil)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, r)
+		return w
+	}
+
+	feedPayloads := func(uri string) []string {
+		w := get(uri)
+		assert.Equal(t, http.StatusOK, w.Result().StatusCode)
+
+		var feed atom.Feed
+		assert.Nil(t, xml.Unmarshal(w.Body.Bytes(), &feed))
+
+		var payloads []string
+		for _, entry := range feed.Entry {
+			payload, err := base64.StdEncoding.DecodeString(entry.Content.Body)
+			assert.Nil(t, err)
+			payloads = append(payloads, string(payload))
+		}
+
+		return payloads
+	}
+
+	feedID, err := store.RetrieveLastFeed()
+	assert.Nil(t, err)
+
+	assert.Equal(t, []string{"OK AGG3"}, feedPayloads("/notifications/recent"))
+	assert.Equal(t, []string{"OK AGG2", "OK AGG1"}, feedPayloads("/notifications/"+feedID))
+
+	var event EventStoreContent
+	w := get("/events/agg1/1")
+	if assert.Equal(t, http.StatusOK, w.Result().StatusCode) && assert.Nil(t, xml.Unmarshal(w.Body.Bytes(), &event)) {
+		assert.Equal(t, base64.StdEncoding.EncodeToString([]byte("OK AGG1")), event.Content)
+	}
+
+	assert.Equal(t, "OK AGG1", get("/events/agg1/1/payload").Body.String())
+
+	w = httptest.NewRecorder()
+	streamed := atomdata.TimestampedEvent{Event: goes.Event{Source: "agg4", Version: 1, TypeCode: "foo", Payload: []byte("ok agg4")}}
+	assert.Nil(t, writeStreamEvent(w, &streamed))
+	assert.Contains(t, w.Body.String(), base64.StdEncoding.EncodeToString([]byte("OK AGG4")))
+
+	//Events that cannot be transformed are not published
+	RegisterTransformer("foo", func(event atomdata.TimestampedEvent) ([]byte, error) {
+		return nil, errors.New("unknown schema")
+	})
+
+	for _, uri := range []string{"/notifications/recent", "/notifications/" + feedID, "/events/agg1/1", "/events/agg1/1/payload"} {
+		assert.Equal(t, http.StatusInternalServerError, get(uri).Result().StatusCode, uri)
+	}
+}
+
+func TestTransformersETags(t *testing.T) {
+	defer ResetTransformers()
+	defer SetTransformersVersion("")
+
+	store := NewMemoryFeedStore(2)
+	testevents.Append(t, store, "foo", "agg1", "agg2", "agg3")
+
+	recentHandler, err := NewRecentHandler(store, "testhost:12345")
+	assert.Nil(t, err)
+	archiveHandler, err := NewArchiveHandler(store, "testhost:12345")
+	assert.Nil(t, err)
+	retrieveHandler, err := NewEventRetrieveHandler(store, "testhost:12345")
+	assert.Nil(t, err)
+	payloadHandler, err := NewPayloadHandler(store)
+	assert.Nil(t, err)
+
+	router := mux.NewRouter()
+	router.HandleFunc(RecentHandlerURI, recentHandler)
+	router.HandleFunc(ArchiveHandlerURI, archiveHandler)
+	router.HandleFunc(RetrieveEventHanderURI, retrieveHandler)
+	router.HandleFunc(PayloadHandlerURI, payloadHandler)
+
+	get := func(uri, etag string) *httptest.ResponseRecorder {
+		r, _ := http.NewRequest("GET", uri, nil)
+		if etag != "" {
+			r.Header.Set("If-None-Match", etag)
+		}
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, r)
+		return w
+	}
+
+	feedID, err := store.RetrieveLastFeed()
+	assert.Nil(t, err)
+	uris := []string{"/notifications/recent", "/notifications/" + feedID, "/events/agg1/1", "/events/agg1/1/payload"}
+
+	etags := func() []string {
+		var tags []string
+		for _, uri := range uris {
+			w := get(uri, "")
+			assert.Equal(t, http.StatusOK, w.Result().StatusCode, uri)
+			tags = append(tags, w.Header().Get("ETag"))
+		}
+		return tags
+	}
+
+	untransformed := etags()
+	assert.Equal(t, `"agg1:1"`, untransformed[2])
+
+	//Entity tags issued before transformers change no longer match
+	RegisterTransformer("foo", func(event atomdata.TimestampedEvent) ([]byte, error) {
+		return []byte(strings.ToUpper(string(event.Payload.([]byte)))), nil
+	})
+
+	transformed := etags()
+	for i, uri := range uris {
+		assert.NotEqual(t, untransformed[i], transformed[i], uri)
+		assert.Equal(t, http.StatusOK, get(uri, untransformed[i]).Result().StatusCode, uri)
+		assert.Equal(t, http.StatusNotModified, get(uri, transformed[i]).Result().StatusCode, uri)
+	}
+
+	//As do those issued before the transformer set version changes
+	SetTransformersVersion("2")
+	for i, uri := range uris {
+		assert.Equal(t, http.StatusOK, get(uri, transformed[i]).Result().StatusCode, uri)
+	}
+
+	//With no transformers events are published as stored
+	SetTransformersVersion("")
+	ResetTransformers()
+	assert.Equal(t, untransformed, etags())
+}
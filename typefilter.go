@@ -0,0 +1,188 @@
+package atompubsvc
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	atomdata "github.com/xtracdev/es-atom-data"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+)
+
+//TypeParam is the query parameter limiting the recent and archive feeds to entries with the given
+//event type codes, e.g. /notifications/recent?type=OrderPlaced,OrderShipped. The parameter may
+//also be repeated.
+const TypeParam = "type"
+
+//typeFilter holds the type codes requested via the type query parameter, sorted and without
+//duplicates. It is empty if no types were requested.
+type typeFilter []string
+
+func parseTypeFilter(req *http.Request) typeFilter {
+	seen := make(map[string]bool)
+	var types typeFilter
+	for _, value := range req.URL.Query()[TypeParam] {
+		for _, typeCode := range strings.Split(value, ",") {
+			typeCode = strings.TrimSpace(typeCode)
+			if typeCode != "" && !seen[typeCode] {
+				seen[typeCode] = true
+				types = append(types, typeCode)
+			}
+		}
+	}
+
+	sort.Strings(types)
+	return types
+}
+
+func (tf typeFilter) matches(typeCode string) bool {
+	if len(tf) == 0 {
+		return true
+	}
+
+	for _, t := range tf {
+		if t == typeCode {
+			return true
+		}
+	}
+
+	return false
+}
+
+//query returns the query string to append to links so they stay within the filtered view, or
+//the empty string if no types were requested.
+func (tf typeFilter) query() string {
+	if len(tf) == 0 {
+		return ""
+	}
+
+	escaped := make([]string, len(tf))
+	for i, t := range tf {
+		escaped[i] = url.QueryEscape(t)
+	}
+
+	return "?" + TypeParam + "=" + strings.Join(escaped, ",")
+}
+
+//key identifies the requested types in entity tags, and is empty if no types were requested
+func (tf typeFilter) key() string {
+	if len(tf) == 0 {
+		return ""
+	}
+
+	hash := sha256.Sum256([]byte(strings.Join(tf, "\x00")))
+	return "t" + hex.EncodeToString(hash[:8])
+}
+
+//linksKey identifies the next and last archives a type filtered archive page links to in its
+//entity tag
+func linksKey(next, last string) string {
+	hash := sha256.Sum256([]byte(next + "\x00" + last))
+	return "l" + hex.EncodeToString(hash[:8])
+}
+
+//eventFilter limits the events of a request to those the caller may see under the access policy
+//and that match the requested types.
+type eventFilter struct {
+	principal *Principal
+	types     typeFilter
+}
+
+func newEventFilter(req *http.Request) *eventFilter {
+	return &eventFilter{
+		principal: PrincipalFromContext(req.Context()),
+		types:     parseTypeFilter(req),
+	}
+}
+
+//active returns true if the filter may drop events
+func (ef *eventFilter) active() bool {
+	return accessPolicy != nil || len(ef.types) > 0
+}
+
+func (ef *eventFilter) allows(event *atomdata.TimestampedEvent) bool {
+	return ef.types.matches(event.TypeCode) && accessPolicy.Allows(ef.principal, event.Source, event.TypeCode)
+}
+
+func (ef *eventFilter) apply(events []atomdata.TimestampedEvent) []atomdata.TimestampedEvent {
+	if !ef.active() {
+		return events
+	}
+
+	var allowed []atomdata.TimestampedEvent
+	for _, event := range events {
+		if ef.allows(&event) {
+			allowed = append(allowed, event)
+		}
+	}
+
+	return allowed
+}
+
+//TypedFeedStore is implemented by stores that can find the feeds holding events of given types
+//without reading the feeds, so type filtered views need not walk the archives. RetrieveTypedFeed
+//returns the nearest feed holding an event with one of the type codes, starting with feedID and
+//moving to earlier feeds if backwards is true, or later feeds otherwise. RetrieveFirstTypedFeed
+//returns the oldest such feed. The empty string is returned if there is no such feed.
+type TypedFeedStore interface {
+	RetrieveTypedFeed(feedID string, typeCodes []string, backwards bool) (string, error)
+	RetrieveFirstTypedFeed(typeCodes []string) (string, error)
+}
+
+//matchingFeed returns the first feed holding events passing the filter, starting with feedID
+//and moving to earlier feeds if backwards is true, or later feeds otherwise. This lets the
+//links of a type filtered view skip archives with no matching events. The empty string is
+//returned if there is no such feed. Without a type filter, feedID is returned as is, so pages
+//filtered only by the access policy keep their links.
+//
+//Stores implementing TypedFeedStore are asked for the feeds holding events of the requested
+//types, which are then only read to check them against any access policy. Otherwise the feeds
+//are read one by one.
+func (ef *eventFilter) matchingFeed(store FeedStore, feedID string, backwards bool) (string, error) {
+	if len(ef.types) == 0 {
+		return feedID, nil
+	}
+
+	typedStore, typed := store.(TypedFeedStore)
+
+	for feedID != "" {
+		if typed {
+			var err error
+			feedID, err = typedStore.RetrieveTypedFeed(feedID, ef.types, backwards)
+			if err != nil || feedID == "" || accessPolicy == nil {
+				return feedID, err
+			}
+		}
+
+		events, err := store.RetrieveArchive(feedID)
+		if err != nil {
+			return "", err
+		}
+
+		if len(ef.apply(events)) > 0 {
+			return feedID, nil
+		}
+
+		feedID, err = adjacentFeed(store, feedID, backwards)
+		if err != nil {
+			return "", err
+		}
+	}
+
+	return "", nil
+}
+
+//adjacentFeed returns the feed preceding feedID if backwards is true, or following it otherwise
+func adjacentFeed(store FeedStore, feedID string, backwards bool) (string, error) {
+	var adjacent sql.NullString
+	var err error
+	if backwards {
+		adjacent, err = store.RetrievePreviousFeed(feedID)
+	} else {
+		adjacent, err = store.RetrieveNextFeed(feedID)
+	}
+
+	return adjacent.String, err
+}
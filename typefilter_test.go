@@ -0,0 +1,258 @@
+package atompubsvc
+
+import (
+	"encoding/xml"
+	"fmt"
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+	"github.com/xtracdev/es-atom-pub/internal/testevents"
+	"golang.org/x/tools/blog/atom"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestParseTypeFilter(t *testing.T) {
+	var tests = []struct {
+		query    string
+		expected typeFilter
+		encoded  string
+	}{
+		{"", nil, ""},
+		{"type=OrderPlaced", typeFilter{"OrderPlaced"}, "?type=OrderPlaced"},
+		{"type=b,a&type=a", typeFilter{"a", "b"}, "?type=a,b"},
+		{"type=+a+,,", typeFilter{"a"}, "?type=a"},
+		{"type=a%26b", typeFilter{"a&b"}, "?type=a%26b"},
+	}
+
+	for _, test := range tests {
+		r, _ := http.NewRequest("GET", "/notifications/recent?"+test.query, nil)
+		types := parseTypeFilter(r)
+		assert.Equal(t, test.expected, types, test.query)
+		assert.Equal(t, test.encoded, types.query(), test.query)
+	}
+
+	assert.Equal(t, "", typeFilter(nil).key())
+	assert.NotEqual(t, typeFilter{"a"}.key(), typeFilter{"a", "b"}.key())
+}
+
+//checkTypedFeeds checks feeds holding events of given types are found in a store archiving every
+//two events
+func checkTypedFeeds(t *testing.T, store interface {
+	EventAppender
+	FeedStore
+	TypedFeedStore
+}) {
+	testevents.Append(t, store, "OrderPlaced", "order-1")
+	testevents.Append(t, store, "Other", "other-1", "other-2", "other-3")
+	testevents.Append(t, store, "OrderShipped", "order-2")
+	testevents.Append(t, store, "Other", "other-4", "other-5")
+
+	third, err := store.RetrieveLastFeed()
+	assert.Nil(t, err)
+	second, err := store.RetrievePreviousFeed(third)
+	assert.Nil(t, err)
+	first, err := store.RetrievePreviousFeed(second.String)
+	assert.Nil(t, err)
+
+	var tests = []struct {
+		feedID    string
+		typeCodes []string
+		backwards bool
+		expected  string
+	}{
+		{third, []string{"OrderPlaced"}, true, first.String},
+		{third, []string{"OrderPlaced", "OrderShipped"}, true, third},
+		{second.String, []string{"OrderShipped"}, false, third},
+		{first.String, []string{"OrderShipped"}, true, ""},
+		{third, []string{"Unknown"}, true, ""},
+		{"nope", []string{"OrderPlaced"}, true, ""},
+	}
+
+	for _, test := range tests {
+		feedID, err := store.RetrieveTypedFeed(test.feedID, test.typeCodes, test.backwards)
+		assert.Nil(t, err)
+		assert.Equal(t, test.expected, feedID, "%v", test)
+	}
+
+	feedID, err := store.RetrieveFirstTypedFeed([]string{"OrderShipped", "Other"})
+	assert.Nil(t, err)
+	assert.Equal(t, first.String, feedID)
+
+	feedID, err = store.RetrieveFirstTypedFeed([]string{"Unknown"})
+	assert.Nil(t, err)
+	assert.Equal(t, "", feedID)
+}
+
+func TestMemoryFeedStoreTypedFeeds(t *testing.T) {
+	checkTypedFeeds(t, NewMemoryFeedStore(2))
+}
+
+//countingTypedStore counts the calls made to a feed store able to find feeds by event type
+type countingTypedStore struct {
+	*countingStore
+	TypedFeedStore
+	FeedIndexStore
+}
+
+func TestTypeFilteredFeedsDoNotWalkArchives(t *testing.T) {
+	memoryStore := NewMemoryFeedStore(2)
+	for i := 0; i < 50; i++ {
+		testevents.Append(t, memoryStore, "foo", fmt.Sprintf("agg%d", i))
+	}
+
+	store := countingTypedStore{newCountingStore(memoryStore), memoryStore, memoryStore}
+
+	recentHandler, err := NewRecentHandler(store, "testhost:12345")
+	assert.Nil(t, err)
+	archiveHandler, err := NewArchiveHandler(store, "testhost:12345")
+	assert.Nil(t, err)
+
+	router := mux.NewRouter()
+	router.HandleFunc(RecentHandlerURI, recentHandler)
+	router.HandleFunc(ArchiveHandlerURI, archiveHandler)
+
+	lastFeed, err := memoryStore.RetrieveLastFeed()
+	assert.Nil(t, err)
+	previous, err := memoryStore.RetrievePreviousFeed(lastFeed)
+	assert.Nil(t, err)
+
+	//Views of a type with no events find there are no matching archives without reading them
+	for _, uri := range []string{"/notifications/recent?type=Unknown", "/notifications/" + previous.String + "?type=Unknown"} {
+		r, _ := http.NewRequest("GET", uri, nil)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, r)
+		assert.Equal(t, http.StatusOK, w.Result().StatusCode, uri)
+
+		var feed atom.Feed
+		assert.Nil(t, xml.Unmarshal(w.Body.Bytes(), &feed))
+		assert.Nil(t, getLink("prev-archive", &feed), uri)
+		assert.Nil(t, getLink("first", &feed), uri)
+	}
+
+	//Only the archive requested and its adjacent feeds are read, however many archives there are
+	assert.Equal(t, 1, store.Calls("RetrieveArchive"))
+	assert.Equal(t, 1, store.Calls("RetrievePreviousFeed"))
+	assert.Equal(t, 1, store.Calls("RetrieveNextFeed"))
+}
+
+func TestTypeFilteredFeeds(t *testing.T) {
+	//Feeds of two events: the first and third hold OrderPlaced events, the second does not
+	store := NewMemoryFeedStore(2)
+	testevents.Append(t, store, "OrderPlaced", "order-1")
+	testevents.Append(t, store, "Other", "other-1")
+	testevents.Append(t, store, "Other", "other-2", "other-3")
+	testevents.Append(t, store, "OrderShipped", "order-3")
+	testevents.Append(t, store, "OrderPlaced", "order-2")
+	testevents.Append(t, store, "Other", "other-4")
+
+	recentHandler, err := NewRecentHandler(store, "testhost:12345")
+	assert.Nil(t, err)
+	archiveHandler, err := NewArchiveHandler(store, "testhost:12345")
+	assert.Nil(t, err)
+
+	router := mux.NewRouter()
+	router.HandleFunc(RecentHandlerURI, recentHandler)
+	router.HandleFunc(ArchiveHandlerURI, archiveHandler)
+
+	get := func(uri string) (*atom.Feed, *httptest.ResponseRecorder) {
+		r, _ := http.NewRequest("GET", strings.TrimPrefix(uri, "https://testhost:12345"), nil)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, r)
+		assert.Equal(t, http.StatusOK, w.Result().StatusCode, uri)
+
+		var feed atom.Feed
+		assert.Nil(t, xml.Unmarshal(w.Body.Bytes(), &feed))
+		return &feed, w
+	}
+
+	ids := func(feed *atom.Feed) []string {
+		var ids []string
+		for _, entry := range feed.Entry {
+			ids = append(ids, entry.ID)
+		}
+		return ids
+	}
+
+	//The recent feed holds only other-4, so is empty in the filtered view, and links to the
+	//last archive holding order-2
+	recent, _ := get("/notifications/recent?type=OrderPlaced")
+	assert.Empty(t, recent.Entry)
+	assert.Equal(t, "https://testhost:12345/notifications/recent?type=OrderPlaced", *getLink("self", recent))
+
+	lastArchive, w := get(*getLink("prev-archive", recent))
+	assert.Equal(t, []string{"urn:esid:order-2:1"}, ids(lastArchive))
+	assert.True(t, strings.HasSuffix(*getLink("next-archive", lastArchive), "/notifications/recent?type=OrderPlaced"))
+	filteredETag := w.Result().Header.Get("ETag")
+
+	//The archive holding only other events is skipped going back
+	firstArchive, _ := get(*getLink("prev-archive", lastArchive))
+	assert.Equal(t, []string{"urn:esid:order-1:1"}, ids(firstArchive))
+	assert.Nil(t, getLink("prev-archive", firstArchive))
+	assert.Equal(t, *getLink("self", lastArchive), *getLink("last", firstArchive))
+
+	//and going forward
+	next, _ := get(*getLink("next-archive", firstArchive))
+	assert.Equal(t, lastArchive.ID, next.ID)
+
+	//Several types may be requested
+	lastArchive, _ = get("/notifications/" + lastArchive.ID + "?type=OrderShipped&type=OrderPlaced")
+	assert.Equal(t, []string{"urn:esid:order-2:1", "urn:esid:order-3:1"}, ids(lastArchive))
+	assert.Contains(t, *getLink("self", lastArchive), "?type=OrderPlaced,OrderShipped")
+
+	//The unfiltered view is unchanged, and has a different entity tag
+	unfiltered, w := get("/notifications/" + lastArchive.ID)
+	assert.Equal(t, 2, len(unfiltered.Entry))
+	assert.Equal(t, "https://testhost:12345/notifications/"+lastArchive.ID, *getLink("self", unfiltered))
+	assert.NotEqual(t, filteredETag, w.Result().Header.Get("ETag"))
+
+	//The first and last links lead to the oldest and newest matching archives
+	assert.Equal(t, *getLink("self", firstArchive), *getLink("first", recent))
+	assert.Equal(t, *getLink("prev-archive", recent), *getLink("last", recent))
+
+	shipped, _ := get("/notifications/recent?type=OrderShipped")
+	assert.Equal(t, "https://testhost:12345/notifications/"+lastArchive.ID+"?type=OrderShipped", *getLink("first", shipped))
+	assert.Equal(t, *getLink("first", shipped), *getLink("last", shipped))
+
+	//A view with no matching events has no archives
+	none, _ := get("/notifications/recent?type=Unknown")
+	assert.Nil(t, getLink("prev-archive", none))
+	assert.Nil(t, getLink("first", none))
+	assert.Nil(t, getLink("last", none))
+
+	//Filtered archive pages link to archives added later, so are revalidated rather than cached
+	filteredURI := "/notifications/" + lastArchive.ID + "?type=OrderPlaced"
+	_, w = get(filteredURI)
+	assert.Equal(t, "no-cache", w.Result().Header.Get("Cache-Control"))
+	assert.Equal(t, "", w.Result().Header.Get("Last-Modified"))
+	assert.Equal(t, filteredETag, w.Result().Header.Get("ETag"))
+
+	conditionalGet := func(etag string) *httptest.ResponseRecorder {
+		r, _ := http.NewRequest("GET", filteredURI, nil)
+		r.Header.Set("If-None-Match", etag)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, r)
+		return w
+	}
+
+	assert.Equal(t, http.StatusNotModified, conditionalGet(filteredETag).Result().StatusCode)
+
+	//Archive other-4 and order-4, then other-5 and other-6
+	testevents.Append(t, store, "OrderPlaced", "order-4")
+	testevents.Append(t, store, "Other", "other-5", "other-6")
+	newestFeed, err := store.RetrieveLastFeed()
+	assert.Nil(t, err)
+	newestMatch, err := store.RetrievePreviousFeed(newestFeed)
+	assert.Nil(t, err)
+	newestID := newestMatch.String
+
+	w = conditionalGet(filteredETag)
+	assert.Equal(t, http.StatusOK, w.Result().StatusCode)
+	assert.NotEqual(t, filteredETag, w.Result().Header.Get("ETag"))
+
+	var updated atom.Feed
+	assert.Nil(t, xml.Unmarshal(w.Body.Bytes(), &updated))
+	assert.Equal(t, "https://testhost:12345/notifications/"+newestID+"?type=OrderPlaced", *getLink("next-archive", &updated))
+	assert.Equal(t, *getLink("next-archive", &updated), *getLink("last", &updated))
+}
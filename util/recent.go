@@ -1,45 +1,21 @@
 package main
 
 import (
-	"crypto/aes"
-	"crypto/cipher"
+	"crypto/tls"
 	"encoding/base64"
 	"errors"
+	"flag"
 	"fmt"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/kms"
+	"github.com/xtracdev/es-atom-pub/client"
 	"io/ioutil"
 	"net/http"
+	"net/url"
 	"os"
 	"strings"
-	"net/url"
-	"crypto/tls"
 )
 
-//Decrypt from cryptopasta commit bc3a108a5776376aa811eea34b93383837994340
-//used via the CC0 license. See https://github.com/gtank/cryptopasta
-func Decrypt(ciphertext []byte, key *[32]byte) (plaintext []byte, err error) {
-	block, err := aes.NewCipher(key[:])
-	if err != nil {
-		return nil, err
-	}
-
-	gcm, err := cipher.NewGCM(block)
-	if err != nil {
-		return nil, err
-	}
-
-	if len(ciphertext) < gcm.NonceSize() {
-		return nil, errors.New("malformed ciphertext")
-	}
-
-	return gcm.Open(nil,
-		ciphertext[:gcm.NonceSize()],
-		ciphertext[gcm.NonceSize():],
-		nil,
-	)
-}
-
 func readRecent(feedUrl string) ([]byte, error) {
 
 	parsed,err := url.Parse(feedUrl)
@@ -78,78 +54,99 @@ func readRecent(feedUrl string) ([]byte, error) {
 	return bytes, nil
 }
 
-func decryptMessage(svc *kms.KMS, parts []string) ([]byte, error) {
-	//Decode the key and the text
-	keyBytes, err := base64.StdEncoding.DecodeString(parts[0])
-	if err != nil {
-		return nil, err
-	}
+//keyFlags collects repeated -key id=path flags naming static master key files
+type keyFlags []string
 
-	//Get the encrypted bytes
-	msgBytes, err := base64.StdEncoding.DecodeString(parts[1])
-	if err != nil {
-		return nil, err
-	}
+func (kf *keyFlags) String() string {
+	return strings.Join(*kf, ",")
+}
 
-	//Decrypt the encryption key
-	di := &kms.DecryptInput{
-		CiphertextBlob: keyBytes,
-	}
+func (kf *keyFlags) Set(value string) error {
+	*kf = append(*kf, value)
+	return nil
+}
 
-	decryptedKey, err := svc.Decrypt(di)
-	if err != nil {
-		return nil, err
+//buildKeyring adds the KMS under each alias, and the master keys read from the given files.
+//The KMS is only set up if aliases are given, or no static keys are.
+func buildKeyring(aliases []string, staticKeys []string) (*client.Keyring, error) {
+	keyring := client.NewKeyring()
+
+	for _, keySpec := range staticKeys {
+		parts := strings.SplitN(keySpec, "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("Expected key id=path, got %s", keySpec)
+		}
+
+		contents, err := ioutil.ReadFile(parts[1])
+		if err != nil {
+			return nil, err
+		}
+
+		key := [32]byte{}
+		decoded, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(contents)))
+		switch {
+		case len(contents) == 32:
+			copy(key[:], contents)
+		case err == nil && len(decoded) == 32:
+			copy(key[:], decoded)
+		default:
+			return nil, fmt.Errorf("Key file %s must contain a 32 byte key, raw or base64 encoded", parts[1])
+		}
+
+		keyring.AddStaticKey(parts[0], &key)
 	}
 
-	//Use the decrypted key to decrypt the message text
-	decryptKey := [32]byte{}
+	if len(aliases) == 0 && len(staticKeys) == 0 {
+		aliases = []string{"kms"}
+	}
 
-	copy(decryptKey[:], decryptedKey.Plaintext[0:32])
+	if len(aliases) > 0 {
+		//KMS set up
+		sess, err := session.NewSession()
+		if err != nil {
+			return nil, err
+		}
 
-	return Decrypt(msgBytes, &decryptKey)
+		svc := kms.New(sess)
+		for _, alias := range aliases {
+			keyring.AddKMSKey(alias, svc)
+		}
+	}
 
+	return keyring, nil
 }
 
 func main() {
 	//Read the recent notifications page  and decrypt the content for grins
-	if len(os.Args) != 2 {
-		fmt.Printf("Usage: %s url\n", os.Args[0])
+	var staticKeys, aliases keyFlags
+	flag.Var(&staticKeys, "key", "static master key as key id=path, may be repeated")
+	flag.Var(&aliases, "kms", "KMS key alias, e.g. alias/my-key, may be repeated")
+	flag.Parse()
+
+	if flag.NArg() != 1 {
+		fmt.Printf("Usage: %s [-key id=path]... [-kms alias]... url\n", os.Args[0])
 		return
 	}
 
-	//KMS set up
-	sess, err := session.NewSession()
+	keyring, err := buildKeyring(aliases, staticKeys)
 	if err != nil {
 		fmt.Println(err.Error())
 		return
 	}
 
-	svc := kms.New(sess)
-
-	feedUrl := os.Args[1] + "/notifications/recent"
+	feedUrl := flag.Arg(0) + "/notifications/recent"
 
-	for i := 0; i < 1; i++ {
-		fmt.Println("Iteration ", i)
-		bytes, err := readRecent(feedUrl)
-		if err != nil {
-			fmt.Println(err)
-			break
-		}
-
-		//Now split the output into two parts - the encrypted key
-		//and the encrypted text
-		parts := strings.Split(string(bytes), "::")
-		if len(parts) != 2 {
-			fmt.Println("Expected two parts, got ", len(parts))
-			break
-		}
-
-		decypted, err := decryptMessage(svc, parts)
-		if err != nil {
-			fmt.Println(err)
-			break
-		}
+	bytes, err := readRecent(feedUrl)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
 
-		fmt.Println("Decrypted :\n", string(decypted))
+	decrypted, err := keyring.Decrypt(bytes)
+	if err != nil {
+		fmt.Println(err)
+		return
 	}
+
+	fmt.Println("Decrypted :\n", string(decrypted))
 }